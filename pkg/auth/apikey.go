@@ -0,0 +1,224 @@
+/*
+Copyright 2022 Pure Storage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/grpc-ecosystem/go-grpc-middleware/util/metautils"
+)
+
+const (
+	// APIKeyPrefix is the prefix of the API keys. An API key can be sent as
+	// a bearer token: Authorization: bearer ak_...
+	APIKeyPrefix = "ak_"
+	// APIKeyMetadataKey is the metadata key, and HTTP header, with an API key
+	APIKeyMetadataKey = "x-api-key"
+	// DefaultAPIKeyIssuer is the issuer of the claims of the API keys
+	// when none is configured
+	DefaultAPIKeyIssuer = "apikey"
+
+	// Number of random bytes of the ID, secret and salt of the API keys
+	apiKeyIDSize     = 8
+	apiKeySecretSize = 32
+	apiKeySaltSize   = 16
+)
+
+var (
+	// ErrAPIKeyNotFound is returned by the key stores when a key does not exist
+	ErrAPIKeyNotFound = errors.New("API key not found")
+)
+
+// APIKey is an API key as saved in a KeyStore. Only the salted hash of the
+// secret of the key is saved.
+type APIKey struct {
+	// ID identifies the key. It is part of the raw key.
+	ID string `json:"id" yaml:"id"`
+	// Salt and Hash are the salt and the SHA-256 hash of the salted secret
+	Salt []byte `json:"salt" yaml:"salt"`
+	Hash []byte `json:"hash" yaml:"hash"`
+	// Claims of the clients using the key, with their roles and groups
+	Claims Claims `json:"claims" yaml:"claims"`
+	// Expiration time in Unix format. Zero if the key does not expire.
+	Expiration int64 `json:"expiration,omitempty" yaml:"expiration,omitempty"`
+	// Revoked keys cannot be used anymore
+	Revoked bool `json:"revoked,omitempty" yaml:"revoked,omitempty"`
+}
+
+// KeyStore saves the API keys
+type KeyStore interface {
+	// GetKey returns the key with the ID, or ErrAPIKeyNotFound
+	GetKey(ctx context.Context, id string) (*APIKey, error)
+	// PutKey adds a key, or replaces the key with the same ID
+	PutKey(ctx context.Context, key *APIKey) error
+	// RevokeKey revokes the key with the ID, or returns ErrAPIKeyNotFound
+	RevokeKey(ctx context.Context, id string) error
+}
+
+// NewAPIKey returns a new raw API key for the claims, to be given to the
+// client, and the APIKey to be saved in a KeyStore. The expiration is in
+// Unix format; zero if the key does not expire.
+func NewAPIKey(claims *Claims, expiration int64) (string, *APIKey, error) {
+	id, err := randomBytes(apiKeyIDSize)
+	if err != nil {
+		return "", nil, err
+	}
+	secret, err := randomBytes(apiKeySecretSize)
+	if err != nil {
+		return "", nil, err
+	}
+	salt, err := randomBytes(apiKeySaltSize)
+	if err != nil {
+		return "", nil, err
+	}
+
+	rawSecret := base64.RawURLEncoding.EncodeToString(secret)
+	key := &APIKey{
+		ID:         hex.EncodeToString(id),
+		Salt:       salt,
+		Hash:       apiKeyHash(salt, rawSecret),
+		Claims:     *claims,
+		Expiration: expiration,
+	}
+	return APIKeyPrefix + key.ID + "_" + rawSecret, key, nil
+}
+
+func randomBytes(n int) ([]byte, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return nil, fmt.Errorf("unable to generate API key: %v", err)
+	}
+	return b, nil
+}
+
+// apiKeyHash returns the hash of the salted secret of a key. The secrets are
+// random, so a single hash is enough to protect them.
+func apiKeyHash(salt []byte, secret string) []byte {
+	h := sha256.New()
+	h.Write(salt)
+	h.Write([]byte(secret))
+	return h.Sum(nil)
+}
+
+// parseAPIKey returns the ID and the secret of a raw API key
+func parseAPIKey(rawkey string) (string, string, error) {
+	if !strings.HasPrefix(rawkey, APIKeyPrefix) {
+		return "", "", fmt.Errorf("API key must start with %s", APIKeyPrefix)
+	}
+	id, secret, ok := strings.Cut(strings.TrimPrefix(rawkey, APIKeyPrefix), "_")
+	if !ok || id == "" || secret == "" {
+		return "", "", fmt.Errorf("API key is invalid")
+	}
+	return id, secret, nil
+}
+
+// IsAPIKey returns true if the token is an API key
+func IsAPIKey(token string) bool {
+	return strings.HasPrefix(token, APIKeyPrefix)
+}
+
+// APIKeyFromContext returns the API key of the incoming metadata, from the
+// x-api-key metadata or from a bearer token starting with ak_
+func APIKeyFromContext(ctx context.Context) (string, bool) {
+	md := metautils.ExtractIncoming(ctx)
+	if key := md.Get(APIKeyMetadataKey); key != "" {
+		return key, true
+	}
+	scheme, token, ok := strings.Cut(md.Get(authorizationHeader), " ")
+	if ok && strings.EqualFold(scheme, "bearer") && IsAPIKey(token) {
+		return token, true
+	}
+	return "", false
+}
+
+// APIKeyAuthConfig configures the authentication of API keys
+type APIKeyAuthConfig struct {
+	// Store has the API keys
+	Store KeyStore
+	// Issuer is set as the issuer of the claims of the keys which do not
+	// have one. Defaults to DefaultAPIKeyIssuer.
+	Issuer string
+	// UsernameClaim has the location of the unique id for the user.
+	// If empty, "sub" will be used for the user name unique id.
+	UsernameClaim UsernameClaimType
+}
+
+// APIKeyAuthenticator authenticates the API keys of a KeyStore
+type APIKeyAuthenticator struct {
+	config APIKeyAuthConfig
+}
+
+// NewAPIKeyAuthenticator returns a new API key authenticator
+func NewAPIKeyAuthenticator(config *APIKeyAuthConfig) (*APIKeyAuthenticator, error) {
+	if config == nil {
+		return nil, fmt.Errorf("must provide configuration")
+	}
+	if config.Store == nil {
+		return nil, fmt.Errorf("API key store missing")
+	}
+
+	a := &APIKeyAuthenticator{
+		config: *config,
+	}
+	if a.config.Issuer == "" {
+		a.config.Issuer = DefaultAPIKeyIssuer
+	}
+	return a, nil
+}
+
+// AuthenticateToken returns the claims of the raw API key if it is valid,
+// not revoked and not expired
+func (a *APIKeyAuthenticator) AuthenticateToken(ctx context.Context, rawkey string) (*Claims, error) {
+	id, secret, err := parseAPIKey(rawkey)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := a.config.Store.GetKey(ctx, id)
+	if errors.Is(err, ErrAPIKeyNotFound) {
+		return nil, fmt.Errorf("API key is invalid")
+	} else if err != nil {
+		return nil, fmt.Errorf("unable to get API key %s: %v", id, err)
+	}
+	if subtle.ConstantTimeCompare(apiKeyHash(key.Salt, secret), key.Hash) != 1 {
+		return nil, fmt.Errorf("API key is invalid")
+	}
+	if key.Revoked {
+		return nil, fmt.Errorf("API key %s is revoked", id)
+	}
+	if key.Expiration != 0 && !time.Now().Before(time.Unix(key.Expiration, 0)) {
+		return nil, fmt.Errorf("API key %s is expired", id)
+	}
+
+	claims := key.Claims
+	if claims.Issuer == "" {
+		claims.Issuer = a.config.Issuer
+	}
+	claims.UsernameClaim = a.config.UsernameClaim
+	if err := claims.ValidateUsername(); err != nil {
+		return nil, err
+	}
+	return &claims, nil
+}
@@ -0,0 +1,167 @@
+/*
+Copyright 2022 Pure Storage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package auth
+
+import (
+	"context"
+	"sort"
+	"sync"
+)
+
+// MemoryKeyStore saves the API keys in memory
+type MemoryKeyStore struct {
+	lock sync.RWMutex
+	keys map[string]APIKey
+}
+
+// NewMemoryKeyStore returns a new in-memory key store with the keys
+func NewMemoryKeyStore(keys ...*APIKey) *MemoryKeyStore {
+	m := &MemoryKeyStore{
+		keys: make(map[string]APIKey),
+	}
+	for _, key := range keys {
+		m.keys[key.ID] = *key
+	}
+	return m
+}
+
+// GetKey returns the key with the ID
+func (m *MemoryKeyStore) GetKey(ctx context.Context, id string) (*APIKey, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	key, ok := m.keys[id]
+	if !ok {
+		return nil, ErrAPIKeyNotFound
+	}
+	return &key, nil
+}
+
+// PutKey adds or replaces the key
+func (m *MemoryKeyStore) PutKey(ctx context.Context, key *APIKey) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.keys[key.ID] = *key
+	return nil
+}
+
+// RevokeKey revokes the key with the ID
+func (m *MemoryKeyStore) RevokeKey(ctx context.Context, id string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	key, ok := m.keys[id]
+	if !ok {
+		return ErrAPIKeyNotFound
+	}
+	key.Revoked = true
+	m.keys[id] = key
+	return nil
+}
+
+// FileKeyStore saves the API keys in a JSON file, as a list of APIKey. The
+// file is read again when it is changed by another process.
+type FileKeyStore struct {
+	file *JSONFile
+
+	lock sync.Mutex
+	keys map[string]APIKey
+}
+
+// NewFileKeyStore returns a key store saving the keys in the file. The file
+// is created on the first change if it does not exist.
+func NewFileKeyStore(path string) (*FileKeyStore, error) {
+	f := &FileKeyStore{
+		file: NewJSONFile(path, "API keys"),
+		keys: make(map[string]APIKey),
+	}
+	if err := f.load(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// load reads the file if it changed since it was last read.
+// Must be called with the lock held.
+func (f *FileKeyStore) load() error {
+	var list []APIKey
+	changed, err := f.file.Load(&list)
+	if err != nil || !changed {
+		return err
+	}
+	keys := make(map[string]APIKey, len(list))
+	for _, key := range list {
+		keys[key.ID] = key
+	}
+	f.keys = keys
+	return nil
+}
+
+// save writes the keys to the file.
+// Must be called with the lock held.
+func (f *FileKeyStore) save() error {
+	list := make([]APIKey, 0, len(f.keys))
+	for _, key := range f.keys {
+		list = append(list, key)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return f.file.Save(list)
+}
+
+// GetKey returns the key with the ID
+func (f *FileKeyStore) GetKey(ctx context.Context, id string) (*APIKey, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if err := f.load(); err != nil {
+		return nil, err
+	}
+	key, ok := f.keys[id]
+	if !ok {
+		return nil, ErrAPIKeyNotFound
+	}
+	return &key, nil
+}
+
+// PutKey adds or replaces the key and saves the file
+func (f *FileKeyStore) PutKey(ctx context.Context, key *APIKey) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if err := f.load(); err != nil {
+		return err
+	}
+	f.keys[key.ID] = *key
+	return f.save()
+}
+
+// RevokeKey revokes the key with the ID and saves the file
+func (f *FileKeyStore) RevokeKey(ctx context.Context, id string) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if err := f.load(); err != nil {
+		return err
+	}
+	key, ok := f.keys[id]
+	if !ok {
+		return ErrAPIKeyNotFound
+	}
+	key.Revoked = true
+	f.keys[id] = key
+	return f.save()
+}
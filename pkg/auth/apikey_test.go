@@ -0,0 +1,124 @@
+/*
+Copyright 2022 Pure Storage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package auth
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestAPIKeyAuthenticator(t *testing.T) {
+	rawkey, key, err := NewAPIKey(&Claims{
+		Subject: "ci",
+		Roles:   []string{"system.user"},
+		Groups:  []string{"builders"},
+	}, 0)
+	require.NoError(t, err)
+	assert.True(t, IsAPIKey(rawkey))
+	assert.NotContains(t, string(key.Hash), strings.TrimPrefix(rawkey, APIKeyPrefix+key.ID+"_"))
+
+	store := NewMemoryKeyStore(key)
+	a, err := NewAPIKeyAuthenticator(&APIKeyAuthConfig{Store: store})
+	require.NoError(t, err)
+
+	claims, err := a.AuthenticateToken(context.Background(), rawkey)
+	require.NoError(t, err)
+	assert.Equal(t, DefaultAPIKeyIssuer, claims.Issuer)
+	assert.Equal(t, "ci", claims.Subject)
+	assert.Equal(t, []string{"system.user"}, claims.Roles)
+	assert.Equal(t, []string{"builders"}, claims.Groups)
+
+	// Wrong secret, unknown and malformed keys
+	_, err = a.AuthenticateToken(context.Background(), rawkey+"x")
+	assert.Error(t, err)
+	_, err = a.AuthenticateToken(context.Background(), APIKeyPrefix+"unknown_secret")
+	assert.Error(t, err)
+	_, err = a.AuthenticateToken(context.Background(), APIKeyPrefix+key.ID)
+	assert.Error(t, err)
+
+	// Revoked keys
+	require.NoError(t, store.RevokeKey(context.Background(), key.ID))
+	_, err = a.AuthenticateToken(context.Background(), rawkey)
+	assert.Error(t, err)
+	assert.ErrorIs(t, store.RevokeKey(context.Background(), "unknown"), ErrAPIKeyNotFound)
+
+	// Expired keys
+	rawkey, key, err = NewAPIKey(&Claims{Subject: "cron"}, time.Now().Add(-time.Minute).Unix())
+	require.NoError(t, err)
+	require.NoError(t, store.PutKey(context.Background(), key))
+	_, err = a.AuthenticateToken(context.Background(), rawkey)
+	assert.Error(t, err)
+}
+
+func TestFileKeyStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.json")
+	store, err := NewFileKeyStore(path)
+	require.NoError(t, err)
+	_, err = store.GetKey(context.Background(), "unknown")
+	assert.ErrorIs(t, err, ErrAPIKeyNotFound)
+
+	rawkey, key, err := NewAPIKey(&Claims{Subject: "ci"}, time.Now().Add(time.Hour).Unix())
+	require.NoError(t, err)
+	require.NoError(t, store.PutKey(context.Background(), key))
+
+	// The keys are saved in the file, without the secret
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), key.ID)
+	assert.NotContains(t, string(data), rawkey)
+
+	other, err := NewFileKeyStore(path)
+	require.NoError(t, err)
+	a, err := NewAPIKeyAuthenticator(&APIKeyAuthConfig{Store: other, Issuer: "ci-keys"})
+	require.NoError(t, err)
+	claims, err := a.AuthenticateToken(context.Background(), rawkey)
+	require.NoError(t, err)
+	assert.Equal(t, "ci-keys", claims.Issuer)
+
+	// Changes of the file are seen by the other stores
+	time.Sleep(10 * time.Millisecond)
+	require.NoError(t, store.RevokeKey(context.Background(), key.ID))
+	_, err = a.AuthenticateToken(context.Background(), rawkey)
+	assert.Error(t, err)
+}
+
+func TestAPIKeyFromContext(t *testing.T) {
+	_, ok := APIKeyFromContext(context.Background())
+	assert.False(t, ok)
+
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(APIKeyMetadataKey, "ak_id_secret"))
+	key, ok := APIKeyFromContext(ctx)
+	assert.True(t, ok)
+	assert.Equal(t, "ak_id_secret", key)
+	assert.True(t, IsGuest(ctx))
+
+	ctx = metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer ak_id_secret"))
+	key, ok = APIKeyFromContext(ctx)
+	assert.True(t, ok)
+	assert.Equal(t, "ak_id_secret", key)
+
+	ctx = metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "bearer eyJhbGciOi"))
+	_, ok = APIKeyFromContext(ctx)
+	assert.False(t, ok)
+}
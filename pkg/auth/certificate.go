@@ -0,0 +1,139 @@
+/*
+Copyright 2022 Pure Storage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package auth
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+	"strings"
+)
+
+// CertificateUsernameField holds the field of the client certificate
+// to be used as the unique id for the user
+type CertificateUsernameField string
+
+const (
+	// default field is the subject common name
+	CertificateUsernameFieldDefault CertificateUsernameField = ""
+	// CertificateUsernameFieldCommonName requests to use the subject
+	// common name as the ID of the user
+	CertificateUsernameFieldCommonName CertificateUsernameField = "cn"
+	// CertificateUsernameFieldURI requests to use the first SAN URI,
+	// for example a SPIFFE ID, as the ID of the user
+	CertificateUsernameFieldURI CertificateUsernameField = "uri"
+)
+
+// CertificateAuthenticator validates and extracts the claims from a client certificate
+type CertificateAuthenticator interface {
+	// AuthenticateCertificate returns the claims of a client certificate which
+	// has already been verified against the client CA during the TLS handshake
+	AuthenticateCertificate(context.Context, *x509.Certificate) (*Claims, error)
+}
+
+// X509AuthConfig configures how the fields of a client certificate are mapped to claims:
+//
+//   - The subject common name is the name of the user.
+//   - The subject organizational units are the groups of the user.
+//   - The SAN emails and URIs, like SPIFFE IDs, are the email and subject of the user
+//     depending on UsernameField.
+type X509AuthConfig struct {
+	// Issuer is set as the issuer of the claims.
+	// If empty, the common name of the certificate issuer is used.
+	Issuer string
+	// UsernameField has the location of the unique id for the user.
+	// If empty, the subject common name will be used.
+	UsernameField CertificateUsernameField
+	// URIPrefix, if set, only accepts the SAN URIs starting with this prefix,
+	// for example "spiffe://example.org/". Certificates without a matching
+	// URI are rejected.
+	URIPrefix string
+	// Roles are given to all the users authenticated with a certificate
+	Roles []string
+	// GroupRoles maps an organizational unit to the roles given to its members
+	GroupRoles map[string][]string
+}
+
+// X509Authenticator is used to authenticate clients using their TLS certificates
+type X509Authenticator struct {
+	config X509AuthConfig
+}
+
+// NewX509Authenticator returns a new client certificate authenticator
+func NewX509Authenticator(config *X509AuthConfig) (*X509Authenticator, error) {
+	if config == nil {
+		return nil, fmt.Errorf("must provide configuration")
+	}
+	switch config.UsernameField {
+	case CertificateUsernameFieldDefault,
+		CertificateUsernameFieldCommonName,
+		CertificateUsernameFieldURI:
+	default:
+		return nil, fmt.Errorf("unknown certificate username field %s. Must be one of %s (default) or %s",
+			config.UsernameField, CertificateUsernameFieldCommonName, CertificateUsernameFieldURI)
+	}
+
+	return &X509Authenticator{
+		config: *config,
+	}, nil
+}
+
+// AuthenticateCertificate returns the claims from the fields of the certificate
+func (x *X509Authenticator) AuthenticateCertificate(ctx context.Context, cert *x509.Certificate) (*Claims, error) {
+	if cert == nil {
+		return nil, fmt.Errorf("missing client certificate")
+	}
+
+	var uri string
+	for _, u := range cert.URIs {
+		if s := u.String(); strings.HasPrefix(s, x.config.URIPrefix) {
+			uri = s
+			break
+		}
+	}
+	if x.config.URIPrefix != "" && uri == "" {
+		return nil, fmt.Errorf("client certificate does not have a URI starting with %s", x.config.URIPrefix)
+	}
+
+	claims := &Claims{
+		Issuer: x.config.Issuer,
+		Name:   cert.Subject.CommonName,
+		Groups: cert.Subject.OrganizationalUnit,
+	}
+	if claims.Issuer == "" {
+		claims.Issuer = cert.Issuer.CommonName
+	}
+	if len(cert.EmailAddresses) != 0 {
+		claims.Email = cert.EmailAddresses[0]
+	}
+
+	switch x.config.UsernameField {
+	case CertificateUsernameFieldURI:
+		claims.Subject = uri
+	default:
+		claims.Subject = cert.Subject.CommonName
+	}
+
+	claims.Roles = append(claims.Roles, x.config.Roles...)
+	for _, group := range claims.Groups {
+		claims.Roles = append(claims.Roles, x.config.GroupRoles[group]...)
+	}
+
+	if err := claims.ValidateUsername(); err != nil {
+		return nil, fmt.Errorf("invalid client certificate: %v", err)
+	}
+	return claims, nil
+}
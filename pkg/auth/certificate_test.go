@@ -0,0 +1,98 @@
+/*
+Copyright 2022 Pure Storage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package auth
+
+import (
+	"context"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestX509Authenticator(t *testing.T) {
+	spiffeID, err := url.Parse("spiffe://example.org/ns/default/sa/app")
+	require.NoError(t, err)
+	otherURI, err := url.Parse("https://example.com/app")
+	require.NoError(t, err)
+
+	cert := &x509.Certificate{
+		Subject: pkix.Name{
+			CommonName:         "app",
+			OrganizationalUnit: []string{"dev", "ops"},
+		},
+		Issuer: pkix.Name{
+			CommonName: "clientca",
+		},
+		EmailAddresses: []string{"app@example.org"},
+		URIs:           []*url.URL{otherURI, spiffeID},
+	}
+
+	_, err = NewX509Authenticator(nil)
+	assert.Error(t, err)
+	_, err = NewX509Authenticator(&X509AuthConfig{UsernameField: "email"})
+	assert.Error(t, err)
+
+	// Defaults
+	a, err := NewX509Authenticator(&X509AuthConfig{})
+	require.NoError(t, err)
+	_, err = a.AuthenticateCertificate(context.Background(), nil)
+	assert.Error(t, err)
+	claims, err := a.AuthenticateCertificate(context.Background(), cert)
+	require.NoError(t, err)
+	assert.Equal(t, "clientca", claims.Issuer)
+	assert.Equal(t, "app", claims.Subject)
+	assert.Equal(t, "app", claims.Name)
+	assert.Equal(t, "app@example.org", claims.Email)
+	assert.Equal(t, []string{"dev", "ops"}, claims.Groups)
+	assert.Empty(t, claims.Roles)
+	username, err := claims.GetUsername()
+	assert.NoError(t, err)
+	assert.Equal(t, "app", username)
+
+	// SPIFFE ID as the username with roles
+	a, err = NewX509Authenticator(&X509AuthConfig{
+		Issuer:        "spiffe",
+		UsernameField: CertificateUsernameFieldURI,
+		URIPrefix:     "spiffe://example.org/",
+		Roles:         []string{"system.user"},
+		GroupRoles: map[string][]string{
+			"ops": {"system.admin"},
+		},
+	})
+	require.NoError(t, err)
+	claims, err = a.AuthenticateCertificate(context.Background(), cert)
+	require.NoError(t, err)
+	assert.Equal(t, "spiffe", claims.Issuer)
+	assert.Equal(t, "spiffe://example.org/ns/default/sa/app", claims.Subject)
+	assert.Equal(t, "app", claims.Name)
+	assert.Equal(t, []string{"system.user", "system.admin"}, claims.Roles)
+
+	// Certificate without a matching URI
+	cert.URIs = []*url.URL{otherURI}
+	_, err = a.AuthenticateCertificate(context.Background(), cert)
+	assert.Error(t, err)
+
+	// Certificate without a username
+	a, err = NewX509Authenticator(&X509AuthConfig{})
+	require.NoError(t, err)
+	cert.Subject.CommonName = ""
+	_, err = a.AuthenticateCertificate(context.Background(), cert)
+	assert.Error(t, err)
+}
@@ -1,6 +1,11 @@
 package auth
 
-import "fmt"
+import (
+	"fmt"
+	"time"
+
+	jwt "github.com/golang-jwt/jwt/v4"
+)
 
 // UsernameClaimType holds the claims type to be used as the unique id for the user
 type UsernameClaimType string
@@ -20,12 +25,89 @@ const (
 )
 
 var (
-	// Required claim keys
-	requiredClaims = []string{"iss", "sub", "exp", "iat", "name", "email"}
+	// DefaultRequiredClaims are the claims required in the tokens when the
+	// RequiredClaims of the ClaimsValidation are not set
+	DefaultRequiredClaims = []string{"iss", "sub", "exp", "iat", "name", "email"}
 	// Custom claims for OpenStorage
 	customClaims = []string{"roles", "groups"}
 )
 
+// ClaimsValidation configures the validation of the claims of the tokens
+// by an authenticator. The zero value requires the DefaultRequiredClaims
+// and accepts the tokens of any audience signed by any algorithm of the
+// keys of the authenticator.
+type ClaimsValidation struct {
+	// RequiredClaims must be present in the tokens. Defaults to
+	// DefaultRequiredClaims if nil. Set to an empty slice to not require
+	// any claim, for example for the tokens of service accounts which do
+	// not have a name or an email.
+	RequiredClaims []string
+	// Audiences, if set, requires the aud claim of the tokens to have at
+	// least one of the audiences
+	Audiences []string
+	// Algorithms, if set, are the signing algorithms accepted, like RS256
+	Algorithms []string
+	// Leeway is the clock skew allowed when checking the exp, iat and nbf
+	// claims of the tokens. The OIDC and JWKS authenticators reject the
+	// tokens without an exp claim in any case.
+	Leeway time.Duration
+	// SkipNotBeforeCheck accepts the tokens used before the time of their
+	// nbf claim. Add nbf to RequiredClaims to reject the tokens without it.
+	SkipNotBeforeCheck bool
+}
+
+// requiredClaims returns the claims required in the tokens
+func (v *ClaimsValidation) requiredClaims() []string {
+	if v.RequiredClaims == nil {
+		return DefaultRequiredClaims
+	}
+	return v.RequiredClaims
+}
+
+// checksTimes returns true if the time based claims must be checked with
+// the leeway or without the nbf claim
+func (v *ClaimsValidation) checksTimes() bool {
+	return v.Leeway != 0 || v.SkipNotBeforeCheck
+}
+
+// validateClaims checks that the claims of a token have the required
+// claims and one of the audiences
+func (v *ClaimsValidation) validateClaims(claims map[string]interface{}) error {
+	for _, requiredClaim := range v.requiredClaims() {
+		if _, ok := claims[requiredClaim]; !ok {
+			// Claim missing
+			return fmt.Errorf("required claim %v missing from token", requiredClaim)
+		}
+	}
+
+	if len(v.Audiences) != 0 {
+		mapClaims := jwt.MapClaims(claims)
+		for _, audience := range v.Audiences {
+			if mapClaims.VerifyAudience(audience, true) {
+				return nil
+			}
+		}
+		return fmt.Errorf("token audience must be one of %v", v.Audiences)
+	}
+	return nil
+}
+
+// validateTimes checks the exp, iat and nbf claims of a token, if present,
+// allowing for the leeway. The exp claim must be present if requireExp is true.
+func (v *ClaimsValidation) validateTimes(claims map[string]interface{}, now time.Time, requireExp bool) error {
+	mapClaims := jwt.MapClaims(claims)
+	if !mapClaims.VerifyExpiresAt(now.Add(-v.Leeway).Unix(), requireExp) {
+		return fmt.Errorf("token is expired")
+	}
+	if !mapClaims.VerifyIssuedAt(now.Add(v.Leeway).Unix(), false) {
+		return fmt.Errorf("token used before issued")
+	}
+	if !v.SkipNotBeforeCheck && !mapClaims.VerifyNotBefore(now.Add(v.Leeway).Unix(), false) {
+		return fmt.Errorf("token is not valid yet")
+	}
+	return nil
+}
+
 // Claims provides information about the claims in the token
 // See https://openid.net/specs/openid-connect-core-1_0.html#IDToken
 // for more information.
@@ -33,6 +115,10 @@ type Claims struct {
 	// Issuer is the token issuer. For selfsigned token do not prefix
 	// with `https://`.
 	Issuer string `json:"iss"`
+	// ID is the unique identifier of the token, used to revoke it
+	ID string `json:"jti,omitempty" yaml:"jti,omitempty"`
+	// IssuedAt is the time the token was issued
+	IssuedAt *jwt.NumericDate `json:"iat,omitempty" yaml:"-"`
 	// Subject identifier. Unique ID of this account
 	Subject string `json:"sub" yaml:"sub"`
 	// Account name
@@ -17,6 +17,7 @@ package auth
 
 import (
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -129,3 +130,50 @@ func TestGetAudience(t *testing.T) {
 	require.Error(t, err)
 	require.Nil(t, actual)
 }
+
+func TestClaimsValidation(t *testing.T) {
+	now := time.Now()
+	claims := map[string]interface{}{
+		"iss": "issuer",
+		"sub": "system:serviceaccount:default:app",
+		"aud": []interface{}{"api", "other"},
+		"exp": float64(now.Add(time.Minute).Unix()),
+		"iat": float64(now.Unix()),
+	}
+
+	// The default claims are required
+	v := &ClaimsValidation{}
+	assert.Error(t, v.validateClaims(claims))
+	v = &ClaimsValidation{RequiredClaims: []string{"iss", "sub", "exp"}}
+	assert.NoError(t, v.validateClaims(claims))
+	v = &ClaimsValidation{RequiredClaims: []string{}}
+	assert.NoError(t, v.validateClaims(map[string]interface{}{}))
+
+	// Audiences
+	v = &ClaimsValidation{RequiredClaims: []string{}, Audiences: []string{"nope", "api"}}
+	assert.NoError(t, v.validateClaims(claims))
+	v = &ClaimsValidation{RequiredClaims: []string{}, Audiences: []string{"nope"}}
+	assert.Error(t, v.validateClaims(claims))
+	assert.Error(t, v.validateClaims(map[string]interface{}{}))
+
+	// Leeway
+	v = &ClaimsValidation{}
+	assert.NoError(t, v.validateTimes(claims, now, false))
+	assert.Error(t, v.validateTimes(claims, now.Add(2*time.Minute), false))
+	assert.Error(t, v.validateTimes(claims, now.Add(-time.Minute), false))
+	v = &ClaimsValidation{Leeway: 5 * time.Minute}
+	assert.NoError(t, v.validateTimes(claims, now.Add(2*time.Minute), false))
+	assert.NoError(t, v.validateTimes(claims, now.Add(-time.Minute), false))
+
+	// Not before
+	claims["nbf"] = float64(now.Add(time.Minute).Unix())
+	v = &ClaimsValidation{}
+	assert.Error(t, v.validateTimes(claims, now, false))
+	v = &ClaimsValidation{SkipNotBeforeCheck: true}
+	assert.NoError(t, v.validateTimes(claims, now, false))
+
+	// Expiration
+	delete(claims, "exp")
+	assert.NoError(t, v.validateTimes(claims, now, false))
+	assert.Error(t, v.validateTimes(claims, now, true))
+}
@@ -0,0 +1,278 @@
+/*
+Copyright 2022 Pure Storage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Default number of active tokens cached by the introspection authenticator
+	defaultIntrospectionCacheSize = 1000
+	// Default timeout of the requests to the introspection endpoint
+	defaultIntrospectionTimeout = 10 * time.Second
+	// Maximum size of the responses of the introspection endpoint
+	maxIntrospectionResponseSize = 1 << 20
+)
+
+// IntrospectionAuthConfig configures an OAuth2 token introspection endpoint
+// as defined by RFC 7662. It is used to authenticate opaque access tokens,
+// which are not JWTs.
+type IntrospectionAuthConfig struct {
+	// Issuer is set as the issuer of the claims when the introspection
+	// response does not have an `iss` member
+	Issuer string
+	// URL of the introspection endpoint
+	// e.g. https://idp.example.com/oauth2/introspect
+	URL string
+	// ClientID and ClientSecret authenticate the server to the
+	// introspection endpoint with HTTP basic authentication
+	ClientID     string
+	ClientSecret string
+	// HTTPClient, if set, is used to call the introspection endpoint.
+	// Defaults to a client with a timeout of 10 seconds.
+	HTTPClient *http.Client
+	// UsernameClaim has the location of the unique id for the user.
+	// If empty, "sub" will be used for the user name unique id.
+	UsernameClaim UsernameClaimType
+	// Namespace sets the namespace for all custom claims. For example
+	// if the response had the key: "https://mynamespace/roles", then
+	// the namespace would be "https://mynamespace/".
+	Namespace string
+	// CacheSize is the maximum number of active tokens cached until their
+	// expiration. Defaults to 1000. A negative value disables the cache.
+	CacheSize int
+}
+
+// IntrospectionAuthenticator authenticates opaque access tokens with an
+// OAuth2 introspection endpoint
+type IntrospectionAuthenticator struct {
+	config IntrospectionAuthConfig
+	client *http.Client
+
+	lock  sync.Mutex
+	cache map[[sha256.Size]byte]*introspectionCacheEntry
+}
+
+type introspectionCacheEntry struct {
+	claims  Claims
+	expires time.Time
+}
+
+// introspectionResponse has the members of the introspection response which
+// are not claims of the token
+type introspectionResponse struct {
+	Active   bool   `json:"active"`
+	Exp      int64  `json:"exp"`
+	Username string `json:"username"`
+}
+
+// NewIntrospectionAuthenticator returns a new introspection authenticator
+func NewIntrospectionAuthenticator(config *IntrospectionAuthConfig) (*IntrospectionAuthenticator, error) {
+	if config == nil {
+		return nil, fmt.Errorf("must provide configuration")
+	}
+	if config.URL == "" {
+		return nil, fmt.Errorf("introspection url missing")
+	}
+	if _, err := url.Parse(config.URL); err != nil {
+		return nil, fmt.Errorf("error parsing introspection url: %v", err)
+	}
+
+	i := &IntrospectionAuthenticator{
+		config: *config,
+		client: config.HTTPClient,
+		cache:  make(map[[sha256.Size]byte]*introspectionCacheEntry),
+	}
+	if i.client == nil {
+		i.client = &http.Client{Timeout: defaultIntrospectionTimeout}
+	}
+	if i.config.CacheSize == 0 {
+		i.config.CacheSize = defaultIntrospectionCacheSize
+	}
+	return i, nil
+}
+
+// AuthenticateToken returns the claims of the token if the introspection
+// endpoint reports it as active. Active tokens with an expiration are cached
+// until they expire.
+func (i *IntrospectionAuthenticator) AuthenticateToken(ctx context.Context, rawtoken string) (*Claims, error) {
+	key := sha256.Sum256([]byte(rawtoken))
+	if claims, ok := i.cached(key); ok {
+		return claims, nil
+	}
+
+	resp, claims, err := i.introspect(ctx, rawtoken)
+	if err != nil {
+		return nil, err
+	}
+	if !resp.Active {
+		return nil, fmt.Errorf("token is not active")
+	}
+	if resp.Exp != 0 {
+		expires := time.Unix(resp.Exp, 0)
+		if !time.Now().Before(expires) {
+			return nil, fmt.Errorf("token is expired")
+		}
+		i.store(key, claims, expires)
+	}
+	return claims, nil
+}
+
+// introspect calls the introspection endpoint
+func (i *IntrospectionAuthenticator) introspect(
+	ctx context.Context,
+	rawtoken string,
+) (*introspectionResponse, *Claims, error) {
+	form := url.Values{
+		"token":           {rawtoken},
+		"token_type_hint": {"access_token"},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, i.config.URL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to create introspection request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if i.config.ClientID != "" {
+		req.SetBasicAuth(url.QueryEscape(i.config.ClientID), url.QueryEscape(i.config.ClientSecret))
+	}
+
+	httpResp, err := i.client.Do(req)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to communicate with introspection endpoint %s: %v", i.config.URL, err)
+	}
+	defer httpResp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(httpResp.Body, maxIntrospectionResponseSize+1))
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to read introspection response: %v", err)
+	}
+	if len(body) > maxIntrospectionResponseSize {
+		return nil, nil, fmt.Errorf("introspection response is larger than %d bytes", maxIntrospectionResponseSize)
+	}
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("introspection endpoint %s returned %s", i.config.URL, httpResp.Status)
+	}
+
+	var resp introspectionResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, nil, fmt.Errorf("unable to decode introspection response: %v", err)
+	}
+	if !resp.Active {
+		return &resp, nil, nil
+	}
+
+	var members map[string]interface{}
+	if err := json.Unmarshal(body, &members); err != nil {
+		return nil, nil, fmt.Errorf("unable to decode introspection response: %v", err)
+	}
+	claims, err := i.parseClaims(members, resp.Username)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &resp, claims, nil
+}
+
+// parseClaims returns the claims of the members of an introspection response
+func (i *IntrospectionAuthenticator) parseClaims(members map[string]interface{}, username string) (*Claims, error) {
+	// Custom claims can be set under a namespace
+	if len(i.config.Namespace) > 0 {
+		for _, cc := range customClaims {
+			if v, ok := members[i.config.Namespace+cc]; ok {
+				members[cc] = v
+			}
+		}
+	}
+
+	cbytes, err := json.Marshal(members)
+	if err != nil {
+		return nil, fmt.Errorf("internal error, unable to re-encode introspection claims: %v", err)
+	}
+	var claims Claims
+	if err := json.Unmarshal(cbytes, &claims); err != nil {
+		return nil, fmt.Errorf("unable to get claims from introspection response: %v", err)
+	}
+
+	if claims.Issuer == "" {
+		claims.Issuer = i.config.Issuer
+	}
+	// The username of the introspection response is a human-readable
+	// identifier of the resource owner
+	if claims.Name == "" {
+		claims.Name = username
+	}
+	claims.UsernameClaim = i.config.UsernameClaim
+	if err := claims.ValidateUsername(); err != nil {
+		return nil, err
+	}
+	return &claims, nil
+}
+
+// cached returns a copy of the claims of a cached token which has not expired
+func (i *IntrospectionAuthenticator) cached(key [sha256.Size]byte) (*Claims, bool) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	entry, ok := i.cache[key]
+	if !ok {
+		return nil, false
+	}
+	if !time.Now().Before(entry.expires) {
+		delete(i.cache, key)
+		return nil, false
+	}
+	claims := entry.claims
+	return &claims, true
+}
+
+// store caches the claims of an active token until it expires
+func (i *IntrospectionAuthenticator) store(key [sha256.Size]byte, claims *Claims, expires time.Time) {
+	if i.config.CacheSize < 0 {
+		return
+	}
+
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	if len(i.cache) >= i.config.CacheSize {
+		now := time.Now()
+		for k, entry := range i.cache {
+			if !now.Before(entry.expires) {
+				delete(i.cache, k)
+			}
+		}
+	}
+	if len(i.cache) >= i.config.CacheSize {
+		// Make room by dropping any entry
+		for k := range i.cache {
+			delete(i.cache, k)
+			break
+		}
+	}
+	i.cache[key] = &introspectionCacheEntry{
+		claims:  *claims,
+		expires: expires,
+	}
+}
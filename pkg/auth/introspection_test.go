@@ -0,0 +1,177 @@
+/*
+Copyright 2022 Pure Storage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestIntrospectionServer returns an introspection endpoint which knows
+// the tokens of the map
+func newTestIntrospectionServer(t *testing.T, tokens map[string]map[string]interface{}, calls *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(calls, 1)
+		id, secret, ok := r.BasicAuth()
+		if !ok || id != "server" || secret != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		assert.Equal(t, http.MethodPost, r.Method)
+		resp, ok := tokens[r.PostFormValue("token")]
+		if !ok {
+			resp = map[string]interface{}{"active": false}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		assert.NoError(t, json.NewEncoder(w).Encode(resp))
+	}))
+}
+
+func TestIntrospectionAuthenticator(t *testing.T) {
+	var calls int32
+	exp := time.Now().Add(time.Hour).Unix()
+	ts := newTestIntrospectionServer(t, map[string]map[string]interface{}{
+		"opaque": {
+			"active":                     true,
+			"sub":                        "user1",
+			"username":                   "jim",
+			"email":                      "jim@example.com",
+			"exp":                        exp,
+			"https://example.com/roles":  []string{"system.user"},
+			"https://example.com/groups": []string{"devs"},
+		},
+		"noexp": {
+			"active": true,
+			"iss":    "https://other.example.com",
+			"sub":    "user2",
+		},
+		"expired": {
+			"active": true,
+			"sub":    "user3",
+			"exp":    time.Now().Add(-time.Minute).Unix(),
+		},
+	}, &calls)
+	defer ts.Close()
+
+	a, err := NewIntrospectionAuthenticator(&IntrospectionAuthConfig{
+		Issuer:       "https://idp.example.com",
+		URL:          ts.URL,
+		ClientID:     "server",
+		ClientSecret: "secret",
+		Namespace:    "https://example.com/",
+	})
+	require.NoError(t, err)
+
+	claims, err := a.AuthenticateToken(context.Background(), "opaque")
+	require.NoError(t, err)
+	assert.Equal(t, "https://idp.example.com", claims.Issuer)
+	assert.Equal(t, "user1", claims.Subject)
+	assert.Equal(t, "jim", claims.Name)
+	assert.Equal(t, "jim@example.com", claims.Email)
+	assert.Equal(t, []string{"system.user"}, claims.Roles)
+	assert.Equal(t, []string{"devs"}, claims.Groups)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+
+	// Active tokens are cached until they expire
+	claims.Roles = nil
+	claims, err = a.AuthenticateToken(context.Background(), "opaque")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"system.user"}, claims.Roles)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+
+	// Tokens without expiration are not cached
+	for n := 0; n < 2; n++ {
+		claims, err = a.AuthenticateToken(context.Background(), "noexp")
+		require.NoError(t, err)
+		assert.Equal(t, "https://other.example.com", claims.Issuer)
+	}
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls))
+
+	_, err = a.AuthenticateToken(context.Background(), "expired")
+	assert.Error(t, err)
+	_, err = a.AuthenticateToken(context.Background(), "unknown")
+	assert.EqualError(t, err, "token is not active")
+	_, err = a.AuthenticateToken(context.Background(), "unknown")
+	assert.Error(t, err)
+	assert.Equal(t, int32(6), atomic.LoadInt32(&calls))
+}
+
+func TestIntrospectionAuthenticatorErrors(t *testing.T) {
+	var calls int32
+	ts := newTestIntrospectionServer(t, nil, &calls)
+	defer ts.Close()
+
+	_, err := NewIntrospectionAuthenticator(&IntrospectionAuthConfig{})
+	assert.Error(t, err)
+
+	// Wrong client credentials
+	a, err := NewIntrospectionAuthenticator(&IntrospectionAuthConfig{
+		URL:          ts.URL,
+		ClientID:     "server",
+		ClientSecret: "wrong",
+	})
+	require.NoError(t, err)
+	_, err = a.AuthenticateToken(context.Background(), "opaque")
+	assert.Error(t, err)
+
+	// Response too large
+	large := newTestIntrospectionServer(t, map[string]map[string]interface{}{
+		"opaque": {
+			"active": true,
+			"sub":    "jim",
+			"extra":  strings.Repeat("a", maxIntrospectionResponseSize),
+		},
+	}, &calls)
+	defer large.Close()
+	a, err = NewIntrospectionAuthenticator(&IntrospectionAuthConfig{
+		URL:          large.URL,
+		ClientID:     "server",
+		ClientSecret: "secret",
+	})
+	require.NoError(t, err)
+	_, err = a.AuthenticateToken(context.Background(), "opaque")
+	assert.ErrorContains(t, err, "larger than")
+}
+
+func TestIntrospectionAuthenticatorCacheSize(t *testing.T) {
+	a, err := NewIntrospectionAuthenticator(&IntrospectionAuthConfig{
+		URL:       "http://localhost",
+		CacheSize: 2,
+	})
+	require.NoError(t, err)
+
+	claims := &Claims{Subject: "user"}
+	for _, token := range []string{"a", "b", "c"} {
+		a.store([32]byte{token[0]}, claims, time.Now().Add(time.Hour))
+	}
+	assert.Len(t, a.cache, 2)
+	_, ok := a.cached([32]byte{'c'})
+	assert.True(t, ok)
+
+	// Expired entries are dropped
+	a.store([32]byte{'d'}, claims, time.Now().Add(-time.Second))
+	_, ok = a.cached([32]byte{'d'})
+	assert.False(t, ok)
+}
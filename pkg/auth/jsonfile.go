@@ -0,0 +1,133 @@
+/*
+Copyright 2022 Pure Storage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package auth
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Files modified within this duration of their last read may change again
+// without a change of their modification time, depending on the resolution
+// of the file system. Their content is compared instead.
+const jsonFileRacyDuration = 2 * time.Second
+
+// JSONFile is a JSON document saved in a file shared by several processes.
+// The file is read again only when its content changes, and is replaced at
+// once when it is written so that readers never see a partial file.
+//
+// JSONFile is not safe for concurrent use. Callers must serialize the calls.
+type JSONFile struct {
+	path string
+	name string
+
+	// State of the file when it was last read or written
+	exists  bool
+	size    int64
+	modTime time.Time
+	hash    [sha256.Size]byte
+	racy    bool
+}
+
+// NewJSONFile returns the JSON file at path. The name describes the content
+// of the file in the errors, e.g. "API keys".
+func NewJSONFile(path, name string) *JSONFile {
+	return &JSONFile{
+		path: path,
+		name: name,
+	}
+}
+
+// Path returns the path of the file
+func (f *JSONFile) Path() string {
+	return f.path
+}
+
+// Load decodes the file into v if the file changed since it was last read
+// or written, and returns true. When the file was removed, v is left
+// unchanged and true is returned.
+func (f *JSONFile) Load(v interface{}) (bool, error) {
+	info, err := os.Stat(f.path)
+	if os.IsNotExist(err) {
+		changed := f.exists
+		f.exists = false
+		return changed, nil
+	} else if err != nil {
+		return false, fmt.Errorf("unable to read %s file %s: %v", f.name, f.path, err)
+	}
+	if f.exists && !f.racy && info.Size() == f.size && info.ModTime().Equal(f.modTime) {
+		return false, nil
+	}
+
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		return false, fmt.Errorf("unable to read %s file %s: %v", f.name, f.path, err)
+	}
+	hash := sha256.Sum256(data)
+	changed := !f.exists || !bytes.Equal(hash[:], f.hash[:])
+	if changed {
+		if err := json.Unmarshal(data, v); err != nil {
+			return false, fmt.Errorf("unable to parse %s file %s: %v", f.name, f.path, err)
+		}
+	}
+	f.setState(info, hash)
+	return changed, nil
+}
+
+// Save encodes v and replaces the file with it
+func (f *JSONFile) Save(v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return fmt.Errorf("unable to encode %s: %v", f.name, err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(f.path), filepath.Base(f.path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("unable to write %s file %s: %v", f.name, f.path, err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("unable to write %s file %s: %v", f.name, f.path, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("unable to write %s file %s: %v", f.name, f.path, err)
+	}
+	if err := os.Rename(tmp.Name(), f.path); err != nil {
+		return fmt.Errorf("unable to write %s file %s: %v", f.name, f.path, err)
+	}
+
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return fmt.Errorf("unable to read %s file %s: %v", f.name, f.path, err)
+	}
+	f.setState(info, sha256.Sum256(data))
+	return nil
+}
+
+// setState saves the state of the file with the content of the hash
+func (f *JSONFile) setState(info os.FileInfo, hash [sha256.Size]byte) {
+	f.exists = true
+	f.size = info.Size()
+	f.modTime = info.ModTime()
+	f.hash = hash
+	f.racy = time.Since(info.ModTime()) < jsonFileRacyDuration
+}
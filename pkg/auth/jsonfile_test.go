@@ -0,0 +1,79 @@
+/*
+Copyright 2022 Pure Storage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package auth
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJSONFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "values.json")
+	f := NewJSONFile(path, "values")
+	assert.Equal(t, path, f.Path())
+
+	// Missing file
+	var values []string
+	changed, err := f.Load(&values)
+	require.NoError(t, err)
+	assert.False(t, changed)
+
+	require.NoError(t, f.Save([]string{"a"}))
+	changed, err = f.Load(&values)
+	require.NoError(t, err)
+	assert.False(t, changed)
+
+	// Changes with the same size and modification time are seen
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	other := NewJSONFile(path, "values")
+	require.NoError(t, other.Save([]string{"b"}))
+	require.NoError(t, os.Chtimes(path, info.ModTime(), info.ModTime()))
+	changed, err = f.Load(&values)
+	require.NoError(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, []string{"b"}, values)
+
+	// Files not modified recently are not read again
+	old := time.Now().Add(-time.Hour)
+	require.NoError(t, os.Chtimes(path, old, old))
+	changed, err = f.Load(&values)
+	require.NoError(t, err)
+	assert.False(t, changed)
+	assert.False(t, f.racy)
+	changed, err = f.Load(&values)
+	require.NoError(t, err)
+	assert.False(t, changed)
+
+	// Invalid content
+	require.NoError(t, os.WriteFile(path, []byte("{"), 0600))
+	_, err = f.Load(&values)
+	assert.Error(t, err)
+
+	// Removed file
+	require.NoError(t, other.Save([]string{"c"}))
+	_, err = f.Load(&values)
+	require.NoError(t, err)
+	require.NoError(t, os.Remove(path))
+	changed, err = f.Load(&values)
+	require.NoError(t, err)
+	assert.True(t, changed)
+}
@@ -49,6 +49,9 @@ type JWKSAuthConfig struct {
 	// if the claims had the key: "https://mynamespace/roles", then
 	// the namespace would be "https://mynamespace/".
 	Namespace string
+	// ClaimsValidation configures the validation of the claims of the
+	// tokens. Only RS256 tokens are accepted unless Algorithms is set.
+	ClaimsValidation ClaimsValidation
 }
 
 // JWKSAuthenticator is used to validate tokens with an JWKS
@@ -107,7 +110,9 @@ func NewJWKSAuthenticator(config *JWKSAuthConfig) (*JWKSAuthenticator, error) {
 func NewJWKSWithIssuerAuthenticator(config *JWKSAuthConfig) (*JWKSAuthenticator, error) {
 	keyset := oidc.NewRemoteKeySet(context.Background(), config.JWKSUrl)
 	oidcConfig := &oidc.Config{
-		SkipClientIDCheck: true,
+		SkipClientIDCheck:    true,
+		SupportedSigningAlgs: config.ClaimsValidation.Algorithms,
+		SkipExpiryCheck:      config.ClaimsValidation.checksTimes(),
 	}
 	verifier := oidc.NewVerifier(config.Issuer, keyset, oidcConfig)
 
@@ -122,6 +127,7 @@ func NewJWKSWithIssuerAuthenticator(config *JWKSAuthConfig) (*JWKSAuthenticator,
 			verifier:      verifier,
 			usernameClaim: config.UsernameClaim,
 			namespace:     config.Namespace,
+			validation:    config.ClaimsValidation,
 		},
 		jwksUrl: config.JWKSUrl,
 		keyset:  keyset,
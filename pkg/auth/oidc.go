@@ -19,6 +19,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"time"
 
 	oidc "github.com/coreos/go-oidc/v3/oidc"
 )
@@ -42,6 +43,9 @@ type OIDCAuthConfig struct {
 	// if the claims had the key: "https://mynamespace/roles", then
 	// the namespace would be "https://mynamespace/".
 	Namespace string
+	// ClaimsValidation configures the validation of the claims of the
+	// tokens. The Audiences are checked in addition to the ClientID.
+	ClaimsValidation ClaimsValidation
 }
 
 // OIDCAuthenticator is used to validate tokens with an OIDC
@@ -51,6 +55,7 @@ type OIDCAuthenticator struct {
 	verifier      *oidc.IDTokenVerifier
 	usernameClaim UsernameClaimType
 	namespace     string
+	validation    ClaimsValidation
 }
 
 // NewOIDC returns a new OIDC authenticator
@@ -67,14 +72,17 @@ func NewOIDCAuthenticator(config *OIDCAuthConfig) (*OIDCAuthenticator, error) {
 	}
 
 	v := p.Verifier(&oidc.Config{
-		ClientID:          config.ClientID,
-		SkipClientIDCheck: config.SkipClientIDCheck,
-		SkipIssuerCheck:   config.SkipIssuerCheck,
+		ClientID:             config.ClientID,
+		SkipClientIDCheck:    config.SkipClientIDCheck,
+		SkipIssuerCheck:      config.SkipIssuerCheck,
+		SupportedSigningAlgs: config.ClaimsValidation.Algorithms,
+		SkipExpiryCheck:      config.ClaimsValidation.checksTimes(),
 	})
 	return &OIDCAuthenticator{
 		url:           config.Issuer,
 		usernameClaim: config.UsernameClaim,
 		namespace:     config.Namespace,
+		validation:    config.ClaimsValidation,
 		provider:      p,
 		verifier:      v,
 	}, nil
@@ -92,16 +100,26 @@ func (o *OIDCAuthenticator) AuthenticateToken(ctx context.Context, rawtoken stri
 	if err := idToken.Claims(&claims); err != nil {
 		return nil, fmt.Errorf("unable to get claim map from token: %v", err)
 	}
-	for _, requiredClaim := range requiredClaims {
-		if _, ok := claims[requiredClaim]; !ok {
-			// Claim missing
-			return nil, fmt.Errorf("required claim %v missing from token", requiredClaim)
-		}
+	if err := o.validateClaims(claims, time.Now()); err != nil {
+		return nil, err
 	}
 
 	return o.parseClaims(claims)
 }
 
+// validateClaims checks the claims of a token verified by the OIDC. The
+// verifier checks the time based claims unless they are checked with a
+// leeway or without the nbf claim. Like the verifier, the exp claim is
+// required.
+func (o *OIDCAuthenticator) validateClaims(claims map[string]interface{}, now time.Time) error {
+	if o.validation.checksTimes() {
+		if err := o.validation.validateTimes(claims, now, true); err != nil {
+			return fmt.Errorf("token failed validation: %v", err)
+		}
+	}
+	return o.validation.validateClaims(claims)
+}
+
 // This will let us unit test this function without having a real OIDC
 func (o *OIDCAuthenticator) parseClaims(claims map[string]interface{}) (*Claims, error) {
 
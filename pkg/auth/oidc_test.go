@@ -17,6 +17,7 @@ package auth
 
 import (
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -77,3 +78,39 @@ func TestOidcParseClaimsWithNamespace(t *testing.T) {
 	assert.Equal(t, []string{"role.1", "role.2"}, sdkClaims.Roles)
 	assert.Equal(t, []string{"group.1", "group.2"}, sdkClaims.Groups)
 }
+
+func TestOidcValidateClaims(t *testing.T) {
+	now := time.Now()
+	claims := map[string]interface{}{
+		"iss": "https://issuer",
+		"sub": "Subject",
+		"exp": float64(now.Add(-time.Minute).Unix()),
+		"iat": float64(now.Add(-time.Hour).Unix()),
+	}
+
+	// The verifier checks the expiration by default
+	o := &OIDCAuthenticator{}
+	err := o.validateClaims(claims, now)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "name")
+
+	o = &OIDCAuthenticator{
+		validation: ClaimsValidation{
+			RequiredClaims: []string{"iss", "sub", "exp"},
+		},
+	}
+	assert.NoError(t, o.validateClaims(claims, now))
+
+	// The expiration is checked with the leeway
+	o.validation.Leeway = 30 * time.Second
+	assert.Error(t, o.validateClaims(claims, now))
+	o.validation.Leeway = 2 * time.Minute
+	assert.NoError(t, o.validateClaims(claims, now))
+
+	// The expiration is required even when no claim is required
+	o.validation.RequiredClaims = []string{}
+	delete(claims, "exp")
+	assert.Error(t, o.validateClaims(claims, now))
+	o.validation = ClaimsValidation{RequiredClaims: []string{}, SkipNotBeforeCheck: true}
+	assert.Error(t, o.validateClaims(claims, now))
+}
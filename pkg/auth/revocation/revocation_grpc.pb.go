@@ -0,0 +1,165 @@
+/// Please use the following editor setup for this file:
+// Tab size=2; Tabs as spaces; Clean up trailing whitepsace
+//
+// In vim add: au FileType proto setl sw=2 ts=2 expandtab list
+//
+// In vscode install vscode-proto3 extension and add this to your settings.json:
+//    "[proto3]": {
+//        "editor.tabSize": 2,
+//        "editor.insertSpaces": true,
+//        "editor.rulers": [80],
+//        "editor.detectIndentation": true,
+//        "files.trimTrailingWhitespace": true
+//    }
+//
+
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             v3.20.1
+// source: revocation.proto
+
+package revocation
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	Revocations_Add_FullMethodName  = "/revocation.Revocations/Add"
+	Revocations_List_FullMethodName = "/revocation.Revocations/List"
+)
+
+// RevocationsClient is the client API for Revocations service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type RevocationsClient interface {
+	// Add revokes the tokens matching the revocation
+	Add(ctx context.Context, in *RevocationsAddRequest, opts ...grpc.CallOption) (*RevocationsAddResponse, error)
+	// List returns the revocations which have not expired
+	List(ctx context.Context, in *RevocationsListRequest, opts ...grpc.CallOption) (*RevocationsListResponse, error)
+}
+
+type revocationsClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewRevocationsClient(cc grpc.ClientConnInterface) RevocationsClient {
+	return &revocationsClient{cc}
+}
+
+func (c *revocationsClient) Add(ctx context.Context, in *RevocationsAddRequest, opts ...grpc.CallOption) (*RevocationsAddResponse, error) {
+	out := new(RevocationsAddResponse)
+	err := c.cc.Invoke(ctx, Revocations_Add_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *revocationsClient) List(ctx context.Context, in *RevocationsListRequest, opts ...grpc.CallOption) (*RevocationsListResponse, error) {
+	out := new(RevocationsListResponse)
+	err := c.cc.Invoke(ctx, Revocations_List_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// RevocationsServer is the server API for Revocations service.
+// All implementations must embed UnimplementedRevocationsServer
+// for forward compatibility
+type RevocationsServer interface {
+	// Add revokes the tokens matching the revocation
+	Add(context.Context, *RevocationsAddRequest) (*RevocationsAddResponse, error)
+	// List returns the revocations which have not expired
+	List(context.Context, *RevocationsListRequest) (*RevocationsListResponse, error)
+	mustEmbedUnimplementedRevocationsServer()
+}
+
+// UnimplementedRevocationsServer must be embedded to have forward compatible implementations.
+type UnimplementedRevocationsServer struct {
+}
+
+func (UnimplementedRevocationsServer) Add(context.Context, *RevocationsAddRequest) (*RevocationsAddResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Add not implemented")
+}
+func (UnimplementedRevocationsServer) List(context.Context, *RevocationsListRequest) (*RevocationsListResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method List not implemented")
+}
+func (UnimplementedRevocationsServer) mustEmbedUnimplementedRevocationsServer() {}
+
+// UnsafeRevocationsServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to RevocationsServer will
+// result in compilation errors.
+type UnsafeRevocationsServer interface {
+	mustEmbedUnimplementedRevocationsServer()
+}
+
+func RegisterRevocationsServer(s grpc.ServiceRegistrar, srv RevocationsServer) {
+	s.RegisterService(&Revocations_ServiceDesc, srv)
+}
+
+func _Revocations_Add_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RevocationsAddRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RevocationsServer).Add(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Revocations_Add_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RevocationsServer).Add(ctx, req.(*RevocationsAddRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Revocations_List_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RevocationsListRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RevocationsServer).List(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Revocations_List_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RevocationsServer).List(ctx, req.(*RevocationsListRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// Revocations_ServiceDesc is the grpc.ServiceDesc for Revocations service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Revocations_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "revocation.Revocations",
+	HandlerType: (*RevocationsServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Add",
+			Handler:    _Revocations_Add_Handler,
+		},
+		{
+			MethodName: "List",
+			Handler:    _Revocations_List_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "revocation.proto",
+}
@@ -0,0 +1,112 @@
+/*
+Package revocation rejects tokens before their expiration
+Copyright 2022 Pure Storage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package revocation
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+
+	"github.com/libopenstorage/grpc-framework/pkg/auth"
+)
+
+// Revoker saves the revocations and checks the claims of the
+// authenticated tokens against them
+type Revoker interface {
+	// Revoke adds the revocation and returns it as saved
+	Revoke(ctx context.Context, r *Revocation) (*Revocation, error)
+	// List returns the revocations which have not expired
+	List(ctx context.Context) ([]*Revocation, error)
+	// IsRevoked returns the revocation matching the claims, or nil if
+	// the claims are not revoked
+	IsRevoked(ctx context.Context, claims *auth.Claims) (*Revocation, error)
+}
+
+// newRevocation returns a copy of the revocation ready to be saved
+func newRevocation(r *Revocation, now time.Time) (*Revocation, error) {
+	if r == nil {
+		return nil, fmt.Errorf("must provide a revocation")
+	}
+	if r.GetJti() == "" && r.GetSubject() == "" && r.GetIssuer() == "" {
+		return nil, fmt.Errorf("revocation must have a jti, a subject or an issuer")
+	}
+
+	r = proto.Clone(r).(*Revocation)
+	r.Created = now.Unix()
+	if r.GetJti() == "" && r.GetNotBefore() == 0 {
+		r.NotBefore = r.GetCreated()
+	}
+	return r, nil
+}
+
+// expired returns true if the revocation can be dropped
+func (r *Revocation) expired(now time.Time) bool {
+	return r.GetExpiration() != 0 && now.Unix() >= r.GetExpiration()
+}
+
+// Matches returns true if the revocation applies to the claims
+func (r *Revocation) Matches(claims *auth.Claims) bool {
+	if r.GetIssuer() != "" && r.GetIssuer() != claims.Issuer {
+		return false
+	}
+	switch {
+	case r.GetJti() != "":
+		return r.GetJti() == claims.ID
+	case r.GetSubject() != "" && r.GetSubject() != claims.Subject:
+		return false
+	}
+
+	// Tokens without an issue time are revoked
+	return claims.IssuedAt == nil || claims.IssuedAt.Unix() < r.GetNotBefore()
+}
+
+// revocationList is the list of revocations of the revokers
+type revocationList []*Revocation
+
+// add returns the list with the revocation, without the expired revocations
+func (l revocationList) add(r *Revocation, now time.Time) revocationList {
+	list := make(revocationList, 0, len(l)+1)
+	for _, existing := range l {
+		if !existing.expired(now) {
+			list = append(list, existing)
+		}
+	}
+	return append(list, r)
+}
+
+// active returns a copy of the revocations which have not expired
+func (l revocationList) active(now time.Time) []*Revocation {
+	list := make([]*Revocation, 0, len(l))
+	for _, r := range l {
+		if !r.expired(now) {
+			list = append(list, proto.Clone(r).(*Revocation))
+		}
+	}
+	return list
+}
+
+// match returns a copy of the first revocation which matches the claims
+func (l revocationList) match(claims *auth.Claims, now time.Time) *Revocation {
+	for _, r := range l {
+		if !r.expired(now) && r.Matches(claims) {
+			return proto.Clone(r).(*Revocation)
+		}
+	}
+	return nil
+}
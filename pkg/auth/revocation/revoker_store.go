@@ -0,0 +1,183 @@
+/*
+Copyright 2022 Pure Storage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package revocation
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/libopenstorage/grpc-framework/pkg/auth"
+)
+
+// Default minimum time between the checks of the file of a FileRevoker
+const defaultFileRevokerReloadInterval = time.Second
+
+// MemoryRevoker saves the revocations in memory
+type MemoryRevoker struct {
+	lock        sync.RWMutex
+	revocations revocationList
+}
+
+// NewMemoryRevoker returns a new in-memory revoker
+func NewMemoryRevoker() *MemoryRevoker {
+	return &MemoryRevoker{}
+}
+
+// Revoke adds the revocation
+func (m *MemoryRevoker) Revoke(ctx context.Context, r *Revocation) (*Revocation, error) {
+	now := time.Now()
+	r, err := newRevocation(r, now)
+	if err != nil {
+		return nil, err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.revocations = m.revocations.add(r, now)
+	return r, nil
+}
+
+// List returns the revocations which have not expired
+func (m *MemoryRevoker) List(ctx context.Context) ([]*Revocation, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	return m.revocations.active(time.Now()), nil
+}
+
+// IsRevoked returns the revocation matching the claims, if any
+func (m *MemoryRevoker) IsRevoked(ctx context.Context, claims *auth.Claims) (*Revocation, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	return m.revocations.match(claims, time.Now()), nil
+}
+
+// FileRevoker saves the revocations in a JSON file, as a list of
+// Revocation. The file is checked for changes by other processes at most
+// once per second, so that the revocations can be shared by the servers.
+type FileRevoker struct {
+	file *auth.JSONFile
+
+	// Minimum time between the checks of the file
+	reloadInterval time.Duration
+
+	lock        sync.RWMutex
+	revocations revocationList
+	checked     time.Time
+}
+
+// NewFileRevoker returns a revoker saving the revocations in the file. The
+// file is created on the first revocation if it does not exist.
+func NewFileRevoker(path string) (*FileRevoker, error) {
+	f := &FileRevoker{
+		file:           auth.NewJSONFile(path, "revocations"),
+		reloadInterval: defaultFileRevokerReloadInterval,
+	}
+	if err := f.load(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// load reads the file if it changed since it was last read.
+// Must be called with the lock held.
+func (f *FileRevoker) load() error {
+	var list revocationList
+	changed, err := f.file.Load(&list)
+	if err != nil {
+		return err
+	}
+	f.checked = time.Now()
+	if changed {
+		f.revocations = list
+	}
+	return nil
+}
+
+// reload reads the file if it changed and was not checked within the
+// reload interval
+func (f *FileRevoker) reload() error {
+	f.lock.RLock()
+	recent := time.Since(f.checked) < f.reloadInterval
+	f.lock.RUnlock()
+	if recent {
+		return nil
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	// Another caller may have checked the file in the meantime
+	if time.Since(f.checked) < f.reloadInterval {
+		return nil
+	}
+	return f.load()
+}
+
+// save writes the revocations to the file.
+// Must be called with the lock held.
+func (f *FileRevoker) save() error {
+	return f.file.Save(f.revocations)
+}
+
+// Revoke adds the revocation and saves the file
+func (f *FileRevoker) Revoke(ctx context.Context, r *Revocation) (*Revocation, error) {
+	now := time.Now()
+	r, err := newRevocation(r, now)
+	if err != nil {
+		return nil, err
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	// Add to the latest revocations
+	if err := f.load(); err != nil {
+		return nil, err
+	}
+	f.revocations = f.revocations.add(r, now)
+	if err := f.save(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// List returns the revocations which have not expired
+func (f *FileRevoker) List(ctx context.Context) ([]*Revocation, error) {
+	if err := f.reload(); err != nil {
+		return nil, err
+	}
+
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+
+	return f.revocations.active(time.Now()), nil
+}
+
+// IsRevoked returns the revocation matching the claims, if any
+func (f *FileRevoker) IsRevoked(ctx context.Context, claims *auth.Claims) (*Revocation, error) {
+	if err := f.reload(); err != nil {
+		return nil, err
+	}
+
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+
+	return f.revocations.match(claims, time.Now()), nil
+}
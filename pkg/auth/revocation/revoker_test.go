@@ -0,0 +1,178 @@
+/*
+Copyright 2022 Pure Storage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package revocation
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	jwt "github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/libopenstorage/grpc-framework/pkg/auth"
+)
+
+func testClaims(issuer, subject, id string, issuedAt time.Time) *auth.Claims {
+	return &auth.Claims{
+		Issuer:   issuer,
+		Subject:  subject,
+		ID:       id,
+		IssuedAt: jwt.NewNumericDate(issuedAt),
+	}
+}
+
+func TestRevocationMatches(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name       string
+		revocation *Revocation
+		claims     *auth.Claims
+		revoked    bool
+	}{
+		{
+			name:       "jti",
+			revocation: &Revocation{Jti: "1"},
+			claims:     testClaims("iss", "jim", "1", now),
+			revoked:    true,
+		},
+		{
+			name:       "other jti",
+			revocation: &Revocation{Jti: "1"},
+			claims:     testClaims("iss", "jim", "2", now),
+		},
+		{
+			name:       "jti of other issuer",
+			revocation: &Revocation{Jti: "1", Issuer: "other"},
+			claims:     testClaims("iss", "jim", "1", now),
+		},
+		{
+			name:       "subject issued before",
+			revocation: &Revocation{Subject: "jim", NotBefore: now.Unix()},
+			claims:     testClaims("iss", "jim", "1", now.Add(-time.Minute)),
+			revoked:    true,
+		},
+		{
+			name:       "subject issued after",
+			revocation: &Revocation{Subject: "jim", NotBefore: now.Unix()},
+			claims:     testClaims("iss", "jim", "1", now.Add(time.Minute)),
+		},
+		{
+			name:       "subject without issue time",
+			revocation: &Revocation{Subject: "jim", NotBefore: now.Unix()},
+			claims:     &auth.Claims{Issuer: "iss", Subject: "jim"},
+			revoked:    true,
+		},
+		{
+			name:       "other subject",
+			revocation: &Revocation{Subject: "jim", NotBefore: now.Unix()},
+			claims:     testClaims("iss", "bob", "1", now.Add(-time.Minute)),
+		},
+		{
+			name:       "issuer",
+			revocation: &Revocation{Issuer: "iss", NotBefore: now.Unix()},
+			claims:     testClaims("iss", "bob", "1", now.Add(-time.Minute)),
+			revoked:    true,
+		},
+		{
+			name:       "other issuer",
+			revocation: &Revocation{Issuer: "iss", NotBefore: now.Unix()},
+			claims:     testClaims("other", "bob", "1", now.Add(-time.Minute)),
+		},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.revoked, test.revocation.Matches(test.claims), test.name)
+	}
+}
+
+func TestMemoryRevoker(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemoryRevoker()
+
+	_, err := m.Revoke(ctx, &Revocation{Reason: "nothing"})
+	assert.Error(t, err)
+
+	// Subject revocations apply to the tokens issued until now by default
+	r, err := m.Revoke(ctx, &Revocation{Subject: "jim", Reason: "left"})
+	require.NoError(t, err)
+	assert.NotZero(t, r.GetCreated())
+	assert.Equal(t, r.GetCreated(), r.GetNotBefore())
+
+	r, err = m.IsRevoked(ctx, testClaims("iss", "jim", "1", time.Now().Add(-time.Minute)))
+	require.NoError(t, err)
+	require.NotNil(t, r)
+	assert.Equal(t, "left", r.GetReason())
+	r, err = m.IsRevoked(ctx, testClaims("iss", "jim", "2", time.Now().Add(time.Minute)))
+	require.NoError(t, err)
+	assert.Nil(t, r)
+
+	// Expired revocations are dropped
+	_, err = m.Revoke(ctx, &Revocation{Jti: "2", Expiration: time.Now().Add(-time.Second).Unix()})
+	require.NoError(t, err)
+	r, err = m.IsRevoked(ctx, testClaims("iss", "bob", "2", time.Now()))
+	require.NoError(t, err)
+	assert.Nil(t, r)
+	_, err = m.Revoke(ctx, &Revocation{Jti: "3"})
+	require.NoError(t, err)
+
+	list, err := m.List(ctx)
+	require.NoError(t, err)
+	require.Len(t, list, 2)
+	assert.Equal(t, "jim", list[0].GetSubject())
+	assert.Equal(t, "3", list[1].GetJti())
+}
+
+func TestFileRevoker(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "revocations.json")
+	f, err := NewFileRevoker(path)
+	require.NoError(t, err)
+	list, err := f.List(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, list)
+
+	_, err = f.Revoke(ctx, &Revocation{Jti: "1", Reason: "leaked"})
+	require.NoError(t, err)
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), "leaked")
+
+	other, err := NewFileRevoker(path)
+	require.NoError(t, err)
+	r, err := other.IsRevoked(ctx, testClaims("iss", "jim", "1", time.Now()))
+	require.NoError(t, err)
+	require.NotNil(t, r)
+	assert.Equal(t, "leaked", r.GetReason())
+
+	// Changes of the file are seen by the other revokers after the reload interval
+	other.reloadInterval = time.Hour
+	_, err = f.Revoke(ctx, &Revocation{Issuer: "iss"})
+	require.NoError(t, err)
+	claims := testClaims("iss", "jim", "2", time.Now().Add(-time.Minute))
+	r, err = other.IsRevoked(ctx, claims)
+	require.NoError(t, err)
+	assert.Nil(t, r)
+	other.reloadInterval = 0
+	r, err = other.IsRevoked(ctx, claims)
+	require.NoError(t, err)
+	assert.NotNil(t, r)
+	list, err = other.List(ctx)
+	require.NoError(t, err)
+	assert.Len(t, list, 2)
+}
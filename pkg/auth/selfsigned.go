@@ -35,6 +35,8 @@ type JwtAuthConfig struct {
 	// UsernameClaim has the location of the unique id for the user.
 	// If empty, "sub" will be used for the user name unique id.
 	UsernameClaim UsernameClaimType
+	// ClaimsValidation configures the validation of the claims of the tokens
+	ClaimsValidation ClaimsValidation
 }
 
 // JwtAuthenticator definition. It contains the raw bytes of the keys and their
@@ -86,12 +88,40 @@ func NewJwtAuthenticator(config *JwtAuthConfig) (*JwtAuthenticator, error) {
 	return authenticator, nil
 }
 
+// jwtTokenClaims are the claims of a token, decoded once by the jwt parser
+// both as a map, to check the claims, and as Claims
+type jwtTokenClaims struct {
+	mapClaims  jwt.MapClaims
+	claims     Claims
+	validation *ClaimsValidation
+}
+
+// UnmarshalJSON decodes the claims of the token
+func (c *jwtTokenClaims) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, &c.mapClaims); err != nil {
+		return err
+	}
+	return json.Unmarshal(data, &c.claims)
+}
+
+// Valid validates the time based claims of the token
+func (c *jwtTokenClaims) Valid() error {
+	return c.validation.validateTimes(c.mapClaims, jwt.TimeFunc(), false)
+}
+
 // AuthenticateToken determines if a token is valid and if it is, returns
 // the information in the claims.
 func (j *JwtAuthenticator) AuthenticateToken(ctx context.Context, rawtoken string) (*Claims, error) {
 
 	// Parse token
-	token, err := jwt.Parse(rawtoken, func(token *jwt.Token) (interface{}, error) {
+	var options []jwt.ParserOption
+	if len(j.config.ClaimsValidation.Algorithms) != 0 {
+		options = append(options, jwt.WithValidMethods(j.config.ClaimsValidation.Algorithms))
+	}
+	tokenClaims := &jwtTokenClaims{
+		validation: &j.config.ClaimsValidation,
+	}
+	token, err := jwt.NewParser(options...).ParseWithClaims(rawtoken, tokenClaims, func(token *jwt.Token) (interface{}, error) {
 
 		// Verify Method
 		if strings.HasPrefix(token.Method.Alg(), "RS") {
@@ -115,32 +145,19 @@ func (j *JwtAuthenticator) AuthenticateToken(ctx context.Context, rawtoken strin
 	}
 
 	// Get claims
-	claims, ok := token.Claims.(jwt.MapClaims)
-	if claims == nil || !ok {
+	claims := tokenClaims.mapClaims
+	if claims == nil {
 		return nil, fmt.Errorf("no claims found in token")
 	}
 
 	// Check for required claims
-	for _, requiredClaim := range requiredClaims {
-		if _, ok := claims[requiredClaim]; !ok {
-			// Claim missing
-			return nil, fmt.Errorf("required claim %v missing from token", requiredClaim)
-		}
+	if err := j.config.ClaimsValidation.validateClaims(claims); err != nil {
+		return nil, err
 	}
 
 	// Token now has been verified.
 	// Claims holds all the authorization information.
-	// Here we need to first decode it then unmarshal it from JSON
-	parts := strings.Split(token.Raw, ".")
-	claimBytes, err := jwt.DecodeSegment(parts[1])
-	if err != nil {
-		return nil, fmt.Errorf("failed to decode claims: %w", err)
-	}
-	var sdkClaims Claims
-	err = json.Unmarshal(claimBytes, &sdkClaims)
-	if err != nil {
-		return nil, fmt.Errorf("unable to get claims: %w", err)
-	}
+	sdkClaims := tokenClaims.claims
 	sdkClaims.UsernameClaim = j.usernameClaim
 	if err := sdkClaims.ValidateUsername(); err != nil {
 		return nil, err
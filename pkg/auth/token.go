@@ -24,6 +24,7 @@ import (
 
 	jwt "github.com/golang-jwt/jwt/v4"
 	"github.com/grpc-ecosystem/go-grpc-middleware/util/metautils"
+	"github.com/pborman/uuid"
 )
 
 const (
@@ -82,20 +83,46 @@ func TokenIssuer(rawtoken string) (string, error) {
 	}
 }
 
+// TokenExpiration returns the expiration time of the raw JWT token. It
+// returns false if the token is not a JWT or does not expire.
+func TokenExpiration(rawtoken string) (time.Time, bool) {
+	parts := strings.Split(rawtoken, ".")
+	if len(parts) < 3 {
+		return time.Time{}, false
+	}
+	claimBytes, err := jwt.DecodeSegment(parts[1])
+	if err != nil {
+		return time.Time{}, false
+	}
+	var claims struct {
+		Exp float64 `json:"exp"`
+	}
+	if err := json.Unmarshal(claimBytes, &claims); err != nil || claims.Exp == 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(claims.Exp), 0), true
+}
+
 // IsJwtToken returns true if the provided string is a valid jwt token
 func IsJwtToken(authstring string) bool {
 	_, _, err := new(jwt.Parser).ParseUnverified(authstring, jwt.MapClaims{})
 	return err == nil
 }
 
-// Token returns a signed JWT containing the claims provided
+// Token returns a signed JWT containing the claims provided. The token has
+// the ID of the claims, or a new unique ID, so that it can be revoked.
 func Token(
 	claims *Claims,
 	signature *Signature,
 	options *Options,
 ) (string, error) {
 
+	id := claims.ID
+	if id == "" {
+		id = uuid.New()
+	}
 	mapclaims := jwt.MapClaims{
+		"jti":   id,
 		"sub":   claims.Subject,
 		"iss":   claims.Issuer,
 		"email": claims.Email,
@@ -117,6 +144,9 @@ func Token(
 	return signedtoken, nil
 }
 
+// IsGuest returns true if the incoming metadata has no authorization token.
+// API keys in the x-api-key metadata are not checked since they are only
+// used when API keys are authenticated.
 func IsGuest(ctx context.Context) bool {
 	return metautils.ExtractIncoming(ctx).Get(authorizationHeader) == ""
 }
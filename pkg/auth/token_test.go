@@ -83,6 +83,15 @@ func TestTokenSharedSecretSimple(t *testing.T) {
 	assert.Equal(t, authenticateClaims.Email, claims.Email)
 	assert.Equal(t, authenticateClaims.Name, claims.Name)
 	assert.Equal(t, authenticateClaims.Roles, claims.Roles)
+
+	// Every token has a unique ID
+	assert.NotEmpty(t, authenticateClaims.ID)
+	assert.NotNil(t, authenticateClaims.IssuedAt)
+	otherToken, err := Token(&claims, &sig, &opts)
+	assert.NoError(t, err)
+	otherClaims, err := TokenClaims(otherToken)
+	assert.NoError(t, err)
+	assert.NotEqual(t, authenticateClaims.ID, otherClaims.ID)
 }
 
 func TestTokenExpired(t *testing.T) {
@@ -135,6 +144,95 @@ func TestTokenIssuer(t *testing.T) {
 	assert.Equal(t, issuer, parsedIssuer)
 }
 
+func TestTokenExpiration(t *testing.T) {
+	sig := Signature{
+		Type: jwt.SigningMethodHS256,
+		Key:  []byte("mysecret"),
+	}
+	exp := time.Now().Add(time.Minute * 10).Unix()
+	rawtoken, err := Token(&Claims{Issuer: "testiss"}, &sig, &Options{Expiration: exp})
+	assert.NoError(t, err)
+
+	expiration, ok := TokenExpiration(rawtoken)
+	assert.True(t, ok)
+	assert.Equal(t, exp, expiration.Unix())
+
+	// Tokens without expiration
+	rawtoken, err = Token(&Claims{Issuer: "testiss"}, &sig, &Options{})
+	assert.NoError(t, err)
+	_, ok = TokenExpiration(rawtoken)
+	assert.False(t, ok)
+	_, ok = TokenExpiration("opaque")
+	assert.False(t, ok)
+}
+
+func TestJwtAuthenticatorClaimsValidation(t *testing.T) {
+	key := []byte("mysecret")
+	signedToken := func(claims jwt.MapClaims) string {
+		rawtoken, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(key)
+		assert.NoError(t, err)
+		return rawtoken
+	}
+	authenticate := func(validation ClaimsValidation, rawtoken string) error {
+		authctr, err := NewJwtAuthenticator(&JwtAuthConfig{
+			SharedSecret:     key,
+			ClaimsValidation: validation,
+		})
+		assert.NoError(t, err)
+		_, err = authctr.AuthenticateToken(context.Background(), rawtoken)
+		return err
+	}
+	now := time.Now()
+	serviceAccount := jwt.MapClaims{
+		"iss": "kubernetes/serviceaccount",
+		"sub": "system:serviceaccount:default:app",
+		"aud": []string{"api"},
+		"exp": now.Add(time.Minute).Unix(),
+		"iat": now.Unix(),
+	}
+
+	// Tokens without name and email are rejected by default
+	rawtoken := signedToken(serviceAccount)
+	assert.Error(t, authenticate(ClaimsValidation{}, rawtoken))
+	assert.NoError(t, authenticate(ClaimsValidation{
+		RequiredClaims: []string{"iss", "sub", "exp"},
+	}, rawtoken))
+
+	// Audiences and algorithms
+	assert.NoError(t, authenticate(ClaimsValidation{
+		RequiredClaims: []string{},
+		Audiences:      []string{"api"},
+		Algorithms:     []string{"HS256", "RS256"},
+	}, rawtoken))
+	assert.Error(t, authenticate(ClaimsValidation{
+		RequiredClaims: []string{},
+		Audiences:      []string{"other"},
+	}, rawtoken))
+	assert.Error(t, authenticate(ClaimsValidation{
+		RequiredClaims: []string{},
+		Algorithms:     []string{"RS256"},
+	}, rawtoken))
+
+	// Leeway
+	serviceAccount["exp"] = now.Add(-10 * time.Second).Unix()
+	rawtoken = signedToken(serviceAccount)
+	assert.Error(t, authenticate(ClaimsValidation{RequiredClaims: []string{}}, rawtoken))
+	assert.NoError(t, authenticate(ClaimsValidation{
+		RequiredClaims: []string{},
+		Leeway:         time.Minute,
+	}, rawtoken))
+
+	// Not before
+	serviceAccount["exp"] = now.Add(time.Hour).Unix()
+	serviceAccount["nbf"] = now.Add(time.Minute).Unix()
+	rawtoken = signedToken(serviceAccount)
+	assert.Error(t, authenticate(ClaimsValidation{RequiredClaims: []string{}}, rawtoken))
+	assert.NoError(t, authenticate(ClaimsValidation{
+		RequiredClaims:     []string{},
+		SkipNotBeforeCheck: true,
+	}, rawtoken))
+}
+
 func TestTokenNTPDrift(t *testing.T) {
 	goodTimeNow := time.Now()
 
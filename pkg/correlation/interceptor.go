@@ -18,6 +18,7 @@ package correlation
 import (
 	"context"
 
+	grpc_middleware "github.com/grpc-ecosystem/go-grpc-middleware"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/metadata"
 
@@ -29,14 +30,10 @@ type ContextInterceptor struct {
 	Origin Component
 }
 
-// ContextUnaryServerInterceptor creates a gRPC interceptor for adding
-// correlation ID to each request
-func (ci *ContextInterceptor) ContextUnaryServerInterceptor(
-	ctx context.Context,
-	req interface{},
-	info *grpc.UnaryServerInfo,
-	handler grpc.UnaryHandler,
-) (interface{}, error) {
+// IncomingContext returns a context with the correlation context from the
+// incoming gRPC metadata, or a new one if the caller did not provide it and
+// ctx has none. Calling it again on the returned context keeps the same ID.
+func (ci *ContextInterceptor) IncomingContext(ctx context.Context) context.Context {
 	md, ok := metadata.FromIncomingContext(ctx)
 	if ok {
 		// Get request context from gRPC metadata
@@ -47,21 +44,37 @@ func (ci *ContextInterceptor) ContextUnaryServerInterceptor(
 			ctx = context.WithValue(ctx, ContextKey, rc)
 		}
 	}
-	ctx = WithCorrelationContext(ctx, ci.Origin)
-
-	return handler(ctx, req)
+	return WithCorrelationContext(ctx, ci.Origin)
 }
 
-// ContextUnaryClientInterceptor creates a gRPC interceptor for adding
+// ContextUnaryServerInterceptor creates a gRPC interceptor for adding
 // correlation ID to each request
-func ContextUnaryClientInterceptor(
+func (ci *ContextInterceptor) ContextUnaryServerInterceptor(
 	ctx context.Context,
-	method string,
-	req, reply interface{},
-	cc *grpc.ClientConn,
-	invoker grpc.UnaryInvoker,
-	opts ...grpc.CallOption,
+	req interface{},
+	info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler,
+) (interface{}, error) {
+	return handler(ci.IncomingContext(ctx), req)
+}
+
+// ContextStreamServerInterceptor creates a gRPC interceptor for adding
+// correlation ID to each stream
+func (ci *ContextInterceptor) ContextStreamServerInterceptor(
+	srv interface{},
+	stream grpc.ServerStream,
+	info *grpc.StreamServerInfo,
+	handler grpc.StreamHandler,
 ) error {
+	wrapped := grpc_middleware.WrapServerStream(stream)
+	wrapped.WrappedContext = ci.IncomingContext(stream.Context())
+
+	return handler(srv, wrapped)
+}
+
+// withOutgoingContext returns a context with the correlation context
+// added to the outgoing gRPC metadata
+func withOutgoingContext(ctx context.Context) context.Context {
 	// Create new metadata from request context in context
 	newContextMap := RequestContextFromContextValue(ctx).AsMap()
 	newContextMD := metadata.New(newContextMap)
@@ -71,11 +84,40 @@ func ContextUnaryClientInterceptor(
 	if ok {
 		newContextMD = metadata.Join(newContextMD, existingMD)
 	}
-	ctx = metadata.NewOutgoingContext(ctx, newContextMD)
+	return metadata.NewOutgoingContext(ctx, newContextMD)
+}
+
+// ContextUnaryClientInterceptor creates a gRPC interceptor for adding
+// correlation ID to each request
+func ContextUnaryClientInterceptor(
+	ctx context.Context,
+	method string,
+	req, reply interface{},
+	cc *grpc.ClientConn,
+	invoker grpc.UnaryInvoker,
+	opts ...grpc.CallOption,
+) error {
+	return invoker(withOutgoingContext(ctx), method, req, reply, cc, opts...)
+}
 
-	return invoker(ctx, method, req, reply, cc, opts...)
+// ContextStreamClientInterceptor creates a gRPC interceptor for adding
+// correlation ID to each stream
+func ContextStreamClientInterceptor(
+	ctx context.Context,
+	desc *grpc.StreamDesc,
+	cc *grpc.ClientConn,
+	method string,
+	streamer grpc.Streamer,
+	opts ...grpc.CallOption,
+) (grpc.ClientStream, error) {
+	return streamer(withOutgoingContext(ctx), desc, cc, method, opts...)
 }
 
+// DialOptionsAddCorrelation adds the correlation interceptors for unary and
+// stream calls to the dial options
 func DialOptionsAddCorrelation(dialOptions []grpc.DialOption) []grpc.DialOption {
-	return client.DialOptionsAdd(dialOptions, grpc.WithUnaryInterceptor(ContextUnaryClientInterceptor))
+	return client.DialOptionsAdd(dialOptions,
+		grpc.WithChainUnaryInterceptor(ContextUnaryClientInterceptor),
+		grpc.WithChainStreamInterceptor(ContextStreamClientInterceptor),
+	)
 }
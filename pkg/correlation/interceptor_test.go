@@ -0,0 +1,90 @@
+/*
+Copyright 2021 Portworx
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package correlation
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+type testServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *testServerStream) Context() context.Context {
+	return s.ctx
+}
+
+func TestContextStreamServerInterceptor(t *testing.T) {
+	ci := &ContextInterceptor{Origin: "test"}
+
+	// Correlation ID provided by the caller
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(
+		ContextIDKey, "myid",
+		ContextOriginKey, "caller",
+	))
+	err := ci.ContextStreamServerInterceptor(nil, &testServerStream{ctx: ctx}, &grpc.StreamServerInfo{},
+		func(srv interface{}, stream grpc.ServerStream) error {
+			rc := RequestContextFromContextValue(stream.Context())
+			assert.Equal(t, "myid", rc.ID)
+			assert.Equal(t, Component("caller"), rc.Origin)
+			return nil
+		})
+	assert.NoError(t, err)
+
+	// New correlation ID
+	err = ci.ContextStreamServerInterceptor(nil, &testServerStream{ctx: context.Background()}, &grpc.StreamServerInfo{},
+		func(srv interface{}, stream grpc.ServerStream) error {
+			rc := RequestContextFromContextValue(stream.Context())
+			assert.NotEmpty(t, rc.ID)
+			assert.Equal(t, Component("test"), rc.Origin)
+			return nil
+		})
+	assert.NoError(t, err)
+}
+
+func TestContextClientInterceptors(t *testing.T) {
+	ctx := WithCorrelationContext(context.Background(), "test")
+	ctx = metadata.AppendToOutgoingContext(ctx, "key", "value")
+	id := RequestContextFromContextValue(ctx).ID
+
+	checkMetadata := func(ctx context.Context) {
+		md, ok := metadata.FromOutgoingContext(ctx)
+		assert.True(t, ok)
+		assert.Equal(t, []string{id}, md.Get(ContextIDKey))
+		assert.Equal(t, []string{"test"}, md.Get(ContextOriginKey))
+		assert.Equal(t, []string{"value"}, md.Get("key"))
+	}
+
+	err := ContextUnaryClientInterceptor(ctx, "/test/method", nil, nil, nil,
+		func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+			checkMetadata(ctx)
+			return nil
+		})
+	assert.NoError(t, err)
+
+	_, err = ContextStreamClientInterceptor(ctx, &grpc.StreamDesc{}, nil, "/test/method",
+		func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+			checkMetadata(ctx)
+			return nil, nil
+		})
+	assert.NoError(t, err)
+}
@@ -0,0 +1,254 @@
+/*
+Copyright 2022 Pure Storage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package errors creates gRPC errors with google.rpc error details, and reads
+// the details of the errors received by the clients.
+package errors
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	spb "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/protoadapt"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+const (
+	// Domain of the errors of the framework
+	Domain = "grpc-framework.libopenstorage.org"
+
+	// ReasonRateLimited is the ErrorInfo reason of the requests rejected by
+	// the rate limiters
+	ReasonRateLimited = "RATE_LIMITED"
+	// ReasonAccessDenied is the ErrorInfo reason of the requests rejected by
+	// the authorization
+	ReasonAccessDenied = "ACCESS_DENIED"
+)
+
+// New returns a gRPC error with the code, the message and the details
+func New(c codes.Code, msg string, details ...protoadapt.MessageV1) error {
+	return WithDetails(status.Error(c, msg), details...)
+}
+
+// WithDetails returns the gRPC error with the details added. The error is
+// converted to a gRPC error if needed. Errors with code OK have no details.
+func WithDetails(err error, details ...protoadapt.MessageV1) error {
+	s := status.Convert(err)
+	if len(details) == 0 {
+		return s.Err()
+	}
+	withDetails, derr := s.WithDetails(details...)
+	if derr != nil {
+		return s.Err()
+	}
+	return withDetails.Err()
+}
+
+// WithErrorInfo returns the gRPC error with an ErrorInfo detail with the
+// reason of the error in the domain, and additional metadata
+func WithErrorInfo(err error, reason, domain string, metadata map[string]string) error {
+	return WithDetails(err, &errdetails.ErrorInfo{
+		Reason:   reason,
+		Domain:   domain,
+		Metadata: metadata,
+	})
+}
+
+// WithRetryInfo returns the gRPC error with a RetryInfo detail telling the
+// client how long to wait before retrying
+func WithRetryInfo(err error, delay time.Duration) error {
+	return WithDetails(err, &errdetails.RetryInfo{
+		RetryDelay: durationpb.New(delay),
+	})
+}
+
+// FieldViolation returns the violation of a field of a BadRequest. The field
+// is a path to the field, like `volume.spec.size`.
+func FieldViolation(field, description string) *errdetails.BadRequest_FieldViolation {
+	return &errdetails.BadRequest_FieldViolation{
+		Field:       field,
+		Description: description,
+	}
+}
+
+// InvalidArgument returns an InvalidArgument error with a BadRequest detail
+// with the violations
+func InvalidArgument(msg string, violations ...*errdetails.BadRequest_FieldViolation) error {
+	if len(violations) == 0 {
+		return New(codes.InvalidArgument, msg)
+	}
+	return New(codes.InvalidArgument, msg, &errdetails.BadRequest{
+		FieldViolations: violations,
+	})
+}
+
+// NotFound returns a NotFound error with a ResourceInfo detail
+func NotFound(resourceType, resourceName string) error {
+	return New(codes.NotFound,
+		fmt.Sprintf("%s %s not found", resourceType, resourceName),
+		&errdetails.ResourceInfo{
+			ResourceType: resourceType,
+			ResourceName: resourceName,
+			Description:  "not found",
+		})
+}
+
+// AlreadyExists returns an AlreadyExists error with a ResourceInfo detail
+func AlreadyExists(resourceType, resourceName string) error {
+	return New(codes.AlreadyExists,
+		fmt.Sprintf("%s %s already exists", resourceType, resourceName),
+		&errdetails.ResourceInfo{
+			ResourceType: resourceType,
+			ResourceName: resourceName,
+			Description:  "already exists",
+		})
+}
+
+// QuotaViolation returns the violation of a QuotaFailure. The subject
+// is the quota which was exceeded, like `user:jim` or `clients`.
+func QuotaViolation(subject, description string) *errdetails.QuotaFailure_Violation {
+	return &errdetails.QuotaFailure_Violation{
+		Subject:     subject,
+		Description: description,
+	}
+}
+
+// ResourceExhausted returns a ResourceExhausted error with a QuotaFailure
+// detail with the violations, and a RetryInfo detail if retryDelay is set
+func ResourceExhausted(msg string, retryDelay time.Duration, violations ...*errdetails.QuotaFailure_Violation) error {
+	var details []protoadapt.MessageV1
+	if len(violations) != 0 {
+		details = append(details, &errdetails.QuotaFailure{
+			Violations: violations,
+		})
+	}
+	if retryDelay > 0 {
+		details = append(details, &errdetails.RetryInfo{
+			RetryDelay: durationpb.New(retryDelay),
+		})
+	}
+	return New(codes.ResourceExhausted, msg, details...)
+}
+
+// Unavailable returns an Unavailable error with a RetryInfo detail if
+// retryDelay is set
+func Unavailable(msg string, retryDelay time.Duration) error {
+	err := New(codes.Unavailable, msg)
+	if retryDelay > 0 {
+		err = WithRetryInfo(err, retryDelay)
+	}
+	return err
+}
+
+// PermissionDenied returns a PermissionDenied error with an ErrorInfo detail
+func PermissionDenied(msg, reason, domain string, metadata map[string]string) error {
+	return WithErrorInfo(New(codes.PermissionDenied, msg), reason, domain, metadata)
+}
+
+// detail returns the first detail of type T of the error
+func detail[T any](err error) (T, bool) {
+	var zero T
+	if err == nil {
+		return zero, false
+	}
+	s, ok := status.FromError(err)
+	if !ok {
+		return zero, false
+	}
+	for _, d := range s.Details() {
+		if v, ok := d.(T); ok {
+			return v, true
+		}
+	}
+	return zero, false
+}
+
+// BadRequest returns the BadRequest detail of the error, or nil
+func BadRequest(err error) *errdetails.BadRequest {
+	d, _ := detail[*errdetails.BadRequest](err)
+	return d
+}
+
+// FieldViolations returns the field violations of the BadRequest detail of the error
+func FieldViolations(err error) []*errdetails.BadRequest_FieldViolation {
+	return BadRequest(err).GetFieldViolations()
+}
+
+// ResourceInfo returns the ResourceInfo detail of the error, or nil
+func ResourceInfo(err error) *errdetails.ResourceInfo {
+	d, _ := detail[*errdetails.ResourceInfo](err)
+	return d
+}
+
+// QuotaFailure returns the QuotaFailure detail of the error, or nil
+func QuotaFailure(err error) *errdetails.QuotaFailure {
+	d, _ := detail[*errdetails.QuotaFailure](err)
+	return d
+}
+
+// ErrorInfo returns the ErrorInfo detail of the error, or nil
+func ErrorInfo(err error) *errdetails.ErrorInfo {
+	d, _ := detail[*errdetails.ErrorInfo](err)
+	return d
+}
+
+// RequestInfo returns the RequestInfo detail of the error, or nil
+func RequestInfo(err error) *errdetails.RequestInfo {
+	d, _ := detail[*errdetails.RequestInfo](err)
+	return d
+}
+
+// RetryDelay returns the delay of the RetryInfo detail of the error. It
+// returns false if the error has no RetryInfo.
+func RetryDelay(err error) (time.Duration, bool) {
+	d, ok := detail[*errdetails.RetryInfo](err)
+	if !ok {
+		return 0, false
+	}
+	return d.GetRetryDelay().AsDuration(), true
+}
+
+// HasReason returns true if the error has an ErrorInfo with the reason in
+// the domain
+func HasReason(err error, reason, domain string) bool {
+	info := ErrorInfo(err)
+	return info != nil && info.GetReason() == reason && info.GetDomain() == domain
+}
+
+// MarshalJSON returns the gRPC status as compact JSON with all the fields.
+// The details are rendered with their type in `@type`, like:
+//
+//	{"code":3,"message":"invalid name","details":[{"@type":"type.googleapis.com/google.rpc.BadRequest","fieldViolations":[...]}]}
+//
+// Unlike protojson, the output does not change between builds.
+func MarshalJSON(s *spb.Status) ([]byte, error) {
+	data, err := protojson.MarshalOptions{EmitUnpopulated: true}.Marshal(s)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, data); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,104 @@
+/*
+Copyright 2022 Pure Storage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package errors
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestInvalidArgument(t *testing.T) {
+	err := InvalidArgument("invalid request",
+		FieldViolation("name", "name is required"),
+		FieldViolation("spec.size", "size must be positive"))
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	assert.Equal(t, "invalid request", status.Convert(err).Message())
+
+	violations := FieldViolations(err)
+	require.Len(t, violations, 2)
+	assert.Equal(t, "name", violations[0].GetField())
+	assert.Equal(t, "size must be positive", violations[1].GetDescription())
+
+	assert.Empty(t, FieldViolations(InvalidArgument("invalid request")))
+}
+
+func TestResourceErrors(t *testing.T) {
+	err := NotFound("volume", "vol1")
+	assert.Equal(t, codes.NotFound, status.Code(err))
+	assert.Equal(t, "volume vol1 not found", status.Convert(err).Message())
+	assert.Equal(t, "volume", ResourceInfo(err).GetResourceType())
+	assert.Equal(t, "vol1", ResourceInfo(err).GetResourceName())
+
+	err = AlreadyExists("volume", "vol1")
+	assert.Equal(t, codes.AlreadyExists, status.Code(err))
+	assert.Equal(t, "vol1", ResourceInfo(err).GetResourceName())
+}
+
+func TestResourceExhausted(t *testing.T) {
+	err := ResourceExhausted("too many requests", 2*time.Second, QuotaViolation("user:jim", "too many requests"))
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+	delay, ok := RetryDelay(err)
+	assert.True(t, ok)
+	assert.Equal(t, 2*time.Second, delay)
+	require.Len(t, QuotaFailure(err).GetViolations(), 1)
+	assert.Equal(t, "user:jim", QuotaFailure(err).GetViolations()[0].GetSubject())
+
+	// No retry information
+	_, ok = RetryDelay(ResourceExhausted("too many requests", 0))
+	assert.False(t, ok)
+	assert.Nil(t, QuotaFailure(ResourceExhausted("too many requests", 0)))
+
+	delay, ok = RetryDelay(Unavailable("try again", time.Minute))
+	assert.True(t, ok)
+	assert.Equal(t, time.Minute, delay)
+}
+
+func TestErrorInfo(t *testing.T) {
+	err := PermissionDenied("access denied", ReasonAccessDenied, Domain, map[string]string{"method": "/a.B/C"})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	assert.True(t, HasReason(err, ReasonAccessDenied, Domain))
+	assert.False(t, HasReason(err, ReasonRateLimited, Domain))
+	assert.False(t, HasReason(err, ReasonAccessDenied, "example.com"))
+	assert.Equal(t, "/a.B/C", ErrorInfo(err).GetMetadata()["method"])
+
+	// Details are added to existing errors, which are converted if needed
+	err = WithErrorInfo(err, "OTHER", "example.com", nil)
+	assert.Len(t, status.Convert(err).Details(), 2)
+	err = WithErrorInfo(fmt.Errorf("failed"), "FAILED", "example.com", nil)
+	assert.Equal(t, codes.Unknown, status.Code(err))
+	assert.Equal(t, "FAILED", ErrorInfo(err).GetReason())
+
+	// Errors without details
+	assert.Nil(t, ErrorInfo(nil))
+	assert.Nil(t, ErrorInfo(fmt.Errorf("failed")))
+	assert.Nil(t, RequestInfo(status.Error(codes.Internal, "failed")))
+}
+
+func TestMarshalJSON(t *testing.T) {
+	err := InvalidArgument("invalid request", FieldViolation("name", "name is required"))
+	data, merr := MarshalJSON(status.Convert(err).Proto())
+	require.NoError(t, merr)
+	assert.Equal(t, `{"code":3,"message":"invalid request","details":[`+
+		`{"@type":"type.googleapis.com/google.rpc.BadRequest","fieldViolations":`+
+		`[{"field":"name","description":"name is required"}]}]}`,
+		string(data))
+}
@@ -17,12 +17,17 @@ limitations under the License.
 package server
 
 import (
+	"context"
 	"fmt"
 	"net"
+	"net/http"
+	"strconv"
 	"sync"
+	"sync/atomic"
 
 	"github.com/sirupsen/logrus"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/reflection"
 )
 
@@ -33,8 +38,15 @@ type GrpcServerConfig struct {
 	Net     string
 	Address string
 	Opts    []grpc.ServerOption
+	// Listener, if provided, is used instead of listening on Net and Address
+	Listener net.Listener
 }
 
+const (
+	// Number of serve errors kept until they are received
+	serveErrorsBufferSize = 8
+)
+
 // GrpcServer is a server manager for gRPC implementations
 type GrpcServer struct {
 	name     string
@@ -44,6 +56,19 @@ type GrpcServer struct {
 	running  bool
 	lock     sync.Mutex
 	opts     []grpc.ServerOption
+	errs     chan error
+
+	// Server handling the HTTP/2 requests, set once started. It is not
+	// protected by the lock which is held while shutting down.
+	httpServer atomic.Pointer[grpc.Server]
+
+	// Requests in-flight in ServeHTTP. grpc.Server.GracefulStop panics when
+	// it drains their transports, so they are finished before stopping.
+	httpLock     sync.Mutex
+	httpClosed   bool
+	httpRequests sync.WaitGroup
+	httpCtx      context.Context
+	httpCancel   context.CancelFunc
 }
 
 // New creates a gRPC server on the specified port and transport.
@@ -54,6 +79,14 @@ func New(config *GrpcServerConfig) (*GrpcServer, error) {
 	if len(config.Name) == 0 {
 		return nil, fmt.Errorf("Name of server must be provided")
 	}
+	if config.Listener != nil {
+		return &GrpcServer{
+			name:     config.Name,
+			listener: config.Listener,
+			opts:     config.Opts,
+			errs:     make(chan error, serveErrorsBufferSize),
+		}, nil
+	}
 	if len(config.Address) == 0 {
 		return nil, fmt.Errorf("Address must be provided")
 	}
@@ -70,6 +103,7 @@ func New(config *GrpcServerConfig) (*GrpcServer, error) {
 		name:     config.Name,
 		listener: l,
 		opts:     config.Opts,
+		errs:     make(chan error, serveErrorsBufferSize),
 	}, nil
 }
 
@@ -116,10 +150,15 @@ func (s *GrpcServer) StartWithServer(server func() *grpc.Server) error {
 func (s *GrpcServer) startGrpcService() {
 	// Start listening for requests
 	reflection.Register(s.server)
-	logrus.Infof("%s gRPC Server ready on %s", s.name, s.Address())
+	logrus.Infof("%s gRPC Server ready on %s", s.name, s.listener.Addr().String())
 	waitForServer := make(chan bool)
-	s.goServe(waitForServer)
+	s.goServe(s.listener, waitForServer)
 	<-waitForServer
+	s.httpLock.Lock()
+	s.httpClosed = false
+	s.httpCtx, s.httpCancel = context.WithCancel(context.Background())
+	s.httpLock.Unlock()
+	s.httpServer.Store(s.server)
 	s.running = true
 }
 
@@ -134,14 +173,99 @@ func (s *GrpcServer) Stop() {
 		return
 	}
 
+	s.closeHTTP(true)
 	s.server.Stop()
 	s.wg.Wait()
 	s.running = false
 }
 
+// Shutdown gracefully stops the gRPC server. It stops accepting new
+// connections and waits for the pending RPCs to finish, starting with the
+// requests of ServeHTTP. If the context expires first, the server is stopped
+// and the pending RPCs are cancelled. It does nothing if the server has
+// already been stopped.
+func (s *GrpcServer) Shutdown(ctx context.Context) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if !s.running {
+		return nil
+	}
+
+	// Finish the requests of ServeHTTP before draining the connections
+	s.closeHTTP(false)
+	httpDone := make(chan struct{})
+	go func() {
+		s.httpRequests.Wait()
+		close(httpDone)
+	}()
+	select {
+	case <-httpDone:
+	case <-ctx.Done():
+		s.closeHTTP(true)
+		<-httpDone
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		s.server.GracefulStop()
+		close(stopped)
+	}()
+
+	var err error
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		logrus.Warnf("%s gRPC Server did not stop gracefully, stopping it now", s.name)
+		s.server.Stop()
+		<-stopped
+		err = ctx.Err()
+	}
+
+	s.wg.Wait()
+	s.running = false
+	return err
+}
+
+// Relisten replaces the listener of a running server with a new listener on
+// the same address. It is used to recover after the server stopped serving
+// because of an error received from Errors().
+func (s *GrpcServer) Relisten() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if !s.running {
+		return fmt.Errorf("Server is not running")
+	}
+
+	addr := s.listener.Addr()
+	s.listener.Close()
+	l, err := net.Listen(addr.Network(), addr.String())
+	if err != nil {
+		return fmt.Errorf("Unable to setup server: %s", err.Error())
+	}
+	s.listener = l
+
+	waitForServer := make(chan bool)
+	s.goServe(s.listener, waitForServer)
+	<-waitForServer
+	logrus.Infof("%s gRPC Server listening again on %s", s.name, addr.String())
+	return nil
+}
+
+// Errors returns the channel which receives the errors returned while
+// serving. The server no longer accepts connections after an error until
+// Relisten is called. Errors are dropped when the channel is full.
+func (s *GrpcServer) Errors() <-chan error {
+	return s.errs
+}
+
 // Address returns the address of the server which can be
 // used by clients to connect.
 func (s *GrpcServer) Address() string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
 	return s.listener.Addr().String()
 }
 
@@ -155,19 +279,102 @@ func (s *GrpcServer) IsRunning() bool {
 
 // Listener returns the listener used for this gRPC server
 func (s *GrpcServer) Listener() net.Listener {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
 	return s.listener
 }
 
-func (s *GrpcServer) goServe(started chan<- bool) {
+// ServiceInfo returns the services registered in the server once started
+func (s *GrpcServer) ServiceInfo() map[string]grpc.ServiceInfo {
+	server := s.httpServer.Load()
+	if server == nil {
+		return nil
+	}
+	return server.GetServiceInfo()
+}
+
+// ServeHTTP serves the gRPC requests received by an HTTP/2 server instead of
+// the listener of the server. See grpc.Server.ServeHTTP for its limitations.
+// The requests are cancelled when the server is stopped, and Shutdown waits
+// for them before draining the other connections.
+func (s *GrpcServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	server, stopped := s.startHTTPRequest()
+	if server == nil {
+		// Trailers-only response, which gRPC-Web and Connect translate too
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Grpc-Status", strconv.Itoa(int(codes.Unavailable)))
+		w.Header().Set("Grpc-Message", fmt.Sprintf("%s gRPC Server is not running", s.name))
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	defer s.httpRequests.Done()
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	defer context.AfterFunc(stopped, cancel)()
+	server.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// startHTTPRequest adds a request to the requests in-flight in ServeHTTP. It
+// returns the server handling the request and a context which is done when
+// the request must be cancelled, or nil if the server is not running.
+func (s *GrpcServer) startHTTPRequest() (*grpc.Server, context.Context) {
+	s.httpLock.Lock()
+	defer s.httpLock.Unlock()
+
+	server := s.httpServer.Load()
+	if server == nil || s.httpClosed {
+		return nil, nil
+	}
+	s.httpRequests.Add(1)
+	return server, s.httpCtx
+}
+
+// closeHTTP stops accepting new requests in ServeHTTP, and cancels the
+// requests in-flight if cancel is true
+func (s *GrpcServer) closeHTTP(cancel bool) {
+	s.httpLock.Lock()
+	defer s.httpLock.Unlock()
+
+	s.httpClosed = true
+	if cancel {
+		s.httpCancel()
+	}
+}
+
+// Serve serves the connections of an additional listener, like an
+// in-memory listener, until the server is stopped. Serve errors are sent
+// to Errors(), but the listener cannot be replaced by Relisten.
+func (s *GrpcServer) Serve(listener net.Listener) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if !s.running {
+		return fmt.Errorf("Server is not running")
+	}
+
+	waitForServer := make(chan bool)
+	s.goServe(listener, waitForServer)
+	<-waitForServer
+	logrus.Infof("%s gRPC Server ready on %s", s.name, listener.Addr().String())
+	return nil
+}
+
+// Lock must have been taken
+func (s *GrpcServer) goServe(listener net.Listener, started chan<- bool) {
 	s.wg.Add(1)
 	go func() {
 		defer s.wg.Done()
 		started <- true
-		err := s.server.Serve(s.listener)
+		err := s.server.Serve(listener)
 		if err != nil {
-			logrus.Fatalf("ERROR: Unable to start %s gRPC server: %s\n",
-				s.name,
-				err.Error())
+			logrus.Errorf("%s gRPC Server stopped serving: %s", s.name, err.Error())
+			select {
+			case s.errs <- err:
+			default:
+				logrus.Warnf("%s gRPC Server error dropped, nobody is receiving errors", s.name)
+			}
 		}
 	}()
 }
@@ -17,10 +17,20 @@ limitations under the License.
 package server
 
 import (
+	"context"
+	"net"
+	"net/http"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
 )
 
 // testServer is a simple struct used abstract
@@ -150,3 +160,147 @@ func TestServerStop(t *testing.T) {
 	assert.NotPanics(t, s.Stop)
 	assert.False(t, s.Server().IsRunning())
 }
+
+func TestServerShutdown(t *testing.T) {
+	s := newTestServer(t)
+	assert.True(t, s.Server().IsRunning())
+	defer s.Stop()
+
+	// Nothing pending
+	assert.NoError(t, s.Server().Shutdown(context.Background()))
+	assert.False(t, s.Server().IsRunning())
+	assert.NoError(t, s.Server().Shutdown(context.Background()))
+	assert.NotPanics(t, s.Stop)
+}
+
+func TestServerShutdownForced(t *testing.T) {
+	server, err := New(&GrpcServerConfig{
+		Name:    "unit-test",
+		Net:     "tcp",
+		Address: "127.0.0.1:0",
+	})
+	assert.NoError(t, err)
+	err = server.Start(func(gs *grpc.Server) {
+		grpc_health_v1.RegisterHealthServer(gs, health.NewServer())
+	})
+	assert.NoError(t, err)
+
+	conn, err := grpc.Dial(server.Address(), grpc.WithInsecure())
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	// A watch never finishes
+	stream, err := grpc_health_v1.NewHealthClient(conn).Watch(
+		context.Background(), &grpc_health_v1.HealthCheckRequest{})
+	assert.NoError(t, err)
+	_, err = stream.Recv()
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, server.Shutdown(ctx), context.DeadlineExceeded)
+	assert.False(t, server.IsRunning())
+
+	// The pending RPC has been cancelled
+	_, err = stream.Recv()
+	assert.Error(t, err)
+}
+
+func TestServerShutdownServeHTTP(t *testing.T) {
+	server, err := New(&GrpcServerConfig{
+		Name:    "unit-test",
+		Net:     "tcp",
+		Address: "127.0.0.1:0",
+	})
+	assert.NoError(t, err)
+	err = server.Start(func(gs *grpc.Server) {
+		grpc_health_v1.RegisterHealthServer(gs, health.NewServer())
+	})
+	assert.NoError(t, err)
+	defer server.Stop()
+
+	// Serve the gRPC requests of an HTTP/2 server without TLS
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	httpServer := &http.Server{Handler: h2c.NewHandler(server, &http2.Server{})}
+	go httpServer.Serve(l)
+	defer httpServer.Close()
+
+	conn, err := grpc.Dial(l.Addr().String(), grpc.WithInsecure())
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	// A watch never finishes
+	stream, err := grpc_health_v1.NewHealthClient(conn).Watch(
+		context.Background(), &grpc_health_v1.HealthCheckRequest{})
+	assert.NoError(t, err)
+	_, err = stream.Recv()
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, server.Shutdown(ctx), context.DeadlineExceeded)
+	assert.False(t, server.IsRunning())
+
+	// The pending RPC has been cancelled and new RPCs are rejected
+	_, err = stream.Recv()
+	assert.Error(t, err)
+	_, err = grpc_health_v1.NewHealthClient(conn).Check(
+		context.Background(), &grpc_health_v1.HealthCheckRequest{})
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+}
+
+func TestServerRelisten(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Stop()
+
+	address := s.Server().Address()
+
+	// Closing the listener stops serving
+	s.Server().Listener().Close()
+	select {
+	case err := <-s.Server().Errors():
+		assert.Error(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("serve error not received")
+	}
+
+	assert.NoError(t, s.Server().Relisten())
+	assert.Equal(t, address, s.Server().Address())
+
+	// Serving again
+	conn, err := grpc.Dial(address, grpc.WithInsecure())
+	assert.NoError(t, err)
+	defer conn.Close()
+	_, err = grpc_health_v1.NewHealthClient(conn).Check(context.Background(), &grpc_health_v1.HealthCheckRequest{})
+	// No health service registered, but the server answered
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "Unimplemented")
+
+	s.Server().Stop()
+	assert.Error(t, s.Server().Relisten())
+}
+
+func TestServerServeListener(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Stop()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	assert.NoError(t, s.Server().Serve(l))
+
+	// Both listeners are served
+	for _, address := range []string{s.Server().Address(), l.Addr().String()} {
+		conn, err := grpc.Dial(address, grpc.WithInsecure())
+		assert.NoError(t, err)
+		_, err = grpc_health_v1.NewHealthClient(conn).Check(context.Background(), &grpc_health_v1.HealthCheckRequest{})
+		assert.Contains(t, err.Error(), "Unimplemented")
+		conn.Close()
+	}
+
+	// Stopping the server stops serving the listener
+	s.Server().Stop()
+	_, err = net.Dial("tcp", l.Addr().String())
+	assert.Error(t, err)
+	assert.Error(t, s.Server().Serve(l))
+}
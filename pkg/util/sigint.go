@@ -17,11 +17,13 @@ limitations under the License.
 package util
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"os/signal"
 	"sync"
 	"syscall"
+	"time"
 
 	"github.com/sirupsen/logrus"
 )
@@ -41,6 +43,28 @@ func NewSigIntManager(handler func()) *SigIntManager {
 	}
 }
 
+// NewSigIntShutdownManager returns a SigIntManager which gracefully shuts down
+// a server, like server.Server, when a signal is captured. The context passed
+// to shutdown expires after timeout. The handler, if any, is called once
+// shutdown returns.
+func NewSigIntShutdownManager(
+	shutdown func(context.Context) error,
+	timeout time.Duration,
+	handler func(),
+) *SigIntManager {
+	return NewSigIntManager(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+
+		if err := shutdown(ctx); err != nil {
+			logrus.Warnf("Unable to shutdown gracefully: %v", err)
+		}
+		if handler != nil {
+			handler()
+		}
+	})
+}
+
 func (s *SigIntManager) Start() error {
 	s.lock.Lock()
 	defer s.lock.Unlock()
@@ -0,0 +1,173 @@
+/*
+Copyright 2022 Pure Storage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package server
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/libopenstorage/grpc-framework/pkg/auth"
+)
+
+const (
+	// Default maximum time a verified token is cached
+	defaultClaimsCacheTTL = 5 * time.Minute
+)
+
+var (
+	claimsCacheRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "grpc_framework_claims_cache_requests_total",
+		Help: "Number of lookups of tokens in the cache of verified claims, by result: hit or miss.",
+	}, []string{"server", "result"})
+)
+
+func init() {
+	prometheus.MustRegister(claimsCacheRequests)
+}
+
+// ClaimsCacheConfig configures the cache of the claims of the verified
+// tokens, which saves the verification of the signature of the tokens
+// already seen. Only JWTs with an expiration are cached. The cache is
+// cleared when the security configuration is updated and when tokens are
+// revoked with the revocation.Revocations service. The tokens found in the
+// cache are still checked against the Revoker of the SecurityConfig, which
+// may be shared with other servers.
+type ClaimsCacheConfig struct {
+	// Size is the maximum number of tokens cached. The least recently used
+	// tokens are dropped first. The cache is disabled if Size is 0.
+	Size int
+	// TTL is the maximum time a token is cached. Tokens are never cached
+	// past their expiration. Defaults to 5 minutes.
+	TTL time.Duration
+}
+
+// claimsCache is an LRU cache of the user information of the verified
+// tokens, keyed by the hash of the tokens
+type claimsCache struct {
+	name string
+	size int
+	ttl  time.Duration
+
+	lock    sync.Mutex
+	entries map[[sha256.Size]byte]*list.Element
+	lru     *list.List
+}
+
+type claimsCacheEntry struct {
+	key      [sha256.Size]byte
+	userInfo auth.UserInfo
+	expires  time.Time
+}
+
+// newClaimsCache returns a new cache, or nil if the cache is disabled
+func newClaimsCache(name string, config ClaimsCacheConfig) *claimsCache {
+	if config.Size <= 0 {
+		return nil
+	}
+	c := &claimsCache{
+		name:    name,
+		size:    config.Size,
+		ttl:     config.TTL,
+		entries: make(map[[sha256.Size]byte]*list.Element),
+		lru:     list.New(),
+	}
+	if c.ttl == 0 {
+		c.ttl = defaultClaimsCacheTTL
+	}
+	return c
+}
+
+// get returns a copy of the user information of the token, if cached
+func (c *claimsCache) get(token string) (*auth.UserInfo, bool) {
+	if c == nil {
+		return nil, false
+	}
+
+	key := sha256.Sum256([]byte(token))
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	elem, ok := c.entries[key]
+	if ok {
+		entry := elem.Value.(*claimsCacheEntry)
+		if time.Now().Before(entry.expires) {
+			c.lru.MoveToFront(elem)
+			claimsCacheRequests.WithLabelValues(c.name, "hit").Inc()
+			userInfo := entry.userInfo
+			return &userInfo, true
+		}
+		c.removeElement(elem)
+	}
+	claimsCacheRequests.WithLabelValues(c.name, "miss").Inc()
+	return nil, false
+}
+
+// add caches the user information of a verified token until the token
+// expires, or for the TTL of the cache if it is shorter
+func (c *claimsCache) add(token string, userInfo *auth.UserInfo) {
+	if c == nil {
+		return
+	}
+	expires, ok := auth.TokenExpiration(token)
+	if !ok {
+		return
+	}
+	if maxExpires := time.Now().Add(c.ttl); maxExpires.Before(expires) {
+		expires = maxExpires
+	}
+	if !time.Now().Before(expires) {
+		return
+	}
+
+	key := sha256.Sum256([]byte(token))
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		c.removeElement(elem)
+	}
+	for c.lru.Len() >= c.size {
+		c.removeElement(c.lru.Back())
+	}
+	c.entries[key] = c.lru.PushFront(&claimsCacheEntry{
+		key:      key,
+		userInfo: *userInfo,
+		expires:  expires,
+	})
+}
+
+// purge removes all the tokens from the cache
+func (c *claimsCache) purge() {
+	if c == nil {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.entries = make(map[[sha256.Size]byte]*list.Element)
+	c.lru.Init()
+}
+
+// removeElement must be called with the lock held
+func (c *claimsCache) removeElement(elem *list.Element) {
+	c.lru.Remove(elem)
+	delete(c.entries, elem.Value.(*claimsCacheEntry).key)
+}
@@ -0,0 +1,168 @@
+/*
+Copyright 2022 Pure Storage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	jwt "github.com/golang-jwt/jwt/v4"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+
+	"github.com/libopenstorage/grpc-framework/pkg/auth"
+	"github.com/libopenstorage/grpc-framework/pkg/auth/role"
+	appserver "github.com/libopenstorage/grpc-framework/test/app/pkg/server"
+	appapi "github.com/libopenstorage/grpc-framework/test/app/protos/apis/hello/apiv1"
+)
+
+// testTokenExpiring returns a token signed by testSharedSecret which expires at exp
+func testTokenExpiring(t *testing.T, subject string, exp time.Time) string {
+	token, err := auth.Token(&auth.Claims{
+		Issuer:  "testissuer",
+		Subject: subject,
+		Name:    subject,
+		Email:   subject + "@example.com",
+		Roles:   []string{"system.admin"},
+	}, &auth.Signature{
+		Type: jwt.SigningMethodHS256,
+		Key:  []byte(testSharedSecret),
+	}, &auth.Options{
+		Expiration: exp.Unix(),
+	})
+	require.NoError(t, err)
+	return token
+}
+
+func testClaimsCacheRequests(t *testing.T, name, result string) float64 {
+	m := &dto.Metric{}
+	require.NoError(t, claimsCacheRequests.WithLabelValues(name, result).Write(m))
+	return m.GetCounter().GetValue()
+}
+
+func TestClaimsCache(t *testing.T) {
+	assert.Nil(t, newClaimsCache("test", ClaimsCacheConfig{}))
+
+	c := newClaimsCache("test", ClaimsCacheConfig{Size: 2, TTL: time.Minute})
+	hits, misses := testClaimsCacheRequests(t, "test", "hit"), testClaimsCacheRequests(t, "test", "miss")
+	tokens := []string{
+		testTokenExpiring(t, "user1", time.Now().Add(time.Hour)),
+		testTokenExpiring(t, "user2", time.Now().Add(time.Hour)),
+		testTokenExpiring(t, "user3", time.Now().Add(time.Hour)),
+	}
+	for i, token := range tokens[:2] {
+		_, ok := c.get(token)
+		assert.False(t, ok)
+		c.add(token, &auth.UserInfo{Username: tokens[i]})
+	}
+
+	// The least recently used token is dropped
+	userInfo, ok := c.get(tokens[0])
+	assert.True(t, ok)
+	assert.Equal(t, tokens[0], userInfo.Username)
+	c.add(tokens[2], &auth.UserInfo{Username: tokens[2]})
+	_, ok = c.get(tokens[1])
+	assert.False(t, ok)
+	_, ok = c.get(tokens[0])
+	assert.True(t, ok)
+	_, ok = c.get(tokens[2])
+	assert.True(t, ok)
+	assert.Equal(t, hits+3, testClaimsCacheRequests(t, "test", "hit"))
+	assert.Equal(t, misses+3, testClaimsCacheRequests(t, "test", "miss"))
+
+	// The tokens are cached until the earliest of their expiration and the TTL
+	c.purge()
+	_, ok = c.get(tokens[0])
+	assert.False(t, ok)
+	c.add(tokens[0], &auth.UserInfo{})
+	elem := c.entries[sha256.Sum256([]byte(tokens[0]))]
+	assert.WithinDuration(t, time.Now().Add(time.Minute), elem.Value.(*claimsCacheEntry).expires, time.Second)
+
+	expiring := testTokenExpiring(t, "user4", time.Now().Add(10*time.Second))
+	c.add(expiring, &auth.UserInfo{})
+	elem = c.entries[sha256.Sum256([]byte(expiring))]
+	assert.WithinDuration(t, time.Now().Add(10*time.Second), elem.Value.(*claimsCacheEntry).expires, time.Second)
+
+	// Expired tokens and tokens which are not JWTs are not cached
+	c.purge()
+	c.add(testTokenExpiring(t, "user5", time.Now().Add(-time.Second)), &auth.UserInfo{})
+	c.add("opaque-token", &auth.UserInfo{})
+	assert.Equal(t, 0, c.lru.Len())
+}
+
+// testCountingAuthenticator counts the tokens authenticated
+type testCountingAuthenticator struct {
+	auth.Authenticator
+	count int32
+}
+
+func (a *testCountingAuthenticator) AuthenticateToken(ctx context.Context, token string) (*auth.Claims, error) {
+	atomic.AddInt32(&a.count, 1)
+	return a.Authenticator.AuthenticateToken(ctx, token)
+}
+
+func TestServerClaimsCache(t *testing.T) {
+	jwtAuthenticator, err := auth.NewJwtAuthenticator(&auth.JwtAuthConfig{
+		SharedSecret: []byte(testSharedSecret),
+	})
+	require.NoError(t, err)
+	authenticator := &testCountingAuthenticator{Authenticator: jwtAuthenticator}
+
+	config := &ServerConfig{
+		Name:    "testServer",
+		Net:     "tcp",
+		Address: "127.0.0.1:0",
+		Socket:  grpcSocket,
+		Security: &SecurityConfig{
+			Authenticators: map[string]auth.Authenticator{
+				"testissuer": authenticator,
+			},
+		},
+	}
+	config.WithDefaultGenericRoleManager().
+		WithClaimsCache(100, time.Minute).
+		RegisterGrpcServers(func(gs *grpc.Server) {
+			appapi.RegisterHelloGreeterServer(gs, &appserver.HelloGreeter{})
+		})
+	s := newTestServer(t, config)
+	defer s.Stop()
+
+	g := appapi.NewHelloGreeterClient(s.Conn())
+	ctx := contextWithToken(t, context.Background(), "testissuer", "jim", []string{"system.admin"})
+	for n := 0; n < 3; n++ {
+		_, err = g.SayHello(ctx, &appapi.HelloGreeterSayHelloRequest{Name: "jim"})
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&authenticator.count))
+
+	// The tokens are verified again after the authenticators are updated
+	_, err = s.server.UpdateSecurity(&SecurityConfig{
+		Authenticators: map[string]auth.Authenticator{
+			"testissuer": authenticator,
+		},
+		Role:        role.NewDefaultGenericRoleManager(),
+		ClaimsCache: ClaimsCacheConfig{Size: 100},
+	})
+	require.NoError(t, err)
+	_, err = g.SayHello(ctx, &appapi.HelloGreeterSayHelloRequest{Name: "jim"})
+	assert.NoError(t, err)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&authenticator.count))
+}
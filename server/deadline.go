@@ -0,0 +1,232 @@
+/*
+Copyright 2022 Pure Storage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	grpc_middleware "github.com/grpc-ecosystem/go-grpc-middleware"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/libopenstorage/grpc-framework/pkg/auth"
+	"github.com/libopenstorage/grpc-framework/pkg/auth/role"
+)
+
+// DeadlinePolicy sets the deadline of the requests. Timeouts use the syntax
+// of auth.ParseToDuration, like `30s` or `5m`, or of time.ParseDuration,
+// like `1m30s`.
+type DeadlinePolicy struct {
+	// Default is the timeout of the requests received without a deadline.
+	// If not provided, these requests have no deadline unless Max is set.
+	Default string
+	// Max is the maximum timeout of the requests. Requests received with a
+	// later deadline, or without a deadline, are cut to Max.
+	Max string
+}
+
+// DeadlineConfig sets the deadlines of the requests received by the server,
+// from the gRPC clients and from the REST gateway. Requests going over their
+// deadline fail with DeadlineExceeded. Handlers get the remaining time of a
+// request with RemainingTime.
+type DeadlineConfig struct {
+	// DeadlinePolicy is used for all the methods without a policy in Methods
+	DeadlinePolicy
+	// Methods is a table of policies keyed by the gRPC full method. Keys can
+	// use the wildcard patterns supported by role.MatchRule, for example:
+	// "/hello.hello.v1.HelloIdentity/*". When more than one pattern matches
+	// a method, the most specific one is used. Empty timeouts of the
+	// policies are taken from the DeadlinePolicy above.
+	Methods map[string]DeadlinePolicy
+}
+
+// enabled returns true if the deadlines of the requests are set by the server
+func (c *DeadlineConfig) enabled() bool {
+	return c.Default != "" || c.Max != "" || len(c.Methods) != 0
+}
+
+// RemainingTime returns the time left before the deadline of the request.
+// It returns false if the request has no deadline.
+func RemainingTime(ctx context.Context) (time.Duration, bool) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return 0, false
+	}
+	return time.Until(deadline), true
+}
+
+type deadlinePolicy struct {
+	pattern    string
+	defaultTTL time.Duration
+	max        time.Duration
+}
+
+// deadlinePolicies selects the deadline policy of a gRPC method
+type deadlinePolicies struct {
+	global   *deadlinePolicy
+	policies []*deadlinePolicy
+
+	// methods caches the policy for each full method already seen
+	methods sync.Map
+}
+
+func newDeadlinePolicies(config DeadlineConfig) (*deadlinePolicies, error) {
+	global, err := newDeadlinePolicy("", config.DeadlinePolicy, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &deadlinePolicies{
+		global: global,
+	}
+	for pattern, policy := range config.Methods {
+		if len(pattern) == 0 {
+			return nil, fmt.Errorf("deadline policy pattern cannot be empty")
+		}
+		dp, err := newDeadlinePolicy(pattern, policy, global)
+		if err != nil {
+			return nil, err
+		}
+		p.policies = append(p.policies, dp)
+	}
+	sort.Slice(p.policies, func(i, j int) bool {
+		return moreSpecificPattern(p.policies[i].pattern, p.policies[j].pattern)
+	})
+
+	return p, nil
+}
+
+// newDeadlinePolicy parses the timeouts of the policy. Empty timeouts are
+// taken from the parent policy, if provided.
+func newDeadlinePolicy(pattern string, policy DeadlinePolicy, parent *deadlinePolicy) (*deadlinePolicy, error) {
+	dp := &deadlinePolicy{
+		pattern: pattern,
+	}
+	if parent != nil {
+		dp.defaultTTL = parent.defaultTTL
+		dp.max = parent.max
+	}
+
+	var err error
+	if policy.Default != "" {
+		if dp.defaultTTL, err = parseTimeout(policy.Default); err != nil {
+			return nil, fmt.Errorf("invalid default deadline %q of %q: %v", policy.Default, pattern, err)
+		}
+	}
+	if policy.Max != "" {
+		if dp.max, err = parseTimeout(policy.Max); err != nil {
+			return nil, fmt.Errorf("invalid maximum deadline %q of %q: %v", policy.Max, pattern, err)
+		}
+	}
+	return dp, nil
+}
+
+// parseTimeout parses a timeout with the syntax of auth.ParseToDuration,
+// or of time.ParseDuration
+func parseTimeout(s string) (time.Duration, error) {
+	d, err := auth.ParseToDuration(s)
+	if err != nil {
+		if d, err = time.ParseDuration(s); err != nil {
+			return 0, err
+		}
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("timeout must be positive")
+	}
+	return d, nil
+}
+
+// match returns the policy for the full method
+func (p *deadlinePolicies) match(fullMethod string) *deadlinePolicy {
+	if v, ok := p.methods.Load(fullMethod); ok {
+		return v.(*deadlinePolicy)
+	}
+
+	policy := p.global
+	for _, dp := range p.policies {
+		if role.MatchRule(dp.pattern, fullMethod) {
+			policy = dp
+			break
+		}
+	}
+	p.methods.Store(fullMethod, policy)
+	return policy
+}
+
+// withDeadline returns the context with the deadline of the policy
+func (p *deadlinePolicy) withDeadline(ctx context.Context) (context.Context, context.CancelFunc) {
+	timeout := p.max
+	if _, ok := ctx.Deadline(); !ok && p.defaultTTL > 0 {
+		if timeout == 0 || p.defaultTTL < timeout {
+			timeout = p.defaultTTL
+		}
+	}
+	if timeout == 0 {
+		return ctx, func() {}
+	}
+	// The earliest deadline is kept if the request already has one
+	return context.WithTimeout(ctx, timeout)
+}
+
+// deadlineError returns DeadlineExceeded if the request failed after going
+// over its deadline. The results of successful requests are kept.
+func deadlineError(ctx context.Context, err error, fullMethod string) error {
+	if err == nil {
+		return nil
+	}
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) || errors.Is(err, context.DeadlineExceeded) {
+		if status.Code(err) != codes.DeadlineExceeded {
+			return status.Errorf(codes.DeadlineExceeded, "Deadline exceeded for %s", fullMethod)
+		}
+	}
+	return err
+}
+
+func (s *GrpcFrameworkServer) deadlineUnaryInterceptor(
+	ctx context.Context,
+	req interface{},
+	info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler,
+) (interface{}, error) {
+	ctx, cancel := s.deadlines.match(info.FullMethod).withDeadline(ctx)
+	defer cancel()
+
+	resp, err := handler(ctx, req)
+	if err = deadlineError(ctx, err, info.FullMethod); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (s *GrpcFrameworkServer) deadlineStreamInterceptor(
+	srv interface{},
+	stream grpc.ServerStream,
+	info *grpc.StreamServerInfo,
+	handler grpc.StreamHandler,
+) error {
+	ctx, cancel := s.deadlines.match(info.FullMethod).withDeadline(stream.Context())
+	defer cancel()
+
+	wrapped := grpc_middleware.WrapServerStream(stream)
+	wrapped.WrappedContext = ctx
+	return deadlineError(ctx, handler(srv, wrapped), info.FullMethod)
+}
@@ -0,0 +1,181 @@
+/*
+Copyright 2022 Pure Storage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	appapi "github.com/libopenstorage/grpc-framework/test/app/protos/apis/hello/apiv1"
+)
+
+func TestDeadlinePolicies(t *testing.T) {
+	p, err := newDeadlinePolicies(DeadlineConfig{
+		DeadlinePolicy: DeadlinePolicy{Default: "30s", Max: "5m"},
+		Methods: map[string]DeadlinePolicy{
+			"/hello.hello.v1.HelloGreeter/*":        {Default: "1m"},
+			"/hello.hello.v1.HelloGreeter/SayHello": {Max: "1m30s"},
+		},
+	})
+	require.NoError(t, err)
+
+	policy := p.match("/hello.hello.v1.HelloGreeter/SayHello")
+	assert.Equal(t, 30*time.Second, policy.defaultTTL)
+	assert.Equal(t, 90*time.Second, policy.max)
+	policy = p.match("/hello.hello.v1.HelloGreeter/Other")
+	assert.Equal(t, time.Minute, policy.defaultTTL)
+	assert.Equal(t, 5*time.Minute, policy.max)
+	policy = p.match("/hello.hello.v1.HelloIdentity/Version")
+	assert.Equal(t, 30*time.Second, policy.defaultTTL)
+	assert.Equal(t, 5*time.Minute, policy.max)
+
+	_, err = newDeadlinePolicies(DeadlineConfig{DeadlinePolicy: DeadlinePolicy{Default: "soon"}})
+	assert.Error(t, err)
+	_, err = newDeadlinePolicies(DeadlineConfig{DeadlinePolicy: DeadlinePolicy{Max: "0s"}})
+	assert.Error(t, err)
+	_, err = newDeadlinePolicies(DeadlineConfig{Methods: map[string]DeadlinePolicy{"": {Max: "1m"}}})
+	assert.Error(t, err)
+}
+
+func TestDeadlinePolicyWithDeadline(t *testing.T) {
+	policy := &deadlinePolicy{defaultTTL: time.Minute, max: time.Hour}
+
+	// Default deadline
+	ctx, cancel := policy.withDeadline(context.Background())
+	defer cancel()
+	remaining, ok := RemainingTime(ctx)
+	assert.True(t, ok)
+	assert.InDelta(t, time.Minute, remaining, float64(time.Second))
+
+	// Deadline of the client, cut to the maximum
+	client, clientCancel := context.WithTimeout(context.Background(), 2*time.Hour)
+	defer clientCancel()
+	ctx, cancel = policy.withDeadline(client)
+	defer cancel()
+	remaining, _ = RemainingTime(ctx)
+	assert.InDelta(t, time.Hour, remaining, float64(time.Second))
+
+	// Earlier deadline of the client
+	client, clientCancel = context.WithTimeout(context.Background(), time.Second)
+	defer clientCancel()
+	ctx, cancel = policy.withDeadline(client)
+	defer cancel()
+	remaining, _ = RemainingTime(ctx)
+	assert.LessOrEqual(t, remaining, time.Second)
+
+	// No deadline
+	ctx, cancel = (&deadlinePolicy{}).withDeadline(context.Background())
+	defer cancel()
+	_, ok = RemainingTime(ctx)
+	assert.False(t, ok)
+}
+
+// testDeadlineGreeter returns the remaining time of the requests, or waits
+// for the end of the request when it is asked to greet "wait" or "late"
+type testDeadlineGreeter struct {
+	appapi.UnimplementedHelloGreeterServer
+}
+
+func (g *testDeadlineGreeter) SayHello(
+	ctx context.Context,
+	req *appapi.HelloGreeterSayHelloRequest,
+) (*appapi.HelloGreeterSayHelloResponse, error) {
+	switch req.GetName() {
+	case "wait":
+		<-ctx.Done()
+		return nil, ctx.Err()
+	case "late":
+		// Succeeds right at the deadline
+		<-ctx.Done()
+		return &appapi.HelloGreeterSayHelloResponse{Message: "late"}, nil
+	}
+	remaining, ok := RemainingTime(ctx)
+	if !ok {
+		return &appapi.HelloGreeterSayHelloResponse{Message: "none"}, nil
+	}
+	return &appapi.HelloGreeterSayHelloResponse{Message: remaining.Round(time.Minute).String()}, nil
+}
+
+func TestServerDeadline(t *testing.T) {
+	c := &ServerConfig{
+		Name:    "testServer",
+		Net:     "tcp",
+		Address: "127.0.0.1:0",
+		Socket:  grpcSocket,
+	}
+	c.WithDeadline("10m", "1h").
+		RegisterGrpcServers(func(gs *grpc.Server) {
+			appapi.RegisterHelloGreeterServer(gs, &testDeadlineGreeter{})
+		})
+	s := newTestServer(t, c)
+	defer s.Stop()
+
+	g := appapi.NewHelloGreeterClient(s.Conn())
+	r, err := g.SayHello(context.Background(), &appapi.HelloGreeterSayHelloRequest{Name: "jim"})
+	require.NoError(t, err)
+	assert.Equal(t, "10m0s", r.GetMessage())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Hour)
+	defer cancel()
+	r, err = g.SayHello(ctx, &appapi.HelloGreeterSayHelloRequest{Name: "jim"})
+	require.NoError(t, err)
+	assert.Equal(t, "1h0m0s", r.GetMessage())
+}
+
+func TestServerDeadlineExceeded(t *testing.T) {
+	c := &ServerConfig{
+		Name:    "testServer",
+		Net:     "tcp",
+		Address: "127.0.0.1:0",
+		Socket:  grpcSocket,
+	}
+	c.WithMethodDeadline("/hello.hello.v1.HelloGreeter/*", "100ms", "").
+		RegisterGrpcServers(func(gs *grpc.Server) {
+			appapi.RegisterHelloGreeterServer(gs, &testDeadlineGreeter{})
+		})
+	s := newTestServer(t, c)
+	defer s.Stop()
+
+	// The handler returns the error of the context
+	g := appapi.NewHelloGreeterClient(s.Conn())
+	_, err := g.SayHello(context.Background(), &appapi.HelloGreeterSayHelloRequest{Name: "wait"})
+	assert.Equal(t, codes.DeadlineExceeded, status.Code(err))
+	assert.Contains(t, status.Convert(err).Message(), "/hello.hello.v1.HelloGreeter/SayHello")
+
+	// Successful results are kept even if the deadline expired meanwhile
+	r, err := g.SayHello(context.Background(), &appapi.HelloGreeterSayHelloRequest{Name: "late"})
+	require.NoError(t, err)
+	assert.Equal(t, "late", r.GetMessage())
+}
+
+func TestDeadlineError(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 0)
+	defer cancel()
+	<-ctx.Done()
+
+	assert.NoError(t, deadlineError(ctx, nil, "/test/method"))
+	err := deadlineError(ctx, status.Error(codes.Internal, "failed"), "/test/method")
+	assert.Equal(t, codes.DeadlineExceeded, status.Code(err))
+	err = deadlineError(context.Background(), status.Error(codes.Internal, "failed"), "/test/method")
+	assert.Equal(t, codes.Internal, status.Code(err))
+}
@@ -2,14 +2,22 @@ package server
 
 import (
 	"context"
+	"fmt"
+	"io"
+	"path"
 	"reflect"
+	"strings"
 
 	"github.com/libopenstorage/grpc-framework/pkg/auth"
 	"github.com/libopenstorage/grpc-framework/pkg/correlation"
+	grpcerrors "github.com/libopenstorage/grpc-framework/pkg/grpc/errors"
 	"github.com/sirupsen/logrus"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
 )
 
 // ExternalAuthZChecker is a caller-supplied function that is invoked by this framework to perform an authZ check.
@@ -64,9 +72,88 @@ type ExternalAuthZRequestGetter interface {
 	// - Return InsecureNoAuthZ to perform just an authN check for a specific request and skip authZ check.
 	// Such insecure requests must also be whilelisted in insecureNoAuthNAuthZReqs or insecureNoAuthZReqs params.
 	// ExternalAuthZChecker function is not invoked for the insecure requests.
+	// For stream APIs, request is the first message received from the client.
 	GetAuthZRequest(ctx context.Context, fullPath string, request interface{}) (ExternalAuthZRequest, HandlerData, error)
 }
 
+// externalAuthorize performs the authZ check of apiRequest using the ExternalAuthZRequestGetter implemented
+// by the service. It returns the context with the handler data saved in it.
+func (s *GrpcFrameworkServer) externalAuthorize(
+	ctx context.Context,
+	caller string,
+	authZChecker ExternalAuthZChecker,
+	insecureNoAuthNAuthZReqs []interface{},
+	insecureNoAuthZReqs []interface{},
+	server interface{},
+	fullMethod string,
+	apiRequest interface{},
+) (context.Context, error) {
+	// Audit log
+	log := correlation.NewFunctionLogger(ctx)
+	log.Out = s.auditLogOutput
+	auditLogErrorf := func(c codes.Code, format string, a ...interface{}) error {
+		log.WithContext(ctx).WithFields(logrus.Fields{
+			"method": caller,
+			"code":   c.String(),
+		}).Warningf(format, a...)
+		err := status.Errorf(c, "external authorization failed")
+		if c == codes.PermissionDenied {
+			err = grpcerrors.WithErrorInfo(err, grpcerrors.ReasonAccessDenied, grpcerrors.Domain,
+				map[string]string{"method": fullMethod})
+		}
+		return err
+	}
+	// do we have an authenticated user?
+	userAuthenticated := false
+	if userInfo, found := auth.NewUserInfoFromContext(ctx); found && !userInfo.Guest {
+		userAuthenticated = true
+	}
+	authZReqGetter, ok := server.(ExternalAuthZRequestGetter)
+	if !ok {
+		return nil, auditLogErrorf(codes.Internal, "%T does not implement authZ request getter", server)
+	}
+	authZReq, handlerData, err := authZReqGetter.GetAuthZRequest(ctx, fullMethod, apiRequest)
+	if err != nil {
+		st, ok := status.FromError(err)
+		if ok {
+			log.WithContext(ctx).WithFields(logrus.Fields{
+				"method": caller,
+				"code":   st.Code().String(),
+			}).Warningf("failed to get authZ request, status: %v", err.Error())
+			return nil, err
+		}
+		return nil, auditLogErrorf(codes.Internal, "failed to get authZ request: %v", err)
+	}
+	switch authZReq {
+	case InsecureNoAuthNAuthZ:
+		// skip authN and authZ as long as the request type exists in our list
+		if !s.listContainsReqType(insecureNoAuthNAuthZReqs, apiRequest) {
+			return nil, auditLogErrorf(codes.Internal, "req %T absent in skip authN and authZ list", apiRequest)
+		}
+	case InsecureNoAuthZ:
+		if !s.listContainsReqType(insecureNoAuthZReqs, apiRequest) {
+			return nil, auditLogErrorf(codes.Internal, "req %T absent in skip authZ list", apiRequest)
+		}
+		// any authenticated user is allowed
+		if !userAuthenticated {
+			return nil, auditLogErrorf(codes.Unauthenticated, "authentication creds not found")
+		}
+	default:
+		if !userAuthenticated {
+			return nil, auditLogErrorf(codes.Unauthenticated, "authentication creds not found")
+		}
+		// perform authZ check
+		allow, err := authZChecker(ctx, authZReq)
+		if err != nil {
+			return nil, auditLogErrorf(codes.Internal, "failed to check authZ: %v", err)
+		}
+		if !allow {
+			return nil, auditLogErrorf(codes.PermissionDenied, "access denied")
+		}
+	}
+	return contextSaveHandlerData(ctx, handlerData), nil
+}
+
 // externalAuthorizerUnaryInterceptor returns authZ interceptor for unary gRPCs. It calls the specified authZChecker
 // for the services that need authZ checks to be performed. Services must implement ExternalAuthZRequestGetter interface.
 func (s *GrpcFrameworkServer) externalAuthorizerUnaryInterceptor(
@@ -77,81 +164,119 @@ func (s *GrpcFrameworkServer) externalAuthorizerUnaryInterceptor(
 	return func(
 		ctx context.Context, apiRequest interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler,
 	) (interface{}, error) {
-		// Audit log
-		log := correlation.NewFunctionLogger(ctx)
-		log.Out = s.auditLogOutput
-		auditLogErrorf := func(c codes.Code, format string, a ...interface{}) error {
-			log.WithContext(ctx).WithFields(logrus.Fields{
-				"method": "externalAuthorizerUnaryInterceptor",
-				"code":   c.String(),
-			}).Warningf(format, a...)
-			return status.Errorf(c, "external authorization failed")
-		}
-		// do we have an authenticated user?
-		userAuthenticated := false
-		if userInfo, found := auth.NewUserInfoFromContext(ctx); found && !userInfo.Guest {
-			userAuthenticated = true
-		}
-		authZReqGetter, ok := info.Server.(ExternalAuthZRequestGetter)
-		if !ok {
-			return nil, auditLogErrorf(codes.Internal, "%T does not implement authZ request getter", info.Server)
-		}
-		authZReq, handlerData, err := authZReqGetter.GetAuthZRequest(ctx, info.FullMethod, apiRequest)
+		newCtx, err := s.externalAuthorize(ctx, "externalAuthorizerUnaryInterceptor",
+			authZChecker, insecureNoAuthNAuthZReqs, insecureNoAuthZReqs,
+			info.Server, info.FullMethod, apiRequest)
 		if err != nil {
-			st, ok := status.FromError(err)
-			if ok {
-				log.WithContext(ctx).WithFields(logrus.Fields{
-					"method": "externalAuthorizerUnaryInterceptor",
-					"code":   st.Code().String(),
-				}).Warningf("failed to get authZ request, status: %v", err.Error())
-				return nil, err
-			}
-			return nil, auditLogErrorf(codes.Internal, "failed to get authZ request: %v", err)
-		}
-		switch authZReq {
-		case InsecureNoAuthNAuthZ:
-			// skip authN and authZ as long as the request type exists in our list
-			if !s.listContainsReqType(insecureNoAuthNAuthZReqs, apiRequest) {
-				return nil, auditLogErrorf(codes.Internal, "req %T absent in skip authN and authZ list", apiRequest)
-			}
-		case InsecureNoAuthZ:
-			if !s.listContainsReqType(insecureNoAuthZReqs, apiRequest) {
-				return nil, auditLogErrorf(codes.Internal, "req %T absent in skip authZ list", apiRequest)
-			}
-			// any authenticated user is allowed
-			if !userAuthenticated {
-				return nil, auditLogErrorf(codes.Unauthenticated, "authentication creds not found")
-			}
-		default:
-			if !userAuthenticated {
-				return nil, auditLogErrorf(codes.Unauthenticated, "authentication creds not found")
-			}
-			// perform authZ check
-			allow, err := authZChecker(ctx, authZReq)
-			if err != nil {
-				return nil, auditLogErrorf(codes.Internal, "failed to check authZ: %v", err)
-			}
-			if !allow {
-				return nil, auditLogErrorf(codes.PermissionDenied, "access denied")
-			}
+			return nil, err
 		}
-		newCtx := contextSaveHandlerData(ctx, handlerData)
 		return handler(newCtx, apiRequest)
 	}
 }
 
+// externalAuthorizerServerStream replays to the handler the first message of the stream,
+// which is received by the interceptor to authorize the stream before calling the handler
+type externalAuthorizerServerStream struct {
+	grpc.ServerStream
+
+	ctx   context.Context
+	first proto.Message
+}
+
+// Context returns the context of the stream with the handler data
+func (es *externalAuthorizerServerStream) Context() context.Context {
+	return es.ctx
+}
+
+func (es *externalAuthorizerServerStream) RecvMsg(m interface{}) error {
+	if es.first == nil {
+		return es.ServerStream.RecvMsg(m)
+	}
+	first := es.first
+	es.first = nil
+
+	msg, ok := m.(proto.Message)
+	if !ok || msg.ProtoReflect().Descriptor() != first.ProtoReflect().Descriptor() {
+		return status.Errorf(codes.Internal, "unexpected message type %T", m)
+	}
+	proto.Reset(msg)
+	proto.Merge(msg, first)
+	return nil
+}
+
+// methodDescriptor returns the descriptor of a gRPC method registered in the protobuf registry
+func methodDescriptor(fullMethod string) (protoreflect.MethodDescriptor, error) {
+	service, method := path.Split(strings.TrimPrefix(fullMethod, "/"))
+	d, err := protoregistry.GlobalFiles.FindDescriptorByName(protoreflect.FullName(strings.TrimSuffix(service, "/")))
+	if err != nil {
+		return nil, fmt.Errorf("unable to find service of %s: %v", fullMethod, err)
+	}
+	sd, ok := d.(protoreflect.ServiceDescriptor)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a service", d.FullName())
+	}
+	md := sd.Methods().ByName(protoreflect.Name(method))
+	if md == nil {
+		return nil, fmt.Errorf("unable to find method %s", fullMethod)
+	}
+	return md, nil
+}
+
+// newStreamRequest returns a new message of the request type of the stream method
+func newStreamRequest(fullMethod string) (proto.Message, error) {
+	md, err := methodDescriptor(fullMethod)
+	if err != nil {
+		return nil, err
+	}
+	mt, err := protoregistry.GlobalTypes.FindMessageByName(md.Input().FullName())
+	if err != nil {
+		return nil, fmt.Errorf("unable to find request type of %s: %v", fullMethod, err)
+	}
+	return mt.New().Interface(), nil
+}
+
+// externalAuthorizerStreamInterceptor returns authZ interceptor for stream gRPCs. The authZ check is performed
+// on the first message received from the client, before the handler of the service is called. The message is
+// then replayed to the handler. Streams where the client waits for the server to send a message first cannot be
+// authorized and time out. Services must implement ExternalAuthZRequestGetter interface.
 func (s *GrpcFrameworkServer) externalAuthorizerStreamInterceptor(
 	authZChecker ExternalAuthZChecker,
 	insecureNoAuthNAuthZReqs []interface{},
 	insecureNoAuthZReqs []interface{},
 ) grpc.StreamServerInterceptor {
 	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
-		// TODO: perform auth Z check; then call the handler commented out below
-		return status.Errorf(
-			codes.PermissionDenied,
-			"External authorizer not implemented for stream APIs")
+		ctx := ss.Context()
+		apiRequest, err := newStreamRequest(info.FullMethod)
+		if err != nil {
+			log := correlation.NewFunctionLogger(ctx)
+			log.Out = s.auditLogOutput
+			log.WithContext(ctx).WithFields(logrus.Fields{
+				"method": "externalAuthorizerStreamInterceptor",
+				"code":   codes.Internal.String(),
+			}).Warningf("failed to get stream request: %v", err)
+			return status.Errorf(codes.Internal, "external authorization failed")
+		}
+		if err := ss.RecvMsg(apiRequest); err == io.EOF {
+			// The client closed the stream without sending a request
+			return status.Errorf(codes.InvalidArgument, "external authorization failed: no request received")
+		} else if err != nil {
+			if _, ok := status.FromError(err); ok {
+				return err
+			}
+			return status.FromContextError(err).Err()
+		}
 
-		// return handler(srv, ss)
+		newCtx, err := s.externalAuthorize(ctx, "externalAuthorizerStreamInterceptor",
+			authZChecker, insecureNoAuthNAuthZReqs, insecureNoAuthZReqs,
+			srv, info.FullMethod, apiRequest)
+		if err != nil {
+			return err
+		}
+		return handler(srv, &externalAuthorizerServerStream{
+			ServerStream: ss,
+			ctx:          newCtx,
+			first:        apiRequest,
+		})
 	}
 }
 
@@ -0,0 +1,335 @@
+/*
+Copyright 2022 Pure Storage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package server
+
+import (
+	"context"
+	"io"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/libopenstorage/grpc-framework/pkg/auth"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+const (
+	testAuthZAllowed      = "allowed"
+	testAuthZDenied       = "denied"
+	testAuthZNoAuthNAuthZ = "noauthnauthz"
+	testAuthZNoAuthZ      = "noauthz"
+)
+
+// testAuthZHealthServer uses the server stream Watch() to test
+// the external authorizer on stream APIs
+type testAuthZHealthServer struct {
+	healthpb.UnimplementedHealthServer
+}
+
+func (h *testAuthZHealthServer) GetAuthZRequest(
+	ctx context.Context,
+	fullPath string,
+	request interface{},
+) (ExternalAuthZRequest, HandlerData, error) {
+	req, ok := request.(*healthpb.HealthCheckRequest)
+	if !ok {
+		return nil, nil, status.Errorf(codes.InvalidArgument, "unexpected request %T", request)
+	}
+	switch req.GetService() {
+	case testAuthZNoAuthNAuthZ:
+		return InsecureNoAuthNAuthZ, "handlerdata", nil
+	case testAuthZNoAuthZ:
+		return InsecureNoAuthZ, "handlerdata", nil
+	}
+	return req.GetService(), "handlerdata", nil
+}
+
+func (h *testAuthZHealthServer) Watch(
+	req *healthpb.HealthCheckRequest,
+	stream healthpb.Health_WatchServer,
+) error {
+	if ContextGetHandlerData(stream.Context()) != "handlerdata" {
+		return status.Error(codes.Internal, "handler data missing from stream context")
+	}
+	return stream.Send(&healthpb.HealthCheckResponse{
+		Status: healthpb.HealthCheckResponse_SERVING,
+	})
+}
+
+func TestExternalAuthorizerStream(t *testing.T) {
+	authenticator, err := auth.NewJwtAuthenticator(&auth.JwtAuthConfig{
+		SharedSecret: []byte(testSharedSecret),
+	})
+	assert.NoError(t, err)
+
+	config := &ServerConfig{
+		Name:    "testServer",
+		Net:     "tcp",
+		Address: "127.0.0.1:0",
+		Security: &SecurityConfig{
+			Authenticators: map[string]auth.Authenticator{
+				"testissuer": authenticator,
+			},
+		},
+		// The health service is used as a stream API which requires auth
+		Health: HealthConfig{
+			RequireAuth: true,
+		},
+	}
+	config.
+		RegisterGrpcServers(func(gs *grpc.Server) {
+			healthpb.RegisterHealthServer(gs, &testAuthZHealthServer{})
+		}).
+		WithExternalAuthZChecker(
+			func(ctx context.Context, authZReq ExternalAuthZRequest) (bool, error) {
+				return authZReq == testAuthZAllowed, nil
+			},
+			[]interface{}{&healthpb.HealthCheckRequest{}},
+			[]interface{}{&healthpb.HealthCheckRequest{}},
+		)
+	s := newTestServer(t, config)
+	defer s.Stop()
+
+	tests := []struct {
+		name          string
+		service       string
+		authenticated bool
+		expectedCode  codes.Code
+	}{
+		{"authorized", testAuthZAllowed, true, codes.OK},
+		{"denied", testAuthZDenied, true, codes.PermissionDenied},
+		{"guest", testAuthZAllowed, false, codes.Unauthenticated},
+		{"skip authN and authZ as guest", testAuthZNoAuthNAuthZ, false, codes.OK},
+		{"skip authZ as guest", testAuthZNoAuthZ, false, codes.Unauthenticated},
+		{"skip authZ", testAuthZNoAuthZ, true, codes.OK},
+	}
+
+	c := healthpb.NewHealthClient(s.Conn())
+	for _, test := range tests {
+		ctx := context.Background()
+		if test.authenticated {
+			ctx = contextWithToken(t, ctx, "testissuer", "jim", nil)
+		}
+		stream, err := c.Watch(ctx, &healthpb.HealthCheckRequest{
+			Service: test.service,
+		})
+		assert.NoError(t, err, test.name)
+
+		resp, err := stream.Recv()
+		assert.Equal(t, test.expectedCode, status.Code(err), test.name)
+		if test.expectedCode == codes.OK {
+			assert.Equal(t, healthpb.HealthCheckResponse_SERVING, resp.GetStatus(), test.name)
+		}
+	}
+}
+
+// testAuthZStreamServiceDesc is a client stream and bidirectional stream
+// service using the messages of the health service. Its descriptor is
+// registered in init() so that the request type of its methods can be found.
+var testAuthZStreamServiceDesc = grpc.ServiceDesc{
+	ServiceName: "test.authz.v1.AuthZStream",
+	HandlerType: (*interface{})(nil),
+	Streams: []grpc.StreamDesc{
+		{
+			// Upload receives all the requests and replies once
+			StreamName: "Upload",
+			Handler: func(srv interface{}, stream grpc.ServerStream) error {
+				srv.(*testAuthZStreamServer).calls.Add(1)
+				for {
+					err := stream.RecvMsg(&healthpb.HealthCheckRequest{})
+					if err == io.EOF {
+						break
+					} else if err != nil {
+						return err
+					}
+				}
+				return srv.(*testAuthZStreamServer).reply(stream)
+			},
+			ClientStreams: true,
+		},
+		{
+			// Chat replies to each request
+			StreamName: "Chat",
+			Handler: func(srv interface{}, stream grpc.ServerStream) error {
+				srv.(*testAuthZStreamServer).calls.Add(1)
+				for {
+					err := stream.RecvMsg(&healthpb.HealthCheckRequest{})
+					if err == io.EOF {
+						return nil
+					} else if err != nil {
+						return err
+					}
+					if err := srv.(*testAuthZStreamServer).reply(stream); err != nil {
+						return err
+					}
+				}
+			},
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+		{
+			// Ignore never receives the requests
+			StreamName: "Ignore",
+			Handler: func(srv interface{}, stream grpc.ServerStream) error {
+				srv.(*testAuthZStreamServer).calls.Add(1)
+				return srv.(*testAuthZStreamServer).reply(stream)
+			},
+			ClientStreams: true,
+		},
+	},
+}
+
+func init() {
+	streaming := true
+	fd, err := protodesc.NewFile(&descriptorpb.FileDescriptorProto{
+		Name:       proto.String("server/test_authz_stream.proto"),
+		Package:    proto.String("test.authz.v1"),
+		Dependency: []string{healthpb.File_grpc_health_v1_health_proto.Path()},
+		Service: []*descriptorpb.ServiceDescriptorProto{{
+			Name: proto.String("AuthZStream"),
+			Method: []*descriptorpb.MethodDescriptorProto{
+				{
+					Name:            proto.String("Upload"),
+					InputType:       proto.String(".grpc.health.v1.HealthCheckRequest"),
+					OutputType:      proto.String(".grpc.health.v1.HealthCheckResponse"),
+					ClientStreaming: &streaming,
+				},
+				{
+					Name:            proto.String("Chat"),
+					InputType:       proto.String(".grpc.health.v1.HealthCheckRequest"),
+					OutputType:      proto.String(".grpc.health.v1.HealthCheckResponse"),
+					ClientStreaming: &streaming,
+					ServerStreaming: &streaming,
+				},
+				{
+					Name:            proto.String("Ignore"),
+					InputType:       proto.String(".grpc.health.v1.HealthCheckRequest"),
+					OutputType:      proto.String(".grpc.health.v1.HealthCheckResponse"),
+					ClientStreaming: &streaming,
+				},
+			},
+		}},
+	}, protoregistry.GlobalFiles)
+	if err != nil {
+		panic(err)
+	}
+	if err := protoregistry.GlobalFiles.RegisterFile(fd); err != nil {
+		panic(err)
+	}
+}
+
+// testAuthZStreamServer counts the calls of the handlers, which must
+// only be called once the stream is authorized
+type testAuthZStreamServer struct {
+	testAuthZHealthServer
+
+	calls atomic.Int32
+}
+
+func (ts *testAuthZStreamServer) reply(stream grpc.ServerStream) error {
+	if ContextGetHandlerData(stream.Context()) != "handlerdata" {
+		return status.Error(codes.Internal, "handler data missing from stream context")
+	}
+	return stream.SendMsg(&healthpb.HealthCheckResponse{
+		Status: healthpb.HealthCheckResponse_SERVING,
+	})
+}
+
+func TestExternalAuthorizerClientStreams(t *testing.T) {
+	authenticator, err := auth.NewJwtAuthenticator(&auth.JwtAuthConfig{
+		SharedSecret: []byte(testSharedSecret),
+	})
+	require.NoError(t, err)
+
+	ts := &testAuthZStreamServer{}
+	config := &ServerConfig{
+		Name:    "testServer",
+		Net:     "tcp",
+		Address: "127.0.0.1:0",
+		Security: &SecurityConfig{
+			Authenticators: map[string]auth.Authenticator{
+				"testissuer": authenticator,
+			},
+		},
+	}
+	config.
+		RegisterGrpcServers(func(gs *grpc.Server) {
+			gs.RegisterService(&testAuthZStreamServiceDesc, ts)
+		}).
+		WithMaxReceiveMessageSize(1024).
+		WithExternalAuthZChecker(
+			func(ctx context.Context, authZReq ExternalAuthZRequest) (bool, error) {
+				return authZReq == testAuthZAllowed, nil
+			},
+			nil,
+			nil,
+		)
+	s := newTestServer(t, config)
+	defer s.Stop()
+
+	tests := []struct {
+		name          string
+		method        int
+		services      []string
+		expectedCode  codes.Code
+		expectedCalls int32
+	}{
+		{"client stream authorized", 0, []string{testAuthZAllowed, testAuthZDenied}, codes.OK, 1},
+		{"client stream denied", 0, []string{testAuthZDenied, testAuthZAllowed}, codes.PermissionDenied, 0},
+		{"client stream without request", 0, nil, codes.InvalidArgument, 0},
+		{"client stream request too large", 0, []string{strings.Repeat("a", 2048)}, codes.ResourceExhausted, 0},
+		{"bidi stream authorized", 1, []string{testAuthZAllowed}, codes.OK, 1},
+		{"bidi stream denied", 1, []string{testAuthZDenied}, codes.PermissionDenied, 0},
+		{"handler not receiving authorized", 2, []string{testAuthZAllowed}, codes.OK, 1},
+		{"handler not receiving denied", 2, []string{testAuthZDenied}, codes.PermissionDenied, 0},
+	}
+
+	for _, test := range tests {
+		ts.calls.Store(0)
+		desc := &testAuthZStreamServiceDesc.Streams[test.method]
+		ctx := contextWithToken(t, context.Background(), "testissuer", "jim", nil)
+		stream, err := s.Conn().NewStream(ctx, desc,
+			"/"+testAuthZStreamServiceDesc.ServiceName+"/"+desc.StreamName)
+		require.NoError(t, err, test.name)
+
+		for _, service := range test.services {
+			// Sending fails with io.EOF once the server has closed the stream
+			err := stream.SendMsg(&healthpb.HealthCheckRequest{Service: service})
+			if err != nil {
+				assert.Equal(t, io.EOF, err, test.name)
+				break
+			}
+		}
+		require.NoError(t, stream.CloseSend(), test.name)
+
+		resp := &healthpb.HealthCheckResponse{}
+		err = stream.RecvMsg(resp)
+		assert.Equal(t, test.expectedCode, status.Code(err), test.name)
+		if test.expectedCode == codes.OK {
+			assert.Equal(t, healthpb.HealthCheckResponse_SERVING, resp.GetStatus(), test.name)
+		}
+		assert.Equal(t, test.expectedCalls, ts.calls.Load(), test.name)
+	}
+}
@@ -20,9 +20,8 @@ import (
 	"fmt"
 	"io"
 	"sync"
+	"sync/atomic"
 
-	"github.com/libopenstorage/grpc-framework/pkg/auth/role"
-	"github.com/libopenstorage/grpc-framework/pkg/correlation"
 	grpcserver "github.com/libopenstorage/grpc-framework/pkg/grpc/server"
 
 	"github.com/sirupsen/logrus"
@@ -31,12 +30,14 @@ import (
 	grpc_auth "github.com/grpc-ecosystem/go-grpc-middleware/auth"
 	grpc_prometheus "github.com/grpc-ecosystem/go-grpc-prometheus"
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
-	"google.golang.org/grpc/status"
 	"google.golang.org/grpc/tap"
 )
 
+// defaultMaxReceiveMessageSize is the default maximum size of the messages
+// received by gRPC servers
+const defaultMaxReceiveMessageSize = 4 * 1024 * 1024
+
 type GrpcFrameworkServer struct {
 	*grpcserver.GrpcServer
 
@@ -49,11 +50,33 @@ type GrpcFrameworkServer struct {
 	auditLogOutput  io.Writer
 	accessLogOutput io.Writer
 
-	roleServer role.RoleManager
+	perUserLimiter      *perUserRateLimiter
+	rateLimiterQueue    *priorityQueueRateLimiter
+	rateLimiterPolicies *rateLimiterPolicies
+	deadlines           *deadlinePolicies
+
+	// Security configuration used by the interceptors
+	security atomic.Pointer[serverSecurity]
+
+	// TLS certificate, shared with the REST gateway
+	certProvider *certificateProvider
+
+	// Health service reporting the status of the server
+	health *healthManager
+
+	// In-memory listener of the REST gateway. In single-port mode, it is
+	// the only listener of the server.
+	memListener *memListener
 }
 
 // New creates a new gRPC server for the gRPC framework
 func NewGrpcFrameworkServer(config *ServerConfig) (*GrpcFrameworkServer, error) {
+	return newGrpcFrameworkServer(config, nil)
+}
+
+// newGrpcFrameworkServer creates a new gRPC server which serves the in-memory
+// listener, if provided, instead of listening on the network
+func newGrpcFrameworkServer(config *ServerConfig, memListener *memListener) (*GrpcFrameworkServer, error) {
 	if nil == config {
 		return nil, fmt.Errorf("configuration must be provided")
 	}
@@ -70,54 +93,176 @@ func NewGrpcFrameworkServer(config *ServerConfig) (*GrpcFrameworkServer, error)
 	})
 
 	// Setup authentication
-
-	// Check the necessary security config options are set. Authentication is enabled. Therefore,
-	// either RoleManager must be provided (this implies use of the default authZ)
-	// or explicit authZ interceptors must be provided
-	// or external authZ checker must be provided (this implies use of external_authorizer.go)
-	if config.Security.Authenticators != nil && config.Security.Role == nil &&
-		(config.AuthZUnaryInterceptor == nil || config.AuthZStreamInterceptor == nil) &&
-		config.ExternalAuthZChecker == nil {
-		return nil, fmt.Errorf("must supply role manager when authentication is enabled and default authZ is used")
+	if err := validateSecurityConfig(config, config.Security); err != nil {
+		return nil, err
 	}
 	for issuer := range config.Security.Authenticators {
 		log.Infof("Authentication enabled for issuer: %s", issuer)
 	}
+	if config.Security.CertificateAuthenticator != nil {
+		log.Info("Authentication enabled for client certificates")
+	}
 
 	// Create gRPC server
-	gServer, err := grpcserver.New(&grpcserver.GrpcServerConfig{
+	gConfig := &grpcserver.GrpcServerConfig{
 		Name:    name,
 		Net:     config.Net,
 		Address: config.Address,
-	})
+	}
+	if memListener != nil {
+		gConfig.Listener = memListener
+	}
+	gServer, err := grpcserver.New(gConfig)
 	if err != nil {
 		return nil, fmt.Errorf("unable to setup %s server: %v", name, err)
 	}
 
+	// Setup per user rate limiter
+	var perUserLimiter *perUserRateLimiter
+	if config.RateLimiters.RateLimiterPerUser != nil {
+		perUserLimiter, err = newPerUserRateLimiter(
+			config.RateLimiters.RateLimiterPerUser,
+			config.RateLimiters.PerUserIdleTimeout,
+			config.RateLimiters.PerUserMaxUsers)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Setup the rate limiter policies per method
+	var policies *rateLimiterPolicies
+	if len(config.RateLimiters.Policies) != 0 {
+		policies, err = newRateLimiterPolicies(
+			config.RateLimiters.Policies,
+			config.RateLimiters.PerUserIdleTimeout,
+			config.RateLimiters.PerUserMaxUsers)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Setup the deadlines of the requests
+	var deadlines *deadlinePolicies
+	if config.Deadlines.enabled() {
+		deadlines, err = newDeadlinePolicies(config.Deadlines)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Setup the queue for the global rate limiter
+	var rateLimiterQueue *priorityQueueRateLimiter
+	if config.RateLimiters.Queue.Enabled && config.RateLimiters.RateLimiter == nil {
+		return nil, fmt.Errorf("rate limiter queue requires a global rate limiter")
+	} else if config.RateLimiters.Queue.Enabled {
+		rateLimiterQueue = newPriorityQueueRateLimiter(
+			name,
+			config.RateLimiters.RateLimiter,
+			config.RateLimiters.Queue)
+	}
+
 	s := &GrpcFrameworkServer{
-		GrpcServer:      gServer,
-		accessLogOutput: config.AccessOutput,
-		auditLogOutput:  config.AuditOutput,
-		roleServer:      config.Security.Role,
-		config:          *config,
-		name:            name,
-		log:             log,
+		GrpcServer:          gServer,
+		accessLogOutput:     config.AccessOutput,
+		auditLogOutput:      config.AuditOutput,
+		perUserLimiter:      perUserLimiter,
+		rateLimiterQueue:    rateLimiterQueue,
+		rateLimiterPolicies: policies,
+		deadlines:           deadlines,
+		config:              *config,
+		name:                name,
+		log:                 log,
+		health:              newHealthManager(config.Health),
+		memListener:         memListener,
 	}
+	s.setSecurity(config.Security)
 	return s, nil
 }
 
+// validateSecurityConfig checks that the security configuration can be used with the server configuration
+func validateSecurityConfig(config *ServerConfig, security *SecurityConfig) error {
+	// Check the necessary security config options are set. Authentication is enabled. Therefore,
+	// either RoleManager must be provided (this implies use of the default authZ)
+	// or explicit authZ interceptors must be provided
+	// or external authZ checker must be provided (this implies use of external_authorizer.go)
+	if security.authEnabled() && security.Role == nil &&
+		(config.AuthZUnaryInterceptor == nil || config.AuthZStreamInterceptor == nil) &&
+		config.ExternalAuthZChecker == nil {
+		return fmt.Errorf("must supply role manager when authentication is enabled and default authZ is used")
+	}
+	if security.CertificateAuthenticator != nil &&
+		(security.Tls == nil || security.Tls.ClientCAFile == "") {
+		return fmt.Errorf("must supply a client CA file when using a certificate authenticator")
+	}
+	if security.DefaultIssuer != "" {
+		if _, ok := security.Authenticators[security.DefaultIssuer]; !ok {
+			return fmt.Errorf("default issuer %s does not have an authenticator", security.DefaultIssuer)
+		}
+	}
+	if security.Tls != nil {
+		if err := validateClientCertPolicy(security.Tls); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// serverSecurity is the security configuration used by the interceptors.
+// It is replaced at once, so that the requests in-flight keep the
+// configuration they started with.
+type serverSecurity struct {
+	config *SecurityConfig
+
+	// Cache of the claims of the tokens verified with the configuration
+	claimsCache *claimsCache
+}
+
+// currentSecurity returns the security configuration for new requests
+func (s *GrpcFrameworkServer) currentSecurity() *serverSecurity {
+	return s.security.Load()
+}
+
+// maxReceiveMessageSize returns the maximum size of the received messages
+func (s *GrpcFrameworkServer) maxReceiveMessageSize() int {
+	if s.config.MaxReceiveMessageSize > 0 {
+		return s.config.MaxReceiveMessageSize
+	}
+	return defaultMaxReceiveMessageSize
+}
+
+// setSecurity replaces the security configuration of the server without
+// waiting for the requests in-flight. The tokens are verified again with
+// the new authenticators.
+func (s *GrpcFrameworkServer) setSecurity(security *SecurityConfig) {
+	s.security.Store(&serverSecurity{
+		config:      security,
+		claimsCache: newClaimsCache(s.name, security.ClaimsCache),
+	})
+}
+
 // Start is used to start the server.
 // It will return an error if the server is already running.
 func (s *GrpcFrameworkServer) Start() error {
 
 	// Setup https if certs have been provided
 	opts := s.config.ServerOptions
-	if s.config.Net != "unix" && s.config.Security.Tls != nil {
-		creds, err := credentials.NewServerTLSFromFile(
-			s.config.Security.Tls.CertFile,
-			s.config.Security.Tls.KeyFile)
-		if err != nil {
-			return fmt.Errorf("failed to create credentials from cert files: %v", err)
+	if s.config.MaxReceiveMessageSize > 0 {
+		opts = append(opts, grpc.MaxRecvMsgSize(s.config.MaxReceiveMessageSize))
+	}
+	if s.memListener != nil && s.config.RestConfig.singlePort() {
+		// TLS is terminated by the REST gateway which receives the requests
+		s.log.Info("Serving gRPC requests from the REST gateway")
+	} else if s.config.Net != "unix" && s.config.Security.Tls != nil {
+		if s.certProvider == nil {
+			var err error
+			s.certProvider, err = newCertificateProvider(s.config.Security.Tls)
+			if err != nil {
+				return err
+			}
+		}
+		var creds credentials.TransportCredentials = credentials.NewTLS(s.certProvider.tlsConfig())
+		if s.memListener != nil {
+			creds = &memCredentials{TransportCredentials: creds}
 		}
 		opts = append(opts, grpc.Creds(creds))
 		s.log.Info("TLS enabled")
@@ -126,22 +271,41 @@ func (s *GrpcFrameworkServer) Start() error {
 	}
 
 	// Add correlation interceptor
-	correlationInterceptor := correlation.ContextInterceptor{
-		Origin: correlation.ComponentGrpcFw,
-	}
+	correlationInterceptor := s.correlationInterceptor()
 
 	// Set up unary interceptors
 	unaryInterceptors := []grpc.UnaryServerInterceptor{
 		s.rwlockUnaryIntercepter,
+		s.recoveryUnaryInterceptor,
 		correlationInterceptor.ContextUnaryServerInterceptor,
 	}
 
+	// Set the deadlines first, so that they also bound the time spent
+	// waiting in the rate limiter queue
+	if s.deadlines != nil {
+		unaryInterceptors = append(unaryInterceptors, s.deadlineUnaryInterceptor)
+	}
+
+	// The default authN and authZ interceptors are skipped for the public
+	// methods, like the health service, which can be called without a token.
+	// The caller's interceptors are always called.
+
 	// use caller's authN interceptor if provided
 	if s.config.AuthNUnaryInterceptor != nil {
 		unaryInterceptors = append(unaryInterceptors, s.config.AuthNUnaryInterceptor)
-	} else if s.config.Security.Authenticators != nil {
+	} else if s.config.Security.authEnabled() {
 		// use the default authN interceptor
-		unaryInterceptors = append(unaryInterceptors, grpc_auth.UnaryServerInterceptor(s.auth))
+		unaryInterceptors = append(unaryInterceptors, s.skipPublicUnaryInterceptor(grpc_auth.UnaryServerInterceptor(s.auth)))
+	}
+
+	// Per user rate limiter needs the user information from authN
+	if s.perUserLimiter != nil || s.rateLimiterPolicies != nil {
+		unaryInterceptors = append(unaryInterceptors, s.rateLimiterPerUserUnaryInterceptor)
+	}
+
+	// Rate limiter queue needs the user information from authN to determine the priority
+	if s.rateLimiterQueue != nil {
+		unaryInterceptors = append(unaryInterceptors, s.rateLimiterQueueUnaryInterceptor)
 	}
 
 	// use caller's authZ interceptor if provided
@@ -150,11 +314,11 @@ func (s *GrpcFrameworkServer) Start() error {
 		unaryInterceptors = append(unaryInterceptors, s.config.AuthZUnaryInterceptor)
 	} else if s.config.ExternalAuthZChecker != nil {
 		// plug the caller-supplied authChecker into our external authorizer framework
-		unaryInterceptors = append(unaryInterceptors, s.externalAuthorizerUnaryInterceptor(
-			s.config.ExternalAuthZChecker, s.config.InsecureNoAuthNAuthZReqs, s.config.InsecureNoAuthZReqs))
-	} else if s.config.Security.Authenticators != nil {
+		unaryInterceptors = append(unaryInterceptors, s.skipPublicUnaryInterceptor(s.externalAuthorizerUnaryInterceptor(
+			s.config.ExternalAuthZChecker, s.config.InsecureNoAuthNAuthZReqs, s.config.InsecureNoAuthZReqs)))
+	} else if s.config.Security.authEnabled() {
 		// use our default authZ interceptor
-		unaryInterceptors = append(unaryInterceptors, s.authorizationServerUnaryInterceptor)
+		unaryInterceptors = append(unaryInterceptors, s.skipPublicUnaryInterceptor(s.authorizationServerUnaryInterceptor))
 	}
 
 	// append remaining default unary interceptors
@@ -163,17 +327,38 @@ func (s *GrpcFrameworkServer) Start() error {
 		grpc_prometheus.UnaryServerInterceptor,
 	}...)
 
+	// Validate the requests once authorized, so that the rejections are logged
+	if s.config.Validation.Enabled {
+		unaryInterceptors = append(unaryInterceptors, s.validationUnaryInterceptor)
+	}
+
 	// Set up stream interceptors
 	streamInterceptors := []grpc.StreamServerInterceptor{
 		s.rwlockStreamIntercepter,
+		s.recoveryStreamInterceptor,
+		correlationInterceptor.ContextStreamServerInterceptor,
+	}
+
+	if s.deadlines != nil {
+		streamInterceptors = append(streamInterceptors, s.deadlineStreamInterceptor)
 	}
 
 	// use caller's authN interceptor if provided
 	if s.config.AuthNStreamInterceptor != nil {
 		streamInterceptors = append(streamInterceptors, s.config.AuthNStreamInterceptor)
-	} else if s.config.Security.Authenticators != nil {
+	} else if s.config.Security.authEnabled() {
 		// use the default authN interceptor
-		streamInterceptors = append(streamInterceptors, grpc_auth.StreamServerInterceptor(s.auth))
+		streamInterceptors = append(streamInterceptors, s.skipPublicStreamInterceptor(grpc_auth.StreamServerInterceptor(s.auth)))
+	}
+
+	// Per user rate limiter needs the user information from authN
+	if s.perUserLimiter != nil || s.rateLimiterPolicies != nil {
+		streamInterceptors = append(streamInterceptors, s.rateLimiterPerUserStreamInterceptor)
+	}
+
+	// Rate limiter queue needs the user information from authN to determine the priority
+	if s.rateLimiterQueue != nil {
+		streamInterceptors = append(streamInterceptors, s.rateLimiterQueueStreamInterceptor)
 	}
 
 	// use caller's authZ interceptor if provided
@@ -182,11 +367,11 @@ func (s *GrpcFrameworkServer) Start() error {
 		streamInterceptors = append(streamInterceptors, s.config.AuthZStreamInterceptor)
 	} else if s.config.ExternalAuthZChecker != nil {
 		// plug the caller-supplied authChecker into our external authorizer interceptor
-		streamInterceptors = append(streamInterceptors, s.externalAuthorizerStreamInterceptor(
-			s.config.ExternalAuthZChecker, s.config.InsecureNoAuthNAuthZReqs, s.config.InsecureNoAuthZReqs))
-	} else if s.config.Security.Authenticators != nil {
+		streamInterceptors = append(streamInterceptors, s.skipPublicStreamInterceptor(s.externalAuthorizerStreamInterceptor(
+			s.config.ExternalAuthZChecker, s.config.InsecureNoAuthNAuthZReqs, s.config.InsecureNoAuthZReqs)))
+	} else if s.config.Security.authEnabled() {
 		// use our default authZ interceptor
-		streamInterceptors = append(streamInterceptors, s.authorizationServerStreamInterceptor)
+		streamInterceptors = append(streamInterceptors, s.skipPublicStreamInterceptor(s.authorizationServerStreamInterceptor))
 	}
 
 	// append remaining default stream interceptors
@@ -195,6 +380,11 @@ func (s *GrpcFrameworkServer) Start() error {
 		grpc_prometheus.StreamServerInterceptor,
 	}...)
 
+	// Validate the requests once authorized, so that the rejections are logged
+	if s.config.Validation.Enabled {
+		streamInterceptors = append(streamInterceptors, s.validationStreamInterceptor)
+	}
+
 	// Append other custom interceptors to the end of the chain
 	unaryInterceptors = append(unaryInterceptors, s.config.UnaryServerInterceptors...)
 	streamInterceptors = append(streamInterceptors, s.config.StreamServerInterceptors...)
@@ -206,8 +396,10 @@ func (s *GrpcFrameworkServer) Start() error {
 		grpc_middleware.ChainStreamServer(streamInterceptors...),
 	))
 
-	// Determine if we should add rate limiters
-	if s.config.RateLimiters.RateLimiter != nil || s.config.RateLimiters.RateLimiterPerUser != nil {
+	// Determine if we should add the global rate limiter. When queueing, the
+	// global rate limiter is checked by the queue interceptors instead since
+	// requests cannot wait in the tap handle.
+	if s.rateLimiterTapEnabled() {
 		opts = append(opts, grpc.InTapHandle(s.rateLimiter))
 	}
 
@@ -220,18 +412,57 @@ func (s *GrpcFrameworkServer) Start() error {
 			ext(grpcServer)
 		}
 
+		// Register the health service unless the application provides its own
+		s.health.register(grpcServer)
+
+		// Register the revocations service when tokens can be revoked
+		s.registerRevocations(grpcServer)
+
 		// Register stats for all the services
 		s.registerPrometheusMetrics(grpcServer)
 
+		// Cache the rate limiter policies of the registered methods
+		s.rateLimiterPolicies.register(grpcServer)
+
 		return grpcServer
 	})
 	if err != nil {
 		return err
 	}
 
+	// Serve the REST gateway in memory along with the network
+	if s.memListener != nil && !s.config.RestConfig.singlePort() {
+		if err := s.GrpcServer.Serve(s.memListener); err != nil {
+			s.GrpcServer.Stop()
+			return err
+		}
+	}
+	s.health.start()
+
 	return nil
 }
 
+// drain sets the health of all services to NOT_SERVING so that clients and load
+// balancers stop sending new requests. It cannot be undone.
+func (s *GrpcFrameworkServer) drain() {
+	s.health.drain()
+}
+
+// Shutdown gracefully stops the server. The health of all services is set to
+// NOT_SERVING, new connections are no longer accepted and the pending RPCs are
+// allowed to finish. If the context expires first, the server is stopped and
+// the pending RPCs are cancelled.
+func (s *GrpcFrameworkServer) Shutdown(ctx context.Context) error {
+	s.drain()
+	return s.GrpcServer.Shutdown(ctx)
+}
+
+// Stop stops the server immediately, cancelling the pending RPCs
+func (s *GrpcFrameworkServer) Stop() {
+	s.drain()
+	s.GrpcServer.Stop()
+}
+
 func (s *GrpcFrameworkServer) registerPrometheusMetrics(grpcServer *grpc.Server) {
 	// Register the gRPCs and enable latency historgram
 	grpc_prometheus.Register(grpcServer)
@@ -250,12 +481,29 @@ func (s *GrpcFrameworkServer) transactionEnd() {
 	s.lock.Unlock()
 }
 
-func (s *GrpcFrameworkServer) globalLimiterAllow() bool {
+// rateLimiterTapEnabled returns true if the rate limiter is checked in the
+// tap handle, before the requests are read
+func (s *GrpcFrameworkServer) rateLimiterTapEnabled() bool {
+	return (s.config.RateLimiters.RateLimiter != nil && s.rateLimiterQueue == nil) ||
+		s.rateLimiterPolicies != nil
+}
+
+func (s *GrpcFrameworkServer) globalLimiterAllow(fullMethod string) bool {
+	limiter := s.config.RateLimiters.RateLimiter
+
+	// Methods with a policy use the limiter from the policy
+	if policy := s.rateLimiterPolicies.match(fullMethod); policy != nil {
+		limiter = policy.limiter
+	} else if s.rateLimiterQueue != nil {
+		// The global limiter is checked by the queue
+		return true
+	}
+
 	// Check if there is no limiter. If none, allow all
-	if s.config.RateLimiters.RateLimiter == nil {
+	if limiter == nil {
 		return true
 	}
-	return s.config.RateLimiters.RateLimiter.Allow()
+	return limiter.Allow()
 }
 
 func (s *GrpcFrameworkServer) rateLimiter(
@@ -264,12 +512,12 @@ func (s *GrpcFrameworkServer) rateLimiter(
 ) (context.Context, error) {
 
 	// Check global limiter
-	if !s.globalLimiterAllow() {
-		return nil, status.Error(codes.ResourceExhausted, "resources for clients exhausted")
+	if !s.globalLimiterAllow(info.FullMethodName) {
+		return nil, rateLimitedError("resources for clients exhausted", rateLimiterClientsSubject, 0)
 	}
 
-	// Check per user limiter
-	// XXX TODO
+	// Per user limits are checked by the per user rate limiter interceptors
+	// once the user has been authenticated.
 
 	return ctx, nil
 }
@@ -0,0 +1,380 @@
+/*
+Copyright 2022 Pure Storage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+)
+
+const (
+	// Default time between runs of the readiness checks
+	defaultReadinessCheckInterval = 10 * time.Second
+	// Default time a readiness check can take before it fails
+	defaultReadinessCheckTimeout = 5 * time.Second
+
+	// REST gateway paths of the health endpoints
+	restHealthzPath = "/healthz"
+	restReadyzPath  = "/readyz"
+)
+
+// healthServiceName is the name of the standard gRPC health service
+var healthServiceName = grpc_health_v1.Health_ServiceDesc.ServiceName
+
+// ReadinessCheck returns an error when the application is not ready to
+// serve requests, for example when its database cannot be reached.
+type ReadinessCheck func(ctx context.Context) error
+
+// HealthConfig configures the grpc.health.v1.Health service registered by
+// the server, unless the application registers its own. The status of the
+// server, the empty service name, and of every registered service follows
+// the server: NOT_SERVING until started, SERVING while running and ready,
+// and NOT_SERVING once it starts to shutdown.
+//
+// The REST gateway maps the status of the server to /healthz and /readyz.
+type HealthConfig struct {
+	// RequireAuth requires the health requests to be authenticated and
+	// authorized like any other request. By default, the health service
+	// can be called without a token: the default authentication and
+	// authorization interceptors, including the external authorizer, skip
+	// it. Custom AuthN and AuthZ interceptors of ServerConfig are called
+	// for the health service in any case.
+	RequireAuth bool
+	// ReadinessChecks are run periodically by name. While any check fails,
+	// the server and all its services are NOT_SERVING.
+	ReadinessChecks map[string]ReadinessCheck
+	// CheckInterval is the time between runs of the readiness checks.
+	// Defaults to 10s if not provided.
+	CheckInterval time.Duration
+	// CheckTimeout is the time a readiness check can take before it fails.
+	// Defaults to 5s if not provided.
+	CheckTimeout time.Duration
+}
+
+// healthManager sets the status of the health service from the state of
+// the server, the statuses set by the application and the readiness checks.
+// It can be shared by more than one gRPC server.
+type healthManager struct {
+	lock   sync.Mutex
+	server *health.Server
+	config HealthConfig
+
+	// services are the registered services with the status set by the
+	// application, or SERVING if not set
+	services map[string]grpc_health_v1.HealthCheckResponse_ServingStatus
+	// failures are the readiness checks which failed the last time they ran
+	failures map[string]error
+	started  bool
+	draining bool
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+func newHealthManager(config HealthConfig) *healthManager {
+	if config.CheckInterval == 0 {
+		config.CheckInterval = defaultReadinessCheckInterval
+	}
+	if config.CheckTimeout == 0 {
+		config.CheckTimeout = defaultReadinessCheckTimeout
+	}
+
+	h := &healthManager{
+		server: health.NewServer(),
+		config: config,
+		services: map[string]grpc_health_v1.HealthCheckResponse_ServingStatus{
+			"": grpc_health_v1.HealthCheckResponse_SERVING,
+		},
+		failures: make(map[string]error),
+	}
+	// Not serving until started
+	h.server.SetServingStatus("", grpc_health_v1.HealthCheckResponse_NOT_SERVING)
+	return h
+}
+
+// register registers the health service in the gRPC server unless the
+// application has registered its own, and tracks the status of the
+// services registered in the gRPC server.
+func (h *healthManager) register(grpcServer *grpc.Server) {
+	info := grpcServer.GetServiceInfo()
+	if _, ok := info[healthServiceName]; !ok {
+		grpc_health_v1.RegisterHealthServer(grpcServer, h.server)
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	for service := range info {
+		if _, ok := h.services[service]; !ok {
+			h.services[service] = grpc_health_v1.HealthCheckResponse_SERVING
+		}
+	}
+	h.update()
+}
+
+// start marks the server as started and starts the readiness checks
+func (h *healthManager) start() {
+	h.lock.Lock()
+	if h.started || h.draining {
+		h.lock.Unlock()
+		return
+	}
+	h.lock.Unlock()
+
+	// Not ready until the checks have run
+	failures := h.runChecks()
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if h.started || h.draining {
+		return
+	}
+	h.started = true
+	h.setFailures(failures)
+	if len(h.config.ReadinessChecks) != 0 {
+		h.done = make(chan struct{})
+		h.wg.Add(1)
+		go h.checkLoop(h.done)
+	}
+	h.update()
+}
+
+// drain sets all the services to NOT_SERVING so that clients and load
+// balancers stop sending new requests. It cannot be undone.
+func (h *healthManager) drain() {
+	h.lock.Lock()
+	if h.draining {
+		h.lock.Unlock()
+		return
+	}
+	h.draining = true
+	h.update()
+	done := h.done
+	h.done = nil
+	h.lock.Unlock()
+
+	if done != nil {
+		close(done)
+		h.wg.Wait()
+	}
+}
+
+// setServingStatus sets the status of a service set by the application
+func (h *healthManager) setServingStatus(
+	service string,
+	status grpc_health_v1.HealthCheckResponse_ServingStatus,
+) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.services[service] = status
+	h.update()
+}
+
+// servingStatus returns the current status of the service
+func (h *healthManager) servingStatus(service string) (grpc_health_v1.HealthCheckResponse_ServingStatus, bool) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	status, ok := h.services[service]
+	if !ok {
+		return grpc_health_v1.HealthCheckResponse_SERVICE_UNKNOWN, false
+	}
+	return h.effectiveStatus(status), true
+}
+
+// live returns true if the server has started and is not shutting down
+func (h *healthManager) live() bool {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	return h.started && !h.draining
+}
+
+// failedChecks returns the names of the readiness checks which failed
+func (h *healthManager) failedChecks() []string {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	names := make([]string, 0, len(h.failures))
+	for name := range h.failures {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// effectiveStatus returns the status of a service given the state of the server.
+// Lock must be held.
+func (h *healthManager) effectiveStatus(status grpc_health_v1.HealthCheckResponse_ServingStatus) grpc_health_v1.HealthCheckResponse_ServingStatus {
+	if !h.started || h.draining || len(h.failures) != 0 ||
+		h.services[""] != grpc_health_v1.HealthCheckResponse_SERVING {
+		return grpc_health_v1.HealthCheckResponse_NOT_SERVING
+	}
+	return status
+}
+
+// update sets the status of all the services in the health service.
+// Lock must be held.
+func (h *healthManager) update() {
+	for service, status := range h.services {
+		h.server.SetServingStatus(service, h.effectiveStatus(status))
+	}
+}
+
+func (h *healthManager) checkLoop(done chan struct{}) {
+	defer h.wg.Done()
+
+	ticker := time.NewTicker(h.config.CheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			failures := h.runChecks()
+
+			h.lock.Lock()
+			if !h.draining {
+				h.setFailures(failures)
+				h.update()
+			}
+			h.lock.Unlock()
+		}
+	}
+}
+
+// runChecks runs all the readiness checks and returns the ones which failed
+func (h *healthManager) runChecks() map[string]error {
+	failures := make(map[string]error)
+	for name, check := range h.config.ReadinessChecks {
+		ctx, cancel := context.WithTimeout(context.Background(), h.config.CheckTimeout)
+		if err := check(ctx); err != nil {
+			failures[name] = err
+		}
+		cancel()
+	}
+	return failures
+}
+
+// setFailures saves the results of the readiness checks and logs their changes.
+// Lock must be held.
+func (h *healthManager) setFailures(failures map[string]error) {
+	for name, err := range failures {
+		if _, failed := h.failures[name]; !failed {
+			logrus.Warnf("Readiness check %s failed: %v", name, err)
+		}
+	}
+	for name := range h.failures {
+		if _, failed := failures[name]; !failed {
+			logrus.Infof("Readiness check %s passed", name)
+		}
+	}
+	h.failures = failures
+}
+
+// isPublicMethod returns true if the method can be called without authentication
+func (s *GrpcFrameworkServer) isPublicMethod(fullMethod string) bool {
+	return !s.config.Health.RequireAuth &&
+		strings.HasPrefix(fullMethod, "/"+healthServiceName+"/")
+}
+
+// skipPublicUnaryInterceptor returns an interceptor which calls i except for the public methods
+func (s *GrpcFrameworkServer) skipPublicUnaryInterceptor(i grpc.UnaryServerInterceptor) grpc.UnaryServerInterceptor {
+	return func(
+		ctx context.Context,
+		req interface{},
+		info *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler,
+	) (interface{}, error) {
+		if s.isPublicMethod(info.FullMethod) {
+			return handler(ctx, req)
+		}
+		return i(ctx, req, info, handler)
+	}
+}
+
+// skipPublicStreamInterceptor returns an interceptor which calls i except for the public methods
+func (s *GrpcFrameworkServer) skipPublicStreamInterceptor(i grpc.StreamServerInterceptor) grpc.StreamServerInterceptor {
+	return func(
+		srv interface{},
+		stream grpc.ServerStream,
+		info *grpc.StreamServerInfo,
+		handler grpc.StreamHandler,
+	) error {
+		if s.isPublicMethod(info.FullMethod) {
+			return handler(srv, stream)
+		}
+		return i(srv, stream, info, handler)
+	}
+}
+
+type restHealthResponse struct {
+	Status       string   `json:"status"`
+	FailedChecks []string `json:"failedChecks,omitempty"`
+}
+
+func writeRestHealthResponse(w http.ResponseWriter, serving bool, resp *restHealthResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	if serving {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+// healthzHandler reports if the server is running
+func (h *healthManager) healthzHandler(w http.ResponseWriter, r *http.Request) {
+	live := h.live()
+	status := grpc_health_v1.HealthCheckResponse_SERVING
+	if !live {
+		status = grpc_health_v1.HealthCheckResponse_NOT_SERVING
+	}
+	writeRestHealthResponse(w, live, &restHealthResponse{
+		Status: status.String(),
+	})
+}
+
+// readyzHandler reports if the server, or the service in the service
+// query parameter, is ready to serve requests
+func (h *healthManager) readyzHandler(w http.ResponseWriter, r *http.Request) {
+	service := r.URL.Query().Get("service")
+	status, ok := h.servingStatus(service)
+	if !ok {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(&restHealthResponse{
+			Status: status.String(),
+		})
+		return
+	}
+	writeRestHealthResponse(w, status == grpc_health_v1.HealthCheckResponse_SERVING, &restHealthResponse{
+		Status:       status.String(),
+		FailedChecks: h.failedChecks(),
+	})
+}
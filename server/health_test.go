@@ -0,0 +1,136 @@
+/*
+Copyright 2022 Pure Storage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/health/grpc_health_v1"
+)
+
+func testHealthStatus(t *testing.T, h *healthManager, service string) grpc_health_v1.HealthCheckResponse_ServingStatus {
+	resp, err := h.server.Check(context.Background(), &grpc_health_v1.HealthCheckRequest{
+		Service: service,
+	})
+	require.NoError(t, err)
+	return resp.GetStatus()
+}
+
+func testRestHealth(t *testing.T, handler http.HandlerFunc, target string) (int, *restHealthResponse) {
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodGet, target, nil))
+
+	resp := &restHealthResponse{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), resp))
+	return w.Code, resp
+}
+
+func TestHealthManagerLifecycle(t *testing.T) {
+	h := newHealthManager(HealthConfig{})
+	h.services["app.Service"] = grpc_health_v1.HealthCheckResponse_SERVING
+
+	// Not serving until started
+	assert.Equal(t, grpc_health_v1.HealthCheckResponse_NOT_SERVING, testHealthStatus(t, h, ""))
+	code, _ := testRestHealth(t, h.healthzHandler, restHealthzPath)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+
+	h.start()
+	h.update()
+	assert.Equal(t, grpc_health_v1.HealthCheckResponse_SERVING, testHealthStatus(t, h, ""))
+	assert.Equal(t, grpc_health_v1.HealthCheckResponse_SERVING, testHealthStatus(t, h, "app.Service"))
+	code, resp := testRestHealth(t, h.healthzHandler, restHealthzPath)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "SERVING", resp.Status)
+	code, _ = testRestHealth(t, h.readyzHandler, restReadyzPath)
+	assert.Equal(t, http.StatusOK, code)
+
+	// Status set by the application
+	h.setServingStatus("app.Service", grpc_health_v1.HealthCheckResponse_NOT_SERVING)
+	assert.Equal(t, grpc_health_v1.HealthCheckResponse_NOT_SERVING, testHealthStatus(t, h, "app.Service"))
+	assert.Equal(t, grpc_health_v1.HealthCheckResponse_SERVING, testHealthStatus(t, h, ""))
+	code, resp = testRestHealth(t, h.readyzHandler, restReadyzPath+"?service=app.Service")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "NOT_SERVING", resp.Status)
+	code, resp = testRestHealth(t, h.readyzHandler, restReadyzPath+"?service=unknown")
+	assert.Equal(t, http.StatusNotFound, code)
+	assert.Equal(t, "SERVICE_UNKNOWN", resp.Status)
+	h.setServingStatus("app.Service", grpc_health_v1.HealthCheckResponse_SERVING)
+
+	// The status of the server applies to all services
+	h.setServingStatus("", grpc_health_v1.HealthCheckResponse_NOT_SERVING)
+	assert.Equal(t, grpc_health_v1.HealthCheckResponse_NOT_SERVING, testHealthStatus(t, h, "app.Service"))
+	h.setServingStatus("", grpc_health_v1.HealthCheckResponse_SERVING)
+	assert.Equal(t, grpc_health_v1.HealthCheckResponse_SERVING, testHealthStatus(t, h, "app.Service"))
+
+	// Draining cannot be undone
+	h.drain()
+	h.drain()
+	assert.Equal(t, grpc_health_v1.HealthCheckResponse_NOT_SERVING, testHealthStatus(t, h, ""))
+	assert.Equal(t, grpc_health_v1.HealthCheckResponse_NOT_SERVING, testHealthStatus(t, h, "app.Service"))
+	h.setServingStatus("app.Service", grpc_health_v1.HealthCheckResponse_SERVING)
+	h.start()
+	assert.Equal(t, grpc_health_v1.HealthCheckResponse_NOT_SERVING, testHealthStatus(t, h, "app.Service"))
+	code, _ = testRestHealth(t, h.healthzHandler, restHealthzPath)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+}
+
+func TestHealthManagerReadinessChecks(t *testing.T) {
+	var failing int32 = 1
+	h := newHealthManager(HealthConfig{
+		CheckInterval: 10 * time.Millisecond,
+		ReadinessChecks: map[string]ReadinessCheck{
+			"db": func(ctx context.Context) error {
+				if atomic.LoadInt32(&failing) == 1 {
+					return fmt.Errorf("unreachable")
+				}
+				return nil
+			},
+			"cache": func(ctx context.Context) error {
+				return nil
+			},
+		},
+	})
+	h.start()
+	defer h.drain()
+
+	// Checks run when starting
+	assert.Equal(t, grpc_health_v1.HealthCheckResponse_NOT_SERVING, testHealthStatus(t, h, ""))
+	code, resp := testRestHealth(t, h.readyzHandler, restReadyzPath)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, []string{"db"}, resp.FailedChecks)
+
+	// Still live while not ready
+	code, _ = testRestHealth(t, h.healthzHandler, restHealthzPath)
+	assert.Equal(t, http.StatusOK, code)
+
+	atomic.StoreInt32(&failing, 0)
+	assert.Eventually(t, func() bool {
+		status, _ := h.servingStatus("")
+		return status == grpc_health_v1.HealthCheckResponse_SERVING
+	}, 5*time.Second, 10*time.Millisecond)
+	code, resp = testRestHealth(t, h.readyzHandler, restReadyzPath)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Empty(t, resp.FailedChecks)
+}
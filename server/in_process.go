@@ -0,0 +1,105 @@
+/*
+Copyright 2022 Pure Storage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package server
+
+import (
+	"context"
+	"net"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/test/bufconn"
+
+	grpcclient "github.com/libopenstorage/grpc-framework/pkg/grpc/client"
+)
+
+const (
+	// Size of the buffer of the in-memory connections to the gRPC server
+	memListenerBufferSize = 1024 * 1024
+	// Authentication type of the in-memory connections
+	memAuthType = "in-memory"
+)
+
+// memListener is an in-memory listener used by the REST gateway to connect
+// to the gRPC server in the same process
+type memListener struct {
+	*bufconn.Listener
+}
+
+// memConn is a connection accepted by a memListener
+type memConn struct {
+	net.Conn
+}
+
+func newMemListener() *memListener {
+	return &memListener{
+		Listener: bufconn.Listen(memListenerBufferSize),
+	}
+}
+
+// Accept marks the accepted connections as in-memory connections
+func (l *memListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &memConn{Conn: conn}, nil
+}
+
+// memAuthInfo is the authentication information of the in-memory connections
+type memAuthInfo struct {
+	credentials.CommonAuthInfo
+}
+
+func (memAuthInfo) AuthType() string {
+	return memAuthType
+}
+
+// memCredentials skips the handshake of the server credentials for the
+// in-memory connections, which do not leave the process, like the
+// connections to the unix domain socket server.
+type memCredentials struct {
+	credentials.TransportCredentials
+}
+
+func (c *memCredentials) ServerHandshake(conn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	if _, ok := conn.(*memConn); ok {
+		return conn, memAuthInfo{
+			CommonAuthInfo: credentials.CommonAuthInfo{
+				SecurityLevel: credentials.NoSecurity,
+			},
+		}, nil
+	}
+	return c.TransportCredentials.ServerHandshake(conn)
+}
+
+func (c *memCredentials) Clone() credentials.TransportCredentials {
+	return &memCredentials{
+		TransportCredentials: c.TransportCredentials.Clone(),
+	}
+}
+
+// localConnect connects to the gRPC server from the same process, in memory
+// when the server has an in-memory listener
+func (s *GrpcFrameworkServer) localConnect(opts []grpc.DialOption) (*grpc.ClientConn, error) {
+	if s.memListener == nil {
+		return grpcclient.Connect(s.Address(), opts)
+	}
+	return grpcclient.Connect("passthrough:///"+s.name, append(opts,
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return s.memListener.DialContext(ctx)
+		})))
+}
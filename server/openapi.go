@@ -0,0 +1,272 @@
+/*
+Copyright 2022 Pure Storage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package server
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"path"
+	"reflect"
+	"strings"
+
+	"google.golang.org/grpc/metadata"
+
+	"github.com/libopenstorage/grpc-framework/pkg/auth"
+)
+
+const (
+	defaultOpenApiPath      = "/swagger.json"
+	defaultSwaggerUIPath    = "/swagger-ui/"
+	swaggerUIInitializer    = "swagger-initializer.js"
+	swaggerUIInitializerFmt = `window.onload = function() {
+  window.ui = SwaggerUIBundle({
+    url: %s,
+    dom_id: '#swagger-ui',
+    deepLinking: true,
+    presets: [
+      SwaggerUIBundle.presets.apis,
+      SwaggerUIStandalonePreset
+    ],
+    plugins: [
+      SwaggerUIBundle.plugins.DownloadUrl
+    ],
+    layout: "StandaloneLayout"
+  });
+};
+`
+)
+
+// Static files of the Swagger UI distribution
+//
+//go:embed swaggerui
+var swaggerUIFiles embed.FS
+
+var (
+	// Members of the OpenAPI documents which are objects merged down to
+	// the given depth. For example, the paths are merged by path and method.
+	openApiMergedObjects = map[string]int{
+		"paths":               2,
+		"components":          2,
+		"definitions":         1,
+		"parameters":          1,
+		"responses":           1,
+		"securityDefinitions": 1,
+	}
+	// Members of the OpenAPI documents which are arrays merged without
+	// duplicates
+	openApiMergedArrays = map[string]bool{
+		"tags":     true,
+		"servers":  true,
+		"security": true,
+		"schemes":  true,
+		"consumes": true,
+		"produces": true,
+	}
+)
+
+// openApiDocuments returns all the documents of the configuration
+func (c *RestServerOpenApiConfig) openApiDocuments() ([][]byte, error) {
+	documents := append([][]byte{}, c.Documents...)
+	for _, fsys := range c.FileSystems {
+		err := fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() || path.Ext(name) != ".json" {
+				return err
+			}
+			document, err := fs.ReadFile(fsys, name)
+			if err != nil {
+				return err
+			}
+			documents = append(documents, document)
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read OpenAPI documents: %v", err)
+		}
+	}
+	if len(documents) == 0 {
+		return nil, fmt.Errorf("No OpenAPI documents provided")
+	}
+	return documents, nil
+}
+
+// mergeOpenApiDocuments merges the OpenAPI documents into a single one. The
+// paths, the schemas and the tags of all the documents are added to the first
+// document. When a member is defined by more than one document, the first
+// definition is kept.
+func mergeOpenApiDocuments(documents [][]byte) ([]byte, error) {
+	var merged map[string]interface{}
+	for i, document := range documents {
+		var doc map[string]interface{}
+		if err := json.Unmarshal(document, &doc); err != nil {
+			return nil, fmt.Errorf("Invalid OpenAPI document %d: %v", i, err)
+		}
+		if merged == nil {
+			merged = doc
+			continue
+		}
+		if doc["openapi"] != merged["openapi"] || doc["swagger"] != merged["swagger"] {
+			return nil, fmt.Errorf("OpenAPI document %d has a different version", i)
+		}
+
+		for key, value := range doc {
+			existing, ok := merged[key]
+			if !ok {
+				merged[key] = value
+				continue
+			}
+			if depth, ok := openApiMergedObjects[key]; ok {
+				dst, dok := existing.(map[string]interface{})
+				src, sok := value.(map[string]interface{})
+				if dok && sok {
+					mergeOpenApiObjects(dst, src, depth)
+				}
+			} else if openApiMergedArrays[key] {
+				dst, dok := existing.([]interface{})
+				src, sok := value.([]interface{})
+				if dok && sok {
+					merged[key] = mergeOpenApiArrays(dst, src)
+				}
+			}
+		}
+	}
+	return json.MarshalIndent(merged, "", "  ")
+}
+
+// mergeOpenApiObjects adds to dst the members of src which dst does not have,
+// recursively for the given depth of objects
+func mergeOpenApiObjects(dst, src map[string]interface{}, depth int) {
+	for key, value := range src {
+		existing, ok := dst[key]
+		if !ok {
+			dst[key] = value
+			continue
+		}
+		if depth > 1 {
+			d, dok := existing.(map[string]interface{})
+			s, sok := value.(map[string]interface{})
+			if dok && sok {
+				mergeOpenApiObjects(d, s, depth-1)
+			}
+		}
+	}
+}
+
+// mergeOpenApiArrays appends to dst the values of src which dst does not have
+func mergeOpenApiArrays(dst, src []interface{}) []interface{} {
+	for _, value := range src {
+		found := false
+		for _, existing := range dst {
+			if reflect.DeepEqual(existing, value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			dst = append(dst, value)
+		}
+	}
+	return dst
+}
+
+// openApiSetupHandlers sets up the handlers of the merged OpenAPI document
+// and of the Swagger UI
+func (s *RestGateway) openApiSetupHandlers(mux *http.ServeMux) error {
+	config := s.config.RestConfig.OpenApiConfig
+	if config.Authenticate && !s.config.Security.authEnabled() {
+		return fmt.Errorf("OpenAPI authentication requires authenticators")
+	}
+
+	documents, err := config.openApiDocuments()
+	if err != nil {
+		return err
+	}
+	document, err := mergeOpenApiDocuments(documents)
+	if err != nil {
+		return err
+	}
+
+	documentPath := config.Path
+	if documentPath == "" {
+		documentPath = defaultOpenApiPath
+	}
+	uiPath := config.SwaggerUIPath
+	if uiPath == "" {
+		uiPath = defaultSwaggerUIPath
+	}
+	if !strings.HasSuffix(uiPath, "/") {
+		uiPath += "/"
+	}
+
+	// Handler to return the merged document
+	var documentHandler http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(document)
+	})
+
+	// Handler to access the Swagger UI, which loads the merged document
+	uiFiles, err := fs.Sub(swaggerUIFiles, "swaggerui")
+	if err != nil {
+		return err
+	}
+	url, err := json.Marshal(documentPath)
+	if err != nil {
+		return err
+	}
+	initializer := []byte(fmt.Sprintf(swaggerUIInitializerFmt, url))
+	fileServer := http.FileServer(http.FS(uiFiles))
+	var uiHandler http.Handler = http.StripPrefix(uiPath, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == swaggerUIInitializer {
+			w.Header().Set("Content-Type", "text/javascript; charset=utf-8")
+			w.Write(initializer)
+			return
+		}
+		fileServer.ServeHTTP(w, r)
+	}))
+
+	if config.Authenticate {
+		documentHandler = s.authenticateHandler(documentHandler)
+		uiHandler = s.authenticateHandler(uiHandler)
+	}
+	mux.Handle(documentPath, documentHandler)
+	mux.Handle(uiPath, uiHandler)
+	return nil
+}
+
+// authenticateHandler serves the requests with a valid token from one of the
+// authenticators of the server
+func (s *RestGateway) authenticateHandler(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := metadata.NewIncomingContext(r.Context(), metadata.Pairs(
+			"authorization", r.Header.Get("Authorization"),
+			auth.APIKeyMetadataKey, r.Header.Get(auth.APIKeyMetadataKey)))
+		if s.grpcServer.currentSecurity().isGuest(ctx) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Missing authentication token", http.StatusUnauthorized)
+			return
+		}
+
+		_, err := s.grpcServer.auth(ctx)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Invalid authentication token", http.StatusUnauthorized)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,157 @@
+/*
+Copyright 2022 Pure Storage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/libopenstorage/grpc-framework/pkg/auth"
+)
+
+const (
+	testHelloOpenApi   = "../test/app/protos/apis/hello/apiv1/hello.swagger.json"
+	testExampleOpenApi = "../test/app/protos/apis/example/apiv1/example.swagger.json"
+)
+
+func testOpenApiDocuments(t *testing.T) ([]byte, fstest.MapFS) {
+	hello, err := os.ReadFile(testHelloOpenApi)
+	require.NoError(t, err)
+	example, err := os.ReadFile(testExampleOpenApi)
+	require.NoError(t, err)
+	return hello, fstest.MapFS{
+		"apiv1/example.swagger.json": &fstest.MapFile{Data: example},
+		"apiv1/README.md":            &fstest.MapFile{Data: []byte("not a document")},
+	}
+}
+
+func testGet(t *testing.T, url, token string) (int, []byte) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	require.NoError(t, err)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp.StatusCode, body
+}
+
+func TestMergeOpenApiDocuments(t *testing.T) {
+	merged, err := mergeOpenApiDocuments([][]byte{
+		[]byte(`{"openapi": "3.0.0", "info": {"title": "a"}, "tags": [{"name": "A"}],
+			"paths": {"/v1/a": {"get": {"operationId": "A_Get"}}},
+			"components": {"schemas": {"rpcStatus": {"type": "object"}, "A": {"type": "object"}}}}`),
+		[]byte(`{"openapi": "3.0.0", "info": {"title": "b"}, "tags": [{"name": "A"}, {"name": "B"}],
+			"paths": {"/v1/a": {"post": {"operationId": "A_Post"}}, "/v1/b": {"get": {"operationId": "B_Get"}}},
+			"components": {"schemas": {"rpcStatus": {"type": "string"}, "B": {"type": "object"}}}}`),
+	})
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"openapi": "3.0.0", "info": {"title": "a"}, "tags": [{"name": "A"}, {"name": "B"}],
+		"paths": {
+			"/v1/a": {"get": {"operationId": "A_Get"}, "post": {"operationId": "A_Post"}},
+			"/v1/b": {"get": {"operationId": "B_Get"}}},
+		"components": {"schemas": {"rpcStatus": {"type": "object"}, "A": {"type": "object"}, "B": {"type": "object"}}}}`,
+		string(merged))
+
+	_, err = mergeOpenApiDocuments([][]byte{[]byte(`{"openapi": "3.0.0"}`), []byte(`{"swagger": "2.0"}`)})
+	assert.Error(t, err)
+	_, err = mergeOpenApiDocuments([][]byte{[]byte(`{"openapi": "3.0.0"}`), []byte(`not json`)})
+	assert.Error(t, err)
+}
+
+func TestServerRestOpenApi(t *testing.T) {
+	hello, fsys := testOpenApiDocuments(t)
+	c := newDefaultConfig(t)
+	c.WithRestOpenApi(hello).WithRestOpenApiFS(fsys)
+	s := newTestServer(t, c)
+	defer s.Stop()
+
+	code, body := testGet(t, "http://localhost:9001/swagger.json", "")
+	assert.Equal(t, http.StatusOK, code)
+	var document struct {
+		Paths map[string]interface{} `json:"paths"`
+	}
+	require.NoError(t, json.Unmarshal(body, &document))
+	assert.Contains(t, document.Paths, "/v1/greeter:sayHello")
+	assert.Contains(t, document.Paths, "/v1/greeter:sayExample")
+
+	code, body = testGet(t, "http://localhost:9001/swagger-ui/", "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, string(body), "swagger-ui-bundle.js")
+
+	code, body = testGet(t, "http://localhost:9001/swagger-ui/swagger-initializer.js", "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, string(body), `url: "/swagger.json"`)
+
+	code, _ = testGet(t, "http://localhost:9001/swagger-ui/swagger-ui-bundle.js", "")
+	assert.Equal(t, http.StatusOK, code)
+}
+
+func TestServerRestOpenApiAuthentication(t *testing.T) {
+	hello, _ := testOpenApiDocuments(t)
+	authenticator, err := auth.NewJwtAuthenticator(&auth.JwtAuthConfig{
+		SharedSecret: []byte(testSharedSecret),
+	})
+	require.NoError(t, err)
+
+	c := newDefaultConfig(t)
+	c.Security = &SecurityConfig{
+		Authenticators: map[string]auth.Authenticator{
+			"testissuer": authenticator,
+		},
+	}
+	c.RestConfig.OpenApiConfig.Path = "/docs/openapi.json"
+	c.RestConfig.OpenApiConfig.SwaggerUIPath = "/docs/ui"
+	c.WithDefaultGenericRoleManager().
+		WithRestOpenApi(hello).
+		WithRestOpenApiAuthentication()
+	s := newTestServer(t, c)
+	defer s.Stop()
+
+	code, _ := testGet(t, "http://localhost:9001/docs/openapi.json", "")
+	assert.Equal(t, http.StatusUnauthorized, code)
+	code, _ = testGet(t, "http://localhost:9001/docs/ui/", "")
+	assert.Equal(t, http.StatusUnauthorized, code)
+	code, _ = testGet(t, "http://localhost:9001/docs/openapi.json", testToken(t, "otherissuer", "jim", nil))
+	assert.Equal(t, http.StatusUnauthorized, code)
+
+	token := testToken(t, "testissuer", "jim", nil)
+	code, _ = testGet(t, "http://localhost:9001/docs/openapi.json", token)
+	assert.Equal(t, http.StatusOK, code)
+	code, body := testGet(t, "http://localhost:9001/docs/ui/swagger-initializer.js", token)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, string(body), `url: "/docs/openapi.json"`)
+}
+
+func TestServerRestOpenApiAuthenticationWithoutAuthenticators(t *testing.T) {
+	hello, _ := testOpenApiDocuments(t)
+	c := newDefaultConfig(t)
+	c.WithRestOpenApi(hello).WithRestOpenApiAuthentication()
+
+	s, err := New(c)
+	require.NoError(t, err)
+	assert.Error(t, s.Start())
+}
@@ -15,8 +15,315 @@ limitations under the License.
 */
 package server
 
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/libopenstorage/grpc-framework/pkg/auth"
+	grpcerrors "github.com/libopenstorage/grpc-framework/pkg/grpc/errors"
+	"golang.org/x/time/rate"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+const (
+	// RetryAfterMetadataKey is the key in the response header metadata which
+	// holds the number of seconds a client should wait before retrying a
+	// request which was rejected by a rate limiter.
+	RetryAfterMetadataKey = "retry-after"
+
+	// Default time after which an unused per user rate limiter is removed
+	defaultPerUserIdleTimeout = 10 * time.Minute
+	// Default maximum number of per user rate limiters
+	defaultPerUserMaxUsers = 10000
+
+	// QuotaFailure subjects of the requests rejected by the rate limiters
+	rateLimiterClientsSubject    = "clients"
+	rateLimiterUserSubjectPrefix = "user:"
+
+	// Prefix of the keys of the per user rate limiters of the clients which
+	// are not authenticated
+	rateLimiterPeerPrefix = "peer:"
+	// Metadata key of the client addresses forwarded by the REST gateway
+	restForwardedForMetadataKey = "x-forwarded-for"
+)
+
+// rateLimitedError returns the error of a request rejected by a rate limiter,
+// with the QuotaFailure, RetryInfo and ErrorInfo details
+func rateLimitedError(msg, subject string, retryDelay time.Duration) error {
+	return grpcerrors.WithErrorInfo(
+		grpcerrors.ResourceExhausted(msg, retryDelay, grpcerrors.QuotaViolation(subject, msg)),
+		grpcerrors.ReasonRateLimited, grpcerrors.Domain, nil)
+}
+
 // RateLimiter provides an interace which can be executed using
 // golang.org/x/time/rate.Limter or a customer Limiter
 type RateLimiter interface {
 	Allow() bool
 }
+
+// RateLimiterFactory can be implemented by a custom RateLimiter set as the
+// per user rate limiter. It is called to create a new RateLimiter for each user.
+// A golang.org/x/time/rate.Limiter does not need to implement this interface since
+// the per user limiters are created using its limit and burst values.
+type RateLimiterFactory interface {
+	NewRateLimiter() RateLimiter
+}
+
+// rateLimiterTemplate is satisfied by golang.org/x/time/rate.Limiter
+type rateLimiterTemplate interface {
+	Limit() rate.Limit
+	Burst() int
+}
+
+type userRateLimiter struct {
+	limiter  RateLimiter
+	lastSeen time.Time
+}
+
+// perUserRateLimiter keeps a rate limiter for each user. Limiters are created
+// on the first request from a user and are evicted after being idle, or when
+// there are too many users, starting with the least recently seen.
+type perUserRateLimiter struct {
+	lock        sync.Mutex
+	newLimiter  func() RateLimiter
+	idleTimeout time.Duration
+	maxUsers    int
+	lastSweep   time.Time
+	users       map[string]*userRateLimiter
+
+	// now can be overridden for testing
+	now func() time.Time
+}
+
+func newPerUserRateLimiter(
+	template RateLimiter,
+	idleTimeout time.Duration,
+	maxUsers int,
+) (*perUserRateLimiter, error) {
+	var newLimiter func() RateLimiter
+	switch t := template.(type) {
+	case RateLimiterFactory:
+		newLimiter = t.NewRateLimiter
+	case rateLimiterTemplate:
+		newLimiter = func() RateLimiter {
+			return rate.NewLimiter(t.Limit(), t.Burst())
+		}
+	default:
+		return nil, fmt.Errorf("per user rate limiter of type %T must be a rate.Limiter or implement RateLimiterFactory", template)
+	}
+
+	if idleTimeout == 0 {
+		idleTimeout = defaultPerUserIdleTimeout
+	}
+	if maxUsers == 0 {
+		maxUsers = defaultPerUserMaxUsers
+	}
+
+	return &perUserRateLimiter{
+		newLimiter:  newLimiter,
+		idleTimeout: idleTimeout,
+		maxUsers:    maxUsers,
+		users:       make(map[string]*userRateLimiter),
+		now:         time.Now,
+	}, nil
+}
+
+// allow returns true if the user is allowed to continue. If not, it returns
+// the time the user should wait before trying again.
+func (p *perUserRateLimiter) allow(username string) (bool, time.Duration) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	now := p.now()
+	p.evictIdle(now)
+
+	u, ok := p.users[username]
+	if !ok {
+		if len(p.users) >= p.maxUsers {
+			p.evictLeastRecentlySeen(now)
+		}
+		u = &userRateLimiter{
+			limiter: p.newLimiter(),
+		}
+		p.users[username] = u
+	}
+	u.lastSeen = now
+
+	// Use a reservation when possible to determine when the user can retry
+	if l, ok := u.limiter.(*rate.Limiter); ok {
+		r := l.ReserveN(now, 1)
+		if !r.OK() {
+			return false, time.Second
+		}
+		if delay := r.DelayFrom(now); delay > 0 {
+			r.CancelAt(now)
+			return false, delay
+		}
+		return true, 0
+	}
+
+	if u.limiter.Allow() {
+		return true, 0
+	}
+	return false, time.Second
+}
+
+// evictIdle removes the limiters which have not been used for idleTimeout.
+// Lock must be held.
+func (p *perUserRateLimiter) evictIdle(now time.Time) {
+	if now.Sub(p.lastSweep) < p.idleTimeout {
+		return
+	}
+	for username, u := range p.users {
+		if now.Sub(u.lastSeen) >= p.idleTimeout {
+			delete(p.users, username)
+		}
+	}
+	p.lastSweep = now
+}
+
+// evictLeastRecentlySeen makes room for a new user by removing the idle
+// limiters, or else the least recently seen limiter. Lock must be held.
+func (p *perUserRateLimiter) evictLeastRecentlySeen(now time.Time) {
+	p.lastSweep = time.Time{}
+	p.evictIdle(now)
+	if len(p.users) < p.maxUsers {
+		return
+	}
+
+	var oldest string
+	var oldestSeen time.Time
+	for username, u := range p.users {
+		if oldest == "" || u.lastSeen.Before(oldestSeen) {
+			oldest, oldestSeen = username, u.lastSeen
+		}
+	}
+	delete(p.users, oldest)
+}
+
+func (p *perUserRateLimiter) len() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return len(p.users)
+}
+
+// rateLimiterUsername returns the key of the per user rate limiters. If the
+// request has been authenticated, the username is used. Guests, and clients
+// of servers which do not authenticate requests, are keyed by the address of
+// their host. An empty string is returned if there is neither.
+func rateLimiterUsername(ctx context.Context) string {
+	if userinfo, ok := auth.NewUserInfoFromContext(ctx); ok && !userinfo.Guest {
+		return userinfo.Username
+	}
+
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return ""
+	}
+	addr := p.Addr.String()
+	if isLocalPeer(p.Addr) {
+		// Requests from the REST gateway all come from the same local
+		// peer. Use the address of the client as seen by the gateway.
+		if forwarded := forwardedFor(ctx); forwarded != "" {
+			addr = forwarded
+		}
+	}
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	return rateLimiterPeerPrefix + addr
+}
+
+// isLocalPeer returns true if the peer is connected through the unix domain
+// socket or the in-memory connection, as the REST gateway is
+func isLocalPeer(addr net.Addr) bool {
+	switch addr.Network() {
+	case "unix", "bufconn":
+		return true
+	}
+	return false
+}
+
+// forwardedFor returns the address of the client forwarded by the REST
+// gateway. The gateway appends the address it received the request from to
+// the X-Forwarded-For values of the request, so only the last one is used
+// since the others are set by the client.
+func forwardedFor(ctx context.Context) string {
+	values := metadata.ValueFromIncomingContext(ctx, restForwardedForMetadataKey)
+	if len(values) == 0 {
+		return ""
+	}
+	addrs := strings.Split(values[len(values)-1], ",")
+	return strings.TrimSpace(addrs[len(addrs)-1])
+}
+
+// perUserLimiterFor returns the per user rate limiter for the method or
+// nil if the method is not limited per user.
+func (s *GrpcFrameworkServer) perUserLimiterFor(fullMethod string) *perUserRateLimiter {
+	if policy := s.rateLimiterPolicies.match(fullMethod); policy != nil {
+		return policy.perUser
+	}
+	return s.perUserLimiter
+}
+
+func (s *GrpcFrameworkServer) perUserLimiterAllow(ctx context.Context, fullMethod string) error {
+	limiter := s.perUserLimiterFor(fullMethod)
+	if limiter == nil {
+		return nil
+	}
+
+	username := rateLimiterUsername(ctx)
+	if username == "" {
+		return nil
+	}
+
+	allowed, retryAfter := limiter.allow(username)
+	if allowed {
+		return nil
+	}
+
+	seconds := int64(math.Ceil(retryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	grpc.SetHeader(ctx, metadata.Pairs(RetryAfterMetadataKey, strconv.FormatInt(seconds, 10)))
+	return rateLimitedError(
+		fmt.Sprintf("resources for user %s exhausted", username),
+		rateLimiterUserSubjectPrefix+username,
+		time.Duration(seconds)*time.Second)
+}
+
+func (s *GrpcFrameworkServer) rateLimiterPerUserUnaryInterceptor(
+	ctx context.Context,
+	req interface{},
+	info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler,
+) (interface{}, error) {
+	if err := s.perUserLimiterAllow(ctx, info.FullMethod); err != nil {
+		return nil, err
+	}
+
+	return handler(ctx, req)
+}
+
+func (s *GrpcFrameworkServer) rateLimiterPerUserStreamInterceptor(
+	srv interface{},
+	stream grpc.ServerStream,
+	info *grpc.StreamServerInfo,
+	handler grpc.StreamHandler,
+) error {
+	if err := s.perUserLimiterAllow(stream.Context(), info.FullMethod); err != nil {
+		return err
+	}
+
+	return handler(srv, stream)
+}
@@ -0,0 +1,156 @@
+/*
+Copyright 2022 Pure Storage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package server
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/libopenstorage/grpc-framework/pkg/auth/role"
+	"golang.org/x/time/rate"
+	"google.golang.org/grpc"
+)
+
+// RateLimiterPolicy sets the rate limits for the gRPC methods matching the
+// pattern of the policy. Methods matching a policy are limited by the policy
+// instead of the global and per user rate limiters.
+type RateLimiterPolicy struct {
+	// Rate is the number of requests per second allowed for all the callers.
+	// If Rate is 0, requests are not limited globally.
+	Rate rate.Limit
+	// Burst is the maximum number of requests allowed at once for all the callers.
+	// It must be positive if Rate is set.
+	Burst int
+	// PerUserRate is the number of requests per second allowed for each user.
+	// If PerUserRate is 0, requests are not limited per user.
+	PerUserRate rate.Limit
+	// PerUserBurst is the maximum number of requests allowed at once for each user.
+	// It must be positive if PerUserRate is set.
+	PerUserBurst int
+}
+
+type rateLimiterPolicy struct {
+	pattern string
+	limiter RateLimiter
+	perUser *perUserRateLimiter
+}
+
+// rateLimiterPolicies selects the policy for a gRPC method
+type rateLimiterPolicies struct {
+	policies []*rateLimiterPolicy
+
+	// methods caches the policy for each method registered in the gRPC
+	// server. Methods without a policy are stored with a nil policy. Other
+	// methods are not cached, since their names come from the clients.
+	methods sync.Map
+}
+
+func newRateLimiterPolicies(
+	policies map[string]RateLimiterPolicy,
+	perUserIdleTimeout time.Duration,
+	perUserMaxUsers int,
+) (*rateLimiterPolicies, error) {
+	p := &rateLimiterPolicies{}
+	for pattern, policy := range policies {
+		if len(pattern) == 0 {
+			return nil, fmt.Errorf("rate limiter policy pattern cannot be empty")
+		}
+
+		if policy.Rate != 0 && policy.Burst <= 0 {
+			return nil, fmt.Errorf("rate limiter policy %s must have a positive burst", pattern)
+		}
+		if policy.PerUserRate != 0 && policy.PerUserBurst <= 0 {
+			return nil, fmt.Errorf("rate limiter policy %s must have a positive per user burst", pattern)
+		}
+
+		rp := &rateLimiterPolicy{
+			pattern: pattern,
+		}
+		if policy.Rate != 0 {
+			rp.limiter = rate.NewLimiter(policy.Rate, policy.Burst)
+		}
+		if policy.PerUserRate != 0 {
+			var err error
+			rp.perUser, err = newPerUserRateLimiter(
+				rate.NewLimiter(policy.PerUserRate, policy.PerUserBurst),
+				perUserIdleTimeout,
+				perUserMaxUsers)
+			if err != nil {
+				return nil, err
+			}
+		}
+		p.policies = append(p.policies, rp)
+	}
+
+	sort.Slice(p.policies, func(i, j int) bool {
+		return moreSpecificPattern(p.policies[i].pattern, p.policies[j].pattern)
+	})
+
+	return p, nil
+}
+
+// moreSpecificPattern returns true if the method pattern pi must be checked
+// before pj. Most specific patterns are checked first: patterns without
+// wildcards, then by the length of the pattern without wildcards.
+func moreSpecificPattern(pi, pj string) bool {
+	iExact, jExact := !strings.Contains(pi, "*"), !strings.Contains(pj, "*")
+	if iExact != jExact {
+		return iExact
+	}
+	li, lj := len(strings.ReplaceAll(pi, "*", "")), len(strings.ReplaceAll(pj, "*", ""))
+	if li != lj {
+		return li > lj
+	}
+	return pi < pj
+}
+
+// match returns the policy for the full method or nil if none matches
+func (p *rateLimiterPolicies) match(fullMethod string) *rateLimiterPolicy {
+	if p == nil {
+		return nil
+	}
+	if v, ok := p.methods.Load(fullMethod); ok {
+		return v.(*rateLimiterPolicy)
+	}
+
+	return p.find(fullMethod)
+}
+
+// find returns the first policy matching the full method
+func (p *rateLimiterPolicies) find(fullMethod string) *rateLimiterPolicy {
+	for _, rp := range p.policies {
+		if role.MatchRule(rp.pattern, fullMethod) {
+			return rp
+		}
+	}
+	return nil
+}
+
+// register caches the policies of the methods registered in the gRPC server
+func (p *rateLimiterPolicies) register(grpcServer *grpc.Server) {
+	if p == nil {
+		return
+	}
+	for service, info := range grpcServer.GetServiceInfo() {
+		for _, method := range info.Methods {
+			fullMethod := "/" + service + "/" + method.Name
+			p.methods.Store(fullMethod, p.find(fullMethod))
+		}
+	}
+}
@@ -0,0 +1,100 @@
+/*
+Copyright 2022 Pure Storage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package server
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+
+	appserver "github.com/libopenstorage/grpc-framework/test/app/pkg/server"
+	appapi "github.com/libopenstorage/grpc-framework/test/app/protos/apis/hello/apiv1"
+)
+
+func TestRateLimiterPoliciesMatch(t *testing.T) {
+	p, err := newRateLimiterPolicies(map[string]RateLimiterPolicy{
+		"*":                                        {Rate: 100, Burst: 100},
+		"/hello.hello.v1.HelloIdentity/*":          {Rate: 50, Burst: 50},
+		"/hello.hello.v1.HelloGreeter/*":           {PerUserRate: 1, PerUserBurst: 1},
+		"/hello.hello.v1.HelloGreeter/SayHello":    {Rate: 1, Burst: 1},
+		"/hello.hello.v1.HelloGreeter/SayGoodbye*": {Rate: 2, Burst: 2},
+	}, 0, 0)
+	assert.NoError(t, err)
+
+	tests := []struct {
+		method  string
+		pattern string
+	}{
+		{"/hello.hello.v1.HelloGreeter/SayHello", "/hello.hello.v1.HelloGreeter/SayHello"},
+		{"/hello.hello.v1.HelloGreeter/SayGoodbyeNow", "/hello.hello.v1.HelloGreeter/SayGoodbye*"},
+		{"/hello.hello.v1.HelloGreeter/Other", "/hello.hello.v1.HelloGreeter/*"},
+		{"/hello.hello.v1.HelloIdentity/ServerVersion", "/hello.hello.v1.HelloIdentity/*"},
+		{"/other.Service/Method", "*"},
+	}
+	for _, test := range tests {
+		// Check twice to also check the cached value
+		for i := 0; i < 2; i++ {
+			policy := p.match(test.method)
+			assert.NotNil(t, policy, test.method)
+			assert.Equal(t, test.pattern, policy.pattern, test.method)
+		}
+	}
+
+	policy := p.match("/hello.hello.v1.HelloGreeter/Other")
+	assert.Nil(t, policy.limiter)
+	assert.NotNil(t, policy.perUser)
+
+	policy = p.match("/hello.hello.v1.HelloGreeter/SayHello")
+	assert.NotNil(t, policy.limiter)
+	assert.Nil(t, policy.perUser)
+	assert.True(t, policy.limiter.Allow())
+	assert.False(t, policy.limiter.Allow())
+
+	p, err = newRateLimiterPolicies(map[string]RateLimiterPolicy{
+		"/hello.hello.v1.HelloIdentity/*": {Rate: 50, Burst: 50},
+	}, 0, 0)
+	assert.NoError(t, err)
+	assert.Nil(t, p.match("/hello.hello.v1.HelloGreeter/SayHello"))
+
+	// Only the methods registered in the gRPC server are cached
+	gs := grpc.NewServer()
+	appapi.RegisterHelloGreeterServer(gs, &appserver.HelloGreeter{})
+	p.register(gs)
+	_, ok := p.methods.Load("/hello.hello.v1.HelloGreeter/SayHello")
+	assert.True(t, ok)
+	assert.Nil(t, p.match("/hello.hello.v1.HelloGreeter/Unknown"))
+	_, ok = p.methods.Load("/hello.hello.v1.HelloGreeter/Unknown")
+	assert.False(t, ok)
+
+	var nilPolicies *rateLimiterPolicies
+	assert.Nil(t, nilPolicies.match("/hello.hello.v1.HelloGreeter/SayHello"))
+
+	_, err = newRateLimiterPolicies(map[string]RateLimiterPolicy{
+		"": {Rate: 50, Burst: 50},
+	}, 0, 0)
+	assert.Error(t, err)
+
+	// A zero burst would reject every request
+	_, err = newRateLimiterPolicies(map[string]RateLimiterPolicy{
+		"*": {Rate: 50},
+	}, 0, 0)
+	assert.Error(t, err)
+	_, err = newRateLimiterPolicies(map[string]RateLimiterPolicy{
+		"*": {PerUserRate: 50},
+	}, 0, 0)
+	assert.Error(t, err)
+}
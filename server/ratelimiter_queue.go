@@ -0,0 +1,379 @@
+/*
+Copyright 2022 Pure Storage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package server
+
+import (
+	"container/heap"
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/grpc-ecosystem/go-grpc-middleware/util/metautils"
+	"github.com/libopenstorage/grpc-framework/pkg/auth"
+	"github.com/libopenstorage/grpc-framework/pkg/auth/role"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/time/rate"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// Default maximum time a request waits in the rate limiter queue
+	defaultRateLimiterQueueMaxWait = 10 * time.Second
+	// Default maximum number of requests waiting in the rate limiter queue
+	defaultRateLimiterQueueMaxDepth = 1000
+	// Time to wait before checking a custom rate limiter again
+	rateLimiterQueuePollInterval = 5 * time.Millisecond
+)
+
+var (
+	rateLimiterQueueDepth = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "grpc_framework_ratelimiter_queue_depth",
+		Help: "Number of requests waiting in the rate limiter priority queue.",
+	}, []string{"server"})
+	rateLimiterQueueWait = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "grpc_framework_ratelimiter_queue_wait_seconds",
+		Help:    "Time requests waited in the rate limiter priority queue, by result: allowed, rejected, timeout or canceled.",
+		Buckets: []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
+	}, []string{"server", "priority", "result"})
+)
+
+func init() {
+	prometheus.MustRegister(rateLimiterQueueDepth, rateLimiterQueueWait)
+}
+
+// RateLimiterQueueConfig configures the global rate limiter to queue the
+// requests over the limit instead of rejecting them. Queued requests are
+// released by priority, highest first, and wait up to their deadline or MaxWait,
+// whichever comes first. The queue requires the global RateLimiter.
+//
+// The priority of a request is the highest value found from its roles, its method
+// and the metadata header. Requests without a priority get DefaultPriority.
+// Priorities are clamped between MinPriority and MaxPriority.
+type RateLimiterQueueConfig struct {
+	Enabled bool
+	// MaxWait is the maximum time a request waits in the queue.
+	// Defaults to 10s if not provided.
+	MaxWait time.Duration
+	// MaxDepth is the maximum number of requests waiting in the queue.
+	// Requests are rejected when the queue is full. Defaults to 1000.
+	MaxDepth int
+	// DefaultPriority is the priority of requests which do not match any
+	// of the priority configurations below.
+	DefaultPriority int
+	// RolePriorities maps a role name to a priority
+	RolePriorities map[string]int
+	// MethodPriorities maps a gRPC full method to a priority. The key can
+	// use the wildcard patterns supported by role.MatchRule, for example:
+	// "/hello.hello.v1.HelloIdentity/*".
+	MethodPriorities map[string]int
+	// PriorityMetadataKey is the metadata header with the priority of the
+	// request as an integer. The value is trusted, therefore only set it
+	// when the clients are trusted.
+	PriorityMetadataKey string
+	// PriorityFunc, if set, overrides all other priority configurations
+	PriorityFunc func(ctx context.Context, fullMethod string) int
+	// MinPriority and MaxPriority are the range of the priorities, which
+	// bounds the priorities sent by the clients. If both are 0, the range
+	// goes from the lowest to the highest of DefaultPriority,
+	// RolePriorities and MethodPriorities.
+	MinPriority int
+	MaxPriority int
+}
+
+// priorityRange returns the lowest and highest priorities of the requests
+func (c *RateLimiterQueueConfig) priorityRange() (int, int) {
+	if c.MinPriority != 0 || c.MaxPriority != 0 {
+		return c.MinPriority, c.MaxPriority
+	}
+
+	lowest, highest := c.DefaultPriority, c.DefaultPriority
+	for _, priorities := range []map[string]int{c.RolePriorities, c.MethodPriorities} {
+		for _, p := range priorities {
+			if p < lowest {
+				lowest = p
+			}
+			if p > highest {
+				highest = p
+			}
+		}
+	}
+	return lowest, highest
+}
+
+// priority returns the priority of the request, within the priority range
+func (c *RateLimiterQueueConfig) priority(ctx context.Context, fullMethod string) int {
+	lowest, highest := c.priorityRange()
+	priority := c.requestPriority(ctx, fullMethod)
+	if priority < lowest {
+		return lowest
+	}
+	if priority > highest {
+		return highest
+	}
+	return priority
+}
+
+// requestPriority returns the priority of the request from the configuration
+func (c *RateLimiterQueueConfig) requestPriority(ctx context.Context, fullMethod string) int {
+	if c.PriorityFunc != nil {
+		return c.PriorityFunc(ctx, fullMethod)
+	}
+
+	found := false
+	priority := c.DefaultPriority
+	use := func(p int) {
+		if !found || p > priority {
+			priority = p
+			found = true
+		}
+	}
+
+	if userinfo, ok := auth.NewUserInfoFromContext(ctx); ok {
+		for _, r := range userinfo.Claims.Roles {
+			if p, ok := c.RolePriorities[r]; ok {
+				use(p)
+			}
+		}
+	}
+	for pattern, p := range c.MethodPriorities {
+		if role.MatchRule(pattern, fullMethod) {
+			use(p)
+		}
+	}
+	if c.PriorityMetadataKey != "" {
+		if v := metautils.ExtractIncoming(ctx).Get(c.PriorityMetadataKey); v != "" {
+			if p, err := strconv.Atoi(v); err == nil {
+				use(p)
+			}
+		}
+	}
+
+	return priority
+}
+
+type rateLimiterWaiter struct {
+	priority int
+	seq      uint64
+	index    int
+	granted  bool
+	ready    chan struct{}
+}
+
+// rateLimiterWaiters is a heap of waiters ordered by priority and then arrival
+type rateLimiterWaiters []*rateLimiterWaiter
+
+func (w rateLimiterWaiters) Len() int { return len(w) }
+
+func (w rateLimiterWaiters) Less(i, j int) bool {
+	if w[i].priority != w[j].priority {
+		return w[i].priority > w[j].priority
+	}
+	return w[i].seq < w[j].seq
+}
+
+func (w rateLimiterWaiters) Swap(i, j int) {
+	w[i], w[j] = w[j], w[i]
+	w[i].index = i
+	w[j].index = j
+}
+
+func (w *rateLimiterWaiters) Push(x interface{}) {
+	waiter := x.(*rateLimiterWaiter)
+	waiter.index = len(*w)
+	*w = append(*w, waiter)
+}
+
+func (w *rateLimiterWaiters) Pop() interface{} {
+	old := *w
+	n := len(old)
+	waiter := old[n-1]
+	old[n-1] = nil
+	waiter.index = -1
+	*w = old[:n-1]
+	return waiter
+}
+
+// priorityQueueRateLimiter queues the requests which are over the limit of
+// a RateLimiter and releases them by priority as the limiter allows.
+type priorityQueueRateLimiter struct {
+	lock       sync.Mutex
+	name       string
+	limiter    RateLimiter
+	config     RateLimiterQueueConfig
+	waiters    rateLimiterWaiters
+	seq        uint64
+	dispatcher bool
+}
+
+func newPriorityQueueRateLimiter(
+	name string,
+	limiter RateLimiter,
+	config RateLimiterQueueConfig,
+) *priorityQueueRateLimiter {
+	if config.MaxWait == 0 {
+		config.MaxWait = defaultRateLimiterQueueMaxWait
+	}
+	if config.MaxDepth == 0 {
+		config.MaxDepth = defaultRateLimiterQueueMaxDepth
+	}
+	return &priorityQueueRateLimiter{
+		name:    name,
+		limiter: limiter,
+		config:  config,
+	}
+}
+
+// wait blocks until the request is allowed by the rate limiter or it
+// has waited for too long.
+func (q *priorityQueueRateLimiter) wait(ctx context.Context, fullMethod string) error {
+	priority := q.config.priority(ctx, fullMethod)
+
+	q.lock.Lock()
+	// Only bypass the queue if nobody is waiting
+	if len(q.waiters) == 0 && q.limiter.Allow() {
+		q.lock.Unlock()
+		return nil
+	}
+	if len(q.waiters) >= q.config.MaxDepth {
+		q.lock.Unlock()
+		q.observe(priority, "rejected", 0)
+		return rateLimitedError("resources for clients exhausted, rate limiter queue is full", rateLimiterClientsSubject, 0)
+	}
+	w := &rateLimiterWaiter{
+		priority: priority,
+		seq:      q.seq,
+		ready:    make(chan struct{}),
+	}
+	q.seq++
+	heap.Push(&q.waiters, w)
+	rateLimiterQueueDepth.WithLabelValues(q.name).Set(float64(len(q.waiters)))
+	if !q.dispatcher {
+		q.dispatcher = true
+		go q.dispatch()
+	}
+	q.lock.Unlock()
+
+	ts := time.Now()
+	timer := time.NewTimer(q.config.MaxWait)
+	defer timer.Stop()
+
+	var err error
+	result := "timeout"
+	select {
+	case <-w.ready:
+		q.observe(priority, "allowed", time.Since(ts))
+		return nil
+	case <-timer.C:
+		err = rateLimitedError("resources for clients exhausted, timed out in rate limiter queue", rateLimiterClientsSubject, 0)
+	case <-ctx.Done():
+		err = status.FromContextError(ctx.Err()).Err()
+		if ctx.Err() == context.Canceled {
+			result = "canceled"
+		}
+	}
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	// The dispatcher may have allowed the request just as we gave up
+	if w.granted {
+		q.observe(priority, "allowed", time.Since(ts))
+		return nil
+	}
+	heap.Remove(&q.waiters, w.index)
+	rateLimiterQueueDepth.WithLabelValues(q.name).Set(float64(len(q.waiters)))
+	q.observe(priority, result, time.Since(ts))
+	return err
+}
+
+// dispatch releases the waiters in priority order as allowed by the limiter.
+// It returns once the queue is empty.
+func (q *priorityQueueRateLimiter) dispatch() {
+	for {
+		q.lock.Lock()
+		if len(q.waiters) == 0 {
+			q.dispatcher = false
+			q.lock.Unlock()
+			return
+		}
+		if q.limiter.Allow() {
+			w := heap.Pop(&q.waiters).(*rateLimiterWaiter)
+			w.granted = true
+			close(w.ready)
+			rateLimiterQueueDepth.WithLabelValues(q.name).Set(float64(len(q.waiters)))
+			q.lock.Unlock()
+			continue
+		}
+		q.lock.Unlock()
+
+		time.Sleep(q.nextTokenDelay())
+	}
+}
+
+// nextTokenDelay returns the time until the limiter may allow another request
+func (q *priorityQueueRateLimiter) nextTokenDelay() time.Duration {
+	if l, ok := q.limiter.(*rate.Limiter); ok {
+		r := l.Reserve()
+		if r.OK() {
+			delay := r.Delay()
+			r.Cancel()
+			if delay > 0 {
+				return delay
+			}
+		}
+	}
+	return rateLimiterQueuePollInterval
+}
+
+func (q *priorityQueueRateLimiter) observe(priority int, result string, d time.Duration) {
+	rateLimiterQueueWait.
+		WithLabelValues(q.name, strconv.Itoa(priority), result).
+		Observe(d.Seconds())
+}
+
+func (s *GrpcFrameworkServer) rateLimiterQueueUnaryInterceptor(
+	ctx context.Context,
+	req interface{},
+	info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler,
+) (interface{}, error) {
+	// Methods with a policy are limited in the tap handle
+	if s.rateLimiterPolicies.match(info.FullMethod) == nil {
+		if err := s.rateLimiterQueue.wait(ctx, info.FullMethod); err != nil {
+			return nil, err
+		}
+	}
+
+	return handler(ctx, req)
+}
+
+func (s *GrpcFrameworkServer) rateLimiterQueueStreamInterceptor(
+	srv interface{},
+	stream grpc.ServerStream,
+	info *grpc.StreamServerInfo,
+	handler grpc.StreamHandler,
+) error {
+	// Methods with a policy are limited in the tap handle
+	if s.rateLimiterPolicies.match(info.FullMethod) == nil {
+		if err := s.rateLimiterQueue.wait(stream.Context(), info.FullMethod); err != nil {
+			return err
+		}
+	}
+
+	return handler(srv, stream)
+}
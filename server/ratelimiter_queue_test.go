@@ -0,0 +1,225 @@
+/*
+Copyright 2022 Pure Storage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package server
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/libopenstorage/grpc-framework/pkg/auth"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+type testTokenLimiter struct {
+	lock   sync.Mutex
+	tokens int
+}
+
+func (l *testTokenLimiter) Allow() bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.tokens > 0 {
+		l.tokens--
+		return true
+	}
+	return false
+}
+
+func (l *testTokenLimiter) add(n int) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.tokens += n
+}
+
+func (q *priorityQueueRateLimiter) depth() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	return len(q.waiters)
+}
+
+func TestPriorityQueueRateLimiterOrder(t *testing.T) {
+	limiter := &testTokenLimiter{}
+	q := newPriorityQueueRateLimiter("test", limiter, RateLimiterQueueConfig{
+		Enabled:             true,
+		PriorityMetadataKey: "priority",
+		MaxPriority:         10,
+	})
+
+	withPriority := func(p string) context.Context {
+		return metadata.NewIncomingContext(context.Background(), metadata.Pairs("priority", p))
+	}
+
+	var (
+		lock  sync.Mutex
+		order []string
+		wg    sync.WaitGroup
+	)
+	enqueue := func(name, priority string) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := q.wait(withPriority(priority), "/test/method")
+			assert.NoError(t, err)
+			lock.Lock()
+			order = append(order, name)
+			lock.Unlock()
+		}()
+	}
+
+	// Queue low priority requests first
+	enqueue("low1", "1")
+	assert.Eventually(t, func() bool { return q.depth() == 1 }, time.Second, time.Millisecond)
+	enqueue("low2", "1")
+	assert.Eventually(t, func() bool { return q.depth() == 2 }, time.Second, time.Millisecond)
+	enqueue("high", "10")
+	assert.Eventually(t, func() bool { return q.depth() == 3 }, time.Second, time.Millisecond)
+
+	// Release one at a time
+	for i := 1; i <= 3; i++ {
+		limiter.add(1)
+		assert.Eventually(t, func() bool { return q.depth() == 3-i }, time.Second, time.Millisecond)
+	}
+	wg.Wait()
+	assert.Equal(t, []string{"high", "low1", "low2"}, order)
+}
+
+func TestPriorityQueueRateLimiterTimeout(t *testing.T) {
+	limiter := &testTokenLimiter{tokens: 1}
+	q := newPriorityQueueRateLimiter("test", limiter, RateLimiterQueueConfig{
+		Enabled:  true,
+		MaxWait:  10 * time.Millisecond,
+		MaxDepth: 1,
+	})
+
+	// Allowed without waiting
+	assert.NoError(t, q.wait(context.Background(), "/test/method"))
+
+	// Times out in the queue
+	err := q.wait(context.Background(), "/test/method")
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+	assert.Equal(t, 0, q.depth())
+
+	// Deadline reached before MaxWait
+	q.config.MaxWait = time.Minute
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err = q.wait(ctx, "/test/method")
+	assert.Equal(t, codes.DeadlineExceeded, status.Code(err))
+	assert.Equal(t, 0, q.depth())
+
+	// Queue is full
+	done := make(chan error)
+	go func() {
+		done <- q.wait(context.Background(), "/test/method")
+	}()
+	assert.Eventually(t, func() bool { return q.depth() == 1 }, time.Second, time.Millisecond)
+	err = q.wait(context.Background(), "/test/method")
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+	assert.Contains(t, err.Error(), "queue is full")
+
+	limiter.add(1)
+	assert.NoError(t, <-done)
+}
+
+func testRateLimiterQueueWaits(t *testing.T, name, result string) uint64 {
+	m := &dto.Metric{}
+	require.NoError(t, rateLimiterQueueWait.WithLabelValues(name, "0", result).(prometheus.Histogram).Write(m))
+	return m.GetHistogram().GetSampleCount()
+}
+
+func TestPriorityQueueRateLimiterCanceled(t *testing.T) {
+	limiter := &testTokenLimiter{}
+	q := newPriorityQueueRateLimiter("testcanceled", limiter, RateLimiterQueueConfig{
+		Enabled: true,
+		MaxWait: time.Minute,
+	})
+
+	canceled := testRateLimiterQueueWaits(t, "testcanceled", "canceled")
+	timeout := testRateLimiterQueueWaits(t, "testcanceled", "timeout")
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- q.wait(ctx, "/test/method")
+	}()
+	assert.Eventually(t, func() bool { return q.depth() == 1 }, time.Second, time.Millisecond)
+	cancel()
+	assert.Equal(t, codes.Canceled, status.Code(<-done))
+	assert.Equal(t, 0, q.depth())
+	assert.Equal(t, canceled+1, testRateLimiterQueueWaits(t, "testcanceled", "canceled"))
+	assert.Equal(t, timeout, testRateLimiterQueueWaits(t, "testcanceled", "timeout"))
+}
+
+func TestRateLimiterQueueRequiresRateLimiter(t *testing.T) {
+	c := newDefaultConfig(t)
+	c.WithRateLimiterQueue(RateLimiterQueueConfig{})
+	_, err := New(c)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "requires a global rate limiter")
+}
+
+func TestRateLimiterQueuePriority(t *testing.T) {
+	c := &RateLimiterQueueConfig{
+		DefaultPriority: 1,
+		RolePriorities: map[string]int{
+			"system.admin": 100,
+		},
+		MethodPriorities: map[string]int{
+			"/hello.hello.v1.HelloIdentity/*": 50,
+		},
+		PriorityMetadataKey: "priority",
+		MinPriority:         -10,
+		MaxPriority:         100,
+	}
+
+	ctx := context.Background()
+	assert.Equal(t, 1, c.priority(ctx, "/hello.hello.v1.HelloGreeter/SayHello"))
+	assert.Equal(t, 50, c.priority(ctx, "/hello.hello.v1.HelloIdentity/ServerVersion"))
+
+	adminCtx := auth.ContextSaveUserInfo(ctx, &auth.UserInfo{
+		Username: "admin",
+		Claims: auth.Claims{
+			Roles: []string{"system.admin"},
+		},
+	})
+	assert.Equal(t, 100, c.priority(adminCtx, "/hello.hello.v1.HelloGreeter/SayHello"))
+
+	// A matching configuration with a lower priority than the default is used
+	mdCtx := metadata.NewIncomingContext(ctx, metadata.Pairs("priority", "-5"))
+	assert.Equal(t, -5, c.priority(mdCtx, "/hello.hello.v1.HelloGreeter/SayHello"))
+
+	// The priorities of the clients are clamped to the range
+	mdCtx = metadata.NewIncomingContext(ctx, metadata.Pairs("priority", "123456"))
+	assert.Equal(t, 100, c.priority(mdCtx, "/hello.hello.v1.HelloGreeter/SayHello"))
+	c.MinPriority, c.MaxPriority = 0, 0
+	mdCtx = metadata.NewIncomingContext(ctx, metadata.Pairs("priority", "-123456"))
+	assert.Equal(t, 1, c.priority(mdCtx, "/hello.hello.v1.HelloGreeter/SayHello"))
+
+	c.PriorityFunc = func(ctx context.Context, fullMethod string) int {
+		return 7
+	}
+	assert.Equal(t, 7, c.priority(adminCtx, "/hello.hello.v1.HelloGreeter/SayHello"))
+}
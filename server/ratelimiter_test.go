@@ -0,0 +1,154 @@
+/*
+Copyright 2022 Pure Storage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package server
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/libopenstorage/grpc-framework/pkg/auth"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/time/rate"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+type testRateLimiter struct {
+	allow bool
+}
+
+func (l *testRateLimiter) Allow() bool {
+	return l.allow
+}
+
+type testRateLimiterFactory struct {
+	testRateLimiter
+	created int
+}
+
+func (f *testRateLimiterFactory) NewRateLimiter() RateLimiter {
+	f.created++
+	return &testRateLimiter{allow: f.allow}
+}
+
+func TestPerUserRateLimiterTemplate(t *testing.T) {
+	_, err := newPerUserRateLimiter(&testRateLimiter{}, 0, 0)
+	assert.Error(t, err)
+
+	p, err := newPerUserRateLimiter(rate.NewLimiter(1, 2), 0, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, defaultPerUserIdleTimeout, p.idleTimeout)
+
+	// Each user gets their own bucket with the burst of the template
+	for _, username := range []string{"user1", "user2"} {
+		for i := 0; i < 2; i++ {
+			allowed, _ := p.allow(username)
+			assert.True(t, allowed)
+		}
+		allowed, retryAfter := p.allow(username)
+		assert.False(t, allowed)
+		assert.True(t, retryAfter > 0 && retryAfter <= time.Second)
+	}
+	assert.Equal(t, 2, p.len())
+
+	f := &testRateLimiterFactory{}
+	p, err = newPerUserRateLimiter(f, 0, 0)
+	assert.NoError(t, err)
+	allowed, retryAfter := p.allow("user1")
+	assert.False(t, allowed)
+	assert.Equal(t, time.Second, retryAfter)
+	p.allow("user2")
+	p.allow("user1")
+	assert.Equal(t, 2, f.created)
+}
+
+func TestPerUserRateLimiterEviction(t *testing.T) {
+	p, err := newPerUserRateLimiter(rate.NewLimiter(1, 1), time.Minute, 0)
+	assert.NoError(t, err)
+
+	now := time.Now()
+	p.now = func() time.Time { return now }
+
+	p.allow("user1")
+	now = now.Add(30 * time.Second)
+	p.allow("user2")
+	assert.Equal(t, 2, p.len())
+
+	// user1 has been idle for a minute
+	now = now.Add(30 * time.Second)
+	p.allow("user2")
+	assert.Equal(t, 1, p.len())
+
+	// user1 gets a new full bucket
+	allowed, _ := p.allow("user1")
+	assert.True(t, allowed)
+	assert.Equal(t, 2, p.len())
+}
+
+func TestPerUserRateLimiterMaxUsers(t *testing.T) {
+	p, err := newPerUserRateLimiter(rate.NewLimiter(1, 1), time.Minute, 2)
+	assert.NoError(t, err)
+	now := time.Now()
+	p.now = func() time.Time { return now }
+
+	p.allow("user1")
+	now = now.Add(time.Second)
+	p.allow("user2")
+	now = now.Add(time.Second)
+	p.allow("user1")
+
+	// The least recently seen user is removed
+	now = now.Add(time.Second)
+	p.allow("user3")
+	assert.Equal(t, 2, p.len())
+	assert.Contains(t, p.users, "user1")
+	assert.NotContains(t, p.users, "user2")
+	assert.Contains(t, p.users, "user3")
+}
+
+func TestRateLimiterUsername(t *testing.T) {
+	ctx := context.Background()
+	assert.Equal(t, "", rateLimiterUsername(ctx))
+
+	// Tokens which have not been authenticated are ignored
+	ctx = metadata.NewIncomingContext(ctx, metadata.Pairs("authorization", "bearer "+
+		"eyJhbGciOiJIUzI1NiJ9.eyJzdWIiOiJmb3JnZWQifQ.c2ln"))
+	assert.Equal(t, "", rateLimiterUsername(ctx))
+
+	ctx = peer.NewContext(ctx, &peer.Peer{
+		Addr: &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 4321},
+	})
+	assert.Equal(t, "peer:10.0.0.1", rateLimiterUsername(ctx))
+	assert.Equal(t, "peer:10.0.0.1", rateLimiterUsername(auth.ContextSaveUserInfo(ctx, auth.NewGuestUser())))
+	assert.Equal(t, "jim", rateLimiterUsername(auth.ContextSaveUserInfo(ctx, &auth.UserInfo{
+		Username: "jim",
+	})))
+
+	// Addresses forwarded by the REST gateway are used for local peers only
+	ctx = metadata.NewIncomingContext(context.Background(),
+		metadata.Pairs(restForwardedForMetadataKey, "10.0.0.3, 10.0.0.2"))
+	assert.Equal(t, "peer:10.0.0.1", rateLimiterUsername(peer.NewContext(ctx, &peer.Peer{
+		Addr: &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 4321},
+	})))
+	assert.Equal(t, "peer:10.0.0.2", rateLimiterUsername(peer.NewContext(ctx, &peer.Peer{
+		Addr: &net.UnixAddr{Name: "/tmp/test.sock", Net: "unix"},
+	})))
+	assert.Equal(t, "peer:@", rateLimiterUsername(peer.NewContext(context.Background(), &peer.Peer{
+		Addr: &net.UnixAddr{Name: "@", Net: "unix"},
+	})))
+}
@@ -0,0 +1,122 @@
+/*
+Copyright 2022 Pure Storage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package server
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+
+	grpc_middleware "github.com/grpc-ecosystem/go-grpc-middleware"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/libopenstorage/grpc-framework/pkg/correlation"
+)
+
+// PanicHandler is called when a handler of the server panics, with the
+// value passed to panic() and the stack of the panic. The error returned is
+// sent to the client. When it returns nil, the client gets an Internal error.
+type PanicHandler func(ctx context.Context, fullMethod string, p interface{}, stack []byte) error
+
+var (
+	serverPanics = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "grpc_framework_server_panics_total",
+		Help: "Number of panics recovered from the handlers of the gRPC server.",
+	}, []string{"server", "method"})
+)
+
+func init() {
+	prometheus.MustRegister(serverPanics)
+}
+
+// recoverPanic converts a panic of the handler to a gRPC error. The panic is
+// logged to the access log with its stack and the correlation ID of the
+// request.
+func (s *GrpcFrameworkServer) recoverPanic(ctx context.Context, fullMethod string, handler func() error) (err error) {
+	defer func() {
+		p := recover()
+		if p == nil {
+			return
+		}
+		stack := debug.Stack()
+		serverPanics.WithLabelValues(s.name, fullMethod).Inc()
+
+		log := correlation.NewFunctionLogger(ctx)
+		log.Out = s.accessLogOutput
+		log.WithContext(ctx).WithFields(logrus.Fields{
+			"method": fullMethod,
+			"panic":  fmt.Sprintf("%v", p),
+			"stack":  string(stack),
+		}).Error("Recovered from panic")
+
+		if s.config.PanicHandler != nil {
+			err = s.config.PanicHandler(ctx, fullMethod, p, stack)
+		}
+		if err == nil {
+			err = status.Errorf(codes.Internal, "Internal error in %s", fullMethod)
+		}
+	}()
+
+	return handler()
+}
+
+func (s *GrpcFrameworkServer) recoveryUnaryInterceptor(
+	ctx context.Context,
+	req interface{},
+	info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler,
+) (interface{}, error) {
+	// Set the correlation context now so that the panics are logged with the
+	// same ID as the rest of the request
+	ctx = s.correlationInterceptor().IncomingContext(ctx)
+
+	var resp interface{}
+	err := s.recoverPanic(ctx, info.FullMethod, func() error {
+		var err error
+		resp, err = handler(ctx, req)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (s *GrpcFrameworkServer) recoveryStreamInterceptor(
+	srv interface{},
+	stream grpc.ServerStream,
+	info *grpc.StreamServerInfo,
+	handler grpc.StreamHandler,
+) error {
+	wrapped := grpc_middleware.WrapServerStream(stream)
+	wrapped.WrappedContext = s.correlationInterceptor().IncomingContext(stream.Context())
+
+	return s.recoverPanic(wrapped.WrappedContext, info.FullMethod, func() error {
+		return handler(srv, wrapped)
+	})
+}
+
+// correlationInterceptor returns the interceptor adding the correlation
+// context to the requests
+func (s *GrpcFrameworkServer) correlationInterceptor() *correlation.ContextInterceptor {
+	return &correlation.ContextInterceptor{
+		Origin: correlation.ComponentGrpcFw,
+	}
+}
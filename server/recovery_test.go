@@ -0,0 +1,100 @@
+/*
+Copyright 2022 Pure Storage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package server
+
+import (
+	"context"
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/libopenstorage/grpc-framework/pkg/correlation"
+	appapi "github.com/libopenstorage/grpc-framework/test/app/protos/apis/hello/apiv1"
+)
+
+// testPanicGreeter panics when it is asked to greet "panic"
+type testPanicGreeter struct {
+	appapi.UnimplementedHelloGreeterServer
+}
+
+func (g *testPanicGreeter) SayHello(
+	ctx context.Context,
+	req *appapi.HelloGreeterSayHelloRequest,
+) (*appapi.HelloGreeterSayHelloResponse, error) {
+	if req.GetName() == "panic" {
+		var greeting *string
+		return &appapi.HelloGreeterSayHelloResponse{Message: *greeting}, nil
+	}
+	return &appapi.HelloGreeterSayHelloResponse{Message: "Hello " + req.GetName()}, nil
+}
+
+func testServerPanics(t *testing.T) float64 {
+	m := &dto.Metric{}
+	require.NoError(t, serverPanics.
+		WithLabelValues("grpc-framework-tcp", appapi.HelloGreeter_SayHello_FullMethodName).Write(m))
+	return m.GetCounter().GetValue()
+}
+
+func TestServerRecovery(t *testing.T) {
+	access := &testLogBuffer{}
+	var handled []interface{}
+	c := &ServerConfig{
+		Name:         "testServer",
+		Net:          "tcp",
+		Address:      "127.0.0.1:0",
+		Socket:       grpcSocket,
+		AccessOutput: access,
+	}
+	c.WithPanicHandler(func(ctx context.Context, fullMethod string, p interface{}, stack []byte) error {
+		handled = append(handled, p)
+		if len(handled) > 1 {
+			return status.Error(codes.Unavailable, "try again")
+		}
+		return nil
+	}).
+		RegisterGrpcServers(func(gs *grpc.Server) {
+			appapi.RegisterHelloGreeterServer(gs, &testPanicGreeter{})
+		})
+	s := newTestServer(t, c)
+	defer s.Stop()
+	panics := testServerPanics(t)
+
+	g := appapi.NewHelloGreeterClient(s.Conn())
+	ctx := metadata.AppendToOutgoingContext(context.Background(), correlation.ContextIDKey, "panic-id")
+	_, err := g.SayHello(ctx, &appapi.HelloGreeterSayHelloRequest{Name: "panic"})
+	assert.Equal(t, codes.Internal, status.Code(err))
+	assert.Equal(t, panics+1, testServerPanics(t))
+	require.Len(t, handled, 1)
+	assert.Contains(t, access.String(), "Recovered from panic")
+	assert.Contains(t, access.String(), "panic-id")
+	assert.Contains(t, access.String(), "testPanicGreeter")
+
+	// The server keeps serving
+	r, err := g.SayHello(context.Background(), &appapi.HelloGreeterSayHelloRequest{Name: "jim"})
+	assert.NoError(t, err)
+	assert.Equal(t, "Hello jim", r.GetMessage())
+
+	// The error of the handler is returned
+	_, err = g.SayHello(context.Background(), &appapi.HelloGreeterSayHelloRequest{Name: "panic"})
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+	assert.Equal(t, panics+2, testServerPanics(t))
+}
@@ -18,28 +18,37 @@ package server
 import (
 	"context"
 	"fmt"
+	"net"
 	"net/http"
+	"sync"
 
 	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/rs/cors"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 	"google.golang.org/grpc"
 
 	"github.com/libopenstorage/grpc-framework/pkg/correlation"
-	grpcclient "github.com/libopenstorage/grpc-framework/pkg/grpc/client"
 )
 
 type RestGateway struct {
-	config     ServerConfig
-	grpcServer *GrpcFrameworkServer
-	server     *http.Server
+	config       ServerConfig
+	grpcServer   *GrpcFrameworkServer
+	server       *http.Server
+	certProvider *certificateProvider
+	errs         chan error
+
+	listenerLock sync.Mutex
+	listener     net.Listener
 }
 
 func NewRestGateway(config *ServerConfig, grpcServer *GrpcFrameworkServer) (*RestGateway, error) {
 	return &RestGateway{
 		config:     *config,
 		grpcServer: grpcServer,
+		errs:       make(chan error, serveErrorsBufferSize),
 	}, nil
 }
 
@@ -50,72 +59,163 @@ func (s *RestGateway) Start() error {
 	}
 
 	// Create object here so that we can access its Close receiver.
-	address := ":" + s.config.RestConfig.Port
+	network, address := "tcp", ":"+s.config.RestConfig.Port
+	if s.config.RestConfig.singlePort() {
+		network, address = s.config.Net, s.config.Address
+		mux = singlePortHandler(s.grpcServer, mux)
+	}
 	s.server = &http.Server{
 		Addr:    address,
 		Handler: mux,
 	}
+	if s.config.Security.Tls != nil {
+		if s.certProvider == nil {
+			s.certProvider, err = newCertificateProvider(s.config.Security.Tls)
+			if err != nil {
+				return err
+			}
+		}
+		s.server.TLSConfig = s.certProvider.tlsConfig()
+	}
+	if s.config.RestConfig.singlePort() {
+		// gRPC requires HTTP/2, which is only negotiated over TLS. Without
+		// TLS, clients must use HTTP/2 with prior knowledge (h2c).
+		// Configuring the server also closes the h2c connections on shutdown.
+		tlsConfig := s.server.TLSConfig
+		h2s := &http2.Server{}
+		if err := http2.ConfigureServer(s.server, h2s); err != nil {
+			return fmt.Errorf("Unable to setup HTTP/2 for the REST gRPC Gateway: %v", err)
+		}
+		if tlsConfig == nil {
+			// ConfigureServer creates a TLS configuration when there is none
+			s.server.TLSConfig = nil
+			s.server.Handler = h2c.NewHandler(s.server.Handler, h2s)
+		}
+	}
+
+	if err := s.listenAndServe(network, address); err != nil {
+		return err
+	}
+	if s.config.RestConfig.singlePort() {
+		logrus.Infof("gRPC and REST Gateway started on %s", s.Address())
+	} else {
+		logrus.Infof("gRPC REST Gateway started on port :%s", s.config.RestConfig.Port)
+	}
+
+	return nil
+}
+
+// listenAndServe listens on the address of the gateway and serves the
+// requests in the background. Serve errors are sent to Errors().
+func (s *RestGateway) listenAndServe(network, address string) error {
+	l, err := net.Listen(network, address)
+	if err != nil {
+		return fmt.Errorf("Unable to start REST gRPC Gateway: %v", err)
+	}
+
+	s.listenerLock.Lock()
+	s.listener = l
+	s.listenerLock.Unlock()
 
-	ready := make(chan bool)
 	go func() {
-		ready <- true
 		var err error
-		if s.config.Security.Tls != nil {
-			err = s.server.ListenAndServeTLS(s.config.Security.Tls.CertFile, s.config.Security.Tls.KeyFile)
+		if s.server.TLSConfig != nil {
+			// Certificate is provided by the TLS configuration
+			err = s.server.ServeTLS(l, "", "")
 		} else {
-			err = s.server.ListenAndServe()
+			err = s.server.Serve(l)
 		}
 
 		if err == http.ErrServerClosed || err == nil {
 			return
-		} else {
-			logrus.Fatalf("Unable to start REST gRPC Gateway: %s\n",
-				err.Error())
+		}
+		logrus.Errorf("REST gRPC Gateway stopped serving: %v", err)
+		select {
+		case s.errs <- err:
+		default:
+			logrus.Warn("REST gRPC Gateway error dropped, nobody is receiving errors")
 		}
 	}()
-	<-ready
-	logrus.Infof("gRPC REST Gateway started on port :%s", s.config.RestConfig.Port)
+	return nil
+}
+
+// Relisten starts listening and serving again after the gateway stopped
+// serving because of an error received from Errors().
+func (s *RestGateway) Relisten() error {
+	s.listenerLock.Lock()
+	addr := s.listener.Addr()
+	s.listener.Close()
+	s.listenerLock.Unlock()
 
+	if err := s.listenAndServe(addr.Network(), addr.String()); err != nil {
+		return err
+	}
+	logrus.Infof("gRPC REST Gateway listening again on %s", addr.String())
 	return nil
 }
 
+// Address returns the address the gateway is listening on
+func (s *RestGateway) Address() string {
+	s.listenerLock.Lock()
+	defer s.listenerLock.Unlock()
+
+	if s.listener == nil {
+		return ""
+	}
+	return s.listener.Addr().String()
+}
+
+// Errors returns the channel which receives the errors returned while
+// serving. The gateway no longer accepts connections after an error until
+// Relisten is called. Errors are dropped when the channel is full.
+func (s *RestGateway) Errors() <-chan error {
+	return s.errs
+}
+
 func (s *RestGateway) Stop() {
+	if s.server == nil {
+		return
+	}
 	if err := s.server.Close(); err != nil {
-		logrus.Fatalf("REST GW STOP error: %v", err)
+		logrus.Warnf("REST gRPC Gateway did not stop cleanly: %v", err)
+	}
+}
+
+// Shutdown gracefully stops the REST gateway. It stops accepting new
+// connections and waits for the pending requests to finish. If the context
+// expires first, all connections are closed.
+func (s *RestGateway) Shutdown(ctx context.Context) error {
+	if s.server == nil {
+		return nil
+	}
+
+	err := s.server.Shutdown(ctx)
+	if err != nil {
+		logrus.Warnf("REST Gateway did not stop gracefully, stopping it now: %v", err)
+		s.server.Close()
 	}
+	return err
 }
 
-// restServerSetupHandlers sets up the handlers to the swagger ui and
-// to the gRPC REST Gateway.
+// restServerSetupHandlers sets up the handlers to the OpenAPI document, the
+// swagger ui and to the gRPC REST Gateway.
 func (s *RestGateway) restServerSetupHandlers() (http.Handler, error) {
 
 	// Create an HTTP server router
 	mux := http.NewServeMux()
 
-	// Swagger files using packr
-	/* Packr on swagger
-
-	swaggerUIBox := packr.NewBox("./swagger-ui")
-	swaggerJSONBox := packr.NewBox("./api")
-	mime.AddExtensionType(".svg", "image/svg+xml")
-
-	// Handler to return swagger.json
-	mux.HandleFunc("/swagger.json", func(w http.ResponseWriter, r *http.Request) {
-		w.Write(swaggerJSONBox.Bytes("api.swagger.json"))
-	})
-
-	// Handler to access the swagger ui. The UI pulls the swagger
-	// json file from /swagger.json
-	// The link below MUST have th last '/'. It is really important.
-	// This link is deprecated
-	prefix := "/swagger-ui/"
-	mux.Handle(prefix,
-		http.StripPrefix(prefix, http.FileServer(swaggerUIBox)))
-	// This is the new location
-	prefix = "/sdk/"
-	mux.Handle(prefix,
-		http.StripPrefix(prefix, http.FileServer(swaggerUIBox)))
-	*/
+	// OpenAPI document and Swagger UI
+	if s.config.RestConfig.OpenApiConfig.Enabled {
+		if err := s.openApiSetupHandlers(mux); err != nil {
+			return nil, err
+		}
+	}
+
+	// Health of the server
+	if s.grpcServer != nil {
+		mux.HandleFunc(restHealthzPath, s.grpcServer.health.healthzHandler)
+		mux.HandleFunc(restReadyzPath, s.grpcServer.health.readyzHandler)
+	}
 
 	if s.config.RestConfig.PrometheusConfig.Enabled {
 		if s.config.RestConfig.PrometheusConfig.Path == "" {
@@ -126,15 +226,13 @@ func (s *RestGateway) restServerSetupHandlers() (http.Handler, error) {
 	}
 
 	// Create a router just for HTTP REST gRPC Server Gateway
-	gmux := runtime.NewServeMux()
+	gmux := runtime.NewServeMux(s.config.RestConfig.HeadersConfig.restGatewayOptions()...)
 
-	// Connect to gRPC unix domain socket
-	conn, err := grpcclient.Connect(
-		s.grpcServer.Address(),
-		[]grpc.DialOption{
+	// Connect to gRPC unix domain socket, or in memory in single-port and in-process modes
+	conn, err := s.grpcServer.localConnect(
+		correlation.DialOptionsAddCorrelation([]grpc.DialOption{
 			grpc.WithInsecure(),
-			grpc.WithUnaryInterceptor(correlation.ContextUnaryClientInterceptor),
-		})
+		}))
 	if err != nil {
 		return nil, fmt.Errorf("Failed to connect to gRPC handler: %v", err)
 	}
@@ -148,18 +246,28 @@ func (s *RestGateway) restServerSetupHandlers() (http.Handler, error) {
 	}
 
 	// Pass all other unhandled paths to the gRPC gateway
-	mux.Handle("/", gmux)
+	mux.Handle("/", restCorrelationHandler(gmux))
+
+	// Serve the gRPC-Web and Connect requests with the gRPC server
+	var handler http.Handler = mux
+	if s.config.RestConfig.WebProtocols {
+		handler = webProtocolsHandler(s.grpcServer, mux)
+	}
 
 	// Enable cors
 	if s.config.RestConfig.CorsOptions.Enabled {
 		if s.config.RestConfig.CorsOptions.CustomOptions == nil {
 			logrus.Warn("REST Cors configuration missing; skipping")
 		} else {
-			c := cors.New(*s.config.RestConfig.CorsOptions.CustomOptions)
-			cmux := c.Handler(mux)
+			options := *s.config.RestConfig.CorsOptions.CustomOptions
+			if s.config.RestConfig.WebProtocols {
+				options = webProtocolsCorsOptions(options)
+			}
+			c := cors.New(options)
+			cmux := c.Handler(handler)
 			return cmux, nil
 		}
 	}
 
-	return mux, nil
+	return handler, nil
 }
@@ -0,0 +1,164 @@
+/*
+Copyright 2022 Pure Storage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"github.com/pborman/uuid"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	spb "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc/status"
+
+	"github.com/libopenstorage/grpc-framework/pkg/auth"
+	"github.com/libopenstorage/grpc-framework/pkg/correlation"
+	grpcerrors "github.com/libopenstorage/grpc-framework/pkg/grpc/errors"
+)
+
+const (
+	// RestCorrelationIDHeader is the HTTP header with the correlation ID of
+	// the REST requests. The ID is generated by the gateway when the client
+	// does not provide it, and returned in the response.
+	RestCorrelationIDHeader = "X-Correlation-Id"
+	// HTTP header with the authentication token: Authorization: bearer <token>
+	restAuthorizationHeader = "Authorization"
+	// Content type of the JSON responses of the gateway
+	restJSONContentType = "application/json"
+)
+
+// restGatewayOptions returns the options of the REST gateway mux
+func (c *RestServerHeadersConfig) restGatewayOptions() []runtime.ServeMuxOption {
+	return []runtime.ServeMuxOption{
+		runtime.WithIncomingHeaderMatcher(c.incomingHeaderMatcher),
+		runtime.WithOutgoingHeaderMatcher(c.outgoingHeaderMatcher),
+		runtime.WithOutgoingTrailerMatcher(c.outgoingTrailerMatcher),
+		runtime.WithErrorHandler(restErrorHandler),
+	}
+}
+
+// incomingHeaderMatcher returns the gRPC metadata key of an HTTP request header
+func (c *RestServerHeadersConfig) incomingHeaderMatcher(key string) (string, bool) {
+	switch {
+	case strings.EqualFold(key, restAuthorizationHeader):
+		// The gateway always forwards the header as the authorization
+		// metadata, where the token is read with the ContextMetadataTokenKey
+		// scheme. Do not forward it a second time under another key.
+		return "", false
+	case strings.EqualFold(key, RestCorrelationIDHeader):
+		return correlation.ContextIDKey, true
+	case strings.EqualFold(key, auth.APIKeyMetadataKey):
+		return auth.APIKeyMetadataKey, true
+	case containsHeader(c.Incoming, key):
+		return strings.ToLower(key), true
+	}
+	return runtime.DefaultHeaderMatcher(key)
+}
+
+// outgoingHeaderMatcher returns the HTTP response header of a gRPC header
+// metadata key
+func (c *RestServerHeadersConfig) outgoingHeaderMatcher(key string) (string, bool) {
+	if containsHeader(c.Outgoing, key) {
+		return key, true
+	}
+	return runtime.MetadataHeaderPrefix + key, true
+}
+
+// outgoingTrailerMatcher returns the HTTP response trailer of a gRPC trailer
+// metadata key
+func (c *RestServerHeadersConfig) outgoingTrailerMatcher(key string) (string, bool) {
+	if containsHeader(c.Outgoing, key) {
+		return key, true
+	}
+	return runtime.MetadataTrailerPrefix + key, true
+}
+
+func containsHeader(headers []string, header string) bool {
+	for _, h := range headers {
+		if strings.EqualFold(h, header) {
+			return true
+		}
+	}
+	return false
+}
+
+// restCorrelationHandler makes sure that every request to the gateway has a
+// correlation ID, and returns it to the client
+func restCorrelationHandler(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RestCorrelationIDHeader)
+		if id == "" {
+			id = uuid.New()
+			r.Header.Set(RestCorrelationIDHeader, id)
+		}
+		w.Header().Set(RestCorrelationIDHeader, id)
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// restErrorHandler writes the gRPC status of the error, like the default
+// error handler of the gateway, with its google.rpc error details. JSON
+// responses are rendered by grpcerrors.MarshalJSON.
+// The correlation ID of the request is added to the details as a
+// google.rpc.RequestInfo.
+func restErrorHandler(
+	ctx context.Context,
+	mux *runtime.ServeMux,
+	marshaler runtime.Marshaler,
+	w http.ResponseWriter,
+	r *http.Request,
+	err error,
+) {
+	if id := r.Header.Get(RestCorrelationIDHeader); id != "" {
+		var httpErr *runtime.HTTPStatusError
+		if errors.As(err, &httpErr) {
+			err = &runtime.HTTPStatusError{
+				HTTPStatus: httpErr.HTTPStatus,
+				Err:        errorWithRequestInfo(httpErr.Err, id),
+			}
+		} else {
+			err = errorWithRequestInfo(err, id)
+		}
+	}
+	if marshaler.ContentType(nil) == restJSONContentType {
+		marshaler = &restErrorMarshaler{Marshaler: marshaler}
+	}
+	runtime.DefaultHTTPErrorHandler(ctx, mux, marshaler, w, r, err)
+}
+
+// restErrorMarshaler renders the gRPC status of the errors as stable JSON
+type restErrorMarshaler struct {
+	runtime.Marshaler
+}
+
+func (m *restErrorMarshaler) Marshal(v interface{}) ([]byte, error) {
+	if s, ok := v.(*spb.Status); ok {
+		return grpcerrors.MarshalJSON(s)
+	}
+	return m.Marshaler.Marshal(v)
+}
+
+// errorWithRequestInfo returns the gRPC status of the error with a
+// google.rpc.RequestInfo detail, unless it already has one
+func errorWithRequestInfo(err error, id string) error {
+	if grpcerrors.RequestInfo(err) != nil {
+		return status.Convert(err).Err()
+	}
+	return grpcerrors.WithDetails(err, &errdetails.RequestInfo{RequestId: id})
+}
@@ -0,0 +1,167 @@
+/*
+Copyright 2022 Pure Storage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/libopenstorage/grpc-framework/pkg/correlation"
+	appapi "github.com/libopenstorage/grpc-framework/test/app/protos/apis/hello/apiv1"
+)
+
+// testMetadataGreeter saves the metadata of the requests and returns
+// metadata in the response
+type testMetadataGreeter struct {
+	appapi.UnimplementedHelloGreeterServer
+
+	lock sync.Mutex
+	md   metadata.MD
+}
+
+func (g *testMetadataGreeter) SayHello(
+	ctx context.Context,
+	req *appapi.HelloGreeterSayHelloRequest,
+) (*appapi.HelloGreeterSayHelloResponse, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	g.lock.Lock()
+	g.md = md
+	g.lock.Unlock()
+
+	if req.GetName() == "" {
+		s, err := status.New(codes.InvalidArgument, "name is required").WithDetails(&errdetails.BadRequest{
+			FieldViolations: []*errdetails.BadRequest_FieldViolation{
+				{Field: "name", Description: "name is required"},
+			},
+		})
+		if err != nil {
+			return nil, err
+		}
+		return nil, s.Err()
+	}
+
+	grpc.SetHeader(ctx, metadata.Pairs("x-request-cost", "5", "x-other", "a"))
+	grpc.SetTrailer(ctx, metadata.Pairs("x-trailer", "t"))
+	return &appapi.HelloGreeterSayHelloResponse{Message: "Hello, " + req.GetName()}, nil
+}
+
+func (g *testMetadataGreeter) metadata() metadata.MD {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return g.md
+}
+
+func TestServerRestHeaders(t *testing.T) {
+	greeter := &testMetadataGreeter{}
+	c := &ServerConfig{
+		Name:    "testServer",
+		Net:     "tcp",
+		Address: "127.0.0.1:0",
+		Socket:  grpcSocket,
+	}
+	c.WithDefaultRestServer("9001").
+		WithRestIncomingHeaders("X-Tenant").
+		WithRestOutgoingHeaders("x-request-cost").
+		RegisterGrpcServers(func(gs *grpc.Server) {
+			appapi.RegisterHelloGreeterServer(gs, greeter)
+		}).
+		RegisterRestHandlers(appapi.RegisterHelloGreeterHandler)
+	s := newTestServer(t, c)
+	defer s.Stop()
+
+	req, err := http.NewRequest(http.MethodPost, "http://localhost:9001/v1/greeter:sayHello", strings.NewReader(`{"name":"jim"}`))
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer abc")
+	req.Header.Set("X-Tenant", "t1")
+	req.Header.Set("X-Unknown", "u")
+	req.Header.Set(RestCorrelationIDHeader, "id1")
+	req.Header.Set("Grpc-Metadata-Foo", "bar")
+	req.Header.Set("TE", "trailers")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// Incoming headers
+	md := greeter.metadata()
+	assert.Equal(t, []string{"Bearer abc"}, md.Get("authorization"))
+	assert.Empty(t, md.Get(runtime.MetadataPrefix+"authorization"))
+	assert.Equal(t, []string{"t1"}, md.Get("x-tenant"))
+	assert.Empty(t, md.Get("x-unknown"))
+	assert.Equal(t, []string{"id1"}, md.Get(correlation.ContextIDKey))
+	assert.Equal(t, []string{"bar"}, md.Get("foo"))
+
+	// Outgoing headers and trailers
+	assert.Equal(t, "id1", resp.Header.Get(RestCorrelationIDHeader))
+	assert.Equal(t, "5", resp.Header.Get("X-Request-Cost"))
+	assert.Equal(t, "a", resp.Header.Get("Grpc-Metadata-X-Other"))
+	assert.Equal(t, "t", resp.Trailer.Get("Grpc-Trailer-X-Trailer"))
+
+	// Errors have the correlation ID and the error details
+	req, err = http.NewRequest(http.MethodPost, "http://localhost:9001/v1/greeter:sayHello", strings.NewReader(`{}`))
+	require.NoError(t, err)
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	id := resp.Header.Get(RestCorrelationIDHeader)
+	require.NotEmpty(t, id)
+	assert.Equal(t, []string{id}, greeter.metadata().Get(correlation.ContextIDKey))
+
+	var restErr struct {
+		Code    int32                    `json:"code"`
+		Message string                   `json:"message"`
+		Details []map[string]interface{} `json:"details"`
+	}
+	require.NoError(t, json.Unmarshal(body, &restErr))
+	assert.Equal(t, int32(codes.InvalidArgument), restErr.Code)
+	assert.Equal(t, "name is required", restErr.Message)
+	require.Len(t, restErr.Details, 2)
+	assert.Equal(t, "type.googleapis.com/google.rpc.BadRequest", restErr.Details[0]["@type"])
+	assert.Equal(t, "type.googleapis.com/google.rpc.RequestInfo", restErr.Details[1]["@type"])
+	assert.Equal(t, id, restErr.Details[1]["requestId"])
+}
+
+func TestErrorWithRequestInfo(t *testing.T) {
+	err := errorWithRequestInfo(status.Error(codes.NotFound, "not found"), "id1")
+	s := status.Convert(err)
+	assert.Equal(t, codes.NotFound, s.Code())
+	require.Len(t, s.Details(), 1)
+	assert.Equal(t, "id1", s.Details()[0].(*errdetails.RequestInfo).GetRequestId())
+
+	// The request information is not added twice
+	s = status.Convert(errorWithRequestInfo(err, "id2"))
+	require.Len(t, s.Details(), 1)
+	assert.Equal(t, "id1", s.Details()[0].(*errdetails.RequestInfo).GetRequestId())
+}
@@ -0,0 +1,121 @@
+/*
+Copyright 2022 Pure Storage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package server
+
+import (
+	"context"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/libopenstorage/grpc-framework/pkg/auth"
+	"github.com/libopenstorage/grpc-framework/pkg/auth/revocation"
+	"github.com/libopenstorage/grpc-framework/pkg/correlation"
+)
+
+// revocationsServer implements the revocation.Revocations service with the
+// Revoker of the current security configuration
+type revocationsServer struct {
+	revocation.UnimplementedRevocationsServer
+
+	server *GrpcFrameworkServer
+}
+
+// registerRevocations registers the revocations service in the gRPC server
+// if the server authenticates the clients and has a Revoker, unless the
+// application has registered its own. Without authentication, anyone could
+// revoke the tokens of everyone.
+func (s *GrpcFrameworkServer) registerRevocations(grpcServer *grpc.Server) {
+	security := s.currentSecurity().config
+	if security.Revoker == nil || !security.authEnabled() {
+		return
+	}
+	if _, ok := grpcServer.GetServiceInfo()[revocation.Revocations_ServiceDesc.ServiceName]; ok {
+		return
+	}
+	revocation.RegisterRevocationsServer(grpcServer, &revocationsServer{server: s})
+}
+
+func (r *revocationsServer) revoker() (revocation.Revoker, error) {
+	revoker := r.server.currentSecurity().config.Revoker
+	if revoker == nil {
+		return nil, status.Error(codes.FailedPrecondition, "Token revocation is not enabled")
+	}
+	return revoker, nil
+}
+
+// Add revokes the tokens matching the revocation
+func (r *revocationsServer) Add(
+	ctx context.Context,
+	req *revocation.RevocationsAddRequest,
+) (*revocation.RevocationsAddResponse, error) {
+	rev := req.GetRevocation()
+	if rev.GetJti() == "" && rev.GetSubject() == "" && rev.GetIssuer() == "" {
+		return nil, status.Error(codes.InvalidArgument, "Revocation must have a jti, a subject or an issuer")
+	}
+	revoker, err := r.revoker()
+	if err != nil {
+		return nil, err
+	}
+
+	rev, err = revoker.Revoke(ctx, rev)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Unable to add revocation: %v", err)
+	}
+
+	// The revoked tokens are verified again
+	r.server.currentSecurity().claimsCache.purge()
+
+	// Audit log
+	log := correlation.NewFunctionLogger(ctx)
+	log.Out = r.server.auditLogOutput
+	fields := logrus.Fields{
+		"jti":       rev.GetJti(),
+		"subject":   rev.GetSubject(),
+		"issuer":    rev.GetIssuer(),
+		"notBefore": rev.GetNotBefore(),
+		"reason":    rev.GetReason(),
+	}
+	if userinfo, ok := auth.NewUserInfoFromContext(ctx); ok {
+		fields["username"] = userinfo.Username
+	}
+	log.WithContext(ctx).WithFields(fields).Info("Tokens revoked")
+
+	return &revocation.RevocationsAddResponse{
+		Revocation: rev,
+	}, nil
+}
+
+// List returns the revocations which have not expired
+func (r *revocationsServer) List(
+	ctx context.Context,
+	req *revocation.RevocationsListRequest,
+) (*revocation.RevocationsListResponse, error) {
+	revoker, err := r.revoker()
+	if err != nil {
+		return nil, err
+	}
+
+	revocations, err := revoker.List(ctx)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Unable to list revocations: %v", err)
+	}
+	return &revocation.RevocationsListResponse{
+		Revocations: revocations,
+	}, nil
+}
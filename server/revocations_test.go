@@ -0,0 +1,135 @@
+/*
+Copyright 2022 Pure Storage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/libopenstorage/grpc-framework/pkg/auth"
+	"github.com/libopenstorage/grpc-framework/pkg/auth/revocation"
+	"github.com/libopenstorage/grpc-framework/pkg/auth/role"
+	appserver "github.com/libopenstorage/grpc-framework/test/app/pkg/server"
+	appapi "github.com/libopenstorage/grpc-framework/test/app/protos/apis/hello/apiv1"
+)
+
+func TestServerRevocations(t *testing.T) {
+	jwtAuthenticator, err := auth.NewJwtAuthenticator(&auth.JwtAuthConfig{
+		SharedSecret: []byte(testSharedSecret),
+	})
+	require.NoError(t, err)
+
+	config := &ServerConfig{
+		Name:    "testServer",
+		Net:     "tcp",
+		Address: "127.0.0.1:0",
+		Socket:  grpcSocket,
+		Security: &SecurityConfig{
+			Authenticators: map[string]auth.Authenticator{
+				"testissuer": jwtAuthenticator,
+			},
+			Role: role.NewGenericRoleManager("", map[string]*role.Role{
+				role.SystemAdminRoleName: role.DefaultRoles[role.SystemAdminRoleName],
+				"greeter": {
+					Rules: []*role.Rule{{
+						Services: []string{"hello.hello.v1.hellogreeter"},
+						Apis:     []string{"*"},
+					}},
+				},
+			}),
+		},
+	}
+	config.WithClaimsCache(100, time.Minute).
+		WithRevoker(revocation.NewMemoryRevoker()).
+		RegisterGrpcServers(func(gs *grpc.Server) {
+			appapi.RegisterHelloGreeterServer(gs, &appserver.HelloGreeter{})
+		})
+	s := newTestServer(t, config)
+	defer s.Stop()
+
+	g := appapi.NewHelloGreeterClient(s.Conn())
+	sayHello := func(token string) error {
+		ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "bearer "+token)
+		_, err := g.SayHello(ctx, &appapi.HelloGreeterSayHelloRequest{Name: "jim"})
+		return err
+	}
+	r := revocation.NewRevocationsClient(s.Conn())
+	adminCtx := contextWithToken(t, context.Background(), "testissuer", "admin", []string{"system.admin"})
+
+	// Revoke a single token by its ID
+	jimToken := testToken(t, "testissuer", "jim", []string{"greeter"})
+	bobToken := testToken(t, "testissuer", "bob", []string{"greeter"})
+	assert.NoError(t, sayHello(jimToken))
+	assert.NoError(t, sayHello(bobToken))
+	claims, err := auth.TokenClaims(jimToken)
+	require.NoError(t, err)
+	require.NotEmpty(t, claims.ID)
+	cache := s.server.netServer.currentSecurity().claimsCache
+	assert.NotEmpty(t, cache.entries)
+	_, err = r.Add(adminCtx, &revocation.RevocationsAddRequest{
+		Revocation: &revocation.Revocation{Jti: claims.ID, Reason: "leaked"},
+	})
+	require.NoError(t, err)
+	// The revoked tokens are verified again
+	assert.Empty(t, cache.entries)
+	assert.Equal(t, codes.Unauthenticated, status.Code(sayHello(jimToken)))
+	assert.NoError(t, sayHello(testToken(t, "testissuer", "jim", []string{"greeter"})))
+
+	// Revoke all the tokens of a subject, even when they are cached
+	_, err = r.Add(adminCtx, &revocation.RevocationsAddRequest{
+		Revocation: &revocation.Revocation{Subject: "bob", NotBefore: time.Now().Add(time.Second).Unix()},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, codes.Unauthenticated, status.Code(sayHello(bobToken)))
+
+	list, err := r.List(adminCtx, &revocation.RevocationsListRequest{})
+	require.NoError(t, err)
+	require.Len(t, list.GetRevocations(), 2)
+	assert.Equal(t, "leaked", list.GetRevocations()[0].GetReason())
+	assert.Equal(t, "bob", list.GetRevocations()[1].GetSubject())
+
+	// The revocations must match some tokens
+	_, err = r.Add(adminCtx, &revocation.RevocationsAddRequest{
+		Revocation: &revocation.Revocation{Reason: "everything"},
+	})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	// The revocations service is authorized like any other service
+	_, err = r.List(
+		contextWithToken(t, context.Background(), "testissuer", "jim", []string{"greeter"}),
+		&revocation.RevocationsListRequest{})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+}
+
+func TestServerRevocationsWithoutAuth(t *testing.T) {
+	// Without authentication, anyone could revoke the tokens
+	config := newDefaultConfig(t)
+	config.WithRevoker(revocation.NewMemoryRevoker())
+	s := newTestServer(t, config)
+	defer s.Stop()
+
+	_, err := revocation.NewRevocationsClient(s.Conn()).List(
+		context.Background(), &revocation.RevocationsListRequest{})
+	assert.Equal(t, codes.Unimplemented, status.Code(err))
+}
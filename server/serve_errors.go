@@ -0,0 +1,180 @@
+/*
+Copyright 2022 Pure Storage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package server
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// Number of serve errors kept until they are received
+	serveErrorsBufferSize = 8
+	// Time to wait before listening again after a serve error
+	serveErrorRestartDelay = time.Second
+	// Name of the REST gateway in serve errors
+	restGatewayName = "rest-gateway"
+)
+
+// ServeErrorPolicy determines what the Server does when one of its servers
+// stops serving because of an error, for example when its listener fails.
+type ServeErrorPolicy string
+
+const (
+	// ServeErrorPolicyStop stops all the servers. Wait returns the error.
+	// This is the default.
+	ServeErrorPolicyStop ServeErrorPolicy = "stop"
+	// ServeErrorPolicyRestart listens again on the address of the server which
+	// failed. If it cannot listen again, all the servers are stopped.
+	ServeErrorPolicyRestart ServeErrorPolicy = "restart"
+	// ServeErrorPolicyIgnore only reports the error. The server which failed
+	// no longer accepts connections.
+	ServeErrorPolicyIgnore ServeErrorPolicy = "ignore"
+)
+
+// ServeError is an error returned by one of the servers while serving
+type ServeError struct {
+	// Server is the name of the server which failed
+	Server string
+	// Err is the error returned by the server
+	Err error
+}
+
+func (e *ServeError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Server, e.Err)
+}
+
+func (e *ServeError) Unwrap() error {
+	return e.Err
+}
+
+// serveErrorSource is a server which reports its serve errors and can
+// start serving again after an error
+type serveErrorSource interface {
+	Errors() <-chan error
+	Relisten() error
+}
+
+func validateServeErrorPolicy(policy ServeErrorPolicy) error {
+	switch policy {
+	case "", ServeErrorPolicyStop, ServeErrorPolicyRestart, ServeErrorPolicyIgnore:
+		return nil
+	default:
+		return fmt.Errorf("unknown serve error policy %s. Must be one of %s (default), %s or %s",
+			policy, ServeErrorPolicyStop, ServeErrorPolicyRestart, ServeErrorPolicyIgnore)
+	}
+}
+
+// Errors returns the channel which receives the errors returned by the gRPC
+// servers and the REST gateway while serving, as a *ServeError, regardless of
+// the ServeErrorPolicy. Errors are dropped when the channel is full.
+func (s *Server) Errors() <-chan error {
+	return s.errors
+}
+
+// Wait blocks until the servers are stopped. It returns the error which
+// stopped them, or nil if they were stopped by Stop or Shutdown.
+func (s *Server) Wait() error {
+	<-s.stopped
+
+	s.errLock.Lock()
+	defer s.errLock.Unlock()
+	return s.err
+}
+
+// markStopped unblocks Wait
+func (s *Server) markStopped() {
+	s.stopOnce.Do(func() {
+		close(s.stopped)
+	})
+}
+
+// watchServeErrors handles the errors of the servers until they are stopped
+func (s *Server) watchServeErrors() {
+	var netErrs, udsErrs, restErrs <-chan error
+	if s.netServer != nil {
+		netErrs = s.netServer.Errors()
+	}
+	if s.udsServer != nil {
+		udsErrs = s.udsServer.Errors()
+	}
+	if s.restGateway != nil {
+		restErrs = s.restGateway.Errors()
+	}
+
+	go func() {
+		for {
+			select {
+			case <-s.stopped:
+				return
+			case err := <-netErrs:
+				s.handleServeError(s.netServer.name, s.netServer, err)
+			case err := <-udsErrs:
+				s.handleServeError(s.udsServer.name, s.udsServer, err)
+			case err := <-restErrs:
+				s.handleServeError(restGatewayName, s.restGateway, err)
+			}
+		}
+	}()
+}
+
+func (s *Server) handleServeError(name string, source serveErrorSource, err error) {
+	serveErr := &ServeError{
+		Server: name,
+		Err:    err,
+	}
+	s.reportServeError(serveErr)
+
+	switch s.config.ServeErrorPolicy {
+	case ServeErrorPolicyIgnore:
+		return
+	case ServeErrorPolicyRestart:
+		select {
+		case <-s.stopped:
+			return
+		case <-time.After(serveErrorRestartDelay):
+		}
+		err := source.Relisten()
+		if err == nil {
+			return
+		}
+		serveErr = &ServeError{
+			Server: name,
+			Err:    err,
+		}
+		s.reportServeError(serveErr)
+	}
+
+	logrus.Errorf("Stopping all servers: %v", serveErr)
+	s.errLock.Lock()
+	if s.err == nil {
+		s.err = serveErr
+	}
+	s.errLock.Unlock()
+
+	// Stop from another goroutine since Stop waits for the servers
+	go s.Stop()
+}
+
+func (s *Server) reportServeError(err *ServeError) {
+	select {
+	case s.errors <- err:
+	default:
+		logrus.Warnf("Serve error dropped, nobody is receiving errors: %v", err)
+	}
+}
@@ -16,13 +16,17 @@ limitations under the License.
 package server
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"os"
+	"sort"
+	"sync"
 
 	grpcserver "github.com/libopenstorage/grpc-framework/pkg/grpc/server"
 	"github.com/libopenstorage/grpc-framework/pkg/util"
 	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/health/grpc_health_v1"
 )
 
 const (
@@ -40,8 +44,21 @@ type Server struct {
 	restGateway *RestGateway
 	grpcPort    string
 
+	certProvider *certificateProvider
+
 	accessLog *os.File
 	auditLog  *os.File
+
+	// Serializes updates to the security configuration, and protects
+	// config.Security
+	securityLock sync.Mutex
+
+	// Serve errors of the servers
+	errors   chan error
+	stopped  chan struct{}
+	stopOnce sync.Once
+	errLock  sync.Mutex
+	err      error
 }
 
 type logger struct {
@@ -63,9 +80,16 @@ func New(config *ServerConfig) (*Server, error) {
 		config.Security = &SecurityConfig{}
 	}
 
+	if err := validateServeErrorPolicy(config.ServeErrorPolicy); err != nil {
+		return nil, err
+	}
+
 	// Check if the socket is provided to enable the REST gateway to communicate
-	// to the unix domain socket
-	if len(config.RestConfig.Port) != 0 && len(config.Socket) == 0 {
+	// to the unix domain socket. In single-port and in-process modes, it
+	// communicates in memory.
+	singlePort := config.RestConfig.singlePort()
+	inProcess := config.RestConfig.inProcess()
+	if !singlePort && !inProcess && len(config.RestConfig.Port) != 0 && len(config.Socket) == 0 {
 		return nil, fmt.Errorf("must provide unix domain socket for REST server to communicate with gRPC server")
 	}
 
@@ -94,11 +118,20 @@ func New(config *ServerConfig) (*Server, error) {
 		logrus.Warnf("grpc-framework Address NOT in host:port format, failed to get port %v", err.Error())
 	}
 
-	// Create a gRPC server on the network
-	netServer, err := NewGrpcFrameworkServer(config)
+	// Create a gRPC server on the network. In single-port mode, the REST
+	// gateway listens on the network and passes the gRPC requests to the server.
+	var netServer *GrpcFrameworkServer
+	if singlePort {
+		netServer, err = newGrpcFrameworkServer(config, newMemListener())
+	} else {
+		netServer, err = NewGrpcFrameworkServer(config)
+	}
 	if err != nil {
 		return nil, err
 	}
+	if inProcess {
+		netServer.memListener = newMemListener()
+	}
 
 	// Create a gRPC server on a unix domain socket
 	var udsServer *GrpcFrameworkServer
@@ -112,23 +145,52 @@ func New(config *ServerConfig) (*Server, error) {
 		}
 	}
 
+	// Share the health of the server between the gRPC servers
+	if udsServer != nil {
+		udsServer.health = netServer.health
+	}
+
 	// Create REST Gateway and connect it to the unix domain socket server
 	var restGateway *RestGateway
-	if config.RestConfig.Enabled {
+	if singlePort || inProcess {
+		restGateway, err = NewRestGateway(config, netServer)
+		if err != nil {
+			return nil, err
+		}
+	} else if config.RestConfig.Enabled {
 		restGateway, err = NewRestGateway(config, udsServer)
 		if err != nil {
 			return nil, err
 		}
 	}
 
+	// Share the TLS certificate between the servers so that it can be
+	// replaced at runtime
+	var certProvider *certificateProvider
+	if config.Security.Tls != nil {
+		certProvider, err = newCertificateProvider(config.Security.Tls)
+		if err != nil {
+			return nil, err
+		}
+		if config.Net != "unix" {
+			netServer.certProvider = certProvider
+		}
+		if restGateway != nil {
+			restGateway.certProvider = certProvider
+		}
+	}
+
 	return &Server{
-		config:      *config,
-		netServer:   netServer,
-		udsServer:   udsServer,
-		restGateway: restGateway,
-		auditLog:    auditLog,
-		accessLog:   accessLog,
-		grpcPort:    port,
+		config:       *config,
+		netServer:    netServer,
+		udsServer:    udsServer,
+		restGateway:  restGateway,
+		auditLog:     auditLog,
+		accessLog:    accessLog,
+		grpcPort:     port,
+		certProvider: certProvider,
+		errors:       make(chan error, serveErrorsBufferSize),
+		stopped:      make(chan struct{}),
 	}, nil
 }
 
@@ -152,11 +214,20 @@ func (s *Server) Start() error {
 			return err
 		}
 	}
+	s.securityLock.Lock()
+	if s.certProvider != nil && s.config.Security.Tls.ReloadInterval > 0 {
+		s.certProvider.watch(s.config.Security.Tls.ReloadInterval)
+	}
+	s.securityLock.Unlock()
+	s.watchServeErrors()
 
 	return nil
 }
 
 func (s *Server) Stop() {
+	if s.certProvider != nil {
+		s.certProvider.stopWatch()
+	}
 	if s.netServer != nil {
 		s.netServer.Stop()
 	}
@@ -172,9 +243,92 @@ func (s *Server) Stop() {
 	if s.auditLog != nil {
 		s.auditLog.Close()
 	}
+	s.markStopped()
+}
+
+// Shutdown gracefully stops all servers. The health of the gRPC services is set
+// to NOT_SERVING, the servers stop accepting new connections and the pending
+// requests are allowed to finish. The REST gateway is stopped first since its
+// requests are served by the gRPC server on the unix domain socket, or in
+// memory in single-port and in-process modes.
+//
+// If the context expires before the pending requests finish, the servers are
+// stopped, the pending requests are cancelled and the context error is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	if s.certProvider != nil {
+		s.certProvider.stopWatch()
+	}
+
+	// Tell the clients to go elsewhere before draining
+	for _, gs := range []*GrpcFrameworkServer{s.netServer, s.udsServer} {
+		if gs != nil {
+			gs.drain()
+		}
+	}
+
+	var errs []error
+	if s.restGateway != nil {
+		if err := s.restGateway.Shutdown(ctx); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	var (
+		wg   sync.WaitGroup
+		lock sync.Mutex
+	)
+	for _, gs := range []*GrpcFrameworkServer{s.netServer, s.udsServer} {
+		if gs == nil {
+			continue
+		}
+		wg.Add(1)
+		go func(gs *GrpcFrameworkServer) {
+			defer wg.Done()
+			if err := gs.Shutdown(ctx); err != nil {
+				lock.Lock()
+				errs = append(errs, err)
+				lock.Unlock()
+			}
+		}(gs)
+	}
+	wg.Wait()
+
+	if s.accessLog != nil {
+		s.accessLog.Close()
+	}
+	if s.auditLog != nil {
+		s.auditLog.Close()
+	}
+	s.markStopped()
+
+	if len(errs) != 0 {
+		return errs[0]
+	}
+	return nil
+}
+
+// SetServingStatus sets the health status of a gRPC service. Use the empty
+// service name to set the status of the whole server. The status reported by
+// the health service is NOT_SERVING, regardless of the status set, while the
+// server is not running or not ready.
+func (s *Server) SetServingStatus(service string, status grpc_health_v1.HealthCheckResponse_ServingStatus) {
+	s.netServer.health.setServingStatus(service, status)
+}
+
+// ServingStatus returns the health status of a gRPC service as reported by the
+// health service. Use the empty service name to get the status of the server.
+func (s *Server) ServingStatus(service string) (grpc_health_v1.HealthCheckResponse_ServingStatus, error) {
+	status, ok := s.netServer.health.servingStatus(service)
+	if !ok {
+		return status, fmt.Errorf("unknown service %s", service)
+	}
+	return status, nil
 }
 
 func (s *Server) Address() string {
+	if s.config.RestConfig.singlePort() {
+		return s.restGateway.Address()
+	}
 	return s.netServer.Address()
 }
 
@@ -205,3 +359,97 @@ func (s *Server) Transaction(f func() error) error {
 
 	return f()
 }
+
+// SecurityUpdate reports the changes made by UpdateSecurity
+type SecurityUpdate struct {
+	// AddedIssuers are the issuers of the new authenticators
+	AddedIssuers []string
+	// RemovedIssuers are the issuers no longer trusted
+	RemovedIssuers []string
+	// TlsReloaded is true if the TLS certificate was replaced
+	TlsReloaded bool
+}
+
+// UpdateSecurity replaces the authenticators, role manager and TLS certificate
+// of the running servers. The update does not wait for the requests in-flight,
+// which finish with the previous configuration, while new requests use the new one.
+//
+// Authentication and TLS cannot be enabled or disabled at runtime since
+// they determine the setup of the servers when they are started.
+func (s *Server) UpdateSecurity(security *SecurityConfig) (*SecurityUpdate, error) {
+	if security == nil {
+		return nil, fmt.Errorf("must provide security configuration")
+	}
+
+	s.securityLock.Lock()
+	defer s.securityLock.Unlock()
+
+	current := s.config.Security
+	if current.authEnabled() != security.authEnabled() {
+		return nil, fmt.Errorf("authentication cannot be enabled or disabled at runtime")
+	}
+	if (current.Tls == nil) != (security.Tls == nil) {
+		return nil, fmt.Errorf("TLS cannot be enabled or disabled at runtime")
+	}
+	if current.Tls != nil && security.Tls != nil &&
+		((current.Tls.ClientCAFile == "") != (security.Tls.ClientCAFile == "") ||
+			current.Tls.ClientCertPolicy != security.Tls.ClientCertPolicy) {
+		return nil, fmt.Errorf("mutual TLS cannot be changed at runtime")
+	}
+	if err := validateSecurityConfig(&s.config, security); err != nil {
+		return nil, err
+	}
+
+	// Load the certificate before replacing the configuration. On failure, nothing is changed.
+	var cert *certificateBundle
+	if security.Tls != nil && s.certProvider != nil {
+		var err error
+		cert, err = readCertificate(security.Tls)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	update := &SecurityUpdate{
+		TlsReloaded: cert != nil,
+	}
+	for issuer := range security.Authenticators {
+		if _, ok := current.Authenticators[issuer]; !ok {
+			update.AddedIssuers = append(update.AddedIssuers, issuer)
+		}
+	}
+	for issuer := range current.Authenticators {
+		if _, ok := security.Authenticators[issuer]; !ok {
+			update.RemovedIssuers = append(update.RemovedIssuers, issuer)
+		}
+	}
+	sort.Strings(update.AddedIssuers)
+	sort.Strings(update.RemovedIssuers)
+
+	s.config.Security = security
+	if s.netServer != nil {
+		s.netServer.setSecurity(security)
+	}
+	if s.udsServer != nil {
+		s.udsServer.setSecurity(security)
+	}
+	if cert != nil {
+		s.certProvider.set(cert)
+	}
+
+	// Restart the watcher in case the reload interval changed
+	if cert != nil {
+		s.certProvider.stopWatch()
+		if security.Tls.ReloadInterval > 0 {
+			s.certProvider.watch(security.Tls.ReloadInterval)
+		}
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"added":       update.AddedIssuers,
+		"removed":     update.RemovedIssuers,
+		"tlsReloaded": update.TlsReloaded,
+	}).Info("Security configuration updated")
+
+	return update, nil
+}
@@ -19,21 +19,50 @@ package server
 import (
 	"context"
 	"io"
+	"io/fs"
+	"time"
 
 	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
 	"github.com/libopenstorage/grpc-framework/pkg/auth"
+	"github.com/libopenstorage/grpc-framework/pkg/auth/revocation"
 	"github.com/libopenstorage/grpc-framework/pkg/auth/role"
 	"github.com/rs/cors"
 	"golang.org/x/time/rate"
 	"google.golang.org/grpc"
 )
 
+// ClientCertPolicy determines how the certificates of the clients are verified
+// when a client CA is configured
+type ClientCertPolicy string
+
+const (
+	// ClientCertPolicyRequire requires all clients to send a certificate signed
+	// by the client CA. This is the default.
+	ClientCertPolicyRequire ClientCertPolicy = "require"
+	// ClientCertPolicyVerifyIfGiven verifies the certificates of the clients which
+	// send one. Clients without a certificate can still authenticate with a token.
+	ClientCertPolicyVerifyIfGiven ClientCertPolicy = "verify-if-given"
+)
+
 // TLSConfig points to the cert files needed for HTTPS
 type TLSConfig struct {
 	// CertFile is the path to the cert file
 	CertFile string
 	// KeyFile is the path to the key file
 	KeyFile string
+	// ReloadInterval, if set, is how often the cert and key files are checked
+	// for changes. Changed files are reloaded and used for new connections
+	// without restarting the server. If the new files cannot be loaded, the
+	// current certificate is kept and the files are checked again on the
+	// next interval. Disabled by default.
+	ReloadInterval time.Duration
+	// ClientCAFile is the path to the bundle of CA certificates used to verify
+	// the certificates of the clients. Setting it enables mutual TLS. It is
+	// reloaded along with the cert and key files.
+	ClientCAFile string
+	// ClientCertPolicy sets how the client certificates are verified.
+	// Defaults to ClientCertPolicyRequire.
+	ClientCertPolicy ClientCertPolicy
 }
 
 // SecurityConfig provides configuration for SDK auth
@@ -47,6 +76,37 @@ type SecurityConfig struct {
 	// client IDs), use NewIteratingMultiAuthenticator or NewMultiAuthenticatorByClientID and
 	// then, add the returned multi-authenticator to this map.
 	Authenticators map[string]auth.Authenticator
+	// DefaultIssuer, if set, is the key in Authenticators of the
+	// authenticator of the tokens which are not JWTs, like the opaque access
+	// tokens checked by an auth.IntrospectionAuthenticator.
+	DefaultIssuer string
+	// CertificateAuthenticator, if set, authenticates the clients using their
+	// TLS certificates when they do not provide a token. It requires a client CA
+	// in the TLS configuration. Only the gRPC clients connecting directly to the
+	// TLS listener can be authenticated by certificate.
+	CertificateAuthenticator auth.CertificateAuthenticator
+	// APIKeyAuthenticator, if set, authenticates the API keys, like an
+	// auth.APIKeyAuthenticator. The keys are read from the x-api-key
+	// metadata, or from the bearer tokens starting with ak_, and do not
+	// need an issuer in Authenticators.
+	APIKeyAuthenticator auth.Authenticator
+	// ClaimsCache caches the claims of the verified tokens. Disabled by
+	// default. The cache is emptied when the security configuration is
+	// updated.
+	ClaimsCache ClaimsCacheConfig
+	// Revoker, if set, rejects the clients whose tokens, API keys or
+	// certificates have been revoked, like a revocation.FileRevoker. When
+	// the server starts with a Revoker and authentication, it registers the
+	// revocation.Revocations service to add and list the revocations. The
+	// service is authorized like any other service: the roles of the
+	// administrators must allow it, and the roles of the other users must
+	// not, e.g. they must not allow all the services with "*".
+	Revoker revocation.Revoker
+}
+
+// authEnabled returns true if the clients must be authenticated
+func (s *SecurityConfig) authEnabled() bool {
+	return s.Authenticators != nil || s.CertificateAuthenticator != nil || s.APIKeyAuthenticator != nil
 }
 
 type RestServerPrometheusConfig struct {
@@ -63,16 +123,112 @@ type RestServerCorsConfig struct {
 	CustomOptions *cors.Options
 }
 
+type RestServerOpenApiConfig struct {
+	Enabled bool
+
+	// OpenAPI documents, like the *.swagger.json files generated by
+	// grpcfw-rest. They are merged with the documents of FileSystems into a
+	// single document.
+	Documents [][]byte
+
+	// File systems, like an embed.FS, from which all the *.json files are
+	// read as OpenAPI documents
+	FileSystems []fs.FS
+
+	// Defaults to `/swagger.json` if not provided
+	Path string
+
+	// Path of the Swagger UI showing the merged document.
+	// Defaults to `/swagger-ui/` if not provided
+	SwaggerUIPath string
+
+	// Authenticate requires a valid token from one of the
+	// Security.Authenticators to get the document and the Swagger UI
+	Authenticate bool
+}
+
+// RestServerHeadersConfig selects the headers forwarded by the REST gateway
+// between the HTTP requests and responses and the gRPC metadata. The token
+// of the Authorization header, the API key of the X-Api-Key header and the
+// correlation ID are always forwarded.
+type RestServerHeadersConfig struct {
+	// HTTP request headers forwarded to the gRPC metadata under their lower
+	// case names. Other headers are forwarded only with the Grpc-Metadata-
+	// prefix, or with the grpcgateway- prefix for the standard HTTP headers.
+	Incoming []string
+
+	// gRPC response header and trailer metadata keys forwarded as HTTP
+	// headers under the same names. Other keys are forwarded with the
+	// Grpc-Metadata- and Grpc-Trailer- prefixes.
+	Outgoing []string
+}
+
 type RestServerConfig struct {
 	Enabled          bool
 	Port             string
 	CorsOptions      RestServerCorsConfig
 	PrometheusConfig RestServerPrometheusConfig
+	OpenApiConfig    RestServerOpenApiConfig
+	HeadersConfig    RestServerHeadersConfig
+
+	// SinglePort serves gRPC, the REST gateway, the metrics and the health
+	// endpoints on the gRPC Address instead of a separate Port. HTTP/2
+	// requests with a gRPC content type are served by the gRPC server and all
+	// other requests by the REST gateway, over TLS or h2c when TLS is not
+	// configured. The gateway connects to the gRPC server in memory, so no
+	// unix domain Socket is needed.
+	SinglePort bool
+
+	// WebProtocols accepts gRPC-Web and Connect requests on the REST
+	// listener for all the methods of the gRPC services, including the
+	// server streaming methods. The requests are served by the gRPC server
+	// with the same interceptors as any other gRPC request.
+	WebProtocols bool
+
+	// InProcess connects the REST gateway to the gRPC server in memory
+	// instead of through the unix domain Socket, which is then not needed.
+	// The requests from the gateway go through the same interceptors as the
+	// requests received from the network.
+	InProcess bool
+}
+
+// singlePort returns true if gRPC and REST are served on the same port
+func (c *RestServerConfig) singlePort() bool {
+	return c.Enabled && c.SinglePort
+}
+
+// inProcess returns true if the REST gateway connects in memory to the gRPC
+// server on the network
+func (c *RestServerConfig) inProcess() bool {
+	return c.Enabled && !c.SinglePort && c.InProcess
 }
 
 type RateLimiterConfig struct {
-	RateLimiter        RateLimiter
+	// RateLimiter is the global rate limiter shared by all requests
+	RateLimiter RateLimiter
+	// RateLimiterPerUser is used as a template to create a rate limiter for
+	// each user. It must be a golang.org/x/time/rate.Limiter or implement
+	// RateLimiterFactory. Requests are keyed by the authenticated username.
+	// Guests, and clients of servers which do not authenticate requests,
+	// are keyed by the address of their host. For REST requests, this is the
+	// address the gateway received the request from.
 	RateLimiterPerUser RateLimiter
+	// PerUserIdleTimeout is the time after which a user's unused rate
+	// limiter is removed. Defaults to 10 minutes if not provided.
+	PerUserIdleTimeout time.Duration
+	// PerUserMaxUsers is the maximum number of per user rate limiters kept.
+	// When reached, the least recently seen user is removed.
+	// Defaults to 10000 if not provided.
+	PerUserMaxUsers int
+	// Queue configures the global rate limiter to queue requests by
+	// priority instead of rejecting them immediately.
+	Queue RateLimiterQueueConfig
+	// Policies is a table of rate limiter policies keyed by the gRPC
+	// full method. Keys can use the wildcard patterns supported by
+	// role.MatchRule, for example: "/hello.hello.v1.HelloIdentity/*".
+	// When more than one pattern matches a method, the most specific
+	// one is used.
+	Policies map[string]RateLimiterPolicy
 }
 
 // ServerConfig provides the configuration to the SDK server
@@ -104,6 +260,20 @@ type ServerConfig struct {
 	// RateLimiters provide caller with the ability to setup rate limits for
 	// the gRPC server
 	RateLimiters RateLimiterConfig
+	// Health configures the health service of the server
+	Health HealthConfig
+	// Validation configures the validation of the requests
+	Validation ValidationConfig
+	// Deadlines sets the default and maximum deadlines of the requests
+	Deadlines DeadlineConfig
+	// PanicHandler, if set, is called when a handler panics. Panics are
+	// always recovered, logged to the access log and counted in the
+	// grpc_framework_server_panics_total metric.
+	PanicHandler PanicHandler
+	// ServeErrorPolicy determines what to do when one of the servers stops
+	// serving because of an error. Defaults to ServeErrorPolicyStop.
+	// See Server.Errors and Server.Wait.
+	ServeErrorPolicy ServeErrorPolicy
 	// ServerExtensions allows you to extend the SDK gRPC server
 	// with callback functions that are sequentially executed
 	// at the end of Server.Start()
@@ -134,6 +304,11 @@ type ServerConfig struct {
 	// ServerOptions hold any special gRPC server options
 	ServerOptions []grpc.ServerOption
 
+	// MaxReceiveMessageSize is the maximum size in bytes of the messages
+	// received by the gRPC server, and of the bodies of the Connect unary
+	// requests. Defaults to 4MB, the default of gRPC, if not provided.
+	MaxReceiveMessageSize int
+
 	// AuthNUnaryInterceptor installs a custom authN unary interceptor and overrides the default one
 	AuthNUnaryInterceptor grpc.UnaryServerInterceptor
 
@@ -211,6 +386,58 @@ func (c *ServerConfig) WithRestPrometheus(path string) *ServerConfig {
 	return c
 }
 
+// WithRestIncomingHeaders forwards the HTTP request headers to the gRPC
+// metadata. See RestServerHeadersConfig.
+func (c *ServerConfig) WithRestIncomingHeaders(headers ...string) *ServerConfig {
+	if c == nil {
+		return c
+	}
+	c.RestConfig.HeadersConfig.Incoming = append(c.RestConfig.HeadersConfig.Incoming, headers...)
+	return c
+}
+
+// WithRestOutgoingHeaders forwards the gRPC response metadata to the HTTP
+// response headers. See RestServerHeadersConfig.
+func (c *ServerConfig) WithRestOutgoingHeaders(keys ...string) *ServerConfig {
+	if c == nil {
+		return c
+	}
+	c.RestConfig.HeadersConfig.Outgoing = append(c.RestConfig.HeadersConfig.Outgoing, keys...)
+	return c
+}
+
+// WithRestOpenApi serves the OpenAPI documents, merged, and a Swagger UI.
+// See RestServerOpenApiConfig.
+func (c *ServerConfig) WithRestOpenApi(documents ...[]byte) *ServerConfig {
+	if c == nil {
+		return c
+	}
+	c.RestConfig.OpenApiConfig.Enabled = true
+	c.RestConfig.OpenApiConfig.Documents = append(c.RestConfig.OpenApiConfig.Documents, documents...)
+	return c
+}
+
+// WithRestOpenApiFS serves the OpenAPI documents of the file system, merged,
+// and a Swagger UI. See RestServerOpenApiConfig.
+func (c *ServerConfig) WithRestOpenApiFS(fsys fs.FS) *ServerConfig {
+	if c == nil {
+		return c
+	}
+	c.RestConfig.OpenApiConfig.Enabled = true
+	c.RestConfig.OpenApiConfig.FileSystems = append(c.RestConfig.OpenApiConfig.FileSystems, fsys)
+	return c
+}
+
+// WithRestOpenApiAuthentication requires a valid token to get the OpenAPI
+// document and the Swagger UI
+func (c *ServerConfig) WithRestOpenApiAuthentication() *ServerConfig {
+	if c == nil {
+		return c
+	}
+	c.RestConfig.OpenApiConfig.Authenticate = true
+	return c
+}
+
 func (c *ServerConfig) WithDefaultRestServer(port string) *ServerConfig {
 	if c == nil {
 		return c
@@ -221,6 +448,40 @@ func (c *ServerConfig) WithDefaultRestServer(port string) *ServerConfig {
 	return c.WithRestCors(DefaultRestServerCors).WithRestPrometheus("/metrics")
 }
 
+// WithSinglePortRestServer serves the default REST server on the gRPC Address.
+// See RestServerConfig.SinglePort.
+func (c *ServerConfig) WithSinglePortRestServer() *ServerConfig {
+	if c == nil {
+		return c
+	}
+
+	c.RestConfig.SinglePort = true
+	c.RestConfig.Enabled = true
+	return c.WithRestCors(DefaultRestServerCors).WithRestPrometheus("/metrics")
+}
+
+// WithRestWebProtocols accepts gRPC-Web and Connect requests on the REST listener.
+// See RestServerConfig.WebProtocols.
+func (c *ServerConfig) WithRestWebProtocols() *ServerConfig {
+	if c == nil {
+		return c
+	}
+
+	c.RestConfig.WebProtocols = true
+	return c
+}
+
+// WithRestInProcess connects the REST gateway to the gRPC server in memory.
+// See RestServerConfig.InProcess.
+func (c *ServerConfig) WithRestInProcess() *ServerConfig {
+	if c == nil {
+		return c
+	}
+
+	c.RestConfig.InProcess = true
+	return c
+}
+
 func (c *ServerConfig) WithAuthNInterceptors(unary grpc.UnaryServerInterceptor, stream grpc.StreamServerInterceptor,
 ) *ServerConfig {
 	if c == nil {
@@ -253,6 +514,28 @@ func (c *ServerConfig) WithExternalAuthZChecker(
 	return c
 }
 
+// WithRequestValidation validates the requests before they are handled,
+// with the validator if provided. See ValidationConfig.
+func (c *ServerConfig) WithRequestValidation(validator RequestValidator) *ServerConfig {
+	if c == nil {
+		return c
+	}
+
+	c.Validation.Enabled = true
+	c.Validation.Validator = validator
+	return c
+}
+
+// WithPanicHandler calls the handler when a gRPC handler panics.
+// See PanicHandler.
+func (c *ServerConfig) WithPanicHandler(handler PanicHandler) *ServerConfig {
+	if c == nil {
+		return c
+	}
+	c.PanicHandler = handler
+	return c
+}
+
 func (c *ServerConfig) WithServerUnaryInterceptors(i ...grpc.UnaryServerInterceptor) *ServerConfig {
 	if c == nil {
 		return c
@@ -280,6 +563,17 @@ func (c *ServerConfig) WithServerOptions(opt ...grpc.ServerOption) *ServerConfig
 	return c
 }
 
+// WithMaxReceiveMessageSize sets the maximum size in bytes of the received messages.
+// See ServerConfig.MaxReceiveMessageSize.
+func (c *ServerConfig) WithMaxReceiveMessageSize(size int) *ServerConfig {
+	if c == nil {
+		return c
+	}
+
+	c.MaxReceiveMessageSize = size
+	return c
+}
+
 func (c *ServerConfig) WithRateLimiter(r RateLimiter) *ServerConfig {
 	if c == nil {
 		return c
@@ -298,12 +592,108 @@ func (c *ServerConfig) WithRateLimiterPerUser(r RateLimiter) *ServerConfig {
 	return c
 }
 
+func (c *ServerConfig) WithRateLimiterQueue(q RateLimiterQueueConfig) *ServerConfig {
+	if c == nil {
+		return c
+	}
+
+	q.Enabled = true
+	c.RateLimiters.Queue = q
+	return c
+}
+
+func (c *ServerConfig) WithRateLimiterPolicy(pattern string, p RateLimiterPolicy) *ServerConfig {
+	if c == nil {
+		return c
+	}
+
+	if c.RateLimiters.Policies == nil {
+		c.RateLimiters.Policies = make(map[string]RateLimiterPolicy)
+	}
+	c.RateLimiters.Policies[pattern] = p
+	return c
+}
+
+// WithDeadline sets the default and maximum timeouts of the requests, like
+// `30s` or `5m`. Empty timeouts are not set. See DeadlineConfig.
+func (c *ServerConfig) WithDeadline(defaultTimeout, maxTimeout string) *ServerConfig {
+	if c == nil {
+		return c
+	}
+
+	c.Deadlines.Default = defaultTimeout
+	c.Deadlines.Max = maxTimeout
+	return c
+}
+
+// WithMethodDeadline sets the default and maximum timeouts of the methods
+// matching the pattern. See DeadlineConfig.
+func (c *ServerConfig) WithMethodDeadline(pattern, defaultTimeout, maxTimeout string) *ServerConfig {
+	if c == nil {
+		return c
+	}
+
+	if c.Deadlines.Methods == nil {
+		c.Deadlines.Methods = make(map[string]DeadlinePolicy)
+	}
+	c.Deadlines.Methods[pattern] = DeadlinePolicy{
+		Default: defaultTimeout,
+		Max:     maxTimeout,
+	}
+	return c
+}
+
+// WithReadinessCheck adds a readiness check to the health service of the server.
+// While the check fails, the server and all its services are NOT_SERVING.
+func (c *ServerConfig) WithReadinessCheck(name string, check ReadinessCheck) *ServerConfig {
+	if c == nil {
+		return c
+	}
+	if c.Health.ReadinessChecks == nil {
+		c.Health.ReadinessChecks = make(map[string]ReadinessCheck)
+	}
+	c.Health.ReadinessChecks[name] = check
+	return c
+}
+
 func (c *ServerConfig) WithDefaultRateLimiters() *ServerConfig {
 	return c.
 		WithRateLimiter(DefaultRateLimiter).
 		WithRateLimiterPerUser(DefaultRateLimiterPerUser)
 }
 
+// WithClaimsCache caches the claims of up to size verified tokens, for at
+// most ttl. See ClaimsCacheConfig.
+func (c *ServerConfig) WithClaimsCache(size int, ttl time.Duration) *ServerConfig {
+	if c == nil {
+		return c
+	}
+	if c.Security == nil {
+		c.Security = &SecurityConfig{}
+	}
+
+	c.Security.ClaimsCache = ClaimsCacheConfig{
+		Size: size,
+		TTL:  ttl,
+	}
+	return c
+}
+
+// WithRevoker rejects the clients whose credentials have been revoked in
+// the revoker, and registers the revocation.Revocations service when the
+// clients are authenticated. See SecurityConfig.Revoker.
+func (c *ServerConfig) WithRevoker(revoker revocation.Revoker) *ServerConfig {
+	if c == nil {
+		return c
+	}
+	if c.Security == nil {
+		c.Security = &SecurityConfig{}
+	}
+
+	c.Security.Revoker = revoker
+	return c
+}
+
 func (c *ServerConfig) WithDefaultGenericRoleManager() *ServerConfig {
 	if c.Security == nil {
 		c.Security = &SecurityConfig{}
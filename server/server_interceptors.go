@@ -23,6 +23,7 @@ import (
 	grpc_auth "github.com/grpc-ecosystem/go-grpc-middleware/auth"
 	"github.com/libopenstorage/grpc-framework/pkg/auth"
 	"github.com/libopenstorage/grpc-framework/pkg/correlation"
+	grpcerrors "github.com/libopenstorage/grpc-framework/pkg/grpc/errors"
 	grpcutil "github.com/libopenstorage/grpc-framework/pkg/grpc/util"
 	"github.com/pborman/uuid"
 	"github.com/sirupsen/logrus"
@@ -66,22 +67,90 @@ func (s *GrpcFrameworkServer) rwlockStreamIntercepter(
 	return handler(srv, stream)
 }
 
+// isGuest returns true if the request has neither a token nor, when API keys
+// are authenticated, an API key
+func (s *serverSecurity) isGuest(ctx context.Context) bool {
+	if !auth.IsGuest(ctx) {
+		return false
+	}
+	if s.config.APIKeyAuthenticator == nil {
+		return true
+	}
+	_, ok := auth.APIKeyFromContext(ctx)
+	return !ok
+}
+
 // Authenticate user and add authorization information back in the context
 func (s *GrpcFrameworkServer) auth(ctx context.Context) (context.Context, error) {
 	// Audit log
 	log := correlation.NewFunctionLogger(ctx)
 	log.Out = s.auditLogOutput
 	auditLogWarningf := func(c codes.Code, err error, format string, a ...interface{}) error {
-		log.WithContext(ctx).WithFields(logrus.Fields{
+		fields := logrus.Fields{
 			"method": "Authentication",
 			"code":   c.String(),
-			"error":  err.Error(),
-		}).Warningf(format, a...)
+		}
+		if err != nil {
+			fields["error"] = err.Error()
+		}
+		log.WithContext(ctx).WithFields(fields).Warningf(format, a...)
 		return status.Errorf(c, format, a...)
 	}
 
+	// Use the same configuration for the whole authentication
+	security := s.currentSecurity()
+
+	// Save the user information of authenticated clients unless their
+	// tokens have been revoked
+	authenticated := func(userInfo *auth.UserInfo) (context.Context, error) {
+		if revoker := security.config.Revoker; revoker != nil {
+			revocation, err := revoker.IsRevoked(ctx, &userInfo.Claims)
+			if err != nil {
+				return nil, auditLogWarningf(codes.Unavailable, err, "Unable to check the revocation of the credentials")
+			}
+			if revocation != nil {
+				return nil, auditLogWarningf(codes.Unauthenticated, nil, "Credentials of %s have been revoked", userInfo.Username)
+			}
+		}
+		return auth.ContextSaveUserInfo(ctx, userInfo), nil
+	}
+
+	// Authenticate with the client certificate when no token is provided
+	if security.isGuest(ctx) && security.config.CertificateAuthenticator != nil {
+		if cert := peerCertificate(ctx); cert != nil {
+			claims, err := security.config.CertificateAuthenticator.AuthenticateCertificate(ctx, cert)
+			if err != nil {
+				return nil, auditLogWarningf(codes.Unauthenticated, err, "Unable to authenticate client certificate")
+			}
+			username, err := claims.GetUsername()
+			if err != nil {
+				return nil, auditLogWarningf(codes.Unauthenticated, err, "Unable to get username from client certificate")
+			}
+			return authenticated(&auth.UserInfo{
+				Username: username,
+				Claims:   *claims,
+			})
+		}
+	}
+
+	// API keys are authenticated without an issuer
+	if apiKey, ok := auth.APIKeyFromContext(ctx); ok && security.config.APIKeyAuthenticator != nil {
+		claims, err := security.config.APIKeyAuthenticator.AuthenticateToken(ctx, apiKey)
+		if err != nil {
+			return nil, auditLogWarningf(codes.Unauthenticated, err, "Unable to authenticate API key")
+		}
+		username, err := claims.GetUsername()
+		if err != nil {
+			return nil, auditLogWarningf(codes.Unauthenticated, err, "Unable to get username from API key")
+		}
+		return authenticated(&auth.UserInfo{
+			Username: username,
+			Claims:   *claims,
+		})
+	}
+
 	// guest call attempted, add system.guest user
-	if auth.IsGuest(ctx) {
+	if security.isGuest(ctx) {
 		return auth.ContextSaveUserInfo(ctx, auth.NewGuestUser()), nil
 	}
 
@@ -91,14 +160,25 @@ func (s *GrpcFrameworkServer) auth(ctx context.Context) (context.Context, error)
 		return nil, auditLogWarningf(codes.Unauthenticated, err, "Invalid or missing authentication token")
 	}
 
-	// Determine issuer
-	issuer, err := auth.TokenIssuer(token)
-	if err != nil {
-		return nil, auditLogWarningf(codes.Unauthenticated, err, "Unable to obtain token issuer from authorization token")
+	// Tokens already verified are cached
+	if userInfo, ok := security.claimsCache.get(token); ok {
+		return authenticated(userInfo)
+	}
+
+	// Determine issuer. Tokens which are not JWTs are authenticated by
+	// the authenticator of the default issuer, if any.
+	var issuer string
+	if security.config.DefaultIssuer != "" && !auth.IsJwtToken(token) {
+		issuer = security.config.DefaultIssuer
+	} else {
+		issuer, err = auth.TokenIssuer(token)
+		if err != nil {
+			return nil, auditLogWarningf(codes.Unauthenticated, err, "Unable to obtain token issuer from authorization token")
+		}
 	}
 
 	// Authenticate user
-	authenticator, ok := s.config.Security.Authenticators[issuer]
+	authenticator, ok := security.config.Authenticators[issuer]
 	if !ok {
 		return nil, auditLogWarningf(codes.Unauthenticated, nil, "%s is not a trusted issuer", issuer)
 	}
@@ -110,13 +190,16 @@ func (s *GrpcFrameworkServer) auth(ctx context.Context) (context.Context, error)
 	if err != nil {
 		return nil, auditLogWarningf(codes.Unauthenticated, err, "Unable to get username from token")
 	}
+	userInfo := &auth.UserInfo{
+		Username: username,
+		Claims:   *claims,
+	}
+	security.claimsCache.add(token, userInfo)
+
 	// Add authorization information back into the context so that other
 	// functions can get access to this information.
 	// If this is in the context is how functions will know that security is enabled.
-	return auth.ContextSaveUserInfo(ctx, &auth.UserInfo{
-		Username: username,
-		Claims:   *claims,
-	}), nil
+	return authenticated(userInfo)
 }
 
 func (s *GrpcFrameworkServer) loggerInterceptor(ctx context.Context, handler func() error, fullMethod string) error {
@@ -206,18 +289,19 @@ func (s *GrpcFrameworkServer) authorizationInterceptor(
 	}).WithContext(ctx)
 
 	// Authorize
-	if err := s.roleServer.Verify(ctx, claims.Roles, fullMethod); err != nil {
+	security := s.currentSecurity()
+	if err := security.config.Role.Verify(ctx, claims.Roles, fullMethod); err != nil {
 		logger.Warning("Access denied")
-		if auth.IsGuest(ctx) {
-			return status.Errorf(
-				codes.PermissionDenied,
-				"Access denied without authentication token")
+		metadata := map[string]string{"method": fullMethod}
+		if security.isGuest(ctx) {
+			return grpcerrors.PermissionDenied(
+				"Access denied without authentication token",
+				grpcerrors.ReasonAccessDenied, grpcerrors.Domain, metadata)
 		}
 
-		return status.Errorf(
-			codes.PermissionDenied,
-			"Access to %s denied: %v",
-			fullMethod, err)
+		return grpcerrors.PermissionDenied(
+			fmt.Sprintf("Access to %s denied: %v", fullMethod, err),
+			grpcerrors.ReasonAccessDenied, grpcerrors.Domain, metadata)
 	}
 
 	// Check if we have been denied
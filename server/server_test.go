@@ -16,25 +16,43 @@ limitations under the License.
 package server
 
 import (
+	"bytes"
 	"context"
+	"crypto/tls"
+	"crypto/x509/pkix"
+	"encoding/json"
 	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
+	jwt "github.com/golang-jwt/jwt/v4"
+	"github.com/libopenstorage/grpc-framework/pkg/auth"
+	"github.com/libopenstorage/grpc-framework/pkg/auth/role"
 	grpcclient "github.com/libopenstorage/grpc-framework/pkg/grpc/client"
+	grpcerrors "github.com/libopenstorage/grpc-framework/pkg/grpc/errors"
 	appserver "github.com/libopenstorage/grpc-framework/test/app/pkg/server"
 	appapi "github.com/libopenstorage/grpc-framework/test/app/protos/apis/hello/apiv1"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"golang.org/x/time/rate"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
 )
 
 var (
-	grpcSocket = "/tmp/grpc-framework-testServer.sock"
+	grpcSocket       = "/tmp/grpc-framework-testServer.sock"
+	testSharedSecret = "mysecret"
 )
 
 type testServer struct {
@@ -94,6 +112,29 @@ func newTestServer(t *testing.T, config *ServerConfig) *testServer {
 	}
 }
 
+// contextWithToken returns an outgoing context with a token signed by testSharedSecret
+func contextWithToken(t *testing.T, ctx context.Context, issuer, subject string, roles []string) context.Context {
+	return metadata.AppendToOutgoingContext(ctx, "authorization", "bearer "+testToken(t, issuer, subject, roles))
+}
+
+// testToken returns a token signed by testSharedSecret
+func testToken(t *testing.T, issuer, subject string, roles []string) string {
+	token, err := auth.Token(&auth.Claims{
+		Issuer:  issuer,
+		Subject: subject,
+		Name:    subject,
+		Email:   subject + "@example.com",
+		Roles:   roles,
+	}, &auth.Signature{
+		Type: jwt.SigningMethodHS256,
+		Key:  []byte(testSharedSecret),
+	}, &auth.Options{
+		Expiration: time.Now().Add(time.Minute).Unix(),
+	})
+	assert.NoError(t, err)
+	return token
+}
+
 func newDefaultTestServer(t *testing.T) *testServer {
 	return newTestServer(t, newDefaultConfig(t))
 }
@@ -217,3 +258,1056 @@ func TestServerNoRateLimiter(t *testing.T) {
 
 	assert.False(t, rateLimiterShowsDenial(t, s))
 }
+
+func TestServerRateLimiterPerUser(t *testing.T) {
+	authenticator, err := auth.NewJwtAuthenticator(&auth.JwtAuthConfig{
+		SharedSecret: []byte(testSharedSecret),
+	})
+	require.NoError(t, err)
+	c := newDefaultConfig(t)
+	c.WithRateLimiterPerUser(rate.NewLimiter(1, 1)).
+		WithDefaultGenericRoleManager()
+	c.Security.Authenticators = map[string]auth.Authenticator{
+		"testissuer": authenticator,
+	}
+	s := newTestServer(t, c)
+	defer s.Stop()
+
+	contextWithUser := func(username string) context.Context {
+		return contextWithToken(t, context.Background(), "testissuer", username, []string{"system.admin"})
+	}
+
+	g := appapi.NewHelloGreeterClient(s.Conn())
+
+	// First user uses up its bucket
+	ctx := contextWithUser("user1")
+	_, err = g.SayHello(ctx, &appapi.HelloGreeterSayHelloRequest{})
+	assert.NoError(t, err)
+
+	var header metadata.MD
+	_, err = g.SayHello(ctx, &appapi.HelloGreeterSayHelloRequest{}, grpc.Header(&header))
+	assert.Error(t, err)
+	serverError, ok := status.FromError(err)
+	assert.True(t, ok)
+	assert.Equal(t, codes.ResourceExhausted, serverError.Code())
+	assert.Equal(t, []string{"1"}, header.Get(RetryAfterMetadataKey))
+	assert.True(t, grpcerrors.HasReason(err, grpcerrors.ReasonRateLimited, grpcerrors.Domain))
+	retryDelay, ok := grpcerrors.RetryDelay(err)
+	assert.True(t, ok)
+	assert.Equal(t, time.Second, retryDelay)
+	require.Len(t, grpcerrors.QuotaFailure(err).GetViolations(), 1)
+	assert.Equal(t, "user:user1", grpcerrors.QuotaFailure(err).GetViolations()[0].GetSubject())
+
+	// Second user is not affected
+	_, err = g.SayHello(contextWithUser("user2"), &appapi.HelloGreeterSayHelloRequest{})
+	assert.NoError(t, err)
+
+	// Guests are limited by the address of their host
+	_, err = g.SayHello(context.Background(), &appapi.HelloGreeterSayHelloRequest{})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = g.SayHello(context.Background(), &appapi.HelloGreeterSayHelloRequest{})
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+	require.Len(t, grpcerrors.QuotaFailure(err).GetViolations(), 1)
+	assert.Equal(t, "user:peer:127.0.0.1", grpcerrors.QuotaFailure(err).GetViolations()[0].GetSubject())
+}
+
+func TestServerRateLimiterPerUserRest(t *testing.T) {
+	c := newDefaultConfig(t)
+	c.WithRateLimiterPerUser(rate.NewLimiter(1, 1)).
+		RegisterRestHandlers(appapi.RegisterHelloGreeterHandler)
+	s := newTestServer(t, c)
+	defer s.Stop()
+
+	// restClientFrom returns a client connecting from the local address ip
+	restClientFrom := func(ip string) *http.Client {
+		dialer := &net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP(ip)}}
+		return &http.Client{Transport: &http.Transport{DialContext: dialer.DialContext}}
+	}
+	client1 := restClientFrom("127.0.0.1")
+	client2 := restClientFrom("127.0.0.2")
+	url := "http://127.0.0.1:9001"
+
+	// First client uses up its bucket
+	assert.Equal(t, http.StatusOK, testRestSayHello(t, client1, url, ""))
+	assert.Equal(t, http.StatusTooManyRequests, testRestSayHello(t, client1, url, ""))
+
+	// Forwarded addresses set by the client are not used
+	req, err := http.NewRequest(http.MethodPost, url+"/v1/greeter:sayHello", strings.NewReader(`{"name":"jim"}`))
+	require.NoError(t, err)
+	req.Header.Set("X-Forwarded-For", "10.0.0.1")
+	resp, err := client1.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+
+	// Second client is not affected
+	assert.Equal(t, http.StatusOK, testRestSayHello(t, client2, url, ""))
+}
+
+func TestServerRateLimiterQueue(t *testing.T) {
+	c := newDefaultConfig(t)
+	c.WithRateLimiter(rate.NewLimiter(20, 1)).
+		WithRateLimiterQueue(RateLimiterQueueConfig{
+			MaxWait: 5 * time.Second,
+		})
+	s := newTestServer(t, c)
+	defer s.Stop()
+
+	// Requests over the limit wait instead of being rejected
+	assert.False(t, rateLimiterShowsDenial(t, s))
+}
+
+func TestServerRateLimiterPolicy(t *testing.T) {
+	c := newDefaultConfig(t)
+	c.WithRateLimiter(rate.NewLimiter(rate.Inf, 0)).
+		WithRateLimiterPolicy("/hello.hello.v1.HelloGreeter/*", RateLimiterPolicy{
+			Rate:  1,
+			Burst: 1,
+		})
+	s := newTestServer(t, c)
+	defer s.Stop()
+
+	g := appapi.NewHelloGreeterClient(s.Conn())
+	_, err := g.SayHello(context.Background(), &appapi.HelloGreeterSayHelloRequest{})
+	assert.NoError(t, err)
+
+	// The method is limited by its policy instead of the global limiter
+	_, err = g.SayHello(context.Background(), &appapi.HelloGreeterSayHelloRequest{})
+	assert.Error(t, err)
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+}
+
+func TestServerUpdateSecurity(t *testing.T) {
+	newAuthenticator := func() auth.Authenticator {
+		a, err := auth.NewJwtAuthenticator(&auth.JwtAuthConfig{
+			SharedSecret: []byte(testSharedSecret),
+		})
+		assert.NoError(t, err)
+		return a
+	}
+
+	config := &ServerConfig{
+		Name:    "testServer",
+		Net:     "tcp",
+		Address: "127.0.0.1:0",
+		Socket:  grpcSocket,
+		Security: &SecurityConfig{
+			Authenticators: map[string]auth.Authenticator{
+				"issuer1": newAuthenticator(),
+				"issuer2": newAuthenticator(),
+			},
+		},
+	}
+	config.RegisterGrpcServers(func(gs *grpc.Server) {
+		appapi.RegisterHelloGreeterServer(gs, &appserver.HelloGreeter{})
+	}).WithDefaultGenericRoleManager()
+	s := newTestServer(t, config)
+	defer s.Stop()
+
+	g := appapi.NewHelloGreeterClient(s.Conn())
+	sayHello := func(issuer string) error {
+		ctx := contextWithToken(t, context.Background(), issuer, "jim", []string{"system.admin"})
+		_, err := g.SayHello(ctx, &appapi.HelloGreeterSayHelloRequest{Name: "jim"})
+		return err
+	}
+	assert.NoError(t, sayHello("issuer1"))
+	assert.Equal(t, codes.Unauthenticated, status.Code(sayHello("issuer3")))
+
+	// Authentication cannot be disabled
+	_, err := s.server.UpdateSecurity(&SecurityConfig{})
+	assert.Error(t, err)
+
+	// Role manager is required
+	_, err = s.server.UpdateSecurity(&SecurityConfig{
+		Authenticators: map[string]auth.Authenticator{
+			"issuer3": newAuthenticator(),
+		},
+	})
+	assert.Error(t, err)
+
+	// The update does not wait for the streams in-flight
+	watchCtx, cancelWatch := context.WithCancel(context.Background())
+	defer cancelWatch()
+	watch, err := grpc_health_v1.NewHealthClient(s.Conn()).Watch(watchCtx, &grpc_health_v1.HealthCheckRequest{})
+	require.NoError(t, err)
+	_, err = watch.Recv()
+	require.NoError(t, err)
+
+	updated := make(chan *SecurityUpdate)
+	go func() {
+		update, err := s.server.UpdateSecurity(&SecurityConfig{
+			Authenticators: map[string]auth.Authenticator{
+				"issuer2": newAuthenticator(),
+				"issuer3": newAuthenticator(),
+			},
+			Role: role.NewDefaultGenericRoleManager(),
+		})
+		assert.NoError(t, err)
+		updated <- update
+	}()
+	var update *SecurityUpdate
+	select {
+	case update = <-updated:
+	case <-time.After(5 * time.Second):
+		t.Fatal("security update blocked by the stream in-flight")
+	}
+	require.NotNil(t, update)
+	assert.Equal(t, []string{"issuer3"}, update.AddedIssuers)
+	assert.Equal(t, []string{"issuer1"}, update.RemovedIssuers)
+	assert.False(t, update.TlsReloaded)
+
+	assert.Equal(t, codes.Unauthenticated, status.Code(sayHello("issuer1")))
+	assert.NoError(t, sayHello("issuer2"))
+	assert.NoError(t, sayHello("issuer3"))
+}
+
+func TestServerDefaultIssuer(t *testing.T) {
+	introspection := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		resp := map[string]interface{}{"active": false}
+		if r.PostFormValue("token") == "opaque-token" {
+			resp = map[string]interface{}{
+				"active": true,
+				"sub":    "jim",
+				"roles":  []string{"system.admin"},
+				"exp":    time.Now().Add(time.Hour).Unix(),
+			}
+		}
+		assert.NoError(t, json.NewEncoder(w).Encode(resp))
+	}))
+	defer introspection.Close()
+
+	opaque, err := auth.NewIntrospectionAuthenticator(&auth.IntrospectionAuthConfig{
+		Issuer: "https://idp.example.com",
+		URL:    introspection.URL,
+	})
+	require.NoError(t, err)
+	jwtAuthenticator, err := auth.NewJwtAuthenticator(&auth.JwtAuthConfig{
+		SharedSecret: []byte(testSharedSecret),
+	})
+	require.NoError(t, err)
+
+	config := &ServerConfig{
+		Name:    "testServer",
+		Net:     "tcp",
+		Address: "127.0.0.1:0",
+		Socket:  grpcSocket,
+		Security: &SecurityConfig{
+			Authenticators: map[string]auth.Authenticator{
+				"https://idp.example.com": opaque,
+				"testissuer":              jwtAuthenticator,
+			},
+			DefaultIssuer: "https://idp.example.com",
+		},
+	}
+	config.RegisterGrpcServers(func(gs *grpc.Server) {
+		appapi.RegisterHelloGreeterServer(gs, &appserver.HelloGreeter{})
+	}).WithDefaultGenericRoleManager()
+	s := newTestServer(t, config)
+	defer s.Stop()
+
+	g := appapi.NewHelloGreeterClient(s.Conn())
+	sayHello := func(token string) error {
+		ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "bearer "+token)
+		_, err := g.SayHello(ctx, &appapi.HelloGreeterSayHelloRequest{Name: "jim"})
+		return err
+	}
+	assert.NoError(t, sayHello("opaque-token"))
+	assert.Equal(t, codes.Unauthenticated, status.Code(sayHello("unknown-token")))
+
+	// JWTs are still authenticated by the authenticator of their issuer
+	assert.NoError(t, sayHello(testToken(t, "testissuer", "jim", []string{"system.admin"})))
+	assert.Equal(t, codes.Unauthenticated,
+		status.Code(sayHello(testToken(t, "https://idp.example.com", "jim", []string{"system.admin"}))))
+
+	// The default issuer must have an authenticator
+	_, err = s.server.UpdateSecurity(&SecurityConfig{
+		Authenticators: map[string]auth.Authenticator{
+			"testissuer": jwtAuthenticator,
+		},
+		DefaultIssuer: "https://idp.example.com",
+		Role:          role.NewDefaultGenericRoleManager(),
+	})
+	assert.Error(t, err)
+}
+
+func TestServerAPIKey(t *testing.T) {
+	rawkey, key, err := auth.NewAPIKey(&auth.Claims{
+		Subject: "ci",
+		Roles:   []string{"system.admin"},
+	}, 0)
+	require.NoError(t, err)
+	store := auth.NewMemoryKeyStore(key)
+	apiKeyAuthenticator, err := auth.NewAPIKeyAuthenticator(&auth.APIKeyAuthConfig{Store: store})
+	require.NoError(t, err)
+
+	config := &ServerConfig{
+		Name:    "testServer",
+		Net:     "tcp",
+		Address: "127.0.0.1:0",
+		Socket:  grpcSocket,
+		Security: &SecurityConfig{
+			APIKeyAuthenticator: apiKeyAuthenticator,
+		},
+	}
+	config.WithDefaultRestServer("9001").
+		WithDefaultGenericRoleManager().
+		RegisterGrpcServers(func(gs *grpc.Server) {
+			appapi.RegisterHelloGreeterServer(gs, &appserver.HelloGreeter{})
+		}).
+		RegisterRestHandlers(appapi.RegisterHelloGreeterHandler)
+	s := newTestServer(t, config)
+	defer s.Stop()
+
+	g := appapi.NewHelloGreeterClient(s.Conn())
+	sayHello := func(kv ...string) error {
+		ctx := metadata.AppendToOutgoingContext(context.Background(), kv...)
+		_, err := g.SayHello(ctx, &appapi.HelloGreeterSayHelloRequest{Name: "jim"})
+		return err
+	}
+	assert.NoError(t, sayHello(auth.APIKeyMetadataKey, rawkey))
+	assert.NoError(t, sayHello("authorization", "bearer "+rawkey))
+	assert.Equal(t, codes.Unauthenticated, status.Code(sayHello(auth.APIKeyMetadataKey, rawkey+"x")))
+	assert.Equal(t, codes.PermissionDenied, status.Code(sayHello()))
+
+	// The REST gateway forwards the API key
+	req, err := http.NewRequest(http.MethodPost, "http://localhost:9001/v1/greeter:sayHello", strings.NewReader(`{"name":"jim"}`))
+	require.NoError(t, err)
+	req.Header.Set("X-Api-Key", rawkey)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// Revoked keys are rejected
+	require.NoError(t, store.RevokeKey(context.Background(), key.ID))
+	assert.Equal(t, codes.Unauthenticated, status.Code(sayHello(auth.APIKeyMetadataKey, rawkey)))
+}
+
+func TestServerAPIKeyWithoutAuthenticator(t *testing.T) {
+	authenticator, err := auth.NewJwtAuthenticator(&auth.JwtAuthConfig{
+		SharedSecret: []byte(testSharedSecret),
+	})
+	require.NoError(t, err)
+	c := newDefaultConfig(t)
+	c.Security = &SecurityConfig{
+		Authenticators: map[string]auth.Authenticator{
+			"testissuer": authenticator,
+		},
+	}
+	c.WithDefaultGenericRoleManager()
+	s := newTestServer(t, c)
+	defer s.Stop()
+
+	// The x-api-key metadata is ignored, and the request is made as a guest
+	g := appapi.NewHelloGreeterClient(s.Conn())
+	ctx := metadata.AppendToOutgoingContext(context.Background(), auth.APIKeyMetadataKey, "ak_id_secret")
+	_, err = g.SayHello(ctx, &appapi.HelloGreeterSayHelloRequest{Name: "jim"})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	assert.Contains(t, status.Convert(err).Message(), "without authentication token")
+}
+
+func TestServerUpdateSecurityTls(t *testing.T) {
+	dir := t.TempDir()
+	first := testCreateCertFiles(t, dir, "first")
+	second := testCreateCertFiles(t, dir, "second")
+
+	config := &ServerConfig{
+		Name:    "testServer",
+		Net:     "tcp",
+		Address: "127.0.0.1:0",
+		Security: &SecurityConfig{
+			Tls: first,
+		},
+	}
+	s, err := New(config)
+	assert.NoError(t, err)
+	assert.NoError(t, s.Start())
+	defer s.Stop()
+
+	assert.Equal(t, "first", testServedCertificateName(t, s.Address()))
+
+	// TLS cannot be disabled
+	_, err = s.UpdateSecurity(&SecurityConfig{})
+	assert.Error(t, err)
+
+	update, err := s.UpdateSecurity(&SecurityConfig{
+		Tls: second,
+	})
+	assert.NoError(t, err)
+	assert.True(t, update.TlsReloaded)
+	assert.Empty(t, update.AddedIssuers)
+	assert.Empty(t, update.RemovedIssuers)
+
+	assert.Equal(t, "second", testServedCertificateName(t, s.Address()))
+}
+
+func TestServerUpdateSecurityWhileStarting(t *testing.T) {
+	dir := t.TempDir()
+	first := testCreateCertFiles(t, dir, "first")
+	second := testCreateCertFiles(t, dir, "second")
+	first.ReloadInterval = time.Minute
+	second.ReloadInterval = time.Minute
+
+	config := &ServerConfig{
+		Name:    "testServer",
+		Net:     "tcp",
+		Address: "127.0.0.1:0",
+		Security: &SecurityConfig{
+			Tls: first,
+		},
+	}
+	s, err := New(config)
+	require.NoError(t, err)
+
+	updated := make(chan error)
+	go func() {
+		_, err := s.UpdateSecurity(&SecurityConfig{
+			Tls: second,
+		})
+		updated <- err
+	}()
+	assert.NoError(t, s.Start())
+	defer s.Stop()
+	assert.NoError(t, <-updated)
+
+	assert.Equal(t, "second", testServedCertificateName(t, s.Address()))
+}
+
+func TestServerTlsReload(t *testing.T) {
+	dir := t.TempDir()
+	tlsConfig := testCreateCertFiles(t, dir, "first")
+	second := testCreateCertFiles(t, dir, "second")
+	tlsConfig.ReloadInterval = 10 * time.Millisecond
+
+	config := &ServerConfig{
+		Name:    "testServer",
+		Net:     "tcp",
+		Address: "127.0.0.1:0",
+		Security: &SecurityConfig{
+			Tls: tlsConfig,
+		},
+	}
+	s, err := New(config)
+	assert.NoError(t, err)
+	assert.NoError(t, s.Start())
+	defer s.Stop()
+
+	assert.Equal(t, "first", testServedCertificateName(t, s.Address()))
+
+	testReplaceCertFiles(t, second, tlsConfig, time.Now().Add(time.Minute))
+	assert.Eventually(t, func() bool {
+		return testServedCertificateName(t, s.Address()) == "second"
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestServerMutualTls(t *testing.T) {
+	dir := t.TempDir()
+	tlsConfig := testCreateCertFiles(t, dir, "server")
+	ca, caKey, caFile := testCreateClientCA(t, dir, "clientca")
+	tlsConfig.ClientCAFile = caFile
+	tlsConfig.ClientCertPolicy = ClientCertPolicyVerifyIfGiven
+
+	authenticator, err := auth.NewJwtAuthenticator(&auth.JwtAuthConfig{
+		SharedSecret: []byte(testSharedSecret),
+	})
+	assert.NoError(t, err)
+	certAuthenticator, err := auth.NewX509Authenticator(&auth.X509AuthConfig{
+		GroupRoles: map[string][]string{
+			"admins": {"system.admin"},
+		},
+	})
+	assert.NoError(t, err)
+
+	config := &ServerConfig{
+		Name:    "testServer",
+		Net:     "tcp",
+		Address: "127.0.0.1:0",
+		Security: &SecurityConfig{
+			Tls: tlsConfig,
+			Authenticators: map[string]auth.Authenticator{
+				"testissuer": authenticator,
+			},
+			CertificateAuthenticator: certAuthenticator,
+		},
+	}
+	config.RegisterGrpcServers(func(gs *grpc.Server) {
+		appapi.RegisterHelloGreeterServer(gs, &appserver.HelloGreeter{})
+	}).WithDefaultGenericRoleManager()
+	s, err := New(config)
+	assert.NoError(t, err)
+	assert.NoError(t, s.Start())
+	defer s.Stop()
+
+	sayHello := func(ctx context.Context, cert *tls.Certificate) error {
+		clientConfig := &tls.Config{
+			InsecureSkipVerify: true,
+		}
+		if cert != nil {
+			clientConfig.Certificates = []tls.Certificate{*cert}
+		}
+		conn, err := grpcclient.Connect(s.Address(), []grpc.DialOption{
+			grpc.WithTransportCredentials(credentials.NewTLS(clientConfig)),
+		})
+		assert.NoError(t, err)
+		defer conn.Close()
+
+		g := appapi.NewHelloGreeterClient(conn)
+		_, err = g.SayHello(ctx, &appapi.HelloGreeterSayHelloRequest{Name: "jim"})
+		return err
+	}
+
+	admin := testCreateClientCert(t, ca, caKey, pkix.Name{
+		CommonName:         "admin",
+		OrganizationalUnit: []string{"admins"},
+	})
+	other := testCreateClientCert(t, ca, caKey, pkix.Name{
+		CommonName:         "other",
+		OrganizationalUnit: []string{"others"},
+	})
+
+	// Authenticated with the certificate
+	assert.NoError(t, sayHello(context.Background(), admin))
+	assert.Equal(t, codes.PermissionDenied, status.Code(sayHello(context.Background(), other)))
+
+	// Tokens have precedence over certificates
+	ctx := contextWithToken(t, context.Background(), "testissuer", "jim", []string{"system.admin"})
+	assert.NoError(t, sayHello(ctx, other))
+	assert.NoError(t, sayHello(ctx, nil))
+
+	// Certificate authenticator requires a client CA
+	_, err = s.UpdateSecurity(&SecurityConfig{
+		Tls:                      testCreateCertFiles(t, dir, "noca"),
+		CertificateAuthenticator: certAuthenticator,
+		Role:                     role.NewDefaultGenericRoleManager(),
+	})
+	assert.Error(t, err)
+}
+
+func TestServerShutdown(t *testing.T) {
+	inflight := make(chan struct{})
+	release := make(chan struct{})
+	c := newDefaultConfig(t)
+	c.WithServerUnaryInterceptors(func(
+		ctx context.Context,
+		req interface{},
+		info *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler,
+	) (interface{}, error) {
+		if info.FullMethod == "/hello.hello.v1.HelloGreeter/SayHello" {
+			close(inflight)
+			<-release
+		}
+		return handler(ctx, req)
+	})
+	s := newTestServer(t, c)
+	defer s.Stop()
+
+	h := grpc_health_v1.NewHealthClient(s.Conn())
+	resp, err := h.Check(context.Background(), &grpc_health_v1.HealthCheckRequest{})
+	assert.NoError(t, err)
+	assert.Equal(t, grpc_health_v1.HealthCheckResponse_SERVING, resp.GetStatus())
+	watchCtx, watchCancel := context.WithCancel(context.Background())
+	defer watchCancel()
+	watch, err := h.Watch(watchCtx, &grpc_health_v1.HealthCheckRequest{})
+	assert.NoError(t, err)
+	resp, err = watch.Recv()
+	assert.NoError(t, err)
+	assert.Equal(t, grpc_health_v1.HealthCheckResponse_SERVING, resp.GetStatus())
+
+	// Start a request which is pending during the shutdown
+	result := make(chan error, 1)
+	go func() {
+		g := appapi.NewHelloGreeterClient(s.Conn())
+		_, err := g.SayHello(context.Background(), &appapi.HelloGreeterSayHelloRequest{Name: "jim"})
+		result <- err
+	}()
+	<-inflight
+
+	shutdown := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		shutdown <- s.server.Shutdown(ctx)
+	}()
+
+	// Health is flipped before draining
+	resp, err = watch.Recv()
+	assert.NoError(t, err)
+	assert.Equal(t, grpc_health_v1.HealthCheckResponse_NOT_SERVING, resp.GetStatus())
+	watchCancel()
+
+	// The pending request finishes
+	close(release)
+	assert.NoError(t, <-result)
+	assert.NoError(t, <-shutdown)
+	assert.False(t, s.server.netServer.IsRunning())
+	assert.False(t, s.server.udsServer.IsRunning())
+}
+
+func TestServerShutdownForced(t *testing.T) {
+	s := newDefaultTestServer(t)
+	defer s.Stop()
+
+	// A watch never finishes
+	watch, err := grpc_health_v1.NewHealthClient(s.Conn()).Watch(
+		context.Background(), &grpc_health_v1.HealthCheckRequest{})
+	assert.NoError(t, err)
+	_, err = watch.Recv()
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, s.server.Shutdown(ctx), context.DeadlineExceeded)
+	assert.False(t, s.server.netServer.IsRunning())
+}
+
+func TestServerHealth(t *testing.T) {
+	authenticator, err := auth.NewJwtAuthenticator(&auth.JwtAuthConfig{
+		SharedSecret: []byte(testSharedSecret),
+	})
+	assert.NoError(t, err)
+
+	c := newDefaultConfig(t)
+	c.Security = &SecurityConfig{
+		Authenticators: map[string]auth.Authenticator{
+			"testissuer": authenticator,
+		},
+	}
+	c.WithDefaultGenericRoleManager()
+	s := newTestServer(t, c)
+	defer s.Stop()
+
+	// Health can be checked without a token
+	h := grpc_health_v1.NewHealthClient(s.Conn())
+	resp, err := h.Check(context.Background(), &grpc_health_v1.HealthCheckRequest{})
+	assert.NoError(t, err)
+	assert.Equal(t, grpc_health_v1.HealthCheckResponse_SERVING, resp.GetStatus())
+	g := appapi.NewHelloGreeterClient(s.Conn())
+	_, err = g.SayHello(context.Background(), &appapi.HelloGreeterSayHelloRequest{})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	assert.True(t, grpcerrors.HasReason(err, grpcerrors.ReasonAccessDenied, grpcerrors.Domain))
+	assert.Equal(t, "/hello.hello.v1.HelloGreeter/SayHello", grpcerrors.ErrorInfo(err).GetMetadata()["method"])
+
+	// Registered services are tracked
+	service := "hello.hello.v1.HelloGreeter"
+	resp, err = h.Check(context.Background(), &grpc_health_v1.HealthCheckRequest{Service: service})
+	assert.NoError(t, err)
+	assert.Equal(t, grpc_health_v1.HealthCheckResponse_SERVING, resp.GetStatus())
+
+	s.server.SetServingStatus(service, grpc_health_v1.HealthCheckResponse_NOT_SERVING)
+	st, err := s.server.ServingStatus(service)
+	assert.NoError(t, err)
+	assert.Equal(t, grpc_health_v1.HealthCheckResponse_NOT_SERVING, st)
+	resp, err = h.Check(context.Background(), &grpc_health_v1.HealthCheckRequest{Service: service})
+	assert.NoError(t, err)
+	assert.Equal(t, grpc_health_v1.HealthCheckResponse_NOT_SERVING, resp.GetStatus())
+	_, err = s.server.ServingStatus("unknown")
+	assert.Error(t, err)
+
+	// Same health on the REST gateway
+	httpResp, err := http.Get("http://localhost:9001/readyz?service=" + service)
+	assert.NoError(t, err)
+	httpResp.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, httpResp.StatusCode)
+	httpResp, err = http.Get("http://localhost:9001/readyz")
+	assert.NoError(t, err)
+	httpResp.Body.Close()
+	assert.Equal(t, http.StatusOK, httpResp.StatusCode)
+	httpResp, err = http.Get("http://localhost:9001/healthz")
+	assert.NoError(t, err)
+	httpResp.Body.Close()
+	assert.Equal(t, http.StatusOK, httpResp.StatusCode)
+}
+
+func TestServerHealthRequireAuth(t *testing.T) {
+	authenticator, err := auth.NewJwtAuthenticator(&auth.JwtAuthConfig{
+		SharedSecret: []byte(testSharedSecret),
+	})
+	assert.NoError(t, err)
+
+	c := newDefaultConfig(t)
+	c.Security = &SecurityConfig{
+		Authenticators: map[string]auth.Authenticator{
+			"testissuer": authenticator,
+		},
+	}
+	c.Health.RequireAuth = true
+	c.WithDefaultGenericRoleManager()
+	s := newTestServer(t, c)
+	defer s.Stop()
+
+	h := grpc_health_v1.NewHealthClient(s.Conn())
+	_, err = h.Check(context.Background(), &grpc_health_v1.HealthCheckRequest{})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	ctx := contextWithToken(t, context.Background(), "testissuer", "jim", []string{"system.admin"})
+	resp, err := h.Check(ctx, &grpc_health_v1.HealthCheckRequest{})
+	assert.NoError(t, err)
+	assert.Equal(t, grpc_health_v1.HealthCheckResponse_SERVING, resp.GetStatus())
+}
+
+func TestServerHealthCustomAuthInterceptor(t *testing.T) {
+	c := newDefaultConfig(t)
+
+	// The caller's interceptors are called for the health service too
+	var calls []string
+	c.AuthNUnaryInterceptor = func(
+		ctx context.Context,
+		req interface{},
+		info *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler,
+	) (interface{}, error) {
+		calls = append(calls, info.FullMethod)
+		return handler(ctx, req)
+	}
+	s := newTestServer(t, c)
+	defer s.Stop()
+
+	h := grpc_health_v1.NewHealthClient(s.Conn())
+	_, err := h.Check(context.Background(), &grpc_health_v1.HealthCheckRequest{})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"/grpc.health.v1.Health/Check"}, calls)
+}
+
+func TestServerServeErrorStop(t *testing.T) {
+	c := newDefaultConfig(t)
+	s := newTestServer(t, c)
+	defer s.Stop()
+
+	// The listener fails while serving
+	s.server.netServer.Listener().Close()
+
+	select {
+	case err := <-s.server.Errors():
+		var serveErr *ServeError
+		assert.ErrorAs(t, err, &serveErr)
+		assert.Equal(t, s.server.netServer.name, serveErr.Server)
+	case <-time.After(5 * time.Second):
+		t.Fatal("serve error not received")
+	}
+
+	err := s.server.Wait()
+	var serveErr *ServeError
+	assert.ErrorAs(t, err, &serveErr)
+	assert.Eventually(t, func() bool {
+		return !s.server.udsServer.IsRunning()
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestServerServeErrorRestart(t *testing.T) {
+	c := newDefaultConfig(t)
+	c.ServeErrorPolicy = ServeErrorPolicyRestart
+	s := newTestServer(t, c)
+	defer s.Stop()
+
+	address := s.Address()
+	s.server.netServer.Listener().Close()
+	select {
+	case err := <-s.server.Errors():
+		assert.Error(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("serve error not received")
+	}
+
+	// Serving again on the same address
+	assert.Eventually(t, func() bool {
+		conn, err := grpc.Dial(address, grpc.WithInsecure())
+		if err != nil {
+			return false
+		}
+		defer conn.Close()
+		g := appapi.NewHelloGreeterClient(conn)
+		_, err = g.SayHello(context.Background(), &appapi.HelloGreeterSayHelloRequest{Name: "jim"})
+		return err == nil
+	}, 5*time.Second, 100*time.Millisecond)
+
+	select {
+	case <-s.server.stopped:
+		t.Fatal("server stopped")
+	default:
+	}
+}
+
+func TestServerServeErrorIgnore(t *testing.T) {
+	c := newDefaultConfig(t)
+	c.ServeErrorPolicy = ServeErrorPolicyIgnore
+	s := newTestServer(t, c)
+	defer s.Stop()
+
+	s.server.netServer.Listener().Close()
+	select {
+	case err := <-s.server.Errors():
+		assert.Error(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("serve error not received")
+	}
+
+	// The other servers keep running
+	assert.True(t, s.server.udsServer.IsRunning())
+	select {
+	case <-s.server.stopped:
+		t.Fatal("server stopped")
+	default:
+	}
+
+	s.Stop()
+	assert.NoError(t, s.server.Wait())
+}
+
+func TestServerServeErrorPolicy(t *testing.T) {
+	c := newDefaultConfig(t)
+	c.ServeErrorPolicy = "unknown"
+	_, err := New(c)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "unknown serve error policy")
+}
+
+func TestServerRestAddressInUse(t *testing.T) {
+	l, err := net.Listen("tcp", ":9001")
+	assert.NoError(t, err)
+	defer l.Close()
+
+	c := newDefaultConfig(t)
+	os.Remove(c.Socket)
+	s, err := New(c)
+	assert.NoError(t, err)
+	defer s.Stop()
+
+	err = s.Start()
+	assert.Error(t, err)
+}
+
+func newSinglePortConfig(t *testing.T) *ServerConfig {
+	config := &ServerConfig{
+		Name:    "testServer",
+		Net:     "tcp",
+		Address: "127.0.0.1:0",
+	}
+	config.WithSinglePortRestServer().
+		RegisterGrpcServers(func(gs *grpc.Server) {
+			appapi.RegisterHelloGreeterServer(gs, &appserver.HelloGreeter{})
+		}).
+		RegisterRestHandlers(appapi.RegisterHelloGreeterHandler)
+	return config
+}
+
+func testSinglePort(t *testing.T, conn *grpc.ClientConn, client *http.Client, url string) {
+	// gRPC
+	g := appapi.NewHelloGreeterClient(conn)
+	resp, err := g.SayHello(context.Background(), &appapi.HelloGreeterSayHelloRequest{Name: "jim"})
+	assert.NoError(t, err)
+	assert.Contains(t, resp.GetMessage(), "jim")
+
+	// REST gateway
+	httpResp, err := client.Post(url+"/v1/greeter:sayHello", "application/json",
+		strings.NewReader(`{"name":"jim"}`))
+	assert.NoError(t, err)
+	body, err := io.ReadAll(httpResp.Body)
+	httpResp.Body.Close()
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, httpResp.StatusCode)
+	assert.Contains(t, string(body), "jim")
+
+	// Health and metrics
+	for _, path := range []string{"/healthz", "/readyz", "/metrics"} {
+		httpResp, err = client.Get(url + path)
+		assert.NoError(t, err)
+		httpResp.Body.Close()
+		assert.Equal(t, http.StatusOK, httpResp.StatusCode, path)
+	}
+}
+
+func TestServerSinglePort(t *testing.T) {
+	c := newSinglePortConfig(t)
+	s, err := New(c)
+	assert.NoError(t, err)
+	assert.NoError(t, s.Start())
+	defer s.Stop()
+	assert.Nil(t, s.udsServer)
+
+	// gRPC over h2c
+	conn, err := grpcclient.Connect(s.Address(), []grpc.DialOption{grpc.WithInsecure()})
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	client := &http.Client{Transport: &http.Transport{}}
+	testSinglePort(t, conn, client, "http://"+s.Address())
+
+	// The gateway waits for the connections on which the client has not sent
+	// a request yet, which the client may have opened while connecting
+	client.CloseIdleConnections()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.NoError(t, s.Shutdown(ctx))
+	assert.False(t, s.netServer.IsRunning())
+}
+
+func TestServerSinglePortShutdownStream(t *testing.T) {
+	c := newSinglePortConfig(t)
+	s, err := New(c)
+	require.NoError(t, err)
+	require.NoError(t, s.Start())
+	defer s.Stop()
+
+	conn, err := grpcclient.Connect(s.Address(), []grpc.DialOption{grpc.WithInsecure()})
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// A watch never finishes
+	stream, err := grpc_health_v1.NewHealthClient(conn).Watch(
+		context.Background(), &grpc_health_v1.HealthCheckRequest{})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, s.Shutdown(ctx), context.DeadlineExceeded)
+	assert.False(t, s.netServer.IsRunning())
+
+	// The pending RPC has been cancelled after sending NOT_SERVING
+	for err == nil {
+		_, err = stream.Recv()
+	}
+	assert.NotEqual(t, io.EOF, err)
+}
+
+func TestServerSinglePortTls(t *testing.T) {
+	dir := t.TempDir()
+	c := newSinglePortConfig(t)
+	c.Security = &SecurityConfig{
+		Tls: testCreateCertFiles(t, dir, "localhost"),
+	}
+	s, err := New(c)
+	assert.NoError(t, err)
+	assert.NoError(t, s.Start())
+	defer s.Stop()
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: true}
+	conn, err := grpcclient.Connect(s.Address(), []grpc.DialOption{
+		grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)),
+	})
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+	testSinglePort(t, conn, client, "https://"+s.Address())
+}
+
+func TestServerSinglePortRateLimiter(t *testing.T) {
+	c := newSinglePortConfig(t)
+	c.WithRateLimiter(rate.NewLimiter(2, 2))
+	s, err := New(c)
+	assert.NoError(t, err)
+	assert.NoError(t, s.Start())
+	defer s.Stop()
+
+	conn, err := grpcclient.Connect(s.Address(), []grpc.DialOption{grpc.WithInsecure()})
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	assert.True(t, rateLimiterShowsDenial(t, &testServer{server: s, conn: conn}))
+}
+
+// testLogBuffer is a log output which can be read while the server writes to it
+type testLogBuffer struct {
+	lock sync.Mutex
+	buf  bytes.Buffer
+}
+
+func (b *testLogBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *testLogBuffer) String() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.String()
+}
+
+func testRestSayHello(t *testing.T, client *http.Client, url, token string) int {
+	req, err := http.NewRequest(http.MethodPost, url+"/v1/greeter:sayHello", strings.NewReader(`{"name":"jim"}`))
+	assert.NoError(t, err)
+	if token != "" {
+		req.Header.Set("Authorization", "bearer "+token)
+	}
+	resp, err := client.Do(req)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestServerRestInProcess(t *testing.T) {
+	authenticator, err := auth.NewJwtAuthenticator(&auth.JwtAuthConfig{
+		SharedSecret: []byte(testSharedSecret),
+	})
+	assert.NoError(t, err)
+
+	audit := &testLogBuffer{}
+	c := &ServerConfig{
+		Name:        "testServer",
+		Net:         "tcp",
+		Address:     "127.0.0.1:0",
+		AuditOutput: audit,
+		Security: &SecurityConfig{
+			Authenticators: map[string]auth.Authenticator{
+				"testissuer": authenticator,
+			},
+		},
+	}
+	c.WithDefaultRestServer("9001").
+		WithRestInProcess().
+		WithDefaultGenericRoleManager().
+		WithRateLimiter(rate.NewLimiter(rate.Inf, 0)).
+		RegisterGrpcServers(func(gs *grpc.Server) {
+			appapi.RegisterHelloGreeterServer(gs, &appserver.HelloGreeter{})
+		}).
+		RegisterRestHandlers(appapi.RegisterHelloGreeterHandler)
+
+	// No unix domain socket needed
+	s, err := New(c)
+	assert.NoError(t, err)
+	assert.NoError(t, s.Start())
+	defer s.Stop()
+	assert.Nil(t, s.udsServer)
+
+	// The requests from the gateway are authenticated, authorized and audited
+	url := "http://localhost:9001"
+	assert.Equal(t, http.StatusForbidden, testRestSayHello(t, http.DefaultClient, url, ""))
+	assert.Contains(t, audit.String(), "Access denied")
+	assert.Equal(t, http.StatusUnauthorized, testRestSayHello(t, http.DefaultClient, url,
+		testToken(t, "otherissuer", "jim", []string{"system.admin"})))
+	assert.Equal(t, http.StatusOK, testRestSayHello(t, http.DefaultClient, url,
+		testToken(t, "testissuer", "jim", []string{"system.admin"})))
+}
+
+func TestServerRestInProcessTls(t *testing.T) {
+	dir := t.TempDir()
+	c := &ServerConfig{
+		Name:    "testServer",
+		Net:     "tcp",
+		Address: "127.0.0.1:0",
+		Security: &SecurityConfig{
+			Tls: testCreateCertFiles(t, dir, "localhost"),
+		},
+	}
+	c.WithDefaultRestServer("9001").
+		WithRestInProcess().
+		RegisterGrpcServers(func(gs *grpc.Server) {
+			appapi.RegisterHelloGreeterServer(gs, &appserver.HelloGreeter{})
+		}).
+		RegisterRestHandlers(appapi.RegisterHelloGreeterHandler)
+	s, err := New(c)
+	assert.NoError(t, err)
+	assert.NoError(t, s.Start())
+	defer s.Stop()
+
+	// The network still requires TLS
+	assert.Equal(t, "localhost", testServedCertificateName(t, s.Address()))
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: true}
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+	assert.Equal(t, http.StatusOK, testRestSayHello(t, client, "https://localhost:9001", ""))
+}
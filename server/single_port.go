@@ -0,0 +1,78 @@
+/*
+Copyright 2022 Pure Storage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package server
+
+import (
+	"net/http"
+	"strconv"
+
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/tap"
+)
+
+const (
+	// Content type of the gRPC requests
+	grpcContentType = "application/grpc"
+)
+
+// isGrpcRequest returns true if the request is a gRPC request. gRPC-Web
+// requests are not gRPC requests.
+func isGrpcRequest(r *http.Request) bool {
+	return r.ProtoMajor == 2 && hasContentType(r.Header.Get("Content-Type"), grpcContentType)
+}
+
+// singlePortHandler returns a handler which sends the gRPC requests to the
+// gRPC server and all other requests to the REST handler
+func singlePortHandler(grpcServer *GrpcFrameworkServer, rest http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isGrpcRequest(r) {
+			grpcServer.ServeHTTP(w, r)
+			return
+		}
+		rest.ServeHTTP(w, r)
+	})
+}
+
+// ServeHTTP serves the gRPC requests received by the REST gateway in
+// single-port mode. The tap handle is not called by grpc.Server.ServeHTTP,
+// so the global rate limiter is checked here instead.
+func (s *GrpcFrameworkServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.rateLimiterTapEnabled() {
+		md := make(metadata.MD, len(r.Header))
+		for k, v := range r.Header {
+			md.Append(k, v...)
+		}
+		_, err := s.rateLimiter(r.Context(), &tap.Info{
+			FullMethodName: r.URL.Path,
+			Header:         md,
+		})
+		if err != nil {
+			writeGrpcError(w, err)
+			return
+		}
+	}
+	s.GrpcServer.ServeHTTP(w, r)
+}
+
+// writeGrpcError writes a gRPC response with only the status of the error
+func writeGrpcError(w http.ResponseWriter, err error) {
+	st := status.Convert(err)
+	w.Header().Set("Content-Type", grpcContentType)
+	w.Header().Set("Grpc-Status", strconv.Itoa(int(st.Code())))
+	w.Header().Set("Grpc-Message", st.Message())
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,342 @@
+/*
+Copyright 2022 Pure Storage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+)
+
+// certificateFilesState holds the state of the certificate files
+// used to determine if they have changed
+type certificateFilesState struct {
+	certModTime time.Time
+	certSize    int64
+	keyModTime  time.Time
+	keySize     int64
+	caModTime   time.Time
+	caSize      int64
+}
+
+func getCertificateFilesState(config *TLSConfig) (certificateFilesState, error) {
+	var state certificateFilesState
+
+	// Stat follows symlinks, which is how mounted Kubernetes secrets are updated
+	certInfo, err := os.Stat(config.CertFile)
+	if err != nil {
+		return state, err
+	}
+	keyInfo, err := os.Stat(config.KeyFile)
+	if err != nil {
+		return state, err
+	}
+
+	state.certModTime = certInfo.ModTime()
+	state.certSize = certInfo.Size()
+	state.keyModTime = keyInfo.ModTime()
+	state.keySize = keyInfo.Size()
+
+	if config.ClientCAFile != "" {
+		caInfo, err := os.Stat(config.ClientCAFile)
+		if err != nil {
+			return state, err
+		}
+		state.caModTime = caInfo.ModTime()
+		state.caSize = caInfo.Size()
+	}
+	return state, nil
+}
+
+// certificateProvider holds the TLS certificate used by the gRPC server
+// and the REST gateway. The certificate can be replaced at runtime and new
+// connections will use the new certificate. The provider can also watch the
+// certificate files and reload them when they change.
+type certificateProvider struct {
+	lock      sync.RWMutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+	config    TLSConfig
+	state     certificateFilesState
+
+	watchLock sync.Mutex
+	done      chan struct{}
+	wg        sync.WaitGroup
+}
+
+func newCertificateProvider(config *TLSConfig) (*certificateProvider, error) {
+	c := &certificateProvider{}
+	if err := c.load(config); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func loadCertificate(config *TLSConfig) (*tls.Certificate, error) {
+	if config == nil {
+		return nil, fmt.Errorf("missing TLS configuration")
+	}
+	cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create credentials from cert files: %v", err)
+	}
+	return &cert, nil
+}
+
+func loadClientCAs(config *TLSConfig) (*x509.CertPool, error) {
+	if config.ClientCAFile == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(config.ClientCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read client CA file: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in client CA file %s", config.ClientCAFile)
+	}
+	return pool, nil
+}
+
+// validateClientCertPolicy checks the client certificate policy of the configuration
+func validateClientCertPolicy(config *TLSConfig) error {
+	switch config.ClientCertPolicy {
+	case "", ClientCertPolicyRequire, ClientCertPolicyVerifyIfGiven:
+		return nil
+	default:
+		return fmt.Errorf("unknown client certificate policy %s. Must be one of %s (default) or %s",
+			config.ClientCertPolicy, ClientCertPolicyRequire, ClientCertPolicyVerifyIfGiven)
+	}
+}
+
+// certificateBundle holds everything read from the files of a TLS configuration
+type certificateBundle struct {
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+	config    TLSConfig
+	state     certificateFilesState
+}
+
+// readCertificate reads the certificate and client CAs from the files in
+// config along with the state of the files when they were read
+func readCertificate(config *TLSConfig) (*certificateBundle, error) {
+	if config == nil {
+		return nil, fmt.Errorf("missing TLS configuration")
+	}
+	if err := validateClientCertPolicy(config); err != nil {
+		return nil, err
+	}
+
+	// Get the state before reading the files so that any change
+	// made while reading is caught by the next check
+	state, err := getCertificateFilesState(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create credentials from cert files: %v", err)
+	}
+	cert, err := loadCertificate(config)
+	if err != nil {
+		return nil, err
+	}
+	clientCAs, err := loadClientCAs(config)
+	if err != nil {
+		return nil, err
+	}
+	return &certificateBundle{
+		cert:      cert,
+		clientCAs: clientCAs,
+		config:    *config,
+		state:     state,
+	}, nil
+}
+
+// load reads the certificate from the files in config and replaces the
+// current certificate. The current certificate is kept on failure.
+func (c *certificateProvider) load(config *TLSConfig) error {
+	bundle, err := readCertificate(config)
+	if err != nil {
+		return err
+	}
+	c.set(bundle)
+	return nil
+}
+
+func (c *certificateProvider) set(bundle *certificateBundle) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.cert = bundle.cert
+	c.clientCAs = bundle.clientCAs
+	c.config = bundle.config
+	c.state = bundle.state
+}
+
+// reloadIfChanged reloads the certificate if the files have changed
+// since they were last loaded. It returns true if it was reloaded.
+func (c *certificateProvider) reloadIfChanged() (bool, error) {
+	c.lock.RLock()
+	config := c.config
+	current := c.state
+	c.lock.RUnlock()
+
+	state, err := getCertificateFilesState(&config)
+	if err != nil {
+		return false, err
+	}
+	if state == current {
+		return false, nil
+	}
+	if err := c.load(&config); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// watch checks the certificate files for changes every interval until stopWatch is called
+func (c *certificateProvider) watch(interval time.Duration) {
+	c.watchLock.Lock()
+	defer c.watchLock.Unlock()
+
+	if c.done != nil {
+		return
+	}
+
+	done := make(chan struct{})
+	c.done = done
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				reloaded, err := c.reloadIfChanged()
+				if err != nil {
+					logrus.Warnf("Unable to reload TLS certificate, keeping the current certificate: %v", err)
+				} else if reloaded {
+					logrus.Infof("TLS certificate reloaded from %s", c.certFile())
+				}
+			}
+		}
+	}()
+}
+
+// stopWatch stops watching the certificate files
+func (c *certificateProvider) stopWatch() {
+	c.watchLock.Lock()
+	defer c.watchLock.Unlock()
+
+	if c.done == nil {
+		return
+	}
+	close(c.done)
+	c.wg.Wait()
+	c.done = nil
+}
+
+func (c *certificateProvider) certFile() string {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.config.CertFile
+}
+
+// GetCertificate implements tls.Config.GetCertificate
+func (c *certificateProvider) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.cert, nil
+}
+
+// verifyClientCertificate verifies the certificate chain sent by the client
+// against the current client CAs
+func (c *certificateProvider) verifyClientCertificate(cs tls.ConnectionState) error {
+	c.lock.RLock()
+	clientCAs := c.clientCAs
+	policy := c.config.ClientCertPolicy
+	c.lock.RUnlock()
+
+	if len(cs.PeerCertificates) == 0 {
+		if policy == ClientCertPolicyVerifyIfGiven {
+			return nil
+		}
+		return fmt.Errorf("client certificate required")
+	}
+	if clientCAs == nil {
+		return fmt.Errorf("client certificates are not accepted")
+	}
+
+	opts := x509.VerifyOptions{
+		Roots:         clientCAs,
+		Intermediates: x509.NewCertPool(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	for _, cert := range cs.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	if _, err := cs.PeerCertificates[0].Verify(opts); err != nil {
+		return fmt.Errorf("failed to verify client certificate: %v", err)
+	}
+	return nil
+}
+
+// tlsConfig returns a TLS configuration which uses the certificate from the provider.
+// If a client CA is configured, the clients certificates are verified with the
+// client CAs current at the time of the handshake. Mutual TLS cannot be enabled or
+// disabled once the TLS configuration is created.
+func (c *certificateProvider) tlsConfig() *tls.Config {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	config := &tls.Config{
+		GetCertificate: c.GetCertificate,
+	}
+	if c.config.ClientCAFile != "" {
+		// The certificates are verified by VerifyConnection instead of using
+		// ClientCAs so that the client CAs can be reloaded
+		config.ClientAuth = tls.RequestClientCert
+		if c.config.ClientCertPolicy != ClientCertPolicyVerifyIfGiven {
+			config.ClientAuth = tls.RequireAnyClientCert
+		}
+		config.VerifyConnection = c.verifyClientCertificate
+	}
+	return config
+}
+
+// peerCertificate returns the certificate of the client, if any, verified
+// during the TLS handshake
+func peerCertificate(ctx context.Context) *x509.Certificate {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return nil
+	}
+	tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(tlsInfo.State.PeerCertificates) == 0 {
+		return nil
+	}
+	return tlsInfo.State.PeerCertificates[0]
+}
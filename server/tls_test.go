@@ -0,0 +1,333 @@
+/*
+Copyright 2022 Pure Storage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testCreateCertFiles creates a self signed certificate for localhost and returns
+// the TLS configuration pointing to the certificate and key files
+func testCreateCertFiles(t *testing.T, dir, commonName string) *TLSConfig {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject: pkix.Name{
+			CommonName: commonName,
+		},
+		DNSNames:    []string{"localhost"},
+		NotBefore:   time.Now().Add(-time.Hour),
+		NotAfter:    time.Now().Add(time.Hour),
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	config := &TLSConfig{
+		CertFile: filepath.Join(dir, commonName+".crt"),
+		KeyFile:  filepath.Join(dir, commonName+".key"),
+	}
+	err = os.WriteFile(config.CertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	require.NoError(t, err)
+	err = os.WriteFile(config.KeyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	require.NoError(t, err)
+
+	return config
+}
+
+// testServedCertificateName returns the common name of the certificate served at address
+func testServedCertificateName(t *testing.T, address string) string {
+	conn, err := tls.Dial("tcp", address, &tls.Config{
+		InsecureSkipVerify: true,
+	})
+	require.NoError(t, err)
+	defer conn.Close()
+
+	certs := conn.ConnectionState().PeerCertificates
+	require.NotEmpty(t, certs)
+	return certs[0].Subject.CommonName
+}
+
+func TestCertificateProvider(t *testing.T) {
+	dir := t.TempDir()
+	first := testCreateCertFiles(t, dir, "first")
+	second := testCreateCertFiles(t, dir, "second")
+
+	_, err := newCertificateProvider(&TLSConfig{
+		CertFile: filepath.Join(dir, "missing.crt"),
+		KeyFile:  filepath.Join(dir, "missing.key"),
+	})
+	assert.Error(t, err)
+
+	c, err := newCertificateProvider(first)
+	require.NoError(t, err)
+	cert, err := c.GetCertificate(nil)
+	assert.NoError(t, err)
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	assert.NoError(t, err)
+	assert.Equal(t, "first", leaf.Subject.CommonName)
+
+	// Failure keeps the current certificate
+	assert.Error(t, c.load(&TLSConfig{CertFile: second.CertFile, KeyFile: first.KeyFile}))
+	newCert, _ := c.GetCertificate(nil)
+	assert.Equal(t, cert, newCert)
+
+	assert.NoError(t, c.load(second))
+	cert, _ = c.GetCertificate(nil)
+	leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	assert.NoError(t, err)
+	assert.Equal(t, "second", leaf.Subject.CommonName)
+}
+
+// testReplaceCertFiles copies the files in from over the files in to
+// and moves their modification time forward
+func testReplaceCertFiles(t *testing.T, from, to *TLSConfig, modTime time.Time) {
+	for src, dst := range map[string]string{
+		from.CertFile: to.CertFile,
+		from.KeyFile:  to.KeyFile,
+	} {
+		data, err := os.ReadFile(src)
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(dst, data, 0600))
+		require.NoError(t, os.Chtimes(dst, modTime, modTime))
+	}
+}
+
+func testCertificateName(t *testing.T, c *certificateProvider) string {
+	cert, err := c.GetCertificate(nil)
+	require.NoError(t, err)
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	require.NoError(t, err)
+	return leaf.Subject.CommonName
+}
+
+func TestCertificateProviderReloadIfChanged(t *testing.T) {
+	dir := t.TempDir()
+	config := testCreateCertFiles(t, dir, "first")
+	second := testCreateCertFiles(t, dir, "second")
+
+	c, err := newCertificateProvider(config)
+	require.NoError(t, err)
+
+	// Nothing changed
+	reloaded, err := c.reloadIfChanged()
+	assert.NoError(t, err)
+	assert.False(t, reloaded)
+	assert.Equal(t, "first", testCertificateName(t, c))
+
+	// Broken files keep the current certificate
+	require.NoError(t, os.WriteFile(config.KeyFile, []byte("broken"), 0600))
+	reloaded, err = c.reloadIfChanged()
+	assert.Error(t, err)
+	assert.False(t, reloaded)
+	assert.Equal(t, "first", testCertificateName(t, c))
+
+	// Fixing the files reloads the certificate
+	testReplaceCertFiles(t, second, config, time.Now().Add(time.Minute))
+	reloaded, err = c.reloadIfChanged()
+	assert.NoError(t, err)
+	assert.True(t, reloaded)
+	assert.Equal(t, "second", testCertificateName(t, c))
+
+	reloaded, err = c.reloadIfChanged()
+	assert.NoError(t, err)
+	assert.False(t, reloaded)
+}
+
+func TestCertificateProviderWatch(t *testing.T) {
+	dir := t.TempDir()
+	config := testCreateCertFiles(t, dir, "first")
+	second := testCreateCertFiles(t, dir, "second")
+
+	c, err := newCertificateProvider(config)
+	require.NoError(t, err)
+	c.watch(10 * time.Millisecond)
+	// Watching twice is a no-op
+	c.watch(10 * time.Millisecond)
+
+	testReplaceCertFiles(t, second, config, time.Now().Add(time.Minute))
+	assert.Eventually(t, func() bool {
+		return testCertificateName(t, c) == "second"
+	}, 5*time.Second, 10*time.Millisecond)
+
+	c.stopWatch()
+	c.stopWatch()
+
+	// Changes are no longer detected
+	third := testCreateCertFiles(t, dir, "third")
+	testReplaceCertFiles(t, third, config, time.Now().Add(2*time.Minute))
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, "second", testCertificateName(t, c))
+}
+
+// testCreateClientCA creates a CA for client certificates and returns its
+// certificate and key along with the path to the CA file
+func testCreateClientCA(t *testing.T, dir, commonName string) (*x509.Certificate, *ecdsa.PrivateKey, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject: pkix.Name{
+			CommonName: commonName,
+		},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	caFile := filepath.Join(dir, commonName+"-ca.crt")
+	err = os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	require.NoError(t, err)
+
+	return cert, key, caFile
+}
+
+// testCreateClientCert creates a client certificate signed by the CA
+func testCreateClientCert(
+	t *testing.T,
+	ca *x509.Certificate,
+	caKey *ecdsa.PrivateKey,
+	subject pkix.Name,
+	uris ...string,
+) *tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      subject,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	for _, u := range uris {
+		parsed, err := url.Parse(u)
+		require.NoError(t, err)
+		template.URIs = append(template.URIs, parsed)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	require.NoError(t, err)
+
+	return &tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+	}
+}
+
+// testServerHandshake returns the result of the TLS handshake on the server
+// side when a client connects with the client certificate, if any
+func testServerHandshake(t *testing.T, c *certificateProvider, clientCert *tls.Certificate) error {
+	l, err := tls.Listen("tcp", "127.0.0.1:0", c.tlsConfig())
+	require.NoError(t, err)
+	defer l.Close()
+
+	result := make(chan error, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			result <- err
+			return
+		}
+		defer conn.Close()
+		result <- conn.(*tls.Conn).Handshake()
+	}()
+
+	clientConfig := &tls.Config{
+		InsecureSkipVerify: true,
+	}
+	if clientCert != nil {
+		clientConfig.Certificates = []tls.Certificate{*clientCert}
+	}
+	conn, err := tls.Dial("tcp", l.Addr().String(), clientConfig)
+	if err == nil {
+		defer conn.Close()
+	}
+	return <-result
+}
+
+func TestCertificateProviderClientCA(t *testing.T) {
+	dir := t.TempDir()
+	config := testCreateCertFiles(t, dir, "server")
+	ca, caKey, caFile := testCreateClientCA(t, dir, "clientca")
+	otherCa, otherCaKey, _ := testCreateClientCA(t, dir, "otherca")
+	clientCert := testCreateClientCert(t, ca, caKey, pkix.Name{CommonName: "client"})
+	otherCert := testCreateClientCert(t, otherCa, otherCaKey, pkix.Name{CommonName: "client"})
+
+	// Invalid configurations
+	_, err := newCertificateProvider(&TLSConfig{
+		CertFile:     config.CertFile,
+		KeyFile:      config.KeyFile,
+		ClientCAFile: config.KeyFile,
+	})
+	assert.Error(t, err)
+	_, err = newCertificateProvider(&TLSConfig{
+		CertFile:         config.CertFile,
+		KeyFile:          config.KeyFile,
+		ClientCAFile:     caFile,
+		ClientCertPolicy: "unknown",
+	})
+	assert.Error(t, err)
+
+	// Client certificates are not requested without a client CA
+	c, err := newCertificateProvider(config)
+	require.NoError(t, err)
+	assert.Equal(t, tls.NoClientCert, c.tlsConfig().ClientAuth)
+	assert.NoError(t, testServerHandshake(t, c, nil))
+
+	// Required by default
+	config.ClientCAFile = caFile
+	c, err = newCertificateProvider(config)
+	require.NoError(t, err)
+	assert.NoError(t, testServerHandshake(t, c, clientCert))
+	assert.Error(t, testServerHandshake(t, c, nil))
+	assert.Error(t, testServerHandshake(t, c, otherCert))
+
+	// Verified if given
+	config.ClientCertPolicy = ClientCertPolicyVerifyIfGiven
+	c, err = newCertificateProvider(config)
+	require.NoError(t, err)
+	assert.NoError(t, testServerHandshake(t, c, clientCert))
+	assert.NoError(t, testServerHandshake(t, c, nil))
+	assert.Error(t, testServerHandshake(t, c, otherCert))
+}
@@ -0,0 +1,209 @@
+/*
+Copyright 2022 Pure Storage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package server
+
+import (
+	"context"
+	"fmt"
+
+	"google.golang.org/genproto/googleapis/api/annotations"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/protoadapt"
+	"google.golang.org/protobuf/reflect/protoreflect"
+
+	grpcerrors "github.com/libopenstorage/grpc-framework/pkg/grpc/errors"
+)
+
+// RequestValidator validates the requests received by the server. It is
+// satisfied by a protovalidate.Validator, which checks the buf.validate
+// constraints of the messages.
+type RequestValidator interface {
+	Validate(msg proto.Message) error
+}
+
+// ValidationConfig configures the validation of the requests. Requests which
+// fail the validation are rejected with InvalidArgument and a BadRequest
+// detail with the field violations.
+type ValidationConfig struct {
+	// Enabled checks that the fields of the requests marked with
+	// `(google.api.field_behavior) = REQUIRED` are set, including in nested
+	// messages. Messages with protoc-gen-validate methods, Validate() or
+	// ValidateAll(), are also checked with them.
+	Enabled bool
+	// Validator is an additional validator of the requests, like a
+	// protovalidate.Validator
+	Validator RequestValidator
+}
+
+// Errors returned by protoc-gen-validate and protovalidate-go with the field
+// and the reason of a violation
+type fieldValidationError interface {
+	Field() string
+	Reason() string
+}
+
+// Errors returned by the ValidateAll() method of protoc-gen-validate
+type multiValidationError interface {
+	AllErrors() []error
+}
+
+// validateRequest returns an InvalidArgument error if the request is invalid
+func (c *ValidationConfig) validateRequest(req interface{}) error {
+	var msg proto.Message
+	switch m := req.(type) {
+	case proto.Message:
+		msg = m
+	case protoadapt.MessageV1:
+		msg = protoadapt.MessageV2Of(m)
+	default:
+		return nil
+	}
+
+	violations := requiredFieldViolations(msg.ProtoReflect(), "")
+
+	var err error
+	switch v := req.(type) {
+	case interface{ ValidateAll() error }:
+		err = v.ValidateAll()
+	case interface{ Validate() error }:
+		err = v.Validate()
+	}
+	violations = append(violations, validationErrorViolations(err)...)
+
+	if c.Validator != nil {
+		violations = append(violations, validationErrorViolations(c.Validator.Validate(msg))...)
+	}
+
+	if len(violations) == 0 {
+		return nil
+	}
+	return grpcerrors.InvalidArgument("invalid request: "+violations[0].GetDescription(), violations...)
+}
+
+// requiredFieldViolations returns the violations of the fields marked as
+// REQUIRED which are not set in the message and its nested messages
+func requiredFieldViolations(msg protoreflect.Message, prefix string) []*errdetails.BadRequest_FieldViolation {
+	var violations []*errdetails.BadRequest_FieldViolation
+	fields := msg.Descriptor().Fields()
+	for i := 0; i < fields.Len(); i++ {
+		fd := fields.Get(i)
+		path := prefix + string(fd.Name())
+		if !msg.Has(fd) {
+			if isRequiredField(fd) {
+				violations = append(violations, grpcerrors.FieldViolation(path, path+" is required"))
+			}
+			continue
+		}
+
+		switch {
+		case fd.IsList() && fd.Message() != nil:
+			list := msg.Get(fd).List()
+			for j := 0; j < list.Len(); j++ {
+				violations = append(violations,
+					requiredFieldViolations(list.Get(j).Message(), fmt.Sprintf("%s[%d].", path, j))...)
+			}
+		case fd.IsMap() && fd.MapValue().Message() != nil:
+			msg.Get(fd).Map().Range(func(key protoreflect.MapKey, value protoreflect.Value) bool {
+				violations = append(violations,
+					requiredFieldViolations(value.Message(), fmt.Sprintf("%s[%v].", path, key.Interface()))...)
+				return true
+			})
+		case fd.Message() != nil && !fd.IsList() && !fd.IsMap():
+			violations = append(violations, requiredFieldViolations(msg.Get(fd).Message(), path+".")...)
+		}
+	}
+	return violations
+}
+
+func isRequiredField(fd protoreflect.FieldDescriptor) bool {
+	opts := fd.Options()
+	if opts == nil || !proto.HasExtension(opts, annotations.E_FieldBehavior) {
+		return false
+	}
+	for _, behavior := range proto.GetExtension(opts, annotations.E_FieldBehavior).([]annotations.FieldBehavior) {
+		if behavior == annotations.FieldBehavior_REQUIRED {
+			return true
+		}
+	}
+	return false
+}
+
+// validationErrorViolations returns the field violations of an error returned
+// by a validator
+func validationErrorViolations(err error) []*errdetails.BadRequest_FieldViolation {
+	if err == nil {
+		return nil
+	}
+	if violations := grpcerrors.FieldViolations(err); len(violations) != 0 {
+		return violations
+	}
+	if multi, ok := err.(multiValidationError); ok {
+		var violations []*errdetails.BadRequest_FieldViolation
+		for _, e := range multi.AllErrors() {
+			violations = append(violations, validationErrorViolations(e)...)
+		}
+		return violations
+	}
+	if field, ok := err.(fieldValidationError); ok {
+		return []*errdetails.BadRequest_FieldViolation{
+			grpcerrors.FieldViolation(field.Field(), field.Reason()),
+		}
+	}
+	if s, ok := status.FromError(err); ok {
+		return []*errdetails.BadRequest_FieldViolation{grpcerrors.FieldViolation("", s.Message())}
+	}
+	return []*errdetails.BadRequest_FieldViolation{grpcerrors.FieldViolation("", err.Error())}
+}
+
+func (s *GrpcFrameworkServer) validationUnaryInterceptor(
+	ctx context.Context,
+	req interface{},
+	info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler,
+) (interface{}, error) {
+	if err := s.config.Validation.validateRequest(req); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func (s *GrpcFrameworkServer) validationStreamInterceptor(
+	srv interface{},
+	stream grpc.ServerStream,
+	info *grpc.StreamServerInfo,
+	handler grpc.StreamHandler,
+) error {
+	return handler(srv, &validatingServerStream{
+		ServerStream: stream,
+		config:       &s.config.Validation,
+	})
+}
+
+// validatingServerStream validates the messages received from the client
+type validatingServerStream struct {
+	grpc.ServerStream
+	config *ValidationConfig
+}
+
+func (s *validatingServerStream) RecvMsg(m interface{}) error {
+	if err := s.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+	return s.config.validateRequest(m)
+}
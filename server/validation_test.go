@@ -0,0 +1,203 @@
+/*
+Copyright 2022 Pure Storage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package server
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/genproto/googleapis/api/annotations"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+
+	grpcerrors "github.com/libopenstorage/grpc-framework/pkg/grpc/errors"
+	appapi "github.com/libopenstorage/grpc-framework/test/app/protos/apis/hello/apiv1"
+)
+
+// testValidationMessage returns a message described by:
+//
+//	message Inner {
+//	  string name = 1 [(google.api.field_behavior) = REQUIRED];
+//	}
+//	message Outer {
+//	  string id = 1 [(google.api.field_behavior) = REQUIRED];
+//	  Inner inner = 2;
+//	  repeated Inner items = 3;
+//	  map<string, Inner> named = 4;
+//	}
+func testValidationMessage(t *testing.T) protoreflect.MessageType {
+	required := &descriptorpb.FieldOptions{}
+	proto.SetExtension(required, annotations.E_FieldBehavior,
+		[]annotations.FieldBehavior{annotations.FieldBehavior_REQUIRED})
+	field := func(name string, number int32, label descriptorpb.FieldDescriptorProto_Label,
+		typ descriptorpb.FieldDescriptorProto_Type, typeName string, options *descriptorpb.FieldOptions,
+	) *descriptorpb.FieldDescriptorProto {
+		f := &descriptorpb.FieldDescriptorProto{
+			Name:     proto.String(name),
+			JsonName: proto.String(name),
+			Number:   proto.Int32(number),
+			Label:    label.Enum(),
+			Type:     typ.Enum(),
+			Options:  options,
+		}
+		if typeName != "" {
+			f.TypeName = proto.String(typeName)
+		}
+		return f
+	}
+	optional := descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL
+	repeated := descriptorpb.FieldDescriptorProto_LABEL_REPEATED
+	str := descriptorpb.FieldDescriptorProto_TYPE_STRING
+	msg := descriptorpb.FieldDescriptorProto_TYPE_MESSAGE
+
+	fd, err := protodesc.NewFile(&descriptorpb.FileDescriptorProto{
+		Name:       proto.String("validation_test.proto"),
+		Package:    proto.String("validation.test"),
+		Syntax:     proto.String("proto3"),
+		Dependency: []string{"google/api/field_behavior.proto"},
+		MessageType: []*descriptorpb.DescriptorProto{
+			{
+				Name:  proto.String("Inner"),
+				Field: []*descriptorpb.FieldDescriptorProto{field("name", 1, optional, str, "", required)},
+			},
+			{
+				Name: proto.String("Outer"),
+				Field: []*descriptorpb.FieldDescriptorProto{
+					field("id", 1, optional, str, "", required),
+					field("inner", 2, optional, msg, ".validation.test.Inner", nil),
+					field("items", 3, repeated, msg, ".validation.test.Inner", nil),
+					field("named", 4, repeated, msg, ".validation.test.Outer.NamedEntry", nil),
+				},
+				NestedType: []*descriptorpb.DescriptorProto{
+					{
+						Name: proto.String("NamedEntry"),
+						Field: []*descriptorpb.FieldDescriptorProto{
+							field("key", 1, optional, str, "", nil),
+							field("value", 2, optional, msg, ".validation.test.Inner", nil),
+						},
+						Options: &descriptorpb.MessageOptions{MapEntry: proto.Bool(true)},
+					},
+				},
+			},
+		},
+	}, protoregistry.GlobalFiles)
+	require.NoError(t, err)
+	return dynamicpb.NewMessageType(fd.Messages().ByName("Outer"))
+}
+
+func TestRequiredFieldViolations(t *testing.T) {
+	outerType := testValidationMessage(t)
+	outer := outerType.New()
+	fields := outer.Descriptor().Fields()
+	innerType := dynamicpb.NewMessageType(fields.ByName("inner").Message())
+
+	violations := requiredFieldViolations(outer, "")
+	require.Len(t, violations, 1)
+	assert.Equal(t, "id", violations[0].GetField())
+	assert.Equal(t, "id is required", violations[0].GetDescription())
+
+	// Nested messages which are set are checked
+	outer.Set(fields.ByName("id"), protoreflect.ValueOfString("id"))
+	outer.Set(fields.ByName("inner"), protoreflect.ValueOfMessage(innerType.New()))
+	items := outer.Mutable(fields.ByName("items")).List()
+	valid := innerType.New()
+	valid.Set(valid.Descriptor().Fields().ByName("name"), protoreflect.ValueOfString("name"))
+	items.Append(protoreflect.ValueOfMessage(valid))
+	items.Append(protoreflect.ValueOfMessage(innerType.New()))
+	outer.Mutable(fields.ByName("named")).Map().
+		Set(protoreflect.ValueOfString("a").MapKey(), protoreflect.ValueOfMessage(innerType.New()))
+
+	var paths []string
+	for _, v := range requiredFieldViolations(outer, "") {
+		paths = append(paths, v.GetField())
+	}
+	assert.ElementsMatch(t, []string{"inner.name", "items[1].name", "named[a].name"}, paths)
+}
+
+type testFieldError struct{ field, reason string }
+
+func (e testFieldError) Error() string  { return e.field + ": " + e.reason }
+func (e testFieldError) Field() string  { return e.field }
+func (e testFieldError) Reason() string { return e.reason }
+
+type testMultiError []error
+
+func (e testMultiError) Error() string      { return "multiple errors" }
+func (e testMultiError) AllErrors() []error { return e }
+
+type testRequestValidator struct{ err error }
+
+func (v *testRequestValidator) Validate(msg proto.Message) error { return v.err }
+
+func TestValidateRequest(t *testing.T) {
+	c := &ValidationConfig{Enabled: true}
+	assert.NoError(t, c.validateRequest(&appapi.HelloGreeterSayHelloRequest{Name: "jim"}))
+	assert.NoError(t, c.validateRequest("not a message"))
+
+	err := c.validateRequest(&appapi.HelloGreeterSayHelloRequest{})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	assert.Equal(t, "invalid request: name is required", status.Convert(err).Message())
+	require.Len(t, grpcerrors.FieldViolations(err), 1)
+	assert.Equal(t, "name", grpcerrors.FieldViolations(err)[0].GetField())
+
+	// Violations of the validator
+	validator := &testRequestValidator{
+		err: testMultiError{
+			testFieldError{field: "name", reason: "must be lowercase"},
+			errors.New("too long"),
+		},
+	}
+	c.Validator = validator
+	err = c.validateRequest(&appapi.HelloGreeterSayHelloRequest{Name: "Jim"})
+	violations := grpcerrors.FieldViolations(err)
+	require.Len(t, violations, 2)
+	assert.Equal(t, "name", violations[0].GetField())
+	assert.Equal(t, "must be lowercase", violations[0].GetDescription())
+	assert.Equal(t, "", violations[1].GetField())
+	assert.Equal(t, "too long", violations[1].GetDescription())
+
+	validator.err = grpcerrors.InvalidArgument("invalid", grpcerrors.FieldViolation("name", "invalid name"))
+	err = c.validateRequest(&appapi.HelloGreeterSayHelloRequest{})
+	violations = grpcerrors.FieldViolations(err)
+	require.Len(t, violations, 2)
+	assert.Equal(t, "name is required", violations[0].GetDescription())
+	assert.Equal(t, "invalid name", violations[1].GetDescription())
+}
+
+func TestServerRequestValidation(t *testing.T) {
+	c := newDefaultConfig(t)
+	c.WithRequestValidation(nil)
+	s := newTestServer(t, c)
+	defer s.Stop()
+
+	g := appapi.NewHelloGreeterClient(s.Conn())
+	_, err := g.SayHello(context.Background(), &appapi.HelloGreeterSayHelloRequest{})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	require.Len(t, grpcerrors.FieldViolations(err), 1)
+	assert.Equal(t, "name", grpcerrors.FieldViolations(err)[0].GetField())
+
+	_, err = g.SayHello(context.Background(), &appapi.HelloGreeterSayHelloRequest{Name: "jim"})
+	assert.NoError(t, err)
+}
@@ -0,0 +1,812 @@
+/*
+Copyright 2022 Pure Storage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/rs/cors"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+
+	spb "google.golang.org/genproto/googleapis/rpc/status"
+)
+
+// gRPC-Web and Connect requests are translated to gRPC requests served by
+// grpc.Server.ServeHTTP, and the gRPC responses are translated back. The
+// requests go through the same interceptors as any other gRPC request.
+//
+// See https://github.com/grpc/grpc/blob/master/doc/PROTOCOL-WEB.md
+// and https://connectrpc.com/docs/protocol
+
+const (
+	grpcWebContentType     = "application/grpc-web"
+	grpcWebTextContentType = "application/grpc-web-text"
+
+	connectStreamContentType = "application/connect"
+	connectProtoContentType  = "application/proto"
+	connectJSONContentType   = "application/json"
+
+	// Prefix of the trailers of the Connect unary responses
+	connectTrailerPrefix = "Trailer-"
+
+	// Flags of the messages
+	messageFlagCompressed = 0x01
+	messageFlagEndStream  = 0x02
+	messageFlagTrailer    = 0x80
+
+	// Size of the prefix of the messages
+	messagePrefixSize = 5
+)
+
+var (
+	// Headers sent by the gRPC-Web and Connect clients
+	webProtocolsAllowedHeaders = []string{
+		"Authorization",
+		"Content-Type",
+		"X-Grpc-Web",
+		"X-User-Agent",
+		"Grpc-Timeout",
+		"Connect-Protocol-Version",
+		"Connect-Timeout-Ms",
+	}
+	// Headers read by the gRPC-Web clients
+	webProtocolsExposedHeaders = []string{
+		"Grpc-Status",
+		"Grpc-Message",
+		"Grpc-Status-Details-Bin",
+	}
+
+	// Connect error codes
+	connectCodes = map[codes.Code]string{
+		codes.Canceled:           "canceled",
+		codes.Unknown:            "unknown",
+		codes.InvalidArgument:    "invalid_argument",
+		codes.DeadlineExceeded:   "deadline_exceeded",
+		codes.NotFound:           "not_found",
+		codes.AlreadyExists:      "already_exists",
+		codes.PermissionDenied:   "permission_denied",
+		codes.ResourceExhausted:  "resource_exhausted",
+		codes.FailedPrecondition: "failed_precondition",
+		codes.Aborted:            "aborted",
+		codes.OutOfRange:         "out_of_range",
+		codes.Unimplemented:      "unimplemented",
+		codes.Internal:           "internal",
+		codes.Unavailable:        "unavailable",
+		codes.DataLoss:           "data_loss",
+		codes.Unauthenticated:    "unauthenticated",
+	}
+	// HTTP status of the Connect unary errors
+	connectHTTPStatus = map[codes.Code]int{
+		codes.Canceled:           499,
+		codes.Unknown:            http.StatusInternalServerError,
+		codes.InvalidArgument:    http.StatusBadRequest,
+		codes.DeadlineExceeded:   http.StatusGatewayTimeout,
+		codes.NotFound:           http.StatusNotFound,
+		codes.AlreadyExists:      http.StatusConflict,
+		codes.PermissionDenied:   http.StatusForbidden,
+		codes.ResourceExhausted:  http.StatusTooManyRequests,
+		codes.FailedPrecondition: http.StatusBadRequest,
+		codes.Aborted:            http.StatusConflict,
+		codes.OutOfRange:         http.StatusBadRequest,
+		codes.Unimplemented:      http.StatusNotImplemented,
+		codes.Internal:           http.StatusInternalServerError,
+		codes.Unavailable:        http.StatusServiceUnavailable,
+		codes.DataLoss:           http.StatusInternalServerError,
+		codes.Unauthenticated:    http.StatusUnauthorized,
+	}
+)
+
+// jsonTranscoder converts the JSON messages of a gRPC method to the binary
+// messages served by the gRPC server and back. The JSON requests are served
+// with the proto codec, so that no JSON codec is registered in gRPC.
+type jsonTranscoder struct {
+	request  protoreflect.MessageType
+	response protoreflect.MessageType
+}
+
+// newJSONTranscoder returns the transcoder of the messages of a gRPC method
+func newJSONTranscoder(fullMethod string) (*jsonTranscoder, error) {
+	md, err := methodDescriptor(fullMethod)
+	if err != nil {
+		return nil, err
+	}
+	request, err := protoregistry.GlobalTypes.FindMessageByName(md.Input().FullName())
+	if err != nil {
+		return nil, fmt.Errorf("unable to find request type of %s: %v", fullMethod, err)
+	}
+	response, err := protoregistry.GlobalTypes.FindMessageByName(md.Output().FullName())
+	if err != nil {
+		return nil, fmt.Errorf("unable to find response type of %s: %v", fullMethod, err)
+	}
+	return &jsonTranscoder{
+		request:  request,
+		response: response,
+	}, nil
+}
+
+// fromJSON returns the binary message of a JSON request message
+func (t *jsonTranscoder) fromJSON(data []byte) ([]byte, error) {
+	m := t.request.New().Interface()
+	if err := (protojson.UnmarshalOptions{DiscardUnknown: true}).Unmarshal(data, m); err != nil {
+		return nil, err
+	}
+	return proto.Marshal(m)
+}
+
+// toJSON returns the JSON message of a binary response message
+func (t *jsonTranscoder) toJSON(data []byte) ([]byte, error) {
+	m := t.response.New().Interface()
+	if err := proto.Unmarshal(data, m); err != nil {
+		return nil, err
+	}
+	return protojson.Marshal(m)
+}
+
+// reader returns a reader of the binary request messages of the JSON
+// messages read from r
+func (t *jsonTranscoder) reader(r io.Reader) io.Reader {
+	return &jsonMessageReader{r: r, t: t}
+}
+
+// writer returns a function which converts the binary response messages
+// written in chunks to JSON messages written by write
+func (t *jsonTranscoder) writer(write func(data []byte)) func(data []byte) {
+	var buf bytes.Buffer
+	return func(data []byte) {
+		buf.Write(data)
+		for buf.Len() >= messagePrefixSize &&
+			buf.Len()-messagePrefixSize >= int(binary.BigEndian.Uint32(buf.Bytes()[1:messagePrefixSize])) {
+			flags, message, _ := readMessageFrame(&buf)
+			message, err := t.toJSON(message)
+			if err != nil {
+				logrus.Warningf("Unable to convert response message to JSON: %v", err)
+				continue
+			}
+			write(messageFrame(flags, message))
+		}
+	}
+}
+
+// jsonMessageReader reads the JSON messages of a request as binary messages
+type jsonMessageReader struct {
+	r       io.Reader
+	t       *jsonTranscoder
+	message []byte
+	err     error
+}
+
+func (j *jsonMessageReader) Read(p []byte) (int, error) {
+	for len(j.message) == 0 {
+		if j.err != nil {
+			return 0, j.err
+		}
+		flags, data, ok := readMessageFrame(j.r)
+		if !ok {
+			j.err = io.EOF
+			continue
+		}
+		if flags&messageFlagCompressed != 0 {
+			j.err = fmt.Errorf("compressed JSON messages are not supported")
+			continue
+		}
+		data, err := j.t.fromJSON(data)
+		if err != nil {
+			j.err = err
+			continue
+		}
+		j.message = messageFrame(flags, data)
+	}
+	n := copy(p, j.message)
+	j.message = j.message[n:]
+	return n, nil
+}
+
+// jsonTranscoderOf returns the transcoder of the messages of the method if
+// the codec is JSON, or the status of the request if JSON is not supported
+func jsonTranscoderOf(fullMethod, codec string) (*jsonTranscoder, *spb.Status) {
+	if codec != "json" {
+		return nil, nil
+	}
+	t, err := newJSONTranscoder(fullMethod)
+	if err != nil {
+		return nil, &spb.Status{
+			Code:    int32(codes.Unimplemented),
+			Message: fmt.Sprintf("JSON messages are not supported: %v", err),
+		}
+	}
+	return t, nil
+}
+
+// webProtocolsCorsOptions returns the CORS options with the headers used by
+// the gRPC-Web and Connect clients
+func webProtocolsCorsOptions(options cors.Options) cors.Options {
+	allowed := options.AllowedHeaders
+	if len(allowed) == 0 {
+		// Defaults of the cors package
+		allowed = []string{"Origin", "Accept", "Content-Type", "X-Requested-With"}
+	}
+	if !containsString(allowed, "*") {
+		options.AllowedHeaders = append(append([]string{}, allowed...), webProtocolsAllowedHeaders...)
+	}
+	options.ExposedHeaders = append(append([]string{}, options.ExposedHeaders...), webProtocolsExposedHeaders...)
+	return options
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// webProtocolsHandler returns a handler which serves the gRPC-Web and Connect
+// requests with the gRPC server and all other requests with the REST handler
+func webProtocolsHandler(grpcServer *GrpcFrameworkServer, rest http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		contentType := r.Header.Get("Content-Type")
+		switch {
+		case r.Method != http.MethodPost:
+			rest.ServeHTTP(w, r)
+		case hasContentType(contentType, grpcWebContentType),
+			hasContentType(contentType, grpcWebTextContentType):
+			serveGrpcWeb(grpcServer, w, r)
+		case hasContentType(contentType, connectStreamContentType):
+			serveConnectStream(grpcServer, w, r)
+		case (contentType == connectProtoContentType || contentType == connectJSONContentType) &&
+			isUnaryMethod(grpcServer, r.URL.Path):
+			// The REST gateway also receives JSON requests, but not on the
+			// paths of the gRPC methods
+			serveConnectUnary(grpcServer, w, r)
+		default:
+			rest.ServeHTTP(w, r)
+		}
+	})
+}
+
+// hasContentType returns true if the content type is base, or base followed
+// by a message codec like base+proto
+func hasContentType(contentType, base string) bool {
+	if !strings.HasPrefix(contentType, base) {
+		return false
+	}
+	rest := contentType[len(base):]
+	return rest == "" || rest[0] == '+' || rest[0] == ';'
+}
+
+// codecOf returns the codec of a content type like application/grpc-web+json
+func codecOf(contentType, base string) string {
+	codec := strings.TrimPrefix(contentType, base)
+	if i := strings.Index(codec, ";"); i >= 0 {
+		codec = codec[:i]
+	}
+	codec = strings.TrimPrefix(codec, "+")
+	if codec == "" {
+		return "proto"
+	}
+	return codec
+}
+
+// isUnaryMethod returns true if the path is a unary method of the gRPC server
+func isUnaryMethod(grpcServer *GrpcFrameworkServer, path string) bool {
+	service, method, ok := strings.Cut(strings.TrimPrefix(path, "/"), "/")
+	if !ok {
+		return false
+	}
+	info, ok := grpcServer.ServiceInfo()[service]
+	if !ok {
+		return false
+	}
+	for _, m := range info.Methods {
+		if m.Name == method {
+			return !m.IsClientStream && !m.IsServerStream
+		}
+	}
+	return false
+}
+
+// grpcRequest returns the gRPC request for a gRPC-Web or Connect request
+func grpcRequest(r *http.Request, codec string, body io.Reader) *http.Request {
+	req := r.Clone(r.Context())
+	req.ProtoMajor, req.ProtoMinor, req.Proto = 2, 0, "HTTP/2"
+	req.Header.Set("Content-Type", grpcContentType+"+"+codec)
+	req.Header.Del("Content-Length")
+	req.ContentLength = -1
+	req.Body = io.NopCloser(body)
+	return req
+}
+
+// grpcResponseWriter receives the response of a gRPC request. The headers
+// are sent on the first write or flush. The headers set afterwards, or with
+// the http.TrailerPrefix, are the trailers.
+type grpcResponseWriter struct {
+	header http.Header
+	sent   http.Header
+	code   int
+
+	// Called once when the headers are sent
+	onHeader func(code int, header http.Header)
+	// Called with the data of the response
+	onData func(data []byte)
+	// Called to flush the response
+	onFlush func()
+}
+
+func newGrpcResponseWriter() *grpcResponseWriter {
+	return &grpcResponseWriter{
+		header: make(http.Header),
+	}
+}
+
+func (g *grpcResponseWriter) Header() http.Header {
+	return g.header
+}
+
+func (g *grpcResponseWriter) WriteHeader(code int) {
+	if g.sent != nil {
+		return
+	}
+	g.code = code
+	g.sent = g.header.Clone()
+	g.sent.Del("Trailer")
+	g.onHeader(code, g.sent)
+}
+
+func (g *grpcResponseWriter) Write(data []byte) (int, error) {
+	g.WriteHeader(http.StatusOK)
+	g.onData(data)
+	return len(data), nil
+}
+
+func (g *grpcResponseWriter) Flush() {
+	g.WriteHeader(http.StatusOK)
+	g.onFlush()
+}
+
+// trailers returns the trailers of the response. If the response only has
+// headers, the status of the response is in the headers.
+func (g *grpcResponseWriter) trailers() http.Header {
+	trailers := make(http.Header)
+	for k, v := range g.header {
+		if strings.HasPrefix(k, http.TrailerPrefix) {
+			trailers[http.CanonicalHeaderKey(strings.TrimPrefix(k, http.TrailerPrefix))] = v
+		} else if _, ok := g.sent[k]; !ok && k != "Trailer" {
+			trailers[k] = v
+		}
+	}
+	return trailers
+}
+
+// status returns the gRPC status of the response
+func (g *grpcResponseWriter) status(trailers http.Header) *spb.Status {
+	get := func(key string) string {
+		if v := trailers.Get(key); v != "" {
+			return v
+		}
+		return g.sent.Get(key)
+	}
+
+	st := &spb.Status{}
+	if details := get("Grpc-Status-Details-Bin"); details != "" {
+		if data, err := decodeBinaryHeader(details); err == nil {
+			proto.Unmarshal(data, st)
+		}
+	}
+	code, err := strconv.Atoi(get("Grpc-Status"))
+	if err != nil {
+		// Not a gRPC response, like an error of the HTTP handler
+		st.Code = int32(codes.Unknown)
+		if g.code != http.StatusOK {
+			st.Code = int32(codes.Internal)
+			st.Message = http.StatusText(g.code)
+		}
+		return st
+	}
+	st.Code = int32(code)
+	if message, err := decodeGrpcMessage(get("Grpc-Message")); err == nil {
+		st.Message = message
+	}
+	return st
+}
+
+func decodeBinaryHeader(v string) ([]byte, error) {
+	if len(v)%4 == 0 {
+		return base64.StdEncoding.DecodeString(v)
+	}
+	return base64.RawStdEncoding.DecodeString(v)
+}
+
+// decodeGrpcMessage decodes the percent encoded grpc-message
+func decodeGrpcMessage(msg string) (string, error) {
+	if !strings.Contains(msg, "%") {
+		return msg, nil
+	}
+	var buf bytes.Buffer
+	for i := 0; i < len(msg); i++ {
+		if msg[i] == '%' && i+2 < len(msg) {
+			b, err := strconv.ParseUint(msg[i+1:i+3], 16, 8)
+			if err != nil {
+				return "", err
+			}
+			buf.WriteByte(byte(b))
+			i += 2
+			continue
+		}
+		buf.WriteByte(msg[i])
+	}
+	return buf.String(), nil
+}
+
+// copyMetadataHeaders copies the headers which are gRPC metadata
+func copyMetadataHeaders(dst, src http.Header, prefix string) {
+	for k, v := range src {
+		switch {
+		case k == "Content-Type", k == "Content-Length", k == "Trailer",
+			strings.HasPrefix(k, "Grpc-"):
+			continue
+		}
+		dst[prefix+k] = append(dst[prefix+k], v...)
+	}
+}
+
+func flush(w http.ResponseWriter) {
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// serveGrpcWeb serves a gRPC-Web request. The messages are the same as the
+// gRPC messages. The trailers are sent in a last message.
+func serveGrpcWeb(grpcServer *GrpcFrameworkServer, w http.ResponseWriter, r *http.Request) {
+	contentType := r.Header.Get("Content-Type")
+	text := hasContentType(contentType, grpcWebTextContentType)
+	base := grpcWebContentType
+	var body io.Reader = r.Body
+	if text {
+		base = grpcWebTextContentType
+		body = &base64ChunkReader{r: r.Body}
+	}
+	codec := codecOf(contentType, base)
+	transcoder, st := jsonTranscoderOf(r.URL.Path, codec)
+	if st != nil {
+		// Trailers-only response
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Grpc-Status", strconv.Itoa(int(st.Code)))
+		w.Header().Set("Grpc-Message", st.Message)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	write := func(data []byte) {
+		if text {
+			data = []byte(base64.StdEncoding.EncodeToString(data))
+		}
+		w.Write(data)
+	}
+	g := newGrpcResponseWriter()
+	g.onHeader = func(code int, header http.Header) {
+		for k, v := range header {
+			w.Header()[k] = v
+		}
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Del("Content-Length")
+		w.WriteHeader(code)
+	}
+	g.onData = write
+	g.onFlush = func() { flush(w) }
+	if transcoder != nil {
+		body = transcoder.reader(body)
+		g.onData = transcoder.writer(write)
+		codec = "proto"
+	}
+
+	grpcServer.ServeHTTP(g, grpcRequest(r, codec, body))
+
+	trailers := g.trailers()
+	if len(trailers) == 0 {
+		// The status was sent in the headers
+		return
+	}
+	var buf bytes.Buffer
+	for k, v := range trailers {
+		for _, value := range v {
+			fmt.Fprintf(&buf, "%s: %s\r\n", strings.ToLower(k), value)
+		}
+	}
+	write(messageFrame(messageFlagTrailer, buf.Bytes()))
+	flush(w)
+}
+
+// serveConnectUnary serves a Connect unary request. The request and response
+// bodies are the messages without a prefix. Errors are sent as JSON with an
+// HTTP error status.
+func serveConnectUnary(grpcServer *GrpcFrameworkServer, w http.ResponseWriter, r *http.Request) {
+	contentType := r.Header.Get("Content-Type")
+	codec := strings.TrimPrefix(contentType, "application/")
+
+	if encoding := r.Header.Get("Content-Encoding"); encoding != "" && encoding != "identity" {
+		writeConnectUnaryError(w, &spb.Status{
+			Code:    int32(codes.Unimplemented),
+			Message: fmt.Sprintf("unsupported content encoding %s", encoding),
+		})
+		return
+	}
+	transcoder, st := jsonTranscoderOf(r.URL.Path, codec)
+	if st != nil {
+		writeConnectUnaryError(w, st)
+		return
+	}
+	message, err := io.ReadAll(http.MaxBytesReader(w, r.Body, int64(grpcServer.maxReceiveMessageSize())))
+	if err != nil {
+		code := codes.InvalidArgument
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			code = codes.ResourceExhausted
+		}
+		writeConnectUnaryError(w, &spb.Status{
+			Code:    int32(code),
+			Message: fmt.Sprintf("unable to read request: %v", err),
+		})
+		return
+	}
+	if transcoder != nil {
+		message, err = transcoder.fromJSON(message)
+		if err != nil {
+			writeConnectUnaryError(w, &spb.Status{
+				Code:    int32(codes.InvalidArgument),
+				Message: fmt.Sprintf("unable to parse request: %v", err),
+			})
+			return
+		}
+		codec = "proto"
+	}
+	req := grpcRequest(r, codec, bytes.NewReader(messageFrame(0, message)))
+	setGrpcTimeout(req)
+
+	var response bytes.Buffer
+	g := newGrpcResponseWriter()
+	g.onHeader = func(int, http.Header) {}
+	g.onData = func(data []byte) { response.Write(data) }
+	g.onFlush = func() {}
+
+	grpcServer.ServeHTTP(g, req)
+
+	trailers := g.trailers()
+	copyMetadataHeaders(w.Header(), g.sent, "")
+	copyMetadataHeaders(w.Header(), trailers, connectTrailerPrefix)
+
+	st = g.status(trailers)
+	if st.Code != int32(codes.OK) {
+		writeConnectUnaryError(w, st)
+		return
+	}
+	flags, message, ok := readMessageFrame(&response)
+	if ok && flags&messageFlagCompressed == 0 && transcoder != nil {
+		message, err = transcoder.toJSON(message)
+		ok = err == nil
+	}
+	if !ok || flags&messageFlagCompressed != 0 {
+		writeConnectUnaryError(w, &spb.Status{
+			Code:    int32(codes.Internal),
+			Message: "invalid response message",
+		})
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(message)))
+	w.WriteHeader(http.StatusOK)
+	w.Write(message)
+}
+
+// serveConnectStream serves a Connect streaming request. The messages are the
+// same as the gRPC messages. The status and the trailers are sent in a last
+// message.
+func serveConnectStream(grpcServer *GrpcFrameworkServer, w http.ResponseWriter, r *http.Request) {
+	contentType := r.Header.Get("Content-Type")
+	codec := codecOf(contentType, connectStreamContentType)
+
+	if encoding := r.Header.Get("Connect-Content-Encoding"); encoding != "" && encoding != "identity" {
+		w.Header().Set("Content-Type", contentType)
+		w.WriteHeader(http.StatusOK)
+		writeConnectEndStream(w, &spb.Status{
+			Code:    int32(codes.Unimplemented),
+			Message: fmt.Sprintf("unsupported content encoding %s", encoding),
+		}, nil)
+		return
+	}
+	transcoder, st := jsonTranscoderOf(r.URL.Path, codec)
+	if st != nil {
+		w.Header().Set("Content-Type", contentType)
+		w.WriteHeader(http.StatusOK)
+		writeConnectEndStream(w, st, nil)
+		return
+	}
+	var body io.Reader = r.Body
+	if transcoder != nil {
+		body = transcoder.reader(body)
+		codec = "proto"
+	}
+	req := grpcRequest(r, codec, body)
+	setGrpcTimeout(req)
+
+	g := newGrpcResponseWriter()
+	g.onHeader = func(code int, header http.Header) {
+		copyMetadataHeaders(w.Header(), header, "")
+		w.Header().Set("Content-Type", contentType)
+		w.WriteHeader(http.StatusOK)
+	}
+	g.onData = func(data []byte) { w.Write(data) }
+	if transcoder != nil {
+		g.onData = transcoder.writer(g.onData)
+	}
+	g.onFlush = func() { flush(w) }
+
+	grpcServer.ServeHTTP(g, req)
+
+	g.WriteHeader(http.StatusOK)
+	trailers := g.trailers()
+	writeConnectEndStream(w, g.status(trailers), trailers)
+	flush(w)
+}
+
+// setGrpcTimeout sets the gRPC timeout from the Connect timeout
+func setGrpcTimeout(r *http.Request) {
+	if timeout := r.Header.Get("Connect-Timeout-Ms"); timeout != "" {
+		r.Header.Set("Grpc-Timeout", timeout+"m")
+		r.Header.Del("Connect-Timeout-Ms")
+	}
+}
+
+type connectErrorDetail struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type connectError struct {
+	Code    string               `json:"code"`
+	Message string               `json:"message,omitempty"`
+	Details []connectErrorDetail `json:"details,omitempty"`
+}
+
+type connectEndStream struct {
+	Error    *connectError       `json:"error,omitempty"`
+	Metadata map[string][]string `json:"metadata,omitempty"`
+}
+
+func newConnectError(st *spb.Status) *connectError {
+	code, ok := connectCodes[codes.Code(st.Code)]
+	if !ok {
+		code = connectCodes[codes.Unknown]
+	}
+	e := &connectError{
+		Code:    code,
+		Message: st.Message,
+	}
+	for _, detail := range st.Details {
+		typeName := detail.GetTypeUrl()
+		if i := strings.LastIndex(typeName, "/"); i >= 0 {
+			typeName = typeName[i+1:]
+		}
+		e.Details = append(e.Details, connectErrorDetail{
+			Type:  typeName,
+			Value: base64.RawStdEncoding.EncodeToString(detail.GetValue()),
+		})
+	}
+	return e
+}
+
+func writeConnectUnaryError(w http.ResponseWriter, st *spb.Status) {
+	httpStatus, ok := connectHTTPStatus[codes.Code(st.Code)]
+	if !ok {
+		httpStatus = http.StatusInternalServerError
+	}
+	w.Header().Set("Content-Type", connectJSONContentType)
+	w.WriteHeader(httpStatus)
+	json.NewEncoder(w).Encode(newConnectError(st))
+}
+
+func writeConnectEndStream(w http.ResponseWriter, st *spb.Status, trailers http.Header) {
+	end := &connectEndStream{}
+	if st.Code != int32(codes.OK) {
+		end.Error = newConnectError(st)
+	}
+	metadata := make(http.Header)
+	copyMetadataHeaders(metadata, trailers, "")
+	if len(metadata) != 0 {
+		end.Metadata = metadata
+	}
+	data, _ := json.Marshal(end)
+	w.Write(messageFrame(messageFlagEndStream, data))
+}
+
+// messageFrame returns a message with its prefix
+func messageFrame(flags byte, data []byte) []byte {
+	frame := make([]byte, messagePrefixSize+len(data))
+	frame[0] = flags
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(data)))
+	copy(frame[messagePrefixSize:], data)
+	return frame
+}
+
+// readMessageFrame reads a message with its prefix
+func readMessageFrame(r io.Reader) (byte, []byte, bool) {
+	prefix := make([]byte, messagePrefixSize)
+	if _, err := io.ReadFull(r, prefix); err != nil {
+		return 0, nil, false
+	}
+	data := make([]byte, binary.BigEndian.Uint32(prefix[1:]))
+	if _, err := io.ReadFull(r, data); err != nil {
+		return 0, nil, false
+	}
+	return prefix[0], data, true
+}
+
+// base64ChunkReader decodes a base64 stream made of padded chunks, as sent
+// by the gRPC-Web text clients
+type base64ChunkReader struct {
+	r       io.Reader
+	encoded []byte
+	decoded []byte
+	err     error
+}
+
+func (b *base64ChunkReader) Read(p []byte) (int, error) {
+	for len(b.decoded) == 0 {
+		if b.err != nil {
+			return 0, b.err
+		}
+		buf := make([]byte, 4096)
+		n, err := b.r.Read(buf)
+		b.encoded = append(b.encoded, buf[:n]...)
+		b.err = err
+
+		// Decode the complete groups of 4 characters
+		complete := len(b.encoded) / 4 * 4
+		for i := 0; i < complete; i += 4 {
+			group, err := base64.StdEncoding.DecodeString(string(b.encoded[i : i+4]))
+			if err != nil {
+				b.err = err
+				break
+			}
+			b.decoded = append(b.decoded, group...)
+		}
+		b.encoded = b.encoded[complete:]
+		if b.err == io.EOF && len(b.encoded) != 0 {
+			b.err = io.ErrUnexpectedEOF
+		}
+	}
+	n := copy(p, b.decoded)
+	b.decoded = b.decoded[n:]
+	return n, nil
+}
+
+// Interface check
+var _ http.Flusher = &grpcResponseWriter{}
@@ -0,0 +1,320 @@
+/*
+Copyright 2022 Pure Storage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/libopenstorage/grpc-framework/pkg/auth"
+	appserver "github.com/libopenstorage/grpc-framework/test/app/pkg/server"
+	appapi "github.com/libopenstorage/grpc-framework/test/app/protos/apis/hello/apiv1"
+)
+
+const (
+	testWebUrl      = "http://localhost:9001"
+	testSayHelloUrl = testWebUrl + "/hello.hello.v1.HelloGreeter/SayHello"
+	testWatchUrl    = testWebUrl + "/grpc.health.v1.Health/Watch"
+)
+
+func newWebProtocolsTestServer(t *testing.T) *testServer {
+	authenticator, err := auth.NewJwtAuthenticator(&auth.JwtAuthConfig{
+		SharedSecret: []byte(testSharedSecret),
+	})
+	require.NoError(t, err)
+
+	c := &ServerConfig{
+		Name:    "testServer",
+		Net:     "tcp",
+		Address: "127.0.0.1:0",
+		Socket:  grpcSocket,
+		Security: &SecurityConfig{
+			Authenticators: map[string]auth.Authenticator{
+				"testissuer": authenticator,
+			},
+		},
+	}
+	c.WithDefaultRestServer("9001").
+		WithRestWebProtocols().
+		WithMaxReceiveMessageSize(1024).
+		WithDefaultGenericRoleManager().
+		RegisterGrpcServers(func(gs *grpc.Server) {
+			appapi.RegisterHelloGreeterServer(gs, &appserver.HelloGreeter{})
+		}).
+		RegisterRestHandlers(appapi.RegisterHelloGreeterHandler)
+	return newTestServer(t, c)
+}
+
+func testWebRequest(t *testing.T, url, contentType, token string, body []byte) *http.Response {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", contentType)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	return resp
+}
+
+// testReadFrames returns the messages of a response body by flag
+func testReadFrames(t *testing.T, body []byte) ([][]byte, [][]byte) {
+	var messages, others [][]byte
+	r := bytes.NewReader(body)
+	for r.Len() != 0 {
+		flags, data, ok := readMessageFrame(r)
+		require.True(t, ok)
+		if flags == 0 {
+			messages = append(messages, data)
+		} else {
+			others = append(others, data)
+		}
+	}
+	return messages, others
+}
+
+func TestWebProtocolsGrpcWeb(t *testing.T) {
+	s := newWebProtocolsTestServer(t)
+	defer s.Stop()
+
+	token := testToken(t, "testissuer", "jim", []string{"system.admin"})
+	req, err := proto.Marshal(&appapi.HelloGreeterSayHelloRequest{Name: "jim"})
+	require.NoError(t, err)
+
+	// Binary
+	resp := testWebRequest(t, testSayHelloUrl, "application/grpc-web+proto", token, messageFrame(0, req))
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "application/grpc-web+proto", resp.Header.Get("Content-Type"))
+
+	messages, trailers := testReadFrames(t, body)
+	require.Len(t, messages, 1)
+	hello := &appapi.HelloGreeterSayHelloResponse{}
+	require.NoError(t, proto.Unmarshal(messages[0], hello))
+	assert.Equal(t, "Hello, jim", hello.GetMessage())
+	require.Len(t, trailers, 1)
+	assert.Contains(t, string(trailers[0]), "grpc-status: 0\r\n")
+
+	// Text
+	resp = testWebRequest(t, testSayHelloUrl, "application/grpc-web-text", token,
+		[]byte(base64.StdEncoding.EncodeToString(messageFrame(0, req))))
+	body, err = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	decoded, err := io.ReadAll(&base64ChunkReader{r: bytes.NewReader(body)})
+	require.NoError(t, err)
+	messages, _ = testReadFrames(t, decoded)
+	require.Len(t, messages, 1)
+
+	// JSON messages are converted without a gRPC codec
+	assert.Nil(t, encoding.GetCodec("json"))
+	resp = testWebRequest(t, testSayHelloUrl, "application/grpc-web+json", token,
+		messageFrame(0, []byte(`{"name":"jim"}`)))
+	body, err = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	assert.Equal(t, "application/grpc-web+json", resp.Header.Get("Content-Type"))
+	messages, trailers = testReadFrames(t, body)
+	require.Len(t, messages, 1)
+	assert.JSONEq(t, `{"message":"Hello, jim"}`, string(messages[0]))
+	require.Len(t, trailers, 1)
+	assert.Contains(t, string(trailers[0]), "grpc-status: 0\r\n")
+
+	// Without a token, the request is denied by the interceptors
+	resp = testWebRequest(t, testSayHelloUrl, "application/grpc-web+proto", "", messageFrame(0, req))
+	body, err = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	messages, trailers = testReadFrames(t, body)
+	assert.Empty(t, messages)
+	require.Len(t, trailers, 1)
+	assert.Contains(t, string(trailers[0]), "grpc-status: 7\r\n")
+}
+
+func TestWebProtocolsConnectUnary(t *testing.T) {
+	s := newWebProtocolsTestServer(t)
+	defer s.Stop()
+
+	token := testToken(t, "testissuer", "jim", []string{"system.admin"})
+
+	resp := testWebRequest(t, testSayHelloUrl, "application/json", token, []byte(`{"name":"jim"}`))
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+	assert.JSONEq(t, `{"message":"Hello, jim"}`, string(body))
+
+	// Errors
+	resp = testWebRequest(t, testSayHelloUrl, "application/json", "", []byte(`{"name":"jim"}`))
+	body, err = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	var connectErr connectError
+	require.NoError(t, json.Unmarshal(body, &connectErr))
+	assert.Equal(t, "permission_denied", connectErr.Code)
+	assert.Contains(t, connectErr.Message, "Access denied")
+
+	resp = testWebRequest(t, testSayHelloUrl, "application/json", token, []byte(`{"name":`))
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	// The body is limited to the maximum size of the messages
+	resp = testWebRequest(t, testSayHelloUrl, "application/json", token,
+		[]byte(`{"name":"`+strings.Repeat("a", 2048)+`"}`))
+	body, err = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	require.NoError(t, json.Unmarshal(body, &connectErr))
+	assert.Equal(t, "resource_exhausted", connectErr.Code)
+
+	// The REST gateway still serves its paths
+	resp = testWebRequest(t, testWebUrl+"/v1/greeter:sayHello", "application/json", token, []byte(`{"name":"jim"}`))
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestWebProtocolsConnectStream(t *testing.T) {
+	s := newWebProtocolsTestServer(t)
+	defer s.Stop()
+
+	req, err := proto.Marshal(&grpc_health_v1.HealthCheckRequest{})
+	require.NoError(t, err)
+
+	// The watch does not end until the deadline
+	httpReq, err := http.NewRequest(http.MethodPost, testWatchUrl, bytes.NewReader(messageFrame(0, req)))
+	require.NoError(t, err)
+	httpReq.Header.Set("Content-Type", "application/connect+proto")
+	httpReq.Header.Set("Connect-Timeout-Ms", "200")
+	resp, err := http.DefaultClient.Do(httpReq)
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	messages, end := testReadFrames(t, body)
+	require.Len(t, messages, 1)
+	health := &grpc_health_v1.HealthCheckResponse{}
+	require.NoError(t, proto.Unmarshal(messages[0], health))
+	assert.Equal(t, grpc_health_v1.HealthCheckResponse_SERVING, health.GetStatus())
+
+	require.Len(t, end, 1)
+	var endStream connectEndStream
+	require.NoError(t, json.Unmarshal(end[0], &endStream))
+	// The health service ends the watch as canceled
+	require.NotNil(t, endStream.Error)
+	assert.Equal(t, "canceled", endStream.Error.Code)
+
+	// JSON messages
+	httpReq, err = http.NewRequest(http.MethodPost, testWatchUrl, bytes.NewReader(messageFrame(0, []byte(`{}`))))
+	require.NoError(t, err)
+	httpReq.Header.Set("Content-Type", "application/connect+json")
+	httpReq.Header.Set("Connect-Timeout-Ms", "200")
+	resp, err = http.DefaultClient.Do(httpReq)
+	require.NoError(t, err)
+	body, err = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	messages, _ = testReadFrames(t, body)
+	require.Len(t, messages, 1)
+	assert.JSONEq(t, `{"status":"SERVING"}`, string(messages[0]))
+}
+
+func TestWebProtocolsShutdownStream(t *testing.T) {
+	s := newWebProtocolsTestServer(t)
+	defer s.Stop()
+
+	req, err := proto.Marshal(&grpc_health_v1.HealthCheckRequest{})
+	require.NoError(t, err)
+
+	// The watch does not end until the server stops
+	resp := testWebRequest(t, testWatchUrl, "application/grpc-web+proto", "", messageFrame(0, req))
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	flags, data, ok := readMessageFrame(resp.Body)
+	require.True(t, ok)
+	require.Equal(t, byte(0), flags)
+	health := &grpc_health_v1.HealthCheckResponse{}
+	require.NoError(t, proto.Unmarshal(data, health))
+	assert.Equal(t, grpc_health_v1.HealthCheckResponse_SERVING, health.GetStatus())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, s.server.Shutdown(ctx), context.DeadlineExceeded)
+	assert.False(t, s.server.udsServer.IsRunning())
+
+	// New requests are unavailable
+	httpReq, err := http.NewRequest(http.MethodPost, testWatchUrl, bytes.NewReader(messageFrame(0, req)))
+	require.NoError(t, err)
+	httpReq.Header.Set("Content-Type", "application/grpc-web+proto")
+	w := httptest.NewRecorder()
+	webProtocolsHandler(s.server.udsServer, http.NotFoundHandler()).ServeHTTP(w, httpReq)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, strconv.Itoa(int(codes.Unavailable)), w.Header().Get("Grpc-Status"))
+	assert.Empty(t, w.Body.Bytes())
+}
+
+func TestWebProtocolsCors(t *testing.T) {
+	s := newWebProtocolsTestServer(t)
+	defer s.Stop()
+
+	req, err := http.NewRequest(http.MethodOptions, testSayHelloUrl, nil)
+	require.NoError(t, err)
+	req.Header.Set("Origin", "http://example.com")
+	req.Header.Set("Access-Control-Request-Method", http.MethodPost)
+	// Browsers send the requested headers sorted and in lower case
+	req.Header.Set("Access-Control-Request-Headers", "authorization,connect-protocol-version,content-type,x-grpc-web")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assert.Equal(t, "*", resp.Header.Get("Access-Control-Allow-Origin"))
+	assert.True(t, strings.Contains(strings.ToLower(resp.Header.Get("Access-Control-Allow-Headers")), "x-grpc-web"))
+}
+
+func TestBase64ChunkReader(t *testing.T) {
+	encoded := base64.StdEncoding.EncodeToString([]byte("a")) +
+		base64.StdEncoding.EncodeToString([]byte("bc")) +
+		base64.StdEncoding.EncodeToString([]byte("def"))
+	decoded, err := io.ReadAll(&base64ChunkReader{r: strings.NewReader(encoded)})
+	assert.NoError(t, err)
+	assert.Equal(t, "abcdef", string(decoded))
+
+	_, err = io.ReadAll(&base64ChunkReader{r: strings.NewReader("YQ")})
+	assert.Error(t, err)
+}
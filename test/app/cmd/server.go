@@ -20,6 +20,7 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"time"
 
 	"github.com/libopenstorage/grpc-framework/pkg/auth"
 	"github.com/libopenstorage/grpc-framework/pkg/util"
@@ -83,8 +84,7 @@ func main() {
 	}
 
 	// Setup a signal handler
-	signal_handler := util.NewSigIntManager(func() {
-		s.Stop()
+	signal_handler := util.NewSigIntShutdownManager(s.Shutdown, 30*time.Second, func() {
 		os.Remove(helloSocket)
 		os.Exit(0)
 	})
@@ -99,6 +99,11 @@ func main() {
 
 	// Wait. The signal handler will exit cleanly
 	logrus.Info("Hello server running")
+	if err := s.Wait(); err != nil {
+		logrus.Errorf("Hello server failed: %v", err)
+		os.Remove(helloSocket)
+		os.Exit(1)
+	}
 	select {}
 }
 